@@ -0,0 +1,71 @@
+package main
+
+import (
+	"database/sql/driver"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestConcurrentBalanceReadsShareQuery holds the first balance query until
+// the other readers have queued up behind it: they all get its result, and
+// the query runs far fewer times than there are readers.
+func TestConcurrentBalanceReadsShareQuery(t *testing.T) {
+	const readers = 50
+	var queries int32
+	started, release := make(chan struct{}, readers), make(chan struct{})
+	useFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		if !queryHas(query, "SUM(delta) FROM account WHERE user_id=$1") {
+			return fakeResult{}
+		}
+		atomic.AddInt32(&queries, 1)
+		started <- struct{}{}
+		<-release
+		return fakeResult{Cols: []string{"balance"}, Rows: [][]driver.Value{{int64(3000)}}}
+	})
+
+	var wg sync.WaitGroup
+	balances := make(chan int64, readers)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b, err := getbalance(5)
+			if err != nil {
+				t.Error(err)
+			}
+			balances <- b
+		}()
+	}
+	<-started
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(balances)
+
+	for b := range balances {
+		if b != 3000 {
+			t.Fatalf("read balance %d, want 3000", b)
+		}
+	}
+	if n := atomic.LoadInt32(&queries); n > readers/10 {
+		t.Errorf("%d readers ran %d queries", readers, n)
+	}
+}
+
+// TestBalanceReadAfterUpdateQueriesAgain checks a finished read is not
+// reused: the next read sees the balance as it is now.
+func TestBalanceReadAfterUpdateQueriesAgain(t *testing.T) {
+	var balance int64 = 3000
+	useFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		return fakeResult{Cols: []string{"balance"}, Rows: [][]driver.Value{{atomic.LoadInt64(&balance)}}}
+	})
+	if b, err := getbalance(5); err != nil || b != 3000 {
+		t.Fatalf("read %d, %v, want 3000", b, err)
+	}
+	atomic.StoreInt64(&balance, 4500)
+	if b, err := getbalance(5); err != nil || b != 4500 {
+		t.Fatalf("read %d, %v after the update, want 4500", b, err)
+	}
+}
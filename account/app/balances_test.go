@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// postBalances asks the router for the balances in body as user 1 with role.
+func postBalances(role, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/account/balances", strings.NewReader(body))
+	r.Header.Set("X-User-Id", "1")
+	r.Header.Set("X-User-Role", role)
+	w := httptest.NewRecorder()
+	newRouter("").ServeHTTP(w, r)
+	return w
+}
+
+func TestBalancesAggregatesPerUser(t *testing.T) {
+	db := newLedgerDB(t)
+	db.ops = map[string]*operation{
+		"dep-5":  {uid: 5, delta: 3000, done: true},
+		"wd-5":   {uid: 5, delta: -1200, done: true},
+		"dep-6":  {uid: 6, delta: 500, done: true},
+		"dep-6b": {uid: 6, delta: 700, done: true},
+		"open-6": {uid: 6, delta: 0},
+	}
+	w := postBalances(roleAdmin, `{"user_ids":[5,6,7]}`)
+	want := `[{"user_id":5,"balance":1800},{"user_id":6,"balance":1200},{"user_id":7,"balance":0}]`
+	if w.Code != http.StatusOK || !sameJSON(t, w.Body.Bytes(), []byte(want)) {
+		t.Fatalf("answered %d %s, want 200 %s", w.Code, w.Body.String(), want)
+	}
+	if n := db.ran("FROM unnest($1::integer[])"); n != 1 {
+		t.Errorf("ran %d balance queries, want one for all users", n)
+	}
+
+	if w := postBalances("", `{"user_ids":[5]}`); w.Code != http.StatusForbidden {
+		t.Errorf("non-admin answered %d, want 403", w.Code)
+	}
+}
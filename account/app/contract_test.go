@@ -0,0 +1,55 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// goldenDir holds the messages of the shared contracts package.
+const goldenDir = "../../contracts/testdata"
+
+func readGolden(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(goldenDir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// sameJSON reports whether a and b are the same json value regardless of
+// formatting and key order.
+func sameJSON(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var va, vb interface{}
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+// TestBalanceMatchesContract checks the balance book reads from account get.
+func TestBalanceMatchesContract(t *testing.T) {
+	useFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		return fakeResult{Cols: []string{"balance"}, Rows: [][]driver.Value{{int64(12000)}}}
+	})
+	r := httptest.NewRequest(http.MethodGet, "/account/get", nil)
+	r.Header.Set("X-User-Id", "5")
+	w := httptest.NewRecorder()
+	get(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", w.Code)
+	}
+	if golden := readGolden(t, "balance.json"); !sameJSON(t, w.Body.Bytes(), golden) {
+		t.Errorf("answered %s, want %s", w.Body.Bytes(), golden)
+	}
+}
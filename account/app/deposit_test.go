@@ -0,0 +1,106 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"contracts"
+)
+
+// TestDepositReplayIsNoop checks a deposit repeated with the request id of
+// a deposit that is already done answers 200 and does not pay again, which
+// is what orders relies on when it retries a refund.
+func TestDepositReplayIsNoop(t *testing.T) {
+	done := map[string]bool{}
+	useFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		switch {
+		case queryHas(query, "INSERT INTO account", "ON CONFLICT (request_id) DO NOTHING"):
+			return fakeResult{}
+		case queryHas(query, "UPDATE account SET delta=$3"):
+			if done[args[1].(string)] {
+				return fakeResult{}
+			}
+			done[args[1].(string)] = true
+			return fakeResult{Affected: 1}
+		case queryHas(query, "SELECT count(1) FROM account"):
+			return fakeResult{Cols: []string{"count"}, Rows: [][]driver.Value{{int64(1)}}}
+		case queryHas(query, "SUM(delta)"):
+			return fakeResult{Cols: []string{"balance"}, Rows: [][]driver.Value{{int64(0)}}}
+		}
+		return fakeResult{}
+	})
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/account/genreq", nil)
+		r.Header.Set("X-User-Id", "5")
+		r.Header.Set("X-Request-Id", "refund-11")
+		w := httptest.NewRecorder()
+		newReq(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("genreq %d answered %d, want 200", i+1, w.Code)
+		}
+		r = httptest.NewRequest(http.MethodPost, "/account/deposit", strings.NewReader(`{"delta":3000}`))
+		r.Header.Set("X-User-Id", "5")
+		r.Header.Set("X-Request-Id", "refund-11")
+		w = httptest.NewRecorder()
+		deposit(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("deposit %d answered %d, want 200", i+1, w.Code)
+		}
+	}
+}
+
+// useNotifyDeposit sets notifyDeposit for the test.
+func useNotifyDeposit(t *testing.T, on bool) {
+	saved := notifyDeposit
+	notifyDeposit = on
+	t.Cleanup(func() { notifyDeposit = saved })
+}
+
+// TestDepositNotifiesOnSuccessOnly checks a failed deposit sends nothing and
+// a successful one tells the user the amount.
+func TestDepositNotifiesOnSuccessOnly(t *testing.T) {
+	useNotifyDeposit(t, true)
+	newLedgerDB(t)
+	d := useStubServices(t, map[string]stubResponse{
+		"/notif/create": {http.StatusOK, ""},
+	})
+	if w := change(t, deposit, "dep-1", fmt.Sprintf(`{"delta":%d}`, int64(maxDelta)+1)); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("overflowing deposit answered %d, want 422", w.Code)
+	}
+	if w := change(t, deposit, "dep-2", `{"delta":3000}`); w.Code != http.StatusOK {
+		t.Fatalf("deposit answered %d", w.Code)
+	}
+	// The notification of the failed deposit would have been sent first.
+	notifs := d.waitSent(t, "/notif/create", 1)
+	if len(notifs) != 1 {
+		t.Fatalf("sent %d notifications, want 1", len(notifs))
+	}
+	n := contracts.Notification{}
+	if err := json.Unmarshal(notifs[0].body, &n); err != nil {
+		t.Fatal(err)
+	}
+	if n.UserID != 5 || n.Message != "Your account was credited with 3000" {
+		t.Errorf("sent %s", notifs[0].body)
+	}
+}
+
+func TestDepositNotificationOptOut(t *testing.T) {
+	useNotifyDeposit(t, false)
+	newLedgerDB(t)
+	d := useStubServices(t, map[string]stubResponse{
+		"/notif/create": {http.StatusOK, ""},
+	})
+	if w := change(t, deposit, "dep-1", `{"delta":3000}`); w.Code != http.StatusOK {
+		t.Fatalf("deposit answered %d", w.Code)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := len(d.sent("/notif/create")); n != 0 {
+		t.Errorf("sent %d notifications with NOTIFY_DEPOSIT off", n)
+	}
+}
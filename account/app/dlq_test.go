@@ -0,0 +1,107 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dlqRow is a callback waiting in the fake callback_dlq table.
+type dlqRow struct {
+	id       int64
+	uid      int64
+	payload  string
+	attempts int64
+	created  time.Time
+}
+
+// dlqDB fakes callback_dlq. Every row is due, the test decides when the
+// worker runs.
+type dlqDB struct {
+	mu     sync.Mutex
+	rows   []*dlqRow
+	nextID int64
+}
+
+func newDLQDB(t *testing.T) *dlqDB {
+	db := &dlqDB{}
+	useFakeDB(t, db.handle)
+	return db
+}
+
+func (db *dlqDB) handle(query string, args []driver.Value) fakeResult {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	switch {
+	case queryHas(query, "INSERT INTO callback_dlq"):
+		db.nextID++
+		db.rows = append(db.rows, &dlqRow{id: db.nextID, uid: args[0].(int64), payload: args[1].(string), created: time.Now()})
+		return fakeResult{Affected: 1}
+	case queryHas(query, "FROM callback_dlq WHERE next_attempt_at"):
+		res := fakeResult{Cols: []string{"id", "user_id", "payload", "attempts", "created_at"}}
+		for _, r := range db.rows {
+			res.Rows = append(res.Rows, []driver.Value{r.id, r.uid, r.payload, r.attempts, r.created})
+		}
+		return res
+	case queryHas(query, "UPDATE callback_dlq SET attempts"):
+		for _, r := range db.rows {
+			if r.id == args[0] {
+				r.attempts = args[1].(int64)
+				return fakeResult{Affected: 1}
+			}
+		}
+	case queryHas(query, "DELETE FROM callback_dlq"):
+		for i, r := range db.rows {
+			if r.id == args[0] {
+				db.rows = append(db.rows[:i], db.rows[i+1:]...)
+				return fakeResult{Affected: 1}
+			}
+		}
+	}
+	return fakeResult{}
+}
+
+// queued returns a copy of the rows in callback_dlq.
+func (db *dlqDB) queued() []dlqRow {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	res := []dlqRow{}
+	for _, r := range db.rows {
+		res = append(res, *r)
+	}
+	return res
+}
+
+func TestFailedCallbackIsQueuedAndResent(t *testing.T) {
+	db := newDLQDB(t)
+	d := useStubServices(t, map[string]stubResponse{
+		"/book/callback/account": {http.StatusServiceUnavailable, ""},
+	})
+	sendCallback(&withDrawalResponseModel{BookID: 7, UserID: 5, Price: 3000, Status: true})
+	q := db.queued()
+	if len(q) != 1 || q[0].uid != 5 {
+		t.Fatalf("callback_dlq has %+v, want the callback of user 5", q)
+	}
+
+	retryDueCallbacks()
+	if q = db.queued(); len(q) != 1 || q[0].attempts != 1 {
+		t.Fatalf("after a failed retry callback_dlq has %+v, want one row with 1 attempt", q)
+	}
+
+	d.mu.Lock()
+	d.routes["/book/callback/account"] = stubResponse{status: http.StatusOK}
+	d.mu.Unlock()
+	retryDueCallbacks()
+	if q = db.queued(); len(q) != 0 {
+		t.Fatalf("after book accepted it callback_dlq has %+v", q)
+	}
+	sent := d.sent("/book/callback/account")
+	if len(sent) != 3 {
+		t.Fatalf("sent %d callbacks, want 3", len(sent))
+	}
+	if got := string(sent[2].body); got != `{"book_id":7,"user_id":5,"price":3000,"status":true}` {
+		t.Errorf("resent %s", got)
+	}
+}
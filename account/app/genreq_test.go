@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// TestGenreqGeneratesFreshID asks for request ids without sending one and
+// checks each is a new UUID, returned in the header and the body, with a
+// pending operation stored under it that a deposit can then complete.
+func TestGenreqGeneratesFreshID(t *testing.T) {
+	db := newLedgerDB(t)
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		w := callAccount(newReq, http.MethodGet, "", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("genreq answered %d", w.Code)
+		}
+		got := requestIDModel{}
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		rid := got.RequestID
+		if _, err := uuid.Parse(rid); err != nil {
+			t.Fatalf("genreq answered %s, want a UUID: %s", w.Body.String(), err)
+		}
+		if h := w.Header().Get("X-Request-Id"); h != rid {
+			t.Errorf("genreq answered header %q and body %q, want the same id", h, rid)
+		}
+		if seen[rid] {
+			t.Fatalf("genreq answered %q twice", rid)
+		}
+		seen[rid] = true
+		if op, ok := db.ops[rid]; !ok || op.uid != 5 || op.done {
+			t.Fatalf("stored %+v under %q, want a pending operation of user 5", op, rid)
+		}
+	}
+
+	for rid := range seen {
+		if w := callAccount(deposit, http.MethodPost, rid, `{"delta":3000}`); w.Code != http.StatusOK {
+			t.Fatalf("deposit under the generated id answered %d", w.Code)
+		}
+	}
+	if b := db.balance(5); b != 6000 {
+		t.Errorf("balance is %d, want 6000", b)
+	}
+}
+
+// TestGenreqKeepsClientID checks a request id sent by the client is used as
+// it is.
+func TestGenreqKeepsClientID(t *testing.T) {
+	db := newLedgerDB(t)
+	w := callAccount(newReq, http.MethodGet, "order-11", "")
+	if w.Code != http.StatusOK || w.Header().Get("X-Request-Id") != "order-11" || !sameJSON(t, w.Body.Bytes(), []byte(`{"request_id":"order-11"}`)) {
+		t.Fatalf("genreq answered %d %s, want order-11 back", w.Code, w.Body.String())
+	}
+	if _, ok := db.ops["order-11"]; !ok {
+		t.Error("no pending operation stored under order-11")
+	}
+}
@@ -1,9 +1,15 @@
 module app
 
-go 1.21
+go 1.21.1
 
 require (
+	contracts v0.0.0
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/mux v1.8.1
 	github.com/lib/pq v1.10.9
+	golang.org/x/sync v0.7.0
+	platform v0.0.0
 )
+
+replace contracts => ../../contracts
+replace platform => ../../platform
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// postFunds sends a hold, capture, release or refund body to h as book does.
+func postFunds(h http.HandlerFunc, uid, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/account", strings.NewReader(body))
+	r.Header.Set("X-User-Id", uid)
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestRefundPaysBackCaptureOnce(t *testing.T) {
+	refunded, captured := false, true
+	useFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		switch {
+		case queryHas(query, "INSERT INTO account", "SELECT user_id"):
+			if args[1] != "capture-7" || args[2] != "refund-7" || !captured || refunded {
+				return fakeResult{}
+			}
+			refunded = true
+			return fakeResult{Affected: 1}
+		case queryHas(query, "SELECT count(1) FROM account"):
+			n := int64(0)
+			if captured {
+				n = 1
+			}
+			return fakeResult{Cols: []string{"count"}, Rows: [][]driver.Value{{n}}}
+		}
+		return fakeResult{}
+	})
+	for i := 0; i < 2; i++ {
+		if w := postFunds(refund, "5", `{"book_id":7,"amount":3000}`); w.Code != http.StatusOK {
+			t.Fatalf("refund %d answered %d, want 200", i+1, w.Code)
+		}
+	}
+	if !refunded {
+		t.Fatal("capture was not refunded")
+	}
+
+	captured, refunded = false, false
+	if w := postFunds(refund, "5", `{"book_id":7,"amount":3000}`); w.Code != http.StatusNotFound {
+		t.Fatalf("refund without capture answered %d, want 404", w.Code)
+	}
+}
+
+// holdDB fakes account and account_hold for the holds of one user.
+type holdDB struct {
+	balance int64
+	holds   map[int64]int64
+	queries []string
+}
+
+func (db *holdDB) handle(query string, args []driver.Value) fakeResult {
+	db.queries = append(db.queries, query)
+	switch {
+	case queryHas(query, "pg_advisory_xact_lock"):
+		return fakeResult{Cols: []string{"lock"}, Rows: [][]driver.Value{{""}}}
+	case queryHas(query, "SELECT amount FROM account_hold"):
+		if amount, ok := db.holds[args[0].(int64)]; ok {
+			return fakeResult{Cols: []string{"amount"}, Rows: [][]driver.Value{{amount}}}
+		}
+		return fakeResult{Cols: []string{"amount"}}
+	case queryHas(query, "SUM(delta)"):
+		b := db.balance
+		for _, amount := range db.holds {
+			b -= amount
+		}
+		return fakeResult{Cols: []string{"balance"}, Rows: [][]driver.Value{{b}}}
+	case queryHas(query, "INSERT INTO account_hold"):
+		if _, ok := db.holds[args[0].(int64)]; ok {
+			return fakeResult{}
+		}
+		db.holds[args[0].(int64)] = args[2].(int64)
+		return fakeResult{Affected: 1}
+	}
+	return fakeResult{}
+}
+
+func TestHold(t *testing.T) {
+	db := &holdDB{balance: 5000, holds: map[int64]int64{}}
+	useFakeDB(t, db.handle)
+	steps := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"first hold", `{"book_id":7,"amount":3000}`, http.StatusOK},
+		{"repeated hold", `{"book_id":7,"amount":3000}`, http.StatusOK},
+		{"other amount for the same book", `{"book_id":7,"amount":1000}`, http.StatusConflict},
+		{"more than left after the first hold", `{"book_id":8,"amount":3000}`, http.StatusUnprocessableEntity},
+		{"what is left", `{"book_id":8,"amount":2000}`, http.StatusOK},
+	}
+	for _, s := range steps {
+		if w := postFunds(hold, "5", s.body); w.Code != s.code {
+			t.Fatalf("%s: answered %d, want %d", s.name, w.Code, s.code)
+		}
+	}
+	if len(db.holds) != 2 || db.holds[7] != 3000 || db.holds[8] != 2000 {
+		t.Fatalf("holds %v", db.holds)
+	}
+	if !queryHas(db.queries[0], "pg_advisory_xact_lock") {
+		t.Errorf("hold started with %q, want the user lock", db.queries[0])
+	}
+}
+
+func TestHoldTakenByAnotherUser(t *testing.T) {
+	db := &holdDB{balance: 5000, holds: map[int64]int64{}}
+	useFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		if queryHas(query, "INSERT INTO account_hold") {
+			return fakeResult{}
+		}
+		return db.handle(query, args)
+	})
+	if w := postFunds(hold, "5", `{"book_id":7,"amount":3000}`); w.Code != http.StatusConflict {
+		t.Fatalf("answered %d, want 409", w.Code)
+	}
+}
+
+// TestBalancesExcludeHolds checks the admin balances answer the same
+// available balance as get, with the active holds taken off.
+func TestBalancesExcludeHolds(t *testing.T) {
+	deposits := map[int64]int64{5: 5000, 6: 1000}
+	holds := map[int64]int64{5: 3000}
+	useFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		if !queryHas(query, "FROM account WHERE", "FROM account_hold WHERE", "unnest") {
+			return fakeResult{}
+		}
+		res := fakeResult{Cols: []string{"id", "balance"}}
+		for _, id := range strings.Split(strings.Trim(args[0].(string), "{}"), ",") {
+			uid, _ := strconv.ParseInt(id, 10, 64)
+			res.Rows = append(res.Rows, []driver.Value{uid, deposits[uid] - holds[uid]})
+		}
+		return res
+	})
+	w := postFunds(balances, "1", `{"user_ids":[5,6,7]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("answered %d, want 200", w.Code)
+	}
+	if want := `[{"user_id":5,"balance":2000},{"user_id":6,"balance":1000},{"user_id":7,"balance":0}]`; w.Body.String() != want {
+		t.Fatalf("answered %s, want %s", w.Body.String(), want)
+	}
+}
@@ -0,0 +1,81 @@
+// Package client calls book and notif on behalf of account. It keeps the
+// paths and headers of those services in one place, the payloads are the
+// types of the shared contracts package.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"contracts"
+)
+
+const (
+	paymentCallbackPath = "/book/callback/account"
+	notifCreatePath     = "/notif/create"
+)
+
+// StatusError is an unexpected status code from a service.
+type StatusError struct {
+	Service string
+	Code    int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s responded with status [%d]", e.Service, e.Code)
+}
+
+// Doer sends HTTP requests. *http.Client implements it, tests can pass a stub
+// instead.
+type Doer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// Client calls the book service at BookURL and the notif service at
+// NotifURL.
+type Client struct {
+	HTTP     Doer
+	BookURL  string
+	NotifURL string
+}
+
+// New returns a Client for the given base URLs using http.DefaultClient.
+func New(bookURL, notifURL string) *Client {
+	return &Client{HTTP: http.DefaultClient, BookURL: bookURL, NotifURL: notifURL}
+}
+
+// PaymentResult reports to book whether the payment of the booking went
+// through. Anything but 200 from book is an error, the caller keeps the
+// result to send it again.
+func (c *Client) PaymentResult(r contracts.PaymentResult) error {
+	return c.post("book", c.BookURL+paymentCallbackPath, r.UserID, r)
+}
+
+// Notify asks notif to send message to the user.
+func (c *Client) Notify(uid int, message string) error {
+	return c.post("notif", c.NotifURL+notifCreatePath, uid, contracts.Notification{UserID: uid, Message: message})
+}
+
+func (c *Client) post(service, url string, uid int, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-User-Id", strconv.Itoa(uid))
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{Service: service, Code: resp.StatusCode}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"contracts"
+)
+
+// goldenDir holds the messages of the shared contracts package.
+const goldenDir = "../../../../contracts/testdata"
+
+func readGolden(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(goldenDir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// sameJSON reports whether a and b are the same json value regardless of
+// formatting and key order.
+func sameJSON(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var va, vb interface{}
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+// stubDoer records the requests and answers each of them with status.
+type stubDoer struct {
+	status int
+	reqs   []*http.Request
+	bodies [][]byte
+}
+
+func (d *stubDoer) Do(req *http.Request) (*http.Response, error) {
+	body, _ := io.ReadAll(req.Body)
+	d.reqs = append(d.reqs, req)
+	d.bodies = append(d.bodies, body)
+	return &http.Response{StatusCode: d.status, Body: io.NopCloser(bytes.NewReader(nil))}, nil
+}
+
+func newStubClient(status int) (*Client, *stubDoer) {
+	d := &stubDoer{status: status}
+	c := New("http://book", "http://notif")
+	c.HTTP = d
+	return c, d
+}
+
+func TestRequestsMatchContracts(t *testing.T) {
+	tests := []struct {
+		name   string
+		golden string
+		url    string
+		call   func(c *Client, golden []byte) error
+	}{
+		{"payment result", "payment_result.json", "http://book/book/callback/account", func(c *Client, golden []byte) error {
+			r := contracts.PaymentResult{}
+			if err := json.Unmarshal(golden, &r); err != nil {
+				return err
+			}
+			return c.PaymentResult(r)
+		}},
+		{"notify", "notification_message.json", "http://notif/notif/create", func(c *Client, _ []byte) error {
+			return c.Notify(5, "Your balance is below 100")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			golden := readGolden(t, tt.golden)
+			c, d := newStubClient(http.StatusOK)
+			if err := tt.call(c, golden); err != nil {
+				t.Fatal(err)
+			}
+			if len(d.reqs) != 1 {
+				t.Fatalf("sent %d requests, want 1", len(d.reqs))
+			}
+			if got := d.reqs[0].URL.String(); got != tt.url {
+				t.Errorf("url %s, want %s", got, tt.url)
+			}
+			if got := d.reqs[0].Header.Get("X-User-Id"); got != "5" {
+				t.Errorf("X-User-Id %q, want 5", got)
+			}
+			if !sameJSON(t, d.bodies[0], golden) {
+				t.Errorf("sent %s, want %s", d.bodies[0], golden)
+			}
+		})
+	}
+}
+
+func TestStatusErrors(t *testing.T) {
+	c, _ := newStubClient(http.StatusBadRequest)
+	err := c.PaymentResult(contracts.PaymentResult{BookID: 7, UserID: 5})
+	if se, ok := err.(*StatusError); !ok || se.Service != "book" || se.Code != http.StatusBadRequest {
+		t.Errorf("book: got %v, want book StatusError 400", err)
+	}
+	c, _ = newStubClient(http.StatusServiceUnavailable)
+	err = c.Notify(5, "hi")
+	if se, ok := err.(*StatusError); !ok || se.Service != "notif" || se.Code != http.StatusServiceUnavailable {
+		t.Errorf("notif: got %v, want notif StatusError 503", err)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// operation is a row of the account table.
+type operation struct {
+	uid    int64
+	delta  int64
+	reason string
+	done   bool
+}
+
+// ledgerDB fakes the account table, with the prepared operations keyed by
+// request id, and account_threshold.
+type ledgerDB struct {
+	mu         sync.Mutex
+	ops        map[string]*operation
+	thresholds map[int64]int64
+	queries    []string
+}
+
+func newLedgerDB(t *testing.T) *ledgerDB {
+	db := &ledgerDB{ops: map[string]*operation{}, thresholds: map[int64]int64{}}
+	useFakeDB(t, db.handle)
+	return db
+}
+
+// balance is the sum of the done operations of the user.
+func (db *ledgerDB) balance(uid int64) int64 {
+	b := int64(0)
+	for _, op := range db.ops {
+		if op.uid == uid && op.done {
+			b += op.delta
+		}
+	}
+	return b
+}
+
+func (db *ledgerDB) handle(query string, args []driver.Value) fakeResult {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.queries = append(db.queries, query)
+	switch {
+	case queryHas(query, "INSERT INTO account (user_id, request_id, delta, status) VALUES ($1, $2, 0, 0)"):
+		if _, ok := db.ops[args[1].(string)]; ok {
+			return fakeResult{}
+		}
+		// genreq passes the user id on as the header string
+		uid, _ := strconv.ParseInt(fmt.Sprint(args[0]), 10, 64)
+		db.ops[args[1].(string)] = &operation{uid: uid}
+		return fakeResult{Affected: 1}
+	case queryHas(query, "UPDATE account SET delta=$3"):
+		op, ok := db.ops[args[1].(string)]
+		if !ok || op.done || op.uid != args[0] {
+			return fakeResult{}
+		}
+		op.delta, op.reason, op.done = args[2].(int64), args[3].(string), true
+		return fakeResult{Affected: 1}
+	case queryHas(query, "SELECT count(1) FROM account"):
+		n := int64(0)
+		if op, ok := db.ops[args[1].(string)]; ok && op.uid == args[0] {
+			n = 1
+		}
+		return fakeResult{Cols: []string{"count"}, Rows: [][]driver.Value{{n}}}
+	case queryHas(query, "FROM unnest($1::integer[])"):
+		res := fakeResult{Cols: []string{"id", "balance"}}
+		for _, v := range strings.Split(strings.Trim(args[0].(string), "{}"), ",") {
+			if uid, err := strconv.ParseInt(v, 10, 64); err == nil {
+				res.Rows = append(res.Rows, []driver.Value{uid, db.balance(uid)})
+			}
+		}
+		return res
+	case queryHas(query, "SUM(delta) FROM account WHERE user_id=$1"):
+		return fakeResult{Cols: []string{"balance"}, Rows: [][]driver.Value{{db.balance(args[0].(int64))}}}
+	case queryHas(query, "INSERT INTO account_threshold"):
+		db.thresholds[args[0].(int64)] = args[1].(int64)
+		return fakeResult{Affected: 1}
+	case queryHas(query, "SELECT threshold FROM account_threshold"):
+		res := fakeResult{Cols: []string{"threshold"}}
+		if th, ok := db.thresholds[args[0].(int64)]; ok {
+			res.Rows = [][]driver.Value{{th}}
+		}
+		return res
+	}
+	return fakeResult{}
+}
+
+// ran counts the statements containing every part.
+func (db *ledgerDB) ran(parts ...string) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	n := 0
+	for _, q := range db.queries {
+		if queryHas(q, parts...) {
+			n++
+		}
+	}
+	return n
+}
+
+// callAccount sends body to h as user 5 with the request id rid, if any.
+func callAccount(h http.HandlerFunc, method, rid, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/account", strings.NewReader(body))
+	r.Header.Set("X-User-Id", "5")
+	if rid != "" {
+		r.Header.Set("X-Request-Id", rid)
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+// change prepares the request id rid and deposits or withdraws with body
+// under it, as orders does.
+func change(t *testing.T, h http.HandlerFunc, rid, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	if w := callAccount(newReq, http.MethodGet, rid, ""); w.Code != http.StatusOK {
+		t.Fatalf("genreq answered %d", w.Code)
+	}
+	return callAccount(h, http.MethodPost, rid, body)
+}
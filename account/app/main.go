@@ -1,77 +1,193 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
-	"os"
 	"strconv"
+	"strings"
+	"time"
 
+	"app/internal/client"
+	"contracts"
+	"platform/config"
+	"platform/database"
+	"platform/web"
+
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"golang.org/x/sync/singleflight"
 )
 
-type deltaModel struct {
-	Delta int `json:"delta"`
+// deltaModel is the body of a deposit.
+type deltaModel = contracts.Deposit
+
+type requestIDModel struct {
+	RequestID string `json:"request_id"`
+}
+
+// withdrawalRequestModel is the body of a withdrawal.
+type withdrawalRequestModel = contracts.Withdrawal
+
+// withDrawalResponseModel is the payment callback sent to book.
+type withDrawalResponseModel = contracts.PaymentResult
+
+type balancesRequestModel struct {
+	UserIDs []int `json:"user_ids"`
 }
 
-type withdrawalRequestModel struct {
-	BookID      int `json:"book_id"`
-	WithDrawSum int `json:"withdrawal_sum"`
+type balanceModel struct {
+	UserID  int   `json:"user_id"`
+	Balance int64 `json:"balance"`
 }
 
-type withDrawalResponseModel struct {
-	BookID int  `json:"book_id"`
-	UserID int  `json:"user_id"`
-	Price  int  `json:"price"`
-	Status bool `json:"status"`
+// holdRequestModel reserves, captures or releases funds for a booking. On
+// capture Amount may be less than the hold, 0 captures the whole hold.
+type holdRequestModel = contracts.FundsRequest
+
+type thresholdModel struct {
+	Threshold int `json:"threshold"`
+}
+
+// dlqCallback is a callback to book that failed and waits in callback_dlq to
+// be sent again.
+type dlqCallback struct {
+	id        int
+	userID    int
+	payload   string
+	attempts  int
+	createdAt time.Time
 }
 
+// services calls book and notif. Tests can put a stub into its HTTP field.
+var services = client.New("", "")
+
 type configModel struct {
-	dbHost string
-	dbPort string
-	dbName string
-	dbUser string
-	dbPass string
-	host   string
-	port   string
+	web.ServerConfig
+	dbHost        string
+	dbPort        string
+	dbName        string
+	dbUser        string
+	dbPass        string
+	bookURL       string
+	notifURL      string
+	maxWithdrawal string
+	slowQuery     string
+	notifyDeposit string
+	origins       string
+	routePrefix   string
+	maintenance   string
+	dbWait        string
 }
 
 const (
-	getBalanceTpl          = `SELECT COALESCE(SUM(delta),0) FROM account WHERE user_id=$1 AND status=1`
-	prepareOperationTpl    = `INSERT INTO account (user_id, request_id, delta, status) VALUES ($1, $2, 0, 0)`
-	updateBalanceTpl       = `UPDATE account SET delta=$3, status=1 WHERE user_id=$1 AND request_id=$2 AND status=0`
-	ordersCallbackEndpoint = "http://book.saga.svc.cluster.local:9000/book/callback/account"
+	// getBalanceTpl returns the available balance, active holds are not
+	// available for spending.
+	getBalanceTpl       = `SELECT COALESCE((SELECT SUM(delta) FROM account WHERE user_id=$1 AND status=1), 0) - COALESCE((SELECT SUM(amount) FROM account_hold WHERE user_id=$1 AND status=0), 0)`
+	createHoldTpl       = `INSERT INTO account_hold (book_id, user_id, amount) VALUES ($1, $2, $3) ON CONFLICT (book_id) DO NOTHING`
+	lockHoldTpl         = `SELECT amount FROM account_hold WHERE book_id=$1 AND user_id=$2 AND status=$3 FOR UPDATE`
+	lockUserTpl         = `SELECT pg_advisory_xact_lock($1)`
+	setHoldStatusTpl    = `UPDATE account_hold SET status=$3, updated_at=now() WHERE book_id=$1 AND user_id=$2 AND status=$4`
+	captureTpl          = `INSERT INTO account (user_id, request_id, delta, status, reason) VALUES ($1, $2, $3, 1, $4)`
+	refundTpl           = `INSERT INTO account (user_id, request_id, delta, status, reason) SELECT user_id, $3, -delta, 1, $4 FROM account WHERE user_id=$1 AND request_id=$2 AND status=1 AND delta < 0 ON CONFLICT (request_id) DO NOTHING`
+	hasOperationTpl     = `SELECT count(1) FROM account WHERE user_id=$1 AND request_id=$2`
+	statementTpl        = `SELECT created_at, request_id, delta, status FROM account WHERE user_id=$1 ORDER BY id`
+	prepareOperationTpl = `INSERT INTO account (user_id, request_id, delta, status) VALUES ($1, $2, 0, 0) ON CONFLICT (request_id) DO NOTHING`
+	updateBalanceTpl    = `UPDATE account SET delta=$3, reason=NULLIF($4, ''), status=1 WHERE user_id=$1 AND request_id=$2 AND status=0`
+	setThresholdTpl     = `INSERT INTO account_threshold (user_id, threshold) VALUES ($1, $2) ON CONFLICT (user_id) DO UPDATE SET threshold = excluded.threshold`
+	getThresholdTpl     = `SELECT threshold FROM account_threshold WHERE user_id=$1`
+	getBalancesTpl      = `SELECT u.id, COALESCE((SELECT SUM(delta) FROM account WHERE user_id=u.id AND status=1), 0) - COALESCE((SELECT SUM(amount) FROM account_hold WHERE user_id=u.id AND status=0), 0) FROM unnest($1::integer[]) AS u(id)`
+	maxBalancesIDs      = 1000
+	roleAdmin           = "admin"
+)
+
+const (
+	dlqPollInterval = 5 * time.Second
+	dlqBaseDelay    = time.Second
+	dlqMaxDelay     = 5 * time.Minute
+	dlqMaxAge       = 24 * time.Hour
+	dlqBatchSize    = 100
+)
+
+const (
+	enqueueCallbackTpl  = `INSERT INTO callback_dlq (user_id, payload, next_attempt_at) VALUES ($1, $2, now() + make_interval(secs => $3))`
+	dueCallbacksTpl     = `SELECT id, user_id, payload, attempts, created_at FROM callback_dlq WHERE next_attempt_at <= now() ORDER BY id LIMIT $1`
+	scheduleCallbackTpl = `UPDATE callback_dlq SET attempts=$2, next_attempt_at=now() + make_interval(secs => $3) WHERE id=$1`
+	deleteCallbackTpl   = `DELETE FROM callback_dlq WHERE id=$1`
 )
 
 var (
 	getbalanceStmt       *sql.Stmt
 	prepareOperationStmt *sql.Stmt
 	updateBalanceStmt    *sql.Stmt
+	setThresholdStmt     *sql.Stmt
+	getThresholdStmt     *sql.Stmt
+	getBalancesStmt      *sql.Stmt
+	createHoldStmt       *sql.Stmt
+	lockHoldStmt         *sql.Stmt
+	lockUserStmt         *sql.Stmt
+	setHoldStatusStmt    *sql.Stmt
+	captureStmt          *sql.Stmt
+	refundStmt           *sql.Stmt
+	hasOperationStmt     *sql.Stmt
+	statementStmt        *sql.Stmt
+	enqueueCallbackStmt  *sql.Stmt
+	dueCallbacksStmt     *sql.Stmt
+	scheduleCallbackStmt *sql.Stmt
+	deleteCallbackStmt   *sql.Stmt
+	dbConn               = &database.Conn{Prepare: mustPrepareStmts}
+	balanceGroup         singleflight.Group
+	// maxWithdrawal caps a single withdrawal, 0 means no cap
+	maxWithdrawal int
+	// notifyDeposit turns the notification about a deposit on
+	notifyDeposit bool
+	// slowQueryThreshold is the duration after which a query is logged as
+	// slow, 0 turns the logging off
+	slowQueryThreshold time.Duration
 )
 
 func readConf() *configModel {
 	cfg := &configModel{
-		dbHost: "account-postgresql",
-		dbPort: "5432",
-		dbName: "accountdb",
-		dbUser: "accountuser",
-		dbPass: "accountpasswd",
-		host:   "0.0.0.0",
-		port:   "80",
-	}
-	dbHost := os.Getenv("DBHOST")
-	dbPort := os.Getenv("DBPORT")
-	dbName := os.Getenv("DBNAME")
-	dbUser := os.Getenv("DBUSER")
-	dbPass := os.Getenv("DBPASS")
-	host := os.Getenv("HOST")
-	port := os.Getenv("PORT")
+		dbHost:        "account-postgresql",
+		dbPort:        "5432",
+		dbName:        "accountdb",
+		dbUser:        "accountuser",
+		dbPass:        "accountpasswd",
+		ServerConfig:  web.DefaultServerConfig(),
+		bookURL:       "http://book.saga.svc.cluster.local:9000",
+		notifURL:      "http://notif.saga.svc.cluster.local:9000",
+		slowQuery:     "200ms",
+		notifyDeposit: "true",
+		dbWait:        "60s",
+	}
+	dbHost := config.Getenv("DBHOST")
+	dbPort := config.Getenv("DBPORT")
+	dbName := config.Getenv("DBNAME")
+	dbUser := config.Getenv("DBUSER")
+	dbPass := config.Getenv("DBPASS")
+	host := config.Getenv("HOST")
+	port := config.Getenv("PORT")
+	bookURL := config.Getenv("BOOK_URL")
+	notifURL := config.Getenv("NOTIF_URL")
+	tlsCertFile := config.Getenv("TLS_CERT_FILE")
+	tlsKeyFile := config.Getenv("TLS_KEY_FILE")
+	maxWithdrawal := config.Getenv("MAX_WITHDRAWAL")
+	slowQuery := config.Getenv("SLOW_QUERY_THRESHOLD")
+	notifyDeposit := config.Getenv("NOTIFY_DEPOSIT")
+	readTimeout := config.Getenv("READ_TIMEOUT")
+	writeTimeout := config.Getenv("WRITE_TIMEOUT")
+	idleTimeout := config.Getenv("IDLE_TIMEOUT")
+	origins := config.Getenv("ALLOWED_ORIGINS")
+	routePrefix := config.Getenv("ROUTE_PREFIX")
+	maintenance := config.Getenv("MAINTENANCE")
+	dbWait := config.Getenv("DB_WAIT_TIMEOUT")
 
 	if dbHost != "" {
 		cfg.dbHost = dbHost
@@ -89,10 +205,52 @@ func readConf() *configModel {
 		cfg.dbPass = dbPass
 	}
 	if host != "" {
-		cfg.host = host
+		cfg.Host = host
 	}
 	if port != "" {
-		cfg.port = port
+		cfg.Port = port
+	}
+	if bookURL != "" {
+		cfg.bookURL = bookURL
+	}
+	if notifURL != "" {
+		cfg.notifURL = notifURL
+	}
+	if tlsCertFile != "" {
+		cfg.TLSCertFile = tlsCertFile
+	}
+	if tlsKeyFile != "" {
+		cfg.TLSKeyFile = tlsKeyFile
+	}
+	if maxWithdrawal != "" {
+		cfg.maxWithdrawal = maxWithdrawal
+	}
+	if slowQuery != "" {
+		cfg.slowQuery = slowQuery
+	}
+	if notifyDeposit != "" {
+		cfg.notifyDeposit = notifyDeposit
+	}
+	if readTimeout != "" {
+		cfg.ReadTimeout = readTimeout
+	}
+	if writeTimeout != "" {
+		cfg.WriteTimeout = writeTimeout
+	}
+	if idleTimeout != "" {
+		cfg.IdleTimeout = idleTimeout
+	}
+	if origins != "" {
+		cfg.origins = origins
+	}
+	if routePrefix != "" {
+		cfg.routePrefix = routePrefix
+	}
+	if maintenance != "" {
+		cfg.maintenance = maintenance
+	}
+	if dbWait != "" {
+		cfg.dbWait = dbWait
 	}
 	return cfg
 }
@@ -102,11 +260,29 @@ func makeDBConn(cfg *configModel) (*sql.DB, error) {
 		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		cfg.dbHost, cfg.dbPort, cfg.dbUser, cfg.dbPass, cfg.dbName,
 	)
-	log.Println("connection string: ", pgConnString)
+	log.Printf("Connecting to database host=%s port=%s dbname=%s\n", cfg.dbHost, cfg.dbPort, cfg.dbName)
 	db, err := sql.Open("postgres", pgConnString)
 	return db, err
 }
 
+// timed runs the query f and logs it under name when it takes longer than
+// slowQueryThreshold.
+func timed(name string, f func() error) error {
+	start := time.Now()
+	err := f()
+	if d := time.Since(start); slowQueryThreshold > 0 && d > slowQueryThreshold {
+		log.Printf("Slow query [%s] took %s\n", name, d)
+	}
+	return err
+}
+
+// maintenanceMode turns every request but health, version and the switch
+// itself away with 503. It starts from MAINTENANCE and is switched at runtime
+// by admins via maintenancePath.
+var maintenanceMode = &web.Maintenance{Health: []string{"/health"}}
+
+const maintenancePath = "/account/maintenance"
+
 func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -119,23 +295,86 @@ func main() {
 	}
 	defer db.Close()
 
-	if err = db.PingContext(ctx); err != nil {
+	dbWait, err := time.ParseDuration(cfg.dbWait)
+	if err != nil {
+		log.Fatal("Failed to parse DB_WAIT_TIMEOUT:", err)
+	}
+	if err = database.Wait(ctx, db, dbWait); err != nil {
 		log.Fatal("Failed to check db connection:", err)
 	}
 
 	mustPrepareStmts(ctx, db)
+	dbConn.Open = func() (*sql.DB, error) { return makeDBConn(cfg) }
+	dbConn.Set(db)
+	if cfg.slowQuery != "" {
+		if slowQueryThreshold, err = time.ParseDuration(cfg.slowQuery); err != nil {
+			log.Fatal("Failed to parse SLOW_QUERY_THRESHOLD:", err)
+		}
+	}
+	services.BookURL, services.NotifURL = cfg.bookURL, cfg.notifURL
 
-	r := mux.NewRouter()
+	go retryCallbacks(ctx)
+	if cfg.maxWithdrawal != "" {
+		if maxWithdrawal, err = strconv.Atoi(cfg.maxWithdrawal); err != nil {
+			log.Fatal("Failed to parse MAX_WITHDRAWAL:", err)
+		}
+	}
+	if notifyDeposit, err = strconv.ParseBool(cfg.notifyDeposit); err != nil {
+		log.Fatal("Failed to parse NOTIFY_DEPOSIT:", err)
+	}
+
+	if cfg.maintenance != "" {
+		on, err := strconv.ParseBool(cfg.maintenance)
+		if err != nil {
+			log.Fatal("Failed to parse MAINTENANCE:", err)
+		}
+		maintenanceMode.Set(on)
+	}
+
+	prefix := strings.TrimSuffix(cfg.routePrefix, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		log.Fatalf("ROUTE_PREFIX [%s] must start with /", cfg.routePrefix)
+	}
+	r := newRouter(prefix)
+
+	h := maintenanceMode.Middleware(prefix+maintenancePath, r)
+	h = web.RecoverPanics(web.CORS(web.ParseOrigins(cfg.origins), h))
+	if err := web.Serve(cfg.ServerConfig, h); err != nil {
+		log.Printf("Failed to bind on [%s:%s]: %s", cfg.Host, cfg.Port, err)
+	}
+}
 
-	r.HandleFunc("/account/genreq", reqlog(isAuthenticatedMiddleware(newReq))).Methods("GET")
-	r.HandleFunc("/account/get", reqlog(isAuthenticatedMiddleware(get)))
-	r.HandleFunc("/account/deposit", reqlog(isAuthenticatedMiddleware(deposit))).Methods("POST")
-	r.HandleFunc("/account/withdrawal", reqlog(isAuthenticatedMiddleware(withdrawal))).Methods("POST")
+// newRouter registers the routes, the api ones under prefix if it isn't
+// empty.
+func newRouter(prefix string) *mux.Router {
+	r := mux.NewRouter()
 
-	bindOn := fmt.Sprintf("%s:%s", cfg.host, cfg.port)
-	if err := http.ListenAndServe(bindOn, r); err != nil {
-		log.Printf("Failed to bind on [%s]: %s", bindOn, err)
+	r.HandleFunc("/health", health)
+	r.HandleFunc("/version", web.VersionInfo).Methods("GET")
+	api := r
+	if prefix != "" {
+		api = r.PathPrefix(prefix).Subrouter()
 	}
+	api.HandleFunc("/account/genreq", reqlog(web.Authenticated(newReq))).Methods("GET")
+	api.HandleFunc("/account/get", reqlog(web.Authenticated(get))).Methods("GET")
+	api.HandleFunc("/account/statement.csv", reqlog(web.Authenticated(statement))).Methods("GET")
+	api.HandleFunc("/account/deposit", reqlog(web.Authenticated(deposit))).Methods("POST")
+	api.HandleFunc("/account/withdrawal", reqlog(web.Authenticated(withdrawal))).Methods("POST")
+	api.HandleFunc("/account/hold", reqlog(web.Authenticated(hold))).Methods("POST")
+	api.HandleFunc("/account/capture", reqlog(web.Authenticated(capture))).Methods("POST")
+	api.HandleFunc("/account/release", reqlog(web.Authenticated(release))).Methods("POST")
+	api.HandleFunc("/account/refund", reqlog(web.Authenticated(refund))).Methods("POST")
+	api.HandleFunc("/account/threshold", reqlog(web.Authenticated(setThreshold))).Methods("POST")
+	api.HandleFunc("/account/balances", reqlog(web.Authenticated(web.RequireRole(roleAdmin, balances)))).Methods("POST")
+	api.HandleFunc(maintenancePath, reqlog(web.Authenticated(web.RequireRole(roleAdmin, maintenanceMode.Switch)))).Methods("GET", "PUT")
+	r.MethodNotAllowedHandler = web.MethodNotAllowed(r)
+	r.NotFoundHandler = http.HandlerFunc(web.NotFound)
+	return r
+}
+
+func health(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status": "OK"}`))
 }
 
 func mustPrepareStmts(ctx context.Context, db *sql.DB) {
@@ -155,16 +394,128 @@ func mustPrepareStmts(ctx context.Context, db *sql.DB) {
 	if err != nil {
 		panic(err)
 	}
+
+	setThresholdStmt, err = db.PrepareContext(ctx, setThresholdTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	getThresholdStmt, err = db.PrepareContext(ctx, getThresholdTpl)
+	if err != nil {
+		panic(err)
+	}
+	getBalancesStmt, err = db.PrepareContext(ctx, getBalancesTpl)
+	if err != nil {
+		panic(err)
+	}
+	createHoldStmt, err = db.PrepareContext(ctx, createHoldTpl)
+	if err != nil {
+		panic(err)
+	}
+	lockHoldStmt, err = db.PrepareContext(ctx, lockHoldTpl)
+	if err != nil {
+		panic(err)
+	}
+	lockUserStmt, err = db.PrepareContext(ctx, lockUserTpl)
+	if err != nil {
+		panic(err)
+	}
+	setHoldStatusStmt, err = db.PrepareContext(ctx, setHoldStatusTpl)
+	if err != nil {
+		panic(err)
+	}
+	captureStmt, err = db.PrepareContext(ctx, captureTpl)
+	if err != nil {
+		panic(err)
+	}
+	refundStmt, err = db.PrepareContext(ctx, refundTpl)
+	if err != nil {
+		panic(err)
+	}
+	hasOperationStmt, err = db.PrepareContext(ctx, hasOperationTpl)
+	if err != nil {
+		panic(err)
+	}
+	statementStmt, err = db.PrepareContext(ctx, statementTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	enqueueCallbackStmt, err = db.PrepareContext(ctx, enqueueCallbackTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	dueCallbacksStmt, err = db.PrepareContext(ctx, dueCallbacksTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	scheduleCallbackStmt, err = db.PrepareContext(ctx, scheduleCallbackTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	deleteCallbackStmt, err = db.PrepareContext(ctx, deleteCallbackTpl)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// A single operation must fit the integer delta column, and a balance must
+// stay within what JSON clients read exactly.
+const (
+	maxDelta   = math.MaxInt32
+	maxBalance = 1<<53 - 1
+)
+
+var errBalanceOverflow = errors.New("balance would overflow")
+
+// getbalance collapses concurrent reads for the same user into one query.
+func getbalance(id int) (int64, error) {
+	v, err, _ := balanceGroup.Do(strconv.Itoa(id), func() (interface{}, error) {
+		var balance int64
+		err := dbConn.Retry(func() error {
+			return timed("getBalance", func() error {
+				return getbalanceStmt.QueryRow(id).Scan(&balance)
+			})
+		})
+		return balance, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return v.(int64), nil
 }
 
-func getbalance(id int) (int, error) {
-	balance := 0
-	err := getbalanceStmt.QueryRow(id).Scan(&balance)
-	return balance, err
+// checkedAdd returns balance+delta, or errBalanceOverflow if delta doesn't
+// fit the delta column or the result is beyond maxBalance either way.
+func checkedAdd(balance int64, delta int) (int64, error) {
+	if int64(delta) > maxDelta || int64(delta) < -maxDelta {
+		return 0, errBalanceOverflow
+	}
+	sum := balance + int64(delta)
+	if sum > maxBalance || sum < -maxBalance {
+		return 0, errBalanceOverflow
+	}
+	return sum, nil
 }
 
-func updatebalance(uid int, rid string, delta int) error {
-	res, err := updateBalanceStmt.Exec(uid, rid, delta)
+// updatebalance applies delta to the prepared operation rid. reason is kept
+// with the operation for audit and may be empty.
+func updatebalance(uid int, rid string, delta int, reason string) error {
+	balance, err := getbalance(uid)
+	if err != nil {
+		return err
+	}
+	if _, err = checkedAdd(balance, delta); err != nil {
+		return err
+	}
+	var res sql.Result
+	err = dbConn.Retry(func() (err error) {
+		res, err = updateBalanceStmt.Exec(uid, rid, delta, reason)
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -173,42 +524,181 @@ func updatebalance(uid int, rid string, delta int) error {
 		return err
 	}
 	if n == 0 {
-		return errors.New("balance did not change")
+		// a repeated request id of an operation that is already done
+		// succeeds without changing the balance again
+		done, err := hasOperation(uid, rid)
+		if err != nil {
+			return err
+		}
+		if !done {
+			return errors.New("balance did not change")
+		}
+		return nil
 	}
+	// a read started before this update must not be shared with later callers
+	balanceGroup.Forget(strconv.Itoa(uid))
 	return err
 }
 
 func get(w http.ResponseWriter, r *http.Request) {
-	headers := r.Header
-	id, err := strconv.Atoi(headers.Get("X-User-Id"))
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Got wrong header [X-User-Id]: %s", err)
+	id, ok := web.MustUserID(w, r)
+	if !ok {
 		return
 	}
 	b, err := getbalance(id)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Failed to get account balance for userID [%d]:%s", id, err)
+		web.InternalError(w, r, fmt.Errorf("failed to get account balance for user [%d]: %w", id, err))
 		return
 	}
 
+	data, _ := json.Marshal(contracts.Balance{Balance: b})
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"balance":%d}`, b)
+	w.Write(data)
 }
 
+// newReq registers a pending operation that a following deposit or
+// withdrawal completes. The request id is taken from X-Request-Id or, if the
+// client sent none, generated, and returned in the body and the header. A
+// request id that is already registered is kept as is, so a client retrying
+// an operation can register its request id again.
 func newReq(w http.ResponseWriter, r *http.Request) {
 	headers := r.Header
 	uid := headers.Get("X-User-Id")
 	rid := headers.Get("X-Request-Id")
-	_, err := prepareOperationStmt.Exec(uid, rid)
+	if rid == "" {
+		rid = uuid.NewString()
+	}
+	err := dbConn.Retry(func() error {
+		_, err := prepareOperationStmt.Exec(uid, rid)
+		return err
+	})
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		web.InternalError(w, r, fmt.Errorf("failed to prepare operation for user [%s]: %w", uid, err))
 		return
 	}
+	data, _ := json.Marshal(requestIDModel{RequestID: rid})
 	w.Header().Add("X-Request-Id", rid)
 	w.Header().Add("X-User-Id", uid)
 	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// balances returns the balances of the given users in one query. Held funds
+// are excluded as in get, a user without operations has balance 0. Available
+// to admins only.
+func balances(w http.ResponseWriter, r *http.Request) {
+	req := balancesRequestModel{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("Failed to parse data:", err)
+		return
+	}
+	if len(req.UserIDs) > maxBalancesIDs {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Too many user ids, at most %d are allowed", maxBalancesIDs)
+		return
+	}
+	found := make(map[int]int64, len(req.UserIDs))
+	err := dbConn.Retry(func() error {
+		rows, err := getBalancesStmt.Query(pq.Array(req.UserIDs))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var uid int
+			var balance int64
+			if err = rows.Scan(&uid, &balance); err != nil {
+				return err
+			}
+			found[uid] = balance
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to get balances for [%d] users: %w", len(req.UserIDs), err))
+		return
+	}
+	res := make([]balanceModel, 0, len(req.UserIDs))
+	for _, uid := range req.UserIDs {
+		res = append(res, balanceModel{UserID: uid, Balance: found[uid]})
+	}
+	data, err := json.Marshal(res)
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to marshal balances: %w", err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// statementFlushRows is how many CSV rows statement writes between flushes.
+const statementFlushRows = 100
+
+// statement streams the user's account operations as CSV. Rows are written
+// as they are read, so a long history is never held in memory.
+func statement(w http.ResponseWriter, r *http.Request) {
+	uid, ok := web.MustUserID(w, r)
+	if !ok {
+		return
+	}
+	var rows *sql.Rows
+	err := dbConn.Retry(func() (err error) {
+		rows, err = statementStmt.Query(uid)
+		return err
+	})
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to get statement for user [%d]: %w", uid, err))
+		return
+	}
+	defer rows.Close()
+
+	// a long statement may take longer than WRITE_TIMEOUT
+	if err = http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Failed to clear write deadline of the statement: %s\n", err)
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="statement.csv"`)
+	w.WriteHeader(http.StatusOK)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"date", "request_id", "delta", "status"})
+	n := 0
+	for rows.Next() {
+		var (
+			date   time.Time
+			rid    sql.NullString
+			delta  sql.NullInt64
+			status sql.NullInt64
+		)
+		if err = rows.Scan(&date, &rid, &delta, &status); err != nil {
+			log.Printf("Failed to read statement for user [%d]: %s\n", uid, err)
+			break
+		}
+		cw.Write([]string{
+			date.UTC().Format(time.RFC3339),
+			rid.String,
+			strconv.FormatInt(delta.Int64, 10),
+			operationStatus(status.Int64),
+		})
+		if n++; n%statementFlushRows == 0 {
+			cw.Flush()
+		}
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Failed to read statement for user [%d]: %s\n", uid, err)
+	}
+	cw.Flush()
+	if err = cw.Error(); err != nil {
+		log.Printf("Failed to write statement for user [%d]: %s\n", uid, err)
+	}
+}
+
+// operationStatus names the status of a row in account.
+func operationStatus(s int64) string {
+	if s == 1 {
+		return "completed"
+	}
+	return "pending"
 }
 
 func deposit(w http.ResponseWriter, r *http.Request) {
@@ -220,34 +710,39 @@ func deposit(w http.ResponseWriter, r *http.Request) {
 		log.Println("Got wrong request id")
 		return
 	}
-	uid, err := strconv.Atoi(headers.Get("X-User-Id"))
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Got wrong header [X-User-Id]: %s", err)
+	uid, ok := web.MustUserID(w, r)
+	if !ok {
 		return
 	}
+	var err error
 	d := deltaModel{}
 	if err = json.NewDecoder(r.Body).Decode(&d); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		log.Println("Failed to parse data:", err)
 		return
 	}
-	if err = updatebalance(uid, rid, d.Delta); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Println("Failed to update balance:", err)
+	if err = updatebalance(uid, rid, d.Delta, ""); errors.Is(err, errBalanceOverflow) {
+		log.Printf("Deposit [%d] of user [%d] would overflow the balance\n", d.Delta, uid)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte("Deposit would overflow the balance"))
+		return
+	} else if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to update balance: %w", err))
 		return
 	}
+	if notifyDeposit {
+		go notifyDeposited(uid, d.Delta)
+	}
 }
 
 func withdrawal(w http.ResponseWriter, r *http.Request) {
 	headers := r.Header
 	rid := headers.Get("X-Request-Id")
-	uid, err := strconv.Atoi(headers.Get("X-User-Id"))
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Got wrong header [X-User-Id]: %s", err)
+	uid, ok := web.MustUserID(w, r)
+	if !ok {
 		return
 	}
+	var err error
 	wr := withdrawalRequestModel{}
 	if err = json.NewDecoder(r.Body).Decode(&wr); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -256,8 +751,8 @@ func withdrawal(w http.ResponseWriter, r *http.Request) {
 	}
 	b, err := getbalance(uid)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("Failed to get balance for user [%d]: %s", uid, err)
+		web.InternalError(w, r, fmt.Errorf("failed to get balance for user [%d]: %w", uid, err))
+		return
 	}
 	wc := &withDrawalResponseModel{
 		BookID: wr.BookID,
@@ -265,60 +760,544 @@ func withdrawal(w http.ResponseWriter, r *http.Request) {
 		Price:  wr.WithDrawSum,
 		Status: false,
 	}
-	if wr.WithDrawSum > b {
-		w.WriteHeader(http.StatusInternalServerError)
+	if maxWithdrawal > 0 && wr.WithDrawSum > maxWithdrawal {
+		log.Printf("Withdrawal [%d] of user [%d] is over the limit [%d]\n", wr.WithDrawSum, uid, maxWithdrawal)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintf(w, "Withdrawal is over the limit of %d, split it or ask for manual review", maxWithdrawal)
 		sendCallback(wc)
 		return
 	}
-	if err = updatebalance(uid, rid, -wr.WithDrawSum); err != nil {
-		log.Printf("Failed to change balance for user [%d]: %s\n", uid, err)
+	if int64(wr.WithDrawSum) > b {
 		w.WriteHeader(http.StatusInternalServerError)
 		sendCallback(wc)
 		return
 	}
+	if err = updatebalance(uid, rid, -wr.WithDrawSum, wr.Reason); errors.Is(err, errBalanceOverflow) {
+		log.Printf("Withdrawal [%d] of user [%d] would overflow the balance\n", wr.WithDrawSum, uid)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte("Withdrawal would overflow the balance"))
+		sendCallback(wc)
+		return
+	} else if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to change balance for user [%d]: %w", uid, err))
+		sendCallback(wc)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	wc.Status = true
 	sendCallback(wc)
+	go notifyLowBalance(uid, b-int64(wr.WithDrawSum))
 }
 
-func sendCallback(r *withDrawalResponseModel) {
-	data, err := json.Marshal(r)
+// Statuses of a hold in account_hold.
+const (
+	holdActive = iota
+	holdCaptured
+	holdReleased
+)
+
+var (
+	errNoHold             = errors.New("there is no active hold for the book")
+	errCaptureExceedsHold = errors.New("capture exceeds the hold")
+	errNotEnoughFunds     = errors.New("not enough funds")
+	errHoldConflict       = errors.New("the book has another hold")
+)
+
+// hold reserves funds for a booking. Held funds are excluded from the
+// balance until they are captured or released. Holding the same amount for
+// the same book again is a no-op, any other second hold of the book answers
+// 409.
+func hold(w http.ResponseWriter, r *http.Request) {
+	uid, ok := web.MustUserID(w, r)
+	if !ok {
+		return
+	}
+	h := holdRequestModel{}
+	if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("Failed to parse data:", err)
+		return
+	}
+	if h.Amount <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("amount must be positive"))
+		return
+	}
+	if int64(h.Amount) > maxDelta {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte("Hold would overflow the balance"))
+		return
+	}
+	if maxWithdrawal > 0 && h.Amount > maxWithdrawal {
+		log.Printf("Hold [%d] of user [%d] is over the limit [%d]\n", h.Amount, uid, maxWithdrawal)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintf(w, "Hold is over the limit of %d", maxWithdrawal)
+		return
+	}
+	err := createHold(uid, h.BookID, h.Amount)
+	switch {
+	case errors.Is(err, errNotEnoughFunds):
+		log.Printf("Not enough funds of user [%d] to hold [%d] for book [%d]\n", uid, h.Amount, h.BookID)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte("Not enough funds"))
+		return
+	case errors.Is(err, errHoldConflict):
+		log.Printf("Book [%d] has another hold, hold [%d] of user [%d] is rejected\n", h.BookID, h.Amount, uid)
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("The book has another hold"))
+		return
+	case err != nil:
+		web.InternalError(w, r, fmt.Errorf("failed to hold [%d] for book [%d]: %w", h.Amount, h.BookID, err))
+		return
+	}
+	balanceGroup.Forget(strconv.Itoa(uid))
+	w.WriteHeader(http.StatusOK)
+}
+
+// createHold holds amount for the booking. The balance is checked and the
+// hold inserted in one transaction under a per-user lock, so concurrent holds
+// can't together take more than the balance.
+func createHold(uid, bid, amount int) error {
+	return dbConn.Retry(func() error {
+		tx, err := dbConn.DB().Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err = tx.Stmt(lockUserStmt).Exec(uid); err != nil {
+			return err
+		}
+		held := 0
+		err = tx.Stmt(lockHoldStmt).QueryRow(bid, uid, holdActive).Scan(&held)
+		if err == nil {
+			if held == amount {
+				return nil
+			}
+			return errHoldConflict
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		var balance int64
+		if err = tx.Stmt(getbalanceStmt).QueryRow(uid).Scan(&balance); err != nil {
+			return err
+		}
+		if int64(amount) > balance {
+			return errNotEnoughFunds
+		}
+		res, err := tx.Stmt(createHoldStmt).Exec(bid, uid, amount)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			// the book is held by another user, or its hold is not active anymore
+			return errHoldConflict
+		}
+		return tx.Commit()
+	})
+}
+
+// capture turns the hold of a booking into a debit and reports the result to
+// book like withdrawal does. A capture less than the hold frees the rest, a
+// capture greater than the hold is rejected.
+func capture(w http.ResponseWriter, r *http.Request) {
+	uid, ok := web.MustUserID(w, r)
+	if !ok {
+		return
+	}
+	h := holdRequestModel{}
+	if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("Failed to parse data:", err)
+		return
+	}
+	wc := &withDrawalResponseModel{
+		BookID: h.BookID,
+		UserID: uid,
+		Price:  h.Amount,
+	}
+	amount, err := captureHold(uid, h.BookID, h.Amount)
+	switch {
+	case errors.Is(err, errNoHold):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, errCaptureExceedsHold):
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintf(w, "Capture of %d exceeds the hold", h.Amount)
+	case err != nil:
+		web.InternalError(w, r, fmt.Errorf("failed to capture hold of book [%d] for user [%d]: %w", h.BookID, uid, err))
+	}
 	if err != nil {
-		log.Printf("Failed to parse data: %s\n", err)
+		sendCallback(wc)
+		return
+	}
+	balanceGroup.Forget(strconv.Itoa(uid))
+	w.WriteHeader(http.StatusOK)
+	wc.Price = amount
+	wc.Status = true
+	sendCallback(wc)
+	if b, err := getbalance(uid); err == nil {
+		go notifyLowBalance(uid, b)
+	}
+}
+
+// captureHold debits amount, or the whole hold if amount is 0, and marks the
+// hold captured in one transaction. It returns the captured amount.
+func captureHold(uid, bid, amount int) (int, error) {
+	err := dbConn.Retry(func() error {
+		tx, err := dbConn.DB().Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		held := 0
+		err = tx.Stmt(lockHoldStmt).QueryRow(bid, uid, holdActive).Scan(&held)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errNoHold
+		}
+		if err != nil {
+			return err
+		}
+		if amount == 0 {
+			amount = held
+		}
+		if amount < 0 || amount > held {
+			return errCaptureExceedsHold
+		}
+		rid := captureRequestID(bid)
+		if _, err = tx.Stmt(captureStmt).Exec(uid, rid, -amount, fmt.Sprintf("book %d", bid)); err != nil {
+			return err
+		}
+		if _, err = tx.Stmt(setHoldStatusStmt).Exec(bid, uid, holdCaptured, holdActive); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	return amount, err
+}
+
+// release frees the hold of a booking. Releasing a hold that is not active
+// answers 404.
+func release(w http.ResponseWriter, r *http.Request) {
+	uid, ok := web.MustUserID(w, r)
+	if !ok {
+		return
+	}
+	h := holdRequestModel{}
+	if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("Failed to parse data:", err)
 		return
 	}
-	reqBody := bytes.NewReader(data)
-	req, err := http.NewRequest("POST", ordersCallbackEndpoint, reqBody)
+	var res sql.Result
+	err := dbConn.Retry(func() (err error) {
+		res, err = setHoldStatusStmt.Exec(h.BookID, uid, holdReleased, holdActive)
+		return err
+	})
 	if err != nil {
-		log.Printf("Failed callback request: %s\n", err)
+		web.InternalError(w, r, fmt.Errorf("failed to release hold of book [%d]: %w", h.BookID, err))
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	balanceGroup.Forget(strconv.Itoa(uid))
+	w.WriteHeader(http.StatusOK)
+}
+
+// captureRequestID is the request id of the operation that captured the hold
+// of the booking.
+func captureRequestID(bid int) string {
+	return fmt.Sprintf("capture-%d", bid)
+}
+
+// refund pays back the captured hold of a booking, for a booking that was
+// cancelled while its payment was being captured. Refunding again is a no-op,
+// so book may retry it. A booking without a capture answers 404.
+func refund(w http.ResponseWriter, r *http.Request) {
+	uid, ok := web.MustUserID(w, r)
+	if !ok {
+		return
+	}
+	h := holdRequestModel{}
+	if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("Failed to parse data:", err)
+		return
+	}
+	err := refundCapture(uid, h.BookID)
+	if errors.Is(err, errNoCapture) {
+		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	req.Header.Set("X-User-Id", strconv.Itoa(r.UserID))
-	c := http.Client{}
-	resp, err := c.Do(req)
 	if err != nil {
-		log.Printf("Failed to call back book endpoint: %s\n", err)
+		web.InternalError(w, r, fmt.Errorf("failed to refund book [%d] for user [%d]: %w", h.BookID, uid, err))
 		return
 	}
-	defer resp.Body.Close()
+	balanceGroup.Forget(strconv.Itoa(uid))
+	w.WriteHeader(http.StatusOK)
 }
 
-func isAuthenticatedMiddleware(h http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		headers := r.Header
-		if _, ok := headers["X-User-Id"]; !ok {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("Not authenticated"))
-			log.Println("Not authenticated")
+var errNoCapture = errors.New("there is no capture for the book")
+
+// refundCapture credits back what captureHold debited for the booking. The
+// refund has a request id of its own, which is unique, so a repeated refund
+// inserts nothing.
+func refundCapture(uid, bid int) error {
+	rid := captureRequestID(bid)
+	var res sql.Result
+	err := dbConn.Retry(func() (err error) {
+		res, err = refundStmt.Exec(uid, rid, fmt.Sprintf("refund-%d", bid), fmt.Sprintf("refund of book %d", bid))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	// Nothing was inserted: either the refund exists already or there was
+	// no capture to refund.
+	captured, err := hasOperation(uid, rid)
+	if err != nil {
+		return err
+	}
+	if !captured {
+		return errNoCapture
+	}
+	return nil
+}
+
+// hasOperation reports whether the user has an operation with request id
+// rid, done or only prepared.
+func hasOperation(uid int, rid string) (bool, error) {
+	n := 0
+	err := dbConn.Retry(func() error {
+		return hasOperationStmt.QueryRow(uid, rid).Scan(&n)
+	})
+	return n > 0, err
+}
+
+func setThreshold(w http.ResponseWriter, r *http.Request) {
+	uid, ok := web.MustUserID(w, r)
+	if !ok {
+		return
+	}
+	var err error
+	t := thresholdModel{}
+	if err = json.NewDecoder(r.Body).Decode(&t); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("Failed to parse data:", err)
+		return
+	}
+	err = dbConn.Retry(func() error {
+		_, err := setThresholdStmt.Exec(uid, t.Threshold)
+		return err
+	})
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to set balance threshold for user [%d]: %w", uid, err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// notifyLowBalance tells the user that the balance fell below the threshold
+// the user has set. It is best effort, errors are only logged.
+func notifyLowBalance(uid int, balance int64) {
+	var threshold int64
+	err := dbConn.Retry(func() error {
+		return getThresholdStmt.QueryRow(uid).Scan(&threshold)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to get balance threshold for user [%d]: %s\n", uid, err)
+		return
+	}
+	if balance >= threshold {
+		return
+	}
+	msg := fmt.Sprintf("Your balance %d is below the threshold %d", balance, threshold)
+	if err = services.Notify(uid, msg); err != nil {
+		log.Printf("Failed to notify user [%d] about low balance: %s\n", uid, err)
+	}
+}
+
+// notifyDeposited tells the user that the account was credited. It is best
+// effort, errors are only logged.
+func notifyDeposited(uid, amount int) {
+	msg := fmt.Sprintf("Your account was credited with %d", amount)
+	if err := services.Notify(uid, msg); err != nil {
+		log.Printf("Failed to notify user [%d] about deposit: %s\n", uid, err)
+	}
+}
+
+// sendCallback reports the result to book. If book can't be reached the
+// callback is saved to callback_dlq and sent again by retryCallbacks.
+func sendCallback(r *withDrawalResponseModel) {
+	if r.BookID == 0 {
+		// withdrawal is not related to a book (e.g. an order), nobody waits for it
+		return
+	}
+	if err := services.PaymentResult(*r); err != nil {
+		log.Printf("Failed to call back book endpoint, will retry later: %s\n", err)
+		data, err := json.Marshal(r)
+		if err != nil {
+			log.Printf("Failed to parse data: %s\n", err)
+			return
+		}
+		enqueueCallback(r.UserID, data)
+	}
+}
+
+// enqueueCallback puts the failed callback into callback_dlq so that
+// retryCallbacks sends it again later.
+func enqueueCallback(uid int, data []byte) {
+	err := dbConn.Retry(func() error {
+		_, err := enqueueCallbackStmt.Exec(uid, string(data), callbackBackoff(0).Seconds())
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to save callback for user [%d], callback is lost: %s: %s\n", uid, data, err)
+	}
+}
+
+// retryCallbacks resends callbacks from callback_dlq until book accepts them.
+// The delay between attempts doubles up to dlqMaxDelay, callbacks older than
+// dlqMaxAge are dropped.
+func retryCallbacks(ctx context.Context) {
+	t := time.NewTicker(dlqPollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
 			return
+		case <-t.C:
 		}
-		h.ServeHTTP(w, r)
+		retryDueCallbacks()
 	}
 }
 
+func retryDueCallbacks() {
+	cbs := []dlqCallback{}
+	err := dbConn.Retry(func() error {
+		cbs = cbs[:0]
+		rows, err := dueCallbacksStmt.Query(dlqBatchSize)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			c := dlqCallback{}
+			if err := rows.Scan(&c.id, &c.userID, &c.payload, &c.attempts, &c.createdAt); err != nil {
+				return err
+			}
+			cbs = append(cbs, c)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		log.Printf("Failed to get callbacks to retry: %s\n", err)
+		return
+	}
+	for _, c := range cbs {
+		if time.Since(c.createdAt) > dlqMaxAge {
+			log.Printf("Giving up on callback [%d] for user [%d] after [%d] attempts: %s\n", c.id, c.userID, c.attempts, c.payload)
+			deleteCallback(c.id)
+			continue
+		}
+		if err := resendCallback(c.payload); err != nil {
+			c.attempts++
+			log.Printf("Failed to resend callback [%d] for user [%d], attempt [%d]: %s\n", c.id, c.userID, c.attempts, err)
+			err = dbConn.Retry(func() error {
+				_, err := scheduleCallbackStmt.Exec(c.id, c.attempts, callbackBackoff(c.attempts).Seconds())
+				return err
+			})
+			if err != nil {
+				log.Printf("Failed to reschedule callback [%d]: %s\n", c.id, err)
+			}
+			continue
+		}
+		log.Printf("Successfully resent callback [%d] for user [%d]\n", c.id, c.userID)
+		deleteCallback(c.id)
+	}
+}
+
+// resendCallback sends a callback saved in callback_dlq to book again.
+func resendCallback(payload string) error {
+	r := withDrawalResponseModel{}
+	if err := json.Unmarshal([]byte(payload), &r); err != nil {
+		return err
+	}
+	return services.PaymentResult(r)
+}
+
+func deleteCallback(id int) {
+	err := dbConn.Retry(func() error {
+		_, err := deleteCallbackStmt.Exec(id)
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to delete callback [%d]: %s\n", id, err)
+	}
+}
+
+// callbackBackoff is the delay before the next attempt after the given number
+// of failed attempts.
+func callbackBackoff(attempts int) time.Duration {
+	d := dlqBaseDelay
+	for i := 0; i < attempts && d < dlqMaxDelay; i++ {
+		d *= 2
+	}
+	if d > dlqMaxDelay {
+		d = dlqMaxDelay
+	}
+	return d
+}
+
+// statusRecorder remembers the status code and the size of the response
+// written by the wrapped handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
 func reqlog(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Got request from: %s\n", r.Host)
-		h.ServeHTTP(w, r)
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		log.Printf("method=%s path=%s status=%d bytes=%d duration=%s request_id=%q host=%s\n",
+			r.Method, r.URL.Path, rec.status, rec.bytes, time.Since(start), r.Header.Get("X-Request-Id"), r.Host)
 	}
 }
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestCheckedAdd(t *testing.T) {
+	tests := []struct {
+		balance  int64
+		delta    int
+		want     int64
+		overflow bool
+	}{
+		{0, maxDelta, maxDelta, false},
+		{0, maxDelta + 1, 0, true},
+		{0, -maxDelta, -maxDelta, false},
+		{0, -maxDelta - 1, 0, true},
+		{maxBalance - 1, 1, maxBalance, false},
+		{maxBalance, 1, 0, true},
+		{maxBalance, -1, maxBalance - 1, false},
+		{-maxBalance, -1, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := checkedAdd(tt.balance, tt.delta)
+		if overflow := errors.Is(err, errBalanceOverflow); overflow != tt.overflow || got != tt.want {
+			t.Errorf("checkedAdd(%d, %d) = %d, %v; want %d, overflow %t", tt.balance, tt.delta, got, err, tt.want, tt.overflow)
+		}
+	}
+}
+
+// TestDepositUpToMaxBalance fills the balance to maxBalance and checks the
+// next deposit is rejected without touching the balance.
+func TestDepositUpToMaxBalance(t *testing.T) {
+	useNotifyDeposit(t, false)
+	db := newLedgerDB(t)
+	db.ops["seed"] = &operation{uid: 5, delta: maxBalance - maxDelta, done: true}
+
+	if w := change(t, deposit, "dep-1", fmt.Sprintf(`{"delta":%d}`, maxDelta)); w.Code != http.StatusOK {
+		t.Fatalf("deposit up to maxBalance answered %d", w.Code)
+	}
+	if b := db.balance(5); b != maxBalance {
+		t.Fatalf("balance is %d, want %d", b, int64(maxBalance))
+	}
+	if w := change(t, deposit, "dep-2", `{"delta":1}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("deposit over maxBalance answered %d, want 422", w.Code)
+	}
+	if b := db.balance(5); b != maxBalance {
+		t.Errorf("balance is %d after the rejected deposit, want %d", b, int64(maxBalance))
+	}
+}
+
+func TestOperationsOverMaxDeltaAreRejected(t *testing.T) {
+	saved := maxWithdrawal
+	maxWithdrawal = 0
+	t.Cleanup(func() { maxWithdrawal = saved })
+	useNotifyDeposit(t, false)
+	useStubServices(t, map[string]stubResponse{"/notif/create": {http.StatusOK, ""}})
+	db := newLedgerDB(t)
+	db.ops["seed"] = &operation{uid: 5, delta: 4 * maxDelta, done: true}
+
+	if w := change(t, withdrawal, "wd-1", fmt.Sprintf(`{"withdrawal_sum":%d}`, maxDelta+1)); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("withdrawal over maxDelta answered %d, want 422", w.Code)
+	}
+	if w := callAccount(hold, http.MethodPost, "", fmt.Sprintf(`{"book_id":7,"amount":%d}`, maxDelta+1)); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("hold over maxDelta answered %d, want 422", w.Code)
+	}
+	if b := db.balance(5); b != 4*maxDelta {
+		t.Errorf("balance is %d, want it untouched", b)
+	}
+	if w := change(t, withdrawal, "wd-2", fmt.Sprintf(`{"withdrawal_sum":%d}`, maxDelta)); w.Code != http.StatusOK {
+		t.Errorf("withdrawal of maxDelta answered %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// route sends a request as user 5 through the router built for prefix.
+func route(prefix, method, target string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set("X-User-Id", "5")
+	w := httptest.NewRecorder()
+	newRouter(prefix).ServeHTTP(w, r)
+	return w
+}
+
+func TestGetAllowsOnlyGET(t *testing.T) {
+	useFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		return fakeResult{Cols: []string{"balance"}, Rows: [][]driver.Value{{int64(3000)}}}
+	})
+	if w := route("", http.MethodGet, "/account/get"); w.Code != http.StatusOK || w.Body.String() != `{"balance":3000}` {
+		t.Fatalf("GET answered %d %s, want 200 with the balance", w.Code, w.Body.String())
+	}
+	for _, m := range []string{http.MethodPost, http.MethodPut, http.MethodDelete} {
+		w := route("", m, "/account/get")
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s answered %d, want 405", m, w.Code)
+		}
+		if got := w.Header().Get("Allow"); got != http.MethodGet {
+			t.Errorf("%s got Allow %q, want GET", m, got)
+		}
+	}
+}
+
+func TestUnknownPathAndWrongMethodAnswerJSON(t *testing.T) {
+	w := route("", http.MethodGet, "/account/nowhere")
+	if w.Code != http.StatusNotFound || w.Body.String() != `{"error":"not_found"}` {
+		t.Errorf("unknown path answered %d %s, want 404 not_found", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("unknown path answered Content-Type %q", ct)
+	}
+
+	w = route("", http.MethodGet, "/account/deposit")
+	if w.Code != http.StatusMethodNotAllowed || w.Body.String() != `{"error":"method_not_allowed"}` {
+		t.Errorf("GET /account/deposit answered %d %s, want 405 method_not_allowed", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("wrong method answered Content-Type %q", ct)
+	}
+	if got := w.Header().Get("Allow"); got != "POST" {
+		t.Errorf("wrong method got Allow %q, want %q", got, "POST")
+	}
+}
+
+// TestRoutePrefix mounts the API under /api: the prefixed path is served,
+// the bare one answers 404, and /version stays at the root.
+func TestRoutePrefix(t *testing.T) {
+	router := newRouter("/api")
+	get := func(target string) int {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("X-User-Id", "5")
+		r.Header.Set("X-User-Role", roleAdmin)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+	for target, want := range map[string]int{
+		"/api" + maintenancePath: http.StatusOK,
+		maintenancePath:          http.StatusNotFound,
+		"/version":               http.StatusOK,
+		"/api/version":           http.StatusNotFound,
+	} {
+		if code := get(target); code != want {
+			t.Errorf("%s answered %d, want %d", target, code, want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"app/internal/client"
+)
+
+// stubResponse is what a stubbed service answers to a path.
+type stubResponse struct {
+	status int
+	body   string
+}
+
+// stubRequest is a request account sent to a stubbed service.
+type stubRequest struct {
+	path   string
+	header http.Header
+	body   []byte
+}
+
+// stubDoer answers the requests to book and notif by path, a path without a
+// response gets 500.
+type stubDoer struct {
+	mu     sync.Mutex
+	routes map[string]stubResponse
+	reqs   []stubRequest
+}
+
+func (d *stubDoer) Do(req *http.Request) (*http.Response, error) {
+	body := []byte{}
+	if req.Body != nil {
+		body, _ = io.ReadAll(req.Body)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.reqs = append(d.reqs, stubRequest{path: req.URL.Path, header: req.Header, body: body})
+	res, ok := d.routes[req.URL.Path]
+	if !ok {
+		res = stubResponse{status: http.StatusInternalServerError}
+	}
+	return &http.Response{StatusCode: res.status, Body: io.NopCloser(bytes.NewBufferString(res.body))}, nil
+}
+
+// sent returns the requests sent to path.
+func (d *stubDoer) sent(path string) []stubRequest {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var reqs []stubRequest
+	for _, r := range d.reqs {
+		if r.path == path {
+			reqs = append(reqs, r)
+		}
+	}
+	return reqs
+}
+
+// waitSent waits for n requests to path, which account sends in the
+// background, and returns them. It gives up after a second.
+func (d *stubDoer) waitSent(t *testing.T, path string, n int) []stubRequest {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		reqs := d.sent(path)
+		if len(reqs) >= n || time.Now().After(deadline) {
+			return reqs
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// useStubServices points services at a stubDoer with routes.
+func useStubServices(t *testing.T, routes map[string]stubResponse) *stubDoer {
+	t.Helper()
+	d := &stubDoer{routes: routes}
+	saved := services
+	services = client.New("http://book", "http://notif")
+	services.HTTP = d
+	t.Cleanup(func() { services = saved })
+	return d
+}
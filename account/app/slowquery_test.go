@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useSlowQueryLog sets slowQueryThreshold and collects the log for the test.
+func useSlowQueryLog(t *testing.T, threshold time.Duration) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	saved := slowQueryThreshold
+	slowQueryThreshold = threshold
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		slowQueryThreshold = saved
+	})
+	return &buf
+}
+
+func TestSlowQueryIsLogged(t *testing.T) {
+	delay := 30 * time.Millisecond
+	useFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		if queryHas(query, "SELECT COALESCE((SELECT SUM(delta) FROM account") {
+			time.Sleep(delay)
+		}
+		return fakeResult{Cols: []string{"balance"}, Rows: [][]driver.Value{{int64(100)}}}
+	})
+
+	buf := useSlowQueryLog(t, 10*time.Millisecond)
+	getbalance(5)
+	if !strings.Contains(buf.String(), "Slow query [getBalance] took") {
+		t.Fatalf("logged %q, want the slow getBalance", buf.String())
+	}
+
+	buf = useSlowQueryLog(t, time.Second)
+	getbalance(5)
+	if strings.Contains(buf.String(), "Slow query") {
+		t.Errorf("logged %q for a query under the threshold", buf.String())
+	}
+}
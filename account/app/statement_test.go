@@ -0,0 +1,38 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStatementCSV(t *testing.T) {
+	day := time.Date(2030, 5, 1, 12, 0, 0, 0, time.FixedZone("MSK", 3*60*60))
+	useFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		if !queryHas(query, "SELECT created_at, request_id, delta, status FROM account WHERE user_id=$1") || args[0] != int64(5) {
+			return fakeResult{}
+		}
+		return fakeResult{Cols: []string{"created_at", "request_id", "delta", "status"}, Rows: [][]driver.Value{
+			{day, "dep-1", int64(3000), int64(1)},
+			{day.Add(time.Hour), "wd-1", int64(-1200), int64(1)},
+			{day.Add(2 * time.Hour), "wd-2", int64(0), int64(0)},
+			{day.Add(3 * time.Hour), nil, nil, nil},
+		}}
+	})
+	w := callAccount(statement, http.MethodGet, "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("statement answered %d", w.Code)
+	}
+	if ct, cd := w.Header().Get("Content-Type"), w.Header().Get("Content-Disposition"); ct != "text/csv" || cd != `attachment; filename="statement.csv"` {
+		t.Errorf("headers %q %q, want a csv attachment", ct, cd)
+	}
+	want := "date,request_id,delta,status\n" +
+		"2030-05-01T09:00:00Z,dep-1,3000,completed\n" +
+		"2030-05-01T10:00:00Z,wd-1,-1200,completed\n" +
+		"2030-05-01T11:00:00Z,wd-2,0,pending\n" +
+		"2030-05-01T12:00:00Z,,0,pending\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("statement\n%s\nwant\n%s", got, want)
+	}
+}
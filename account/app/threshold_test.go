@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"contracts"
+)
+
+func TestWithdrawalBelowThresholdNotifies(t *testing.T) {
+	newLedgerDB(t)
+	d := useStubServices(t, map[string]stubResponse{
+		"/book/callback/account": {http.StatusOK, ""},
+		"/notif/create":          {http.StatusOK, ""},
+	})
+	if w := change(t, deposit, "dep-1", `{"delta":1000}`); w.Code != http.StatusOK {
+		t.Fatalf("deposit answered %d", w.Code)
+	}
+	if w := callAccount(setThreshold, http.MethodPost, "", `{"threshold":500}`); w.Code != http.StatusOK {
+		t.Fatalf("threshold answered %d", w.Code)
+	}
+
+	if w := change(t, withdrawal, "wd-1", `{"book_id":7,"withdrawal_sum":300}`); w.Code != http.StatusOK {
+		t.Fatalf("withdrawal above the threshold answered %d", w.Code)
+	}
+	if w := change(t, withdrawal, "wd-2", `{"book_id":8,"withdrawal_sum":400}`); w.Code != http.StatusOK {
+		t.Fatalf("withdrawal below the threshold answered %d", w.Code)
+	}
+	notifs := d.waitSent(t, "/notif/create", 1)
+	if len(notifs) != 1 {
+		t.Fatalf("sent %d notifications, want 1", len(notifs))
+	}
+	n := contracts.Notification{}
+	if err := json.Unmarshal(notifs[0].body, &n); err != nil {
+		t.Fatal(err)
+	}
+	if n.UserID != 5 || n.Message != "Your balance 300 is below the threshold 500" {
+		t.Errorf("sent %s", notifs[0].body)
+	}
+}
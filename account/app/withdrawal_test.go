@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestWithdrawalCapAndReason(t *testing.T) {
+	db := newLedgerDB(t)
+	d := useStubServices(t, map[string]stubResponse{
+		"/book/callback/account": {http.StatusOK, ""},
+	})
+	saved := maxWithdrawal
+	maxWithdrawal = 1000
+	t.Cleanup(func() { maxWithdrawal = saved })
+	if w := change(t, deposit, "dep-1", `{"delta":5000}`); w.Code != http.StatusOK {
+		t.Fatalf("deposit answered %d", w.Code)
+	}
+
+	if w := change(t, withdrawal, "wd-1", `{"book_id":7,"withdrawal_sum":1001}`); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("withdrawal over the cap answered %d, want 422", w.Code)
+	}
+	if op := db.ops["wd-1"]; op.done {
+		t.Error("withdrawal over the cap was applied")
+	}
+	callbacks := d.sent("/book/callback/account")
+	if len(callbacks) != 1 || string(callbacks[0].body) != `{"book_id":7,"user_id":5,"price":1001,"status":false}` {
+		t.Errorf("callbacks %v, want one negative for book 7", callbacks)
+	}
+
+	if w := change(t, withdrawal, "wd-2", `{"book_id":8,"withdrawal_sum":1000,"reason":"Concert tickets"}`); w.Code != http.StatusOK {
+		t.Fatalf("withdrawal at the cap answered %d", w.Code)
+	}
+	if op := db.ops["wd-2"]; !op.done || op.delta != -1000 || op.reason != "Concert tickets" {
+		t.Errorf("stored %+v, want -1000 with the reason", *op)
+	}
+}
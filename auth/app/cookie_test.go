@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// useCookieConf sets the session cookie attributes as main does from cfg.
+func useCookieConf(t *testing.T, cfg *configModel) {
+	t.Helper()
+	savedSecure, savedSameSite, savedDomain := cookieSecure, cookieSameSite, cookieDomain
+	t.Cleanup(func() { cookieSecure, cookieSameSite, cookieDomain = savedSecure, savedSameSite, savedDomain })
+	var err error
+	if cookieSecure, err = strconv.ParseBool(cfg.cookieSecure); err != nil {
+		t.Fatal(err)
+	}
+	if cookieSameSite, err = parseSameSite(cfg.cookieSameSite); err != nil {
+		t.Fatal(err)
+	}
+	cookieDomain = cfg.cookieDomain
+}
+
+func TestCookieAttributesFollowConfig(t *testing.T) {
+	useSessions(t)
+	useUsers(t)
+	tests := []struct {
+		name     string
+		env      map[string]string
+		secure   bool
+		sameSite http.SameSite
+		domain   string
+	}{
+		{"defaults", nil, true, http.SameSiteLaxMode, ""},
+		{"cross subdomain", map[string]string{"COOKIE_SAMESITE": "none", "COOKIE_DOMAIN": "example.com"}, true, http.SameSiteNoneMode, "example.com"},
+		{"plain http for local runs", map[string]string{"COOKIE_SECURE": "false", "COOKIE_SAMESITE": "Strict"}, false, http.SameSiteStrictMode, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			useCookieConf(t, readConf())
+
+			w := postLogin(`{"login":"alice","password":"secret"}`)
+			cs := w.Result().Cookies()
+			if w.Code != http.StatusOK || len(cs) != 1 {
+				t.Fatalf("login answered %d with cookies %v", w.Code, cs)
+			}
+			c := cs[0]
+			if c.Name != "session_id" || c.Value == "" || c.Path != "/" || !c.HttpOnly || c.Secure != tt.secure || c.SameSite != tt.sameSite || c.Domain != tt.domain {
+				t.Errorf("login set %+v", c)
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/logout", nil)
+			r.AddCookie(&http.Cookie{Name: "session_id", Value: c.Value})
+			w = httptest.NewRecorder()
+			logout(w, r)
+			cs = w.Result().Cookies()
+			if len(cs) != 1 {
+				t.Fatalf("logout set cookies %v", cs)
+			}
+			cleared := cs[0]
+			if cleared.Value != "" || cleared.MaxAge >= 0 || cleared.Path != "/" || cleared.Domain != tt.domain || cleared.Secure != tt.secure || cleared.SameSite != tt.sameSite {
+				t.Errorf("logout set %+v, want the login cookie cleared", cleared)
+			}
+		})
+	}
+}
+
+func TestUnknownSameSiteIsRejected(t *testing.T) {
+	if _, err := parseSameSite("sometimes"); err == nil {
+		t.Error("parsed an unknown SameSite mode")
+	}
+}
@@ -6,4 +6,7 @@ require (
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/mux v1.8.1
 	github.com/lib/pq v1.10.9
+	platform v0.0.0
 )
+
+replace platform => ../../platform
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// useBackends points healthAll at list, parsed as HEALTH_BACKENDS and
+// HEALTH_CRITICAL are.
+func useBackends(t *testing.T, list, critical string) {
+	bs, err := parseBackends(list, critical)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := backends
+	backends = bs
+	t.Cleanup(func() { backends = saved })
+}
+
+func TestHealthAllMixedBackends(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(up.Close)
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(failing.Close)
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+
+	list := "book=" + up.URL + ",events=" + up.URL + "/,notif=" + failing.URL + ",profile=" + gone.URL
+	tests := []struct {
+		name     string
+		critical string
+		want     int
+	}{
+		{"only optional backends down", "book,events", http.StatusOK},
+		{"critical backend failing", "book,notif", http.StatusServiceUnavailable},
+		{"critical backend unreachable", "profile", http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useBackends(t, list, tt.critical)
+			w := httptest.NewRecorder()
+			healthAll(w, httptest.NewRequest(http.MethodGet, "/health/all", nil))
+			if w.Code != tt.want {
+				t.Errorf("answered %d, want %d", w.Code, tt.want)
+			}
+			got := map[string]string{}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]string{"book": "up", "events": "up", "notif": "down", "profile": "down"}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("statuses %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// useUsers fakes the users table with the single user alice.
+func useUsers(t *testing.T) {
+	useFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		cols := []string{"id", "login", "password", "email", "first_name", "last_name", "role"}
+		if !queryHas(query, "FROM auth_user WHERE login") {
+			return fakeResult{}
+		}
+		if args[0] != "alice" {
+			return fakeResult{Cols: cols}
+		}
+		return fakeResult{Cols: cols, Rows: [][]driver.Value{{int64(5), "alice", "secret", "alice@example.com", "Alice", "Smith", "user"}}}
+	})
+}
+
+// postLogin logs in with body.
+func postLogin(body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	login(w, r)
+	return w
+}
+
+func TestLoginFailuresLookTheSame(t *testing.T) {
+	useSessions(t)
+	useUsers(t)
+	unknown := postLogin(`{"login":"bob","password":"secret"}`)
+	wrong := postLogin(`{"login":"alice","password":"guess"}`)
+	if unknown.Code != http.StatusUnauthorized || wrong.Code != http.StatusUnauthorized {
+		t.Fatalf("answered %d for an unknown login and %d for a wrong password, want 401", unknown.Code, wrong.Code)
+	}
+	if unknown.Body.String() != wrong.Body.String() {
+		t.Errorf("bodies differ: %s and %s", unknown.Body.String(), wrong.Body.String())
+	}
+	for _, w := range []*httptest.ResponseRecorder{unknown, wrong} {
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("answered %s with Content-Type %q, want application/json", w.Body.String(), ct)
+		}
+	}
+	if len(unknown.Result().Cookies()) != 0 || len(wrong.Result().Cookies()) != 0 {
+		t.Error("failed login set a cookie")
+	}
+	if ok := postLogin(`{"login":"alice","password":"secret"}`); ok.Code != http.StatusOK {
+		t.Errorf("right password answered %d, want 200", ok.Code)
+	}
+}
+
+func TestLoginIncludesUserOnRequest(t *testing.T) {
+	useSessions(t)
+	useUsers(t)
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/login", `{"status":"ok"}`},
+		{"/login?include=user", `{"status":"ok","user":{"id":5,"login":"alice","email":"alice@example.com","first_name":"Alice","last_name":"Smith"}}`},
+		{"/login?include=orders", `{"status":"ok"}`},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(`{"login":"alice","password":"secret"}`))
+		w := httptest.NewRecorder()
+		login(w, r)
+		if w.Code != http.StatusOK || w.Body.String() != tt.want {
+			t.Errorf("%s answered %d %s, want 200 %s", tt.target, w.Code, w.Body.String(), tt.want)
+		}
+		if cs := w.Result().Cookies(); len(cs) != 1 || cs[0].Name != "session_id" {
+			t.Errorf("%s set cookies %v, want the session cookie", tt.target, cs)
+		}
+	}
+}
+
+func TestLoginQueryErrorIsNotBadCredentials(t *testing.T) {
+	useSessions(t)
+	useUsers(t)
+	if w := postLogin(`{"login":"bob","password":"secret"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("unknown user answered %d, want 401", w.Code)
+	}
+
+	useFakeDB(t, func(string, []driver.Value) fakeResult {
+		return fakeResult{Err: errors.New("canceling statement due to statement timeout")}
+	})
+	w := postLogin(`{"login":"alice","password":"secret"}`)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("failed query answered %d, want 500", w.Code)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("failed query set a cookie")
+	}
+}
@@ -2,16 +2,24 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
+	"net/mail"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"platform/config"
+	"platform/database"
+	"platform/web"
+
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
@@ -24,6 +32,55 @@ type userModel struct {
 	Email     string `json:"email"`
 	FirstName string `json:"first_name"`
 	LastName  string `json:"last_name"`
+	role      string
+}
+
+// fieldError is a problem with one field of a request.
+type fieldError struct {
+	Field string `json:"field"`
+	Msg   string `json:"msg"`
+}
+
+// validationErrors collects every field problem of a request, so the client
+// gets all of them in one response instead of one at a time.
+type validationErrors []fieldError
+
+func (v *validationErrors) add(field, msg string) {
+	*v = append(*v, fieldError{Field: field, Msg: msg})
+}
+
+// write answers 400 with the collected errors as
+// {"errors":[{"field":...,"msg":...}]}. It reports whether there were any.
+func (v validationErrors) write(w http.ResponseWriter) bool {
+	if len(v) == 0 {
+		return false
+	}
+	data, err := json.Marshal(struct {
+		Errors validationErrors `json:"errors"`
+	}{v})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to marshal validation errors: %s\n", err)
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(data)
+	return true
+}
+
+// publicUserModel is the part of the user that is safe to give to the client.
+type publicUserModel struct {
+	ID        int    `json:"id"`
+	Login     string `json:"login"`
+	Email     string `json:"email"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+}
+
+type loginResponseModel struct {
+	Status string           `json:"status"`
+	User   *publicUserModel `json:"user,omitempty"`
 }
 
 type loginModel struct {
@@ -32,20 +89,47 @@ type loginModel struct {
 }
 
 type configModel struct {
-	dbHost string
-	dbPort string
-	dbName string
-	dbUser string
-	dbPass string
-	host   string
-	port   string
+	web.ServerConfig
+	dbHost         string
+	dbPort         string
+	dbName         string
+	dbUser         string
+	dbPass         string
+	healthBackends string
+	healthCritical string
+	cookieSecure   string
+	cookieSameSite string
+	cookieDomain   string
+	maxSessions    string
+	origins        string
+	routePrefix    string
+	maintenance    string
+	dbWait         string
 }
 
 const (
 	createUserTpl = `INSERT INTO auth_user (login, password, email, first_name, last_name) VALUES ($1, $2, $3, $4, $5) returning id`
-	getUserTpl    = `SELECT id, login, email, first_name, last_name FROM auth_user WHERE login=$1 AND password=$2`
+	getUserTpl    = `SELECT id, login, password, email, first_name, last_name, role FROM auth_user WHERE login=$1 AND deleted_at IS NULL`
+	deleteUserTpl = `UPDATE auth_user SET deleted_at=now(), updated_at=now() WHERE id=$1 AND deleted_at IS NULL`
+	roleAdmin     = "admin"
+)
+
+const (
+	reconnectDelay   = 100 * time.Millisecond
+	reconnectTimeout = 30 * time.Second
+	healthTimeout    = 2 * time.Second
 )
 
+// backendModel is a service whose health /health/all reports. When a critical
+// backend is down the whole system is reported unavailable.
+type backendModel struct {
+	name     string
+	url      string
+	critical bool
+}
+
+var httpClient = &http.Client{}
+
 var (
 	createUserStmt  *sql.Stmt
 	getUserStmt     *sql.Stmt
@@ -53,25 +137,63 @@ var (
 	updateUserStmt  *sql.Stmt
 	deleteUserStmt  *sql.Stmt
 	SESSIONS        = map[string]userModel{}
+	// userSessions lists the session ids of every user, oldest first.
+	userSessions = map[int][]string{}
+	sessionsMu   sync.RWMutex
+	// maxSessions is how many sessions a user may have at once, 0 means no
+	// limit
+	maxSessions int
+
+	errInvalidCredentials = errors.New("there is no user with specified credentials")
+	// dummyPassword is compared against when the login does not exist so an
+	// unknown login takes as long as a wrong password.
+	dummyPassword = sha256.Sum256([]byte("dummy-password"))
+	dbConn        = &database.Conn{Prepare: mustPrepareStmts}
+	backends      []backendModel
+	// cookieSecure, cookieSameSite and cookieDomain are the attributes of the
+	// session cookie
+	cookieSecure   bool
+	cookieSameSite http.SameSite
+	cookieDomain   string
 )
 
 func readConf() *configModel {
 	cfg := &configModel{
-		dbHost: "auth-postgresql",
-		dbPort: "5432",
-		dbName: "authdb",
-		dbUser: "authuser",
-		dbPass: "authpasswd",
-		host:   "0.0.0.0",
-		port:   "80",
-	}
-	dbHost := os.Getenv("DBHOST")
-	dbPort := os.Getenv("DBPORT")
-	dbName := os.Getenv("DBNAME")
-	dbUser := os.Getenv("DBUSER")
-	dbPass := os.Getenv("DBPASS")
-	host := os.Getenv("HOST")
-	port := os.Getenv("PORT")
+		dbHost:         "auth-postgresql",
+		dbPort:         "5432",
+		dbName:         "authdb",
+		dbUser:         "authuser",
+		dbPass:         "authpasswd",
+		ServerConfig:   web.DefaultServerConfig(),
+		healthBackends: "account=http://account.saga.svc.cluster.local:9000,book=http://book.saga.svc.cluster.local:9000,events=http://events.saga.svc.cluster.local:9000,notif=http://notif.saga.svc.cluster.local:9000,orders=http://orders.saga.svc.cluster.local:9000,profile=http://profile.saga.svc.cluster.local:9000",
+		healthCritical: "account,book,events",
+		cookieSecure:   "true",
+		cookieSameSite: "lax",
+		maxSessions:    "5",
+		dbWait:         "60s",
+	}
+	dbHost := config.Getenv("DBHOST")
+	dbPort := config.Getenv("DBPORT")
+	dbName := config.Getenv("DBNAME")
+	dbUser := config.Getenv("DBUSER")
+	dbPass := config.Getenv("DBPASS")
+	host := config.Getenv("HOST")
+	port := config.Getenv("PORT")
+	tlsCertFile := config.Getenv("TLS_CERT_FILE")
+	tlsKeyFile := config.Getenv("TLS_KEY_FILE")
+	healthBackends := config.Getenv("HEALTH_BACKENDS")
+	healthCritical := config.Getenv("HEALTH_CRITICAL")
+	cookieSecure := config.Getenv("COOKIE_SECURE")
+	cookieSameSite := config.Getenv("COOKIE_SAMESITE")
+	cookieDomain := config.Getenv("COOKIE_DOMAIN")
+	maxSessions := config.Getenv("MAX_SESSIONS")
+	readTimeout := config.Getenv("READ_TIMEOUT")
+	writeTimeout := config.Getenv("WRITE_TIMEOUT")
+	idleTimeout := config.Getenv("IDLE_TIMEOUT")
+	origins := config.Getenv("ALLOWED_ORIGINS")
+	routePrefix := config.Getenv("ROUTE_PREFIX")
+	maintenance := config.Getenv("MAINTENANCE")
+	dbWait := config.Getenv("DB_WAIT_TIMEOUT")
 
 	if dbHost != "" {
 		cfg.dbHost = dbHost
@@ -89,10 +211,55 @@ func readConf() *configModel {
 		cfg.dbPass = dbPass
 	}
 	if host != "" {
-		cfg.host = host
+		cfg.Host = host
 	}
 	if port != "" {
-		cfg.port = port
+		cfg.Port = port
+	}
+	if tlsCertFile != "" {
+		cfg.TLSCertFile = tlsCertFile
+	}
+	if tlsKeyFile != "" {
+		cfg.TLSKeyFile = tlsKeyFile
+	}
+	if healthBackends != "" {
+		cfg.healthBackends = healthBackends
+	}
+	if healthCritical != "" {
+		cfg.healthCritical = healthCritical
+	}
+	if cookieSecure != "" {
+		cfg.cookieSecure = cookieSecure
+	}
+	if cookieSameSite != "" {
+		cfg.cookieSameSite = cookieSameSite
+	}
+	if cookieDomain != "" {
+		cfg.cookieDomain = cookieDomain
+	}
+	if maxSessions != "" {
+		cfg.maxSessions = maxSessions
+	}
+	if readTimeout != "" {
+		cfg.ReadTimeout = readTimeout
+	}
+	if writeTimeout != "" {
+		cfg.WriteTimeout = writeTimeout
+	}
+	if idleTimeout != "" {
+		cfg.IdleTimeout = idleTimeout
+	}
+	if origins != "" {
+		cfg.origins = origins
+	}
+	if routePrefix != "" {
+		cfg.routePrefix = routePrefix
+	}
+	if maintenance != "" {
+		cfg.maintenance = maintenance
+	}
+	if dbWait != "" {
+		cfg.dbWait = dbWait
 	}
 	return cfg
 }
@@ -102,11 +269,18 @@ func makeDBConn(cfg *configModel) (*sql.DB, error) {
 		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		cfg.dbHost, cfg.dbPort, cfg.dbUser, cfg.dbPass, cfg.dbName,
 	)
-	log.Println("connection string: ", pgConnString)
+	log.Printf("Connecting to database host=%s port=%s dbname=%s\n", cfg.dbHost, cfg.dbPort, cfg.dbName)
 	db, err := sql.Open("postgres", pgConnString)
 	return db, err
 }
 
+// maintenanceMode turns every request but health, version and the switch
+// itself away with 503. It starts from MAINTENANCE and is switched at runtime
+// by admins via maintenancePath.
+var maintenanceMode = &web.Maintenance{Health: []string{"/health", "/health/all"}}
+
+const maintenancePath = "/maintenance"
+
 func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -119,26 +293,94 @@ func main() {
 	}
 	defer db.Close()
 
-	if err = db.PingContext(ctx); err != nil {
+	dbWait, err := time.ParseDuration(cfg.dbWait)
+	if err != nil {
+		log.Fatal("Failed to parse DB_WAIT_TIMEOUT:", err)
+	}
+	if err = database.Wait(ctx, db, dbWait); err != nil {
 		log.Fatal("Failed to check db connection:", err)
 	}
 
 	mustPrepareStmts(ctx, db)
+	dbConn.Open = func() (*sql.DB, error) { return makeDBConn(cfg) }
+	dbConn.Set(db)
+	if backends, err = parseBackends(cfg.healthBackends, cfg.healthCritical); err != nil {
+		log.Fatal("Failed to parse HEALTH_BACKENDS:", err)
+	}
+	if cookieSecure, err = strconv.ParseBool(cfg.cookieSecure); err != nil {
+		log.Fatal("Failed to parse COOKIE_SECURE:", err)
+	}
+	if cookieSameSite, err = parseSameSite(cfg.cookieSameSite); err != nil {
+		log.Fatal("Failed to parse COOKIE_SAMESITE:", err)
+	}
+	cookieDomain = cfg.cookieDomain
+	if maxSessions, err = strconv.Atoi(cfg.maxSessions); err != nil {
+		log.Fatal("Failed to parse MAX_SESSIONS:", err)
+	}
+
+	if cfg.maintenance != "" {
+		on, err := strconv.ParseBool(cfg.maintenance)
+		if err != nil {
+			log.Fatal("Failed to parse MAINTENANCE:", err)
+		}
+		maintenanceMode.Set(on)
+	}
+
+	prefix := strings.TrimSuffix(cfg.routePrefix, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		log.Fatalf("ROUTE_PREFIX [%s] must start with /", cfg.routePrefix)
+	}
+	r := newRouter(prefix)
+
+	h := maintenanceMode.Middleware(prefix+maintenancePath, r)
+	h = web.RecoverPanics(web.CORS(web.ParseOrigins(cfg.origins), h))
+	if err := web.Serve(cfg.ServerConfig, h); err != nil {
+		log.Printf("Failed to bind on [%s:%s]: %s", cfg.Host, cfg.Port, err)
+	}
+}
 
+// newRouter registers the routes, the api ones under prefix if it isn't
+// empty.
+func newRouter(prefix string) *mux.Router {
 	r := mux.NewRouter()
 
-	r.HandleFunc("/sessions", sessions).Methods("GET")
-	r.HandleFunc("/register", register).Methods("POST")
-	r.HandleFunc("/login", login).Methods("POST")
-	r.HandleFunc("/signin", signin).Methods("GET")
-	r.HandleFunc("/auth", auth)
-	r.HandleFunc("/logout", logout).Methods("GET", "POST")
+	api := r
+	if prefix != "" {
+		api = r.PathPrefix(prefix).Subrouter()
+	}
+	api.HandleFunc("/sessions", sessions).Methods("GET")
+	api.HandleFunc("/register", register).Methods("POST")
+	api.HandleFunc("/login", login).Methods("POST")
+	api.HandleFunc("/signin", signin).Methods("GET")
+	api.HandleFunc("/auth", auth)
+	api.HandleFunc("/logout", logout).Methods("GET", "POST")
+	api.HandleFunc("/logout/all", logoutAll).Methods("POST")
+	api.HandleFunc("/unregister", unregister).Methods("POST")
+	api.HandleFunc(maintenancePath, maintenance).Methods("GET", "PUT")
 	r.HandleFunc("/health", health)
+	r.HandleFunc("/version", web.VersionInfo).Methods("GET")
+	r.HandleFunc("/health/all", healthAll).Methods("GET")
+	r.MethodNotAllowedHandler = web.MethodNotAllowed(r)
+	r.NotFoundHandler = http.HandlerFunc(web.NotFound)
+	return r
+}
 
-	bindOn := fmt.Sprintf("%s:%s", cfg.host, cfg.port)
-	if err := http.ListenAndServe(bindOn, r); err != nil {
-		log.Printf("Failed to bind on [%s]: %s", bindOn, err)
+// maintenance reports the maintenance mode and, on PUT, switches it.
+// Available to admins only.
+func maintenance(w http.ResponseWriter, r *http.Request) {
+	userInfo, ok := sessionUser(r)
+	if !ok {
+		web.Unauthenticated(w)
+		return
 	}
+	if userInfo.role != roleAdmin {
+		log.Printf("User [%d] is not allowed to switch maintenance mode\n", userInfo.id)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	// the switch logs who switched from X-User-Id, as in the other services
+	r.Header.Set("X-User-Id", strconv.Itoa(userInfo.id))
+	maintenanceMode.Switch(w, r)
 }
 
 func mustPrepareStmts(ctx context.Context, db *sql.DB) {
@@ -153,6 +395,11 @@ func mustPrepareStmts(ctx context.Context, db *sql.DB) {
 	if err != nil {
 		panic(err)
 	}
+
+	deleteUserStmt, err = db.PrepareContext(ctx, deleteUserTpl)
+	if err != nil {
+		panic(err)
+	}
 }
 
 func register(w http.ResponseWriter, r *http.Request) {
@@ -164,11 +411,13 @@ func register(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Failed to parse user data"))
 		return
 	}
+	if validateUser(u).write(w) {
+		log.Printf("Got invalid user data for login [%s]\n", u.Login)
+		return
+	}
 	var id int64
 	if id, err = createUser(u); err != nil {
-		log.Println("Failed to create new user:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Failed to create new user"))
+		web.InternalError(w, r, fmt.Errorf("failed to create new user: %w", err))
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -176,21 +425,45 @@ func register(w http.ResponseWriter, r *http.Request) {
 	log.Printf("User with email=%s was created", (*u).Email)
 }
 
+// validateUser checks the fields of a new user.
+func validateUser(u *userModel) validationErrors {
+	var errs validationErrors
+	if strings.TrimSpace(u.Login) == "" {
+		errs.add("login", "required")
+	}
+	if u.Password == "" {
+		errs.add("password", "required")
+	}
+	if a, err := mail.ParseAddress(u.Email); err != nil || a.Address != u.Email {
+		errs.add("email", "invalid")
+	}
+	return errs
+}
+
 func signin(w http.ResponseWriter, _ *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"message": "Please go to login and provide Login/Password"}`))
 	log.Println(`Please go to login and provide Login/Password"}`)
 }
 
-func sessions(w http.ResponseWriter, _ *http.Request) {
-	var data []byte
-	var err error
-	if data, err = json.Marshal(SESSIONS); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+// sessions reports only the number of active sessions, user data is never
+// exposed here. Available to admins only.
+func sessions(w http.ResponseWriter, r *http.Request) {
+	userInfo, ok := sessionUser(r)
+	if !ok {
+		web.Unauthenticated(w)
+		return
+	}
+	if userInfo.role != roleAdmin {
+		log.Printf("User [%d] is not allowed to list sessions\n", userInfo.id)
+		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
-	w.Write(data)
+	sessionsMu.RLock()
+	count := len(SESSIONS)
+	sessionsMu.RUnlock()
+	fmt.Fprintf(w, `{"count":%d}`, count)
 }
 
 func login(w http.ResponseWriter, r *http.Request) {
@@ -203,52 +476,133 @@ func login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var u *userModel
-	if u, err = getUserByCredentials(l); err != nil {
+	if u, err = getUserByCredentials(l); errors.Is(err, errInvalidCredentials) {
 		log.Println("Unauthorized due to:", err)
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":"invalid credentials"}`))
+		return
+	} else if err != nil {
+		// a database outage must not look like a wrong password
+		web.InternalError(w, r, fmt.Errorf("failed to get user by credentials: %w", err))
 		return
 	}
 	sessionID := createSession(u)
-	cookie := http.Cookie{
+	http.SetCookie(w, sessionCookie(sessionID))
+	res := loginResponseModel{Status: "ok"}
+	// ?include=user saves the client a call to /auth right after login
+	if r.URL.Query().Get("include") == "user" {
+		res.User = &publicUserModel{
+			ID:        u.id,
+			Login:     u.Login,
+			Email:     u.Email,
+			FirstName: u.FirstName,
+			LastName:  u.LastName,
+		}
+	}
+	data, _ := json.Marshal(res)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// parseSameSite converts lax, strict or none to the cookie SameSite mode.
+func parseSameSite(s string) (http.SameSite, error) {
+	switch strings.ToLower(s) {
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, fmt.Errorf("unknown SameSite mode [%s]", s)
+}
+
+// sessionCookie builds the session cookie with the configured attributes.
+func sessionCookie(sessionID string) *http.Cookie {
+	return &http.Cookie{
 		Name:     "session_id",
 		Value:    sessionID,
+		Path:     "/",
+		Domain:   cookieDomain,
 		HttpOnly: true,
+		Secure:   cookieSecure,
+		SameSite: cookieSameSite,
 	}
-	http.SetCookie(w, &cookie)
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// clearedSessionCookie makes the browser drop the session cookie. It must
+// carry the same Path and Domain as the cookie set on login.
+func clearedSessionCookie() *http.Cookie {
+	c := sessionCookie("")
+	c.Expires = time.Unix(0, 0)
+	c.MaxAge = -1
+	return c
 }
 
 func auth(w http.ResponseWriter, r *http.Request) {
 	if sessionID, err := r.Cookie("session_id"); err == nil {
 		log.Println("sessionID:", sessionID)
-		if userInfo, ok := SESSIONS[sessionID.Value]; ok {
+		if userInfo, ok := lookupSession(sessionID.Value); ok {
 			log.Println("inserInfo:", userInfo)
 			w.Header().Set("X-User-Id", strconv.Itoa(userInfo.id))
 			w.Header().Set("X-User", userInfo.Login)
 			w.Header().Set("X-Email", userInfo.Email)
 			w.Header().Set("X-First-Name", userInfo.FirstName)
 			w.Header().Set("X-Last-Name", userInfo.LastName)
+			w.Header().Set("X-User-Role", userInfo.role)
 			w.WriteHeader(http.StatusOK)
 			data, _ := json.Marshal(userInfo)
 			w.Write(data)
 			return
 		}
 	}
-	w.WriteHeader(http.StatusUnauthorized)
+	web.Unauthenticated(w)
 }
 
 func logout(w http.ResponseWriter, r *http.Request) {
 	if sessionID, err := r.Cookie("session_id"); err == nil {
-		delete(SESSIONS, sessionID.Value)
+		deleteSession(sessionID.Value)
+	}
+	http.SetCookie(w, clearedSessionCookie())
+	w.WriteHeader(http.StatusOK)
+}
+
+// logoutAll drops every session of the current user, e.g. when the user
+// suspects the account is compromised.
+func logoutAll(w http.ResponseWriter, r *http.Request) {
+	userInfo, ok := sessionUser(r)
+	if !ok {
+		web.Unauthenticated(w)
+		return
 	}
-	cookie := http.Cookie{
-		Name:    "session_id",
-		Value:   "",
-		Expires: time.Now(),
+	n := deleteUserSessions(userInfo.id)
+	log.Printf("Dropped [%d] sessions of user [%d]\n", n, userInfo.id)
+	http.SetCookie(w, clearedSessionCookie())
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"count":%d}`, n)
+}
+
+// unregister soft deletes the user of the current session and drops all of
+// the user's sessions. The row is kept in auth_user for audit.
+func unregister(w http.ResponseWriter, r *http.Request) {
+	userInfo, ok := sessionUser(r)
+	if !ok {
+		web.Unauthenticated(w)
+		return
 	}
+	err := dbConn.Retry(func() error {
+		_, err := deleteUserStmt.Exec(userInfo.id)
+		return err
+	})
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to delete user [%d]: %w", userInfo.id, err))
+		return
+	}
+	deleteUserSessions(userInfo.id)
+	http.SetCookie(w, clearedSessionCookie())
 	w.WriteHeader(http.StatusOK)
-	http.SetCookie(w, &cookie)
+	log.Printf("User with id=%d was deleted", userInfo.id)
 }
 
 func health(w http.ResponseWriter, _ *http.Request) {
@@ -256,51 +610,144 @@ func health(w http.ResponseWriter, _ *http.Request) {
 	w.Write([]byte(`{"status": "OK"}`))
 }
 
+// parseBackends parses a comma separated list of name=url pairs. Backends
+// named in the comma separated critical list are marked critical.
+func parseBackends(list, critical string) ([]backendModel, error) {
+	isCritical := map[string]bool{}
+	for _, name := range strings.Split(critical, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			isCritical[name] = true
+		}
+	}
+	var bs []backendModel
+	for _, pair := range strings.Split(list, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, url, ok := strings.Cut(pair, "=")
+		if !ok || name == "" || url == "" {
+			return nil, fmt.Errorf("wrong backend [%s], want name=url", pair)
+		}
+		bs = append(bs, backendModel{name: name, url: strings.TrimRight(url, "/"), critical: isCritical[name]})
+	}
+	return bs, nil
+}
+
+// healthAll pings /health of every backend concurrently and answers with the
+// status of each one. It answers 503 if any critical backend is down.
+func healthAll(w http.ResponseWriter, r *http.Request) {
+	statuses := make([]string, len(backends))
+	var wg sync.WaitGroup
+	for i, b := range backends {
+		wg.Add(1)
+		go func(i int, b backendModel) {
+			defer wg.Done()
+			statuses[i] = "up"
+			if err := ping(r.Context(), b.url+"/health"); err != nil {
+				log.Printf("Backend [%s] is down: %s\n", b.name, err)
+				statuses[i] = "down"
+			}
+		}(i, b)
+	}
+	wg.Wait()
+
+	res := make(map[string]string, len(backends))
+	code := http.StatusOK
+	for i, b := range backends {
+		res[b.name] = statuses[i]
+		if b.critical && statuses[i] != "up" {
+			code = http.StatusServiceUnavailable
+		}
+	}
+	data, err := json.Marshal(res)
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to marshal health statuses: %w", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+func ping(ctx context.Context, url string) error {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("responded with status [%d]", resp.StatusCode)
+	}
+	return nil
+}
+
 func createUser(u *userModel) (int64, error) {
 	var lastID int64
-	if err := createUserStmt.QueryRow(
-		u.Login,
-		u.Password,
-		u.Email,
-		u.FirstName,
-		u.LastName,
-	).Scan(&lastID); err != nil {
+	if err := dbConn.Retry(func() error {
+		return createUserStmt.QueryRow(
+			u.Login,
+			u.Password,
+			u.Email,
+			u.FirstName,
+			u.LastName,
+		).Scan(&lastID)
+	}); err != nil {
 		return 0, err
 	}
 	return lastID, nil
 }
 
+// getUserByCredentials returns the user with the login and password, or
+// errInvalidCredentials if there is none. Any other error is a failed query.
 func getUserByCredentials(l *loginModel) (*userModel, error) {
-	rows, err := getUserStmt.Query(l.Login, l.Password)
-	if err != nil {
+	u := &userModel{}
+	err := dbConn.Retry(func() error {
+		return getUserStmt.QueryRow(l.Login).Scan(
+			&u.id,
+			&u.Login,
+			&u.Password,
+			&u.Email,
+			&u.FirstName,
+			&u.LastName,
+			&u.role,
+		)
+	})
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return nil, err
 	}
-	if !rows.Next() {
-		return nil, errors.New("there is no user with specified credentials")
+	expected := dummyPassword
+	if err == nil {
+		expected = sha256.Sum256([]byte(u.Password))
 	}
+	given := sha256.Sum256([]byte(l.Password))
+	match := subtle.ConstantTimeCompare(expected[:], given[:]) == 1
+	if err != nil || !match {
+		return nil, errInvalidCredentials
+	}
+	u.Password = ""
+	return u, nil
+}
 
-	id := new(int)
-	login := new(string)
-	email := new(string)
-	firstName := new(string)
-	lastName := new(string)
-
-	if err = rows.Scan(
-		id,
-		login,
-		email,
-		firstName,
-		lastName,
-	); err != nil {
-		return nil, err
+// sessionUser returns the user bound to the request's session cookie.
+func sessionUser(r *http.Request) (userModel, bool) {
+	sessionID, err := r.Cookie("session_id")
+	if err != nil {
+		return userModel{}, false
 	}
-	return &userModel{
-		id:        *id,
-		Login:     *login,
-		Email:     *email,
-		FirstName: *firstName,
-		LastName:  *lastName,
-	}, nil
+	return lookupSession(sessionID.Value)
+}
+
+func lookupSession(sessionID string) (userModel, bool) {
+	sessionsMu.RLock()
+	defer sessionsMu.RUnlock()
+	u, ok := SESSIONS[sessionID]
+	return u, ok
 }
 
 func createSession(u *userModel) string {
@@ -309,6 +756,50 @@ func createSession(u *userModel) string {
 		return ""
 	}
 	sessionID := uuid.New().String()
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
 	SESSIONS[sessionID] = *u
+	ids := append(userSessions[u.id], sessionID)
+	for maxSessions > 0 && len(ids) > maxSessions {
+		log.Printf("User [%d] has too many sessions, dropping the oldest one\n", u.id)
+		delete(SESSIONS, ids[0])
+		ids = ids[1:]
+	}
+	userSessions[u.id] = ids
 	return sessionID
 }
+
+func deleteSession(sessionID string) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	u, ok := SESSIONS[sessionID]
+	if !ok {
+		return
+	}
+	delete(SESSIONS, sessionID)
+	ids := userSessions[u.id]
+	for i, id := range ids {
+		if id == sessionID {
+			ids = append(ids[:i:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(userSessions, u.id)
+		return
+	}
+	userSessions[u.id] = ids
+}
+
+// deleteUserSessions drops every session of the user and returns how many
+// there were.
+func deleteUserSessions(uid int) int {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	ids := userSessions[uid]
+	for _, id := range ids {
+		delete(SESSIONS, id)
+	}
+	delete(userSessions, uid)
+	return len(ids)
+}
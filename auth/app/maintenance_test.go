@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// useMaintenance restores the maintenance mode after the test.
+func useMaintenance(t *testing.T) {
+	saved := maintenanceMode.On()
+	t.Cleanup(func() { maintenanceMode.Set(saved) })
+}
+
+// TestMaintenanceSwitchBySession checks the switch of auth, which has no
+// X-User-Role in front of it, is allowed to admin sessions only, and that
+// /health/all, which only auth serves, stays up in maintenance.
+func TestMaintenanceSwitchBySession(t *testing.T) {
+	useMaintenance(t)
+	useSessions(t)
+	useBackends(t, "", "")
+	user := createSession(&userModel{id: 5, Login: "alice", role: "user"})
+	admin := createSession(&userModel{id: 1, Login: "admin", role: roleAdmin})
+	h := maintenanceMode.Middleware(maintenancePath, newRouter(""))
+	call := func(method, target, sid, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if sid != "" {
+			r.AddCookie(&http.Cookie{Name: "session_id", Value: sid})
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := call(http.MethodPut, maintenancePath, "", `{"enabled":true}`); w.Code != http.StatusUnauthorized {
+		t.Fatalf("switching maintenance without a session answered %d, want 401", w.Code)
+	}
+	if w := call(http.MethodPut, maintenancePath, user, `{"enabled":true}`); w.Code != http.StatusForbidden {
+		t.Fatalf("a user switching maintenance answered %d, want 403", w.Code)
+	}
+	if w := call(http.MethodPut, maintenancePath, admin, `{"enabled":true}`); w.Code != http.StatusOK || w.Body.String() != `{"enabled":true}` {
+		t.Fatalf("switching maintenance on answered %d %s", w.Code, w.Body.String())
+	}
+
+	if w := call(http.MethodPost, "/login", "", "{"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("login answered %d in maintenance, want 503", w.Code)
+	}
+	for _, target := range []string{"/health", "/health/all", "/version"} {
+		if w := call(http.MethodGet, target, "", ""); w.Code != http.StatusOK {
+			t.Errorf("%s answered %d in maintenance, want 200", target, w.Code)
+		}
+	}
+
+	if w := call(http.MethodPut, maintenancePath, admin, `{"enabled":false}`); w.Code != http.StatusOK || w.Body.String() != `{"enabled":false}` {
+		t.Fatalf("switching maintenance off answered %d %s", w.Code, w.Body.String())
+	}
+	if w := call(http.MethodPost, "/login", "", "{"); w.Code != http.StatusBadRequest {
+		t.Errorf("login answered %d after maintenance, want 400", w.Code)
+	}
+}
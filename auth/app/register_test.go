@@ -0,0 +1,52 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// postRegister registers a user with body.
+func postRegister(body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	register(w, r)
+	return w
+}
+
+func TestRegisterReportsAllFieldErrors(t *testing.T) {
+	created := 0
+	useFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		if queryHas(query, "INSERT INTO auth_user") {
+			created++
+			return fakeResult{Cols: []string{"id"}, Rows: [][]driver.Value{{int64(5)}}}
+		}
+		return fakeResult{}
+	})
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"all wrong", `{"login":" ","email":"alice"}`, `{"errors":[{"field":"login","msg":"required"},{"field":"password","msg":"required"},{"field":"email","msg":"invalid"}]}`},
+		{"password and email", `{"login":"alice","email":"Alice <alice@example.com>"}`, `{"errors":[{"field":"password","msg":"required"},{"field":"email","msg":"invalid"}]}`},
+		{"email only", `{"login":"alice","password":"secret"}`, `{"errors":[{"field":"email","msg":"invalid"}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := postRegister(tt.body)
+			if w.Code != http.StatusBadRequest || w.Body.String() != tt.want {
+				t.Errorf("answered %d %s, want 400 %s", w.Code, w.Body.String(), tt.want)
+			}
+		})
+	}
+	if created != 0 {
+		t.Fatalf("created %d invalid users", created)
+	}
+
+	if w := postRegister(`{"login":"alice","password":"secret","email":"alice@example.com"}`); w.Code != http.StatusOK {
+		t.Errorf("valid user answered %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthPassesRole(t *testing.T) {
+	useSessions(t)
+	for _, u := range []*userModel{{id: 1, Login: "admin", role: roleAdmin}, {id: 5, Login: "alice", role: "user"}} {
+		r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+		r.AddCookie(&http.Cookie{Name: "session_id", Value: createSession(u)})
+		w := httptest.NewRecorder()
+		auth(w, r)
+		if got := w.Header().Get("X-User-Role"); w.Code != http.StatusOK || got != u.role {
+			t.Errorf("%s: answered %d with X-User-Role %q, want 200 %q", u.Login, w.Code, got, u.role)
+		}
+	}
+}
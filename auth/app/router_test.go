@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// route sends a request as user 5 through the router built for prefix.
+func route(prefix, method, target string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set("X-User-Id", "5")
+	w := httptest.NewRecorder()
+	newRouter(prefix).ServeHTTP(w, r)
+	return w
+}
+
+func TestUnknownPathAndWrongMethodAnswerJSON(t *testing.T) {
+	w := route("", http.MethodGet, "/nowhere")
+	if w.Code != http.StatusNotFound || w.Body.String() != `{"error":"not_found"}` {
+		t.Errorf("unknown path answered %d %s, want 404 not_found", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("unknown path answered Content-Type %q", ct)
+	}
+
+	w = route("", http.MethodGet, "/login")
+	if w.Code != http.StatusMethodNotAllowed || w.Body.String() != `{"error":"method_not_allowed"}` {
+		t.Errorf("GET /login answered %d %s, want 405 method_not_allowed", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("wrong method answered Content-Type %q", ct)
+	}
+	if got := w.Header().Get("Allow"); got != "POST" {
+		t.Errorf("wrong method got Allow %q, want %q", got, "POST")
+	}
+}
+
+// TestRoutePrefix mounts the API under /api: the prefixed login is served,
+// the bare one answers 404, and /version stays at the root.
+func TestRoutePrefix(t *testing.T) {
+	router := newRouter("/api")
+	for target, want := range map[string]int{
+		"/api/login": http.StatusBadRequest,
+		"/login":     http.StatusNotFound,
+	} {
+		r := httptest.NewRequest(http.MethodPost, target, strings.NewReader("{"))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("POST %s with a broken body answered %d, want %d", target, w.Code, want)
+		}
+	}
+	for target, want := range map[string]int{"/version": http.StatusOK, "/api/version": http.StatusNotFound} {
+		if w := route("/api", http.MethodGet, target); w.Code != want {
+			t.Errorf("%s answered %d, want %d", target, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// useSessions gives the test an empty session store.
+func useSessions(t *testing.T) {
+	sessionsMu.Lock()
+	saved, savedUsers := SESSIONS, userSessions
+	SESSIONS, userSessions = map[string]userModel{}, map[int][]string{}
+	sessionsMu.Unlock()
+	t.Cleanup(func() {
+		sessionsMu.Lock()
+		SESSIONS, userSessions = saved, savedUsers
+		sessionsMu.Unlock()
+	})
+}
+
+// authStatus asks auth about the session as the gateway does.
+func authStatus(sessionID string) int {
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	r.AddCookie(&http.Cookie{Name: "session_id", Value: sessionID})
+	w := httptest.NewRecorder()
+	auth(w, r)
+	return w.Code
+}
+
+// getSessions calls /sessions with the session sid, none if sid is empty.
+func getSessions(sid string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/sessions", nil)
+	if sid != "" {
+		r.AddCookie(&http.Cookie{Name: "session_id", Value: sid})
+	}
+	w := httptest.NewRecorder()
+	sessions(w, r)
+	return w
+}
+
+func TestSessionsExposeNoUserData(t *testing.T) {
+	useSessions(t)
+	user := createSession(&userModel{id: 5, Login: "alice", Email: "alice@example.com", role: "user"})
+	admin := createSession(&userModel{id: 1, Login: "admin", Email: "admin@example.com", role: roleAdmin})
+	tests := []struct {
+		name   string
+		sid    string
+		status int
+	}{
+		{"unauthenticated", "", http.StatusUnauthorized},
+		{"unknown session", "nope", http.StatusUnauthorized},
+		{"not an admin", user, http.StatusForbidden},
+		{"admin", admin, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := getSessions(tt.sid)
+			if w.Code != tt.status {
+				t.Fatalf("answered %d, want %d", w.Code, tt.status)
+			}
+			if body := w.Body.String(); strings.Contains(body, "email") || strings.Contains(body, "@example.com") {
+				t.Errorf("answered user data: %s", body)
+			}
+		})
+	}
+	if body := getSessions(admin).Body.String(); body != `{"count":2}` {
+		t.Errorf("admin got %s, want the count only", body)
+	}
+}
+
+// useMaxSessions sets maxSessions for the test.
+func useMaxSessions(t *testing.T, n int) {
+	saved := maxSessions
+	maxSessions = n
+	t.Cleanup(func() { maxSessions = saved })
+}
+
+// loginSession logs alice in and returns the session id of the cookie.
+func loginSession(t *testing.T) string {
+	t.Helper()
+	w := postLogin(`{"login":"alice","password":"secret"}`)
+	cs := w.Result().Cookies()
+	if w.Code != http.StatusOK || len(cs) != 1 {
+		t.Fatalf("login answered %d with cookies %v", w.Code, cs)
+	}
+	return cs[0].Value
+}
+
+func TestOldestSessionIsDroppedOverLimit(t *testing.T) {
+	useSessions(t)
+	useMaxSessions(t, 3)
+	useUsers(t)
+	other := createSession(&userModel{id: 6, Login: "bob"})
+	var sids []string
+	for i := 0; i < 4; i++ {
+		sids = append(sids, loginSession(t))
+	}
+	if code := authStatus(sids[0]); code != http.StatusUnauthorized {
+		t.Errorf("oldest session answered %d, want 401", code)
+	}
+	for _, sid := range append(sids[1:], other) {
+		if code := authStatus(sid); code != http.StatusOK {
+			t.Errorf("session answered %d, want 200", code)
+		}
+	}
+	sessionsMu.RLock()
+	defer sessionsMu.RUnlock()
+	if len(SESSIONS) != 4 || len(userSessions[5]) != 3 {
+		t.Errorf("kept %d sessions, %d of alice, want 4 and 3", len(SESSIONS), len(userSessions[5]))
+	}
+}
+
+func TestNoSessionLimit(t *testing.T) {
+	useSessions(t)
+	useMaxSessions(t, 0)
+	useUsers(t)
+	first := loginSession(t)
+	for i := 0; i < 20; i++ {
+		loginSession(t)
+	}
+	if code := authStatus(first); code != http.StatusOK {
+		t.Errorf("first session answered %d without a limit, want 200", code)
+	}
+}
+
+func TestLogoutAllDropsEveryUserSession(t *testing.T) {
+	useSessions(t)
+	useUsers(t)
+	sids := []string{loginSession(t), loginSession(t), loginSession(t)}
+	other := createSession(&userModel{id: 6, Login: "bob"})
+
+	r := httptest.NewRequest(http.MethodPost, "/logout/all", nil)
+	r.AddCookie(&http.Cookie{Name: "session_id", Value: sids[1]})
+	w := httptest.NewRecorder()
+	logoutAll(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != `{"count":3}` {
+		t.Fatalf("logout all answered %d %s, want 200 with 3 dropped", w.Code, w.Body.String())
+	}
+	if cs := w.Result().Cookies(); len(cs) != 1 || cs[0].MaxAge >= 0 {
+		t.Errorf("logout all set cookies %v, want the session cookie cleared", cs)
+	}
+	for _, sid := range sids {
+		if code := authStatus(sid); code != http.StatusUnauthorized {
+			t.Errorf("session answered %d after logout all, want 401", code)
+		}
+	}
+	if code := authStatus(other); code != http.StatusOK {
+		t.Errorf("another user's session answered %d, want 200", code)
+	}
+
+	w = httptest.NewRecorder()
+	logoutAll(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("logout all with a dropped session answered %d, want 401", w.Code)
+	}
+}
+
+// TestUnauthenticatedAnswersJSON checks every route that needs a session
+// answers 401 with the JSON error the other services use.
+func TestUnauthenticatedAnswersJSON(t *testing.T) {
+	useSessions(t)
+	for _, tt := range []struct{ method, target string }{
+		{http.MethodGet, "/auth"},
+		{http.MethodGet, "/sessions"},
+		{http.MethodPost, "/logout/all"},
+		{http.MethodPost, "/unregister"},
+		{http.MethodGet, maintenancePath},
+	} {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		r.AddCookie(&http.Cookie{Name: "session_id", Value: "nope"})
+		w := httptest.NewRecorder()
+		newRouter("").ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized || w.Body.String() != `{"error":"unauthenticated"}` || w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s answered %d %q with %q, want 401 with the JSON error", tt.method, tt.target, w.Code, w.Body.String(), w.Header().Get("Content-Type"))
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// adminBooks asks the router for the admin list with query as user 1 with
+// role.
+func adminBooks(query, role string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/book/admin/list"+query, nil)
+	r.Header.Set("X-User-Id", "1")
+	r.Header.Set("X-User-Role", role)
+	w := httptest.NewRecorder()
+	newRouter("").ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminListFiltersByStatus(t *testing.T) {
+	useBooksList(t,
+		bookModel{ID: 7, UserID: 5, EventID: 3, Price: 1500, Status: statusNeedToPay, Quantity: 1},
+		bookModel{ID: 8, UserID: 6, EventID: 3, Price: 1500, Status: statusCompleted, Quantity: 1, OrderID: 11},
+		bookModel{ID: 9, UserID: 6, EventID: 4, Price: 900, Status: statusNeedToPay, Quantity: 2},
+		bookModel{ID: 10, UserID: 5, EventID: 4, Status: statusNeedToOccupy, Quantity: 1},
+	)
+	useStubServices(t, map[string]stubResponse{
+		"/events/availability": {http.StatusOK, `[{"id":3,"event_name":"Rock Concert","price":1500},{"id":4,"event_name":"Hamlet","price":900}]`},
+	})
+
+	want := `[{"id":7,"user_id":5,"event_id":3,"price":1500,"status":"need_to_pay","quantity":1,"event_name":"Rock Concert","event_price":1500},` +
+		`{"id":9,"user_id":6,"event_id":4,"price":900,"status":"need_to_pay","quantity":2,"event_name":"Hamlet","event_price":900}]`
+	for _, status := range []string{"need_to_pay", "3"} {
+		w := adminBooks("?status="+status, roleAdmin)
+		if w.Code != http.StatusOK || !sameJSON(t, w.Body.Bytes(), []byte(want)) {
+			t.Errorf("status=%s answered %d %s, want %s", status, w.Code, w.Body.String(), want)
+		}
+	}
+
+	w := adminBooks("?status=need_to_pay&limit=1&offset=1&count=true", roleAdmin)
+	page := struct {
+		Items []bookModel `json:"items"`
+		Total int         `json:"total"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("second page answered %d %s", w.Code, w.Body.String())
+	}
+	if len(page.Items) != 1 || page.Items[0].ID != 9 || page.Total != 2 {
+		t.Errorf("second page answered %s, want booking 9 of 2", w.Body.String())
+	}
+
+	if w := adminBooks("", roleAdmin); w.Code != http.StatusOK || len(decodeBooks(t, w)) != 4 {
+		t.Errorf("list without a filter answered %d %s, want all 4 bookings", w.Code, w.Body.String())
+	}
+	if w := adminBooks("?status=lost", roleAdmin); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown status answered %d, want 400", w.Code)
+	}
+	if w := adminBooks("?status=need_to_pay", "user"); w.Code != http.StatusForbidden {
+		t.Errorf("a user listing all bookings answered %d, want 403", w.Code)
+	}
+}
+
+// TestAdminListAsksEventsAsEachUser checks the admin list asks events for
+// the events of every booking as the user who booked, not as the admin.
+func TestAdminListAsksEventsAsEachUser(t *testing.T) {
+	useBooksList(t,
+		bookModel{ID: 7, UserID: 5, EventID: 3, Status: statusNeedToPay, Quantity: 1},
+		bookModel{ID: 8, UserID: 6, EventID: 3, Status: statusCompleted, Quantity: 1},
+		bookModel{ID: 9, UserID: 5, EventID: 4, Status: statusNeedToPay, Quantity: 2},
+	)
+	d := useStubServices(t, map[string]stubResponse{
+		"/events/availability": {http.StatusOK, `[{"id":3,"event_name":"Rock Concert","price":1500},{"id":4,"event_name":"Hamlet","price":900}]`},
+	})
+	if w := adminBooks("", roleAdmin); w.Code != http.StatusOK {
+		t.Fatalf("list answered %d %s", w.Code, w.Body.String())
+	}
+	asked := map[string]string{}
+	for _, r := range d.sent("/events/availability") {
+		asked[r.header.Get("X-User-Id")] = string(r.body)
+	}
+	want := map[string]string{"5": `{"ids":[3,4]}`, "6": `{"ids":[3]}`}
+	if len(asked) != len(want) {
+		t.Fatalf("asked events as users %v, want as 5 and 6", asked)
+	}
+	for uid, ids := range want {
+		if !sameJSON(t, []byte(asked[uid]), []byte(ids)) {
+			t.Errorf("asked as user %s for %s, want %s", uid, asked[uid], ids)
+		}
+	}
+}
+
+// decodeBooks reads the bookings w answered with.
+func decodeBooks(t *testing.T, w *httptest.ResponseRecorder) []bookModel {
+	t.Helper()
+	books := []bookModel{}
+	if err := json.Unmarshal(w.Body.Bytes(), &books); err != nil {
+		t.Fatalf("answered %s: %s", w.Body.String(), err)
+	}
+	return books
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// bookDB fakes the statements of book for a user with active bookings of
+// the event already, and records the statements it got.
+type bookDB struct {
+	mu      sync.Mutex
+	active  int64
+	queries []string
+}
+
+func (db *bookDB) handle(query string, args []driver.Value) fakeResult {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.queries = append(db.queries, query)
+	switch {
+	case queryHas(query, "pg_advisory_xact_lock"):
+		return fakeResult{Cols: []string{"pg_advisory_xact_lock"}, Rows: [][]driver.Value{{""}}}
+	case queryHas(query, "SELECT COUNT(1) FROM book"):
+		return fakeResult{Cols: []string{"count"}, Rows: [][]driver.Value{{db.active}}}
+	case queryHas(query, "INSERT INTO book "):
+		return fakeResult{Cols: []string{"id"}, Rows: [][]driver.Value{{int64(7)}}}
+	}
+	return fakeResult{}
+}
+
+func (db *bookDB) ran(parts ...string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, q := range db.queries {
+		if queryHas(q, parts...) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestBookRejectsSecondActiveBooking(t *testing.T) {
+	db := &bookDB{active: 1}
+	useFakeDB(t, db.handle)
+	_, err := book(5, &bookModel{EventID: 3, Quantity: 1}, false)
+	if !errors.Is(err, errDuplicateBooking) {
+		t.Fatalf("got %v, want errDuplicateBooking", err)
+	}
+	if !db.ran("pg_advisory_xact_lock") {
+		t.Error("user and event were not locked")
+	}
+	if db.ran("INSERT INTO book ") {
+		t.Error("duplicate booking was inserted")
+	}
+}
+
+func TestBookAllowsFirstBooking(t *testing.T) {
+	db := &bookDB{}
+	useFakeDB(t, db.handle)
+	id, err := book(5, &bookModel{EventID: 3, Quantity: 1}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 7 {
+		t.Fatalf("id %d, want 7", id)
+	}
+}
+
+func TestBookAllowMultipleSkipsCheck(t *testing.T) {
+	db := &bookDB{active: 1}
+	useFakeDB(t, db.handle)
+	id, err := book(5, &bookModel{EventID: 3, Quantity: 1}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 7 {
+		t.Fatalf("id %d, want 7", id)
+	}
+	if db.ran("SELECT COUNT(1) FROM book") {
+		t.Error("active bookings were counted for an event allowing several")
+	}
+}
+
+func TestCreateAnswersConflictForSecondBooking(t *testing.T) {
+	tests := []struct {
+		name     string
+		multiple string
+		status   int
+	}{
+		{"one booking per user", "false", http.StatusConflict},
+		{"allow multiple", "true", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &bookDB{active: 1}
+			useFakeDB(t, db.handle)
+			useStubServices(t, map[string]stubResponse{
+				"/events/get/3":  {http.StatusOK, `{"id":3,"price":100,"allow_multiple":` + tt.multiple + `}`},
+				"/events/occupy": {http.StatusOK, ""},
+			})
+			r := httptest.NewRequest(http.MethodPost, "/book/create", strings.NewReader(`{"event_id":3}`))
+			r.Header.Set("X-User-Id", "5")
+			w := httptest.NewRecorder()
+			create(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestCreateRejectsMalformedBody(t *testing.T) {
+	db := &bookDB{}
+	useFakeDB(t, db.handle)
+	d := useStubServices(t, map[string]stubResponse{})
+	r := httptest.NewRequest(http.MethodPost, "/book/create", strings.NewReader(`{"event_id":`))
+	r.Header.Set("X-User-Id", "5")
+	w := httptest.NewRecorder()
+	create(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if db.ran("INSERT INTO book ") || len(d.reqs) != 0 {
+		t.Error("malformed request was booked")
+	}
+}
+
+// newCreateDB fakes the book table for create: the new booking gets id 7
+// and is then run by a sagaDB.
+func newCreateDB(t *testing.T) *sagaDB {
+	bdb := &bookDB{}
+	sdb := &sagaDB{book: bookModel{ID: 7, UserID: 5, EventID: 3, Quantity: 1, Status: statusNeedToOccupy}}
+	useFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		if queryHas(query, "pg_advisory_xact_lock") || queryHas(query, "SELECT COUNT(1) FROM book") || queryHas(query, "INSERT INTO book ") {
+			return bdb.handle(query, args)
+		}
+		return sdb.handle(query, args)
+	})
+	return sdb
+}
+
+// postCreate creates a booking with body as user 5.
+func postCreate(body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/book/create", strings.NewReader(body))
+	r.Header.Set("X-User-Id", "5")
+	w := httptest.NewRecorder()
+	create(w, r)
+	return w
+}
+
+// downDoer fails every request as if the other service was unreachable.
+type downDoer struct{}
+
+func (downDoer) Do(*http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+// TestCreateCancelsWhenEventsIsDown books while events can't be reached:
+// the slot can't be occupied, so create answers 502 and the booking is
+// cancelled.
+func TestCreateCancelsWhenEventsIsDown(t *testing.T) {
+	sdb := newCreateDB(t)
+	useStubServices(t, nil)
+	services.HTTP = downDoer{}
+
+	w := postCreate(`{"event_id":3}`)
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusBadGateway)
+	}
+	b := bookModel{}
+	if err := json.Unmarshal(w.Body.Bytes(), &b); err != nil || b.ID != 7 || b.Status != statusCancelled {
+		t.Errorf("answered %s, want the cancelled booking", w.Body.String())
+	}
+	if s := sdb.status(); s != statusCancelled {
+		t.Errorf("book is %s, want %s", s, statusCancelled)
+	}
+}
+
+// TestCreateLeavesNoHalfStartedBooking checks a booking is created already
+// in the first saga step, and a saga that can't start leaves it cancelled
+// rather than waiting for a step nobody runs.
+func TestCreateLeavesNoHalfStartedBooking(t *testing.T) {
+	tests := []struct {
+		name   string
+		occupy stubResponse
+		code   int
+		status BookStatus
+	}{
+		{"saga starts", stubResponse{http.StatusOK, ""}, http.StatusOK, statusNeedToOccupy},
+		{"events rejects the slot", stubResponse{http.StatusServiceUnavailable, ""}, http.StatusBadGateway, statusCancelled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sdb := newCreateDB(t)
+			useStubServices(t, map[string]stubResponse{
+				"/events/get/3":  {http.StatusOK, `{"id":3,"price":100}`},
+				"/events/occupy": tt.occupy,
+			})
+			w := postCreate(`{"event_id":3}`)
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d", w.Code, tt.code)
+			}
+			b := bookModel{}
+			if err := json.Unmarshal(w.Body.Bytes(), &b); err != nil || b.ID != 7 || b.Status != tt.status {
+				t.Errorf("answered %s, want booking 7 %s", w.Body.String(), tt.status)
+			}
+			if s := sdb.status(); s != tt.status {
+				t.Errorf("book is %s, want %s", s, tt.status)
+			}
+			if log := sdb.steps(""); len(log) == 0 || log[0].status != statusNeedToOccupy {
+				t.Errorf("saga log %+v, want it to start at %s", log, statusNeedToOccupy)
+			}
+		})
+	}
+}
+
+// paidDB fakes a paid booking that completeBook moves to statusCompleted
+// once, as the conditional update does.
+type paidDB struct {
+	mu        sync.Mutex
+	status    BookStatus
+	sagaSteps []string
+}
+
+func (db *paidDB) handle(query string, args []driver.Value) fakeResult {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	switch {
+	case queryHas(query, "UPDATE book SET status=$2", "status=$3"):
+		if db.status != BookStatus(args[2].(int64)) {
+			return fakeResult{}
+		}
+		db.status = BookStatus(args[1].(int64))
+		return fakeResult{Affected: 1}
+	case queryHas(query, "INSERT INTO book_saga_log"):
+		db.sagaSteps = append(db.sagaSteps, args[2].(string)+":"+args[3].(string))
+		return fakeResult{Affected: 1}
+	}
+	return fakeResult{Affected: 1}
+}
+
+func TestCompleteBookMovesPaidToCompleted(t *testing.T) {
+	db := &paidDB{status: statusPaid}
+	useFakeDB(t, db.handle)
+	d := useStubServices(t, map[string]stubResponse{
+		"/events/commit":  {http.StatusOK, ""},
+		"/orders/booking": {http.StatusOK, `{"id":11}`},
+		"/notif/create":   {http.StatusOK, ""},
+		"/events/get/3":   {http.StatusOK, `{"id":3,"event_name":"Concert"}`},
+	})
+	b := &bookModel{ID: 7, UserID: 5, EventID: 3, Price: 100, Status: statusPaid}
+	if err := completeBook(b); err != nil {
+		t.Fatal(err)
+	}
+	if db.status != statusCompleted || b.Status != statusCompleted {
+		t.Fatalf("status %s, want %s", db.status, statusCompleted)
+	}
+	if b.OrderID != 11 {
+		t.Errorf("order %d, want 11", b.OrderID)
+	}
+	// A retry of the completed booking must not notify the user again.
+	if err := completeBook(&bookModel{ID: 7, UserID: 5, EventID: 3, Price: 100, Status: statusPaid, OrderID: 11}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(d.sent("/notif/create")); n != 1 {
+		t.Errorf("sent %d notifications, want 1", n)
+	}
+}
+
+func TestCompleteBookKeepsPaidWhenCommitFails(t *testing.T) {
+	db := &paidDB{status: statusPaid}
+	useFakeDB(t, db.handle)
+	d := useStubServices(t, map[string]stubResponse{
+		"/events/commit": {http.StatusServiceUnavailable, ""},
+	})
+	b := &bookModel{ID: 7, UserID: 5, EventID: 3, Price: 100, Status: statusPaid}
+	if err := completeBook(b); err == nil {
+		t.Fatal("completed a booking whose slot was not committed")
+	}
+	if db.status != statusPaid {
+		t.Fatalf("status %s, want %s", db.status, statusPaid)
+	}
+	if len(db.sagaSteps) != 1 || !strings.HasPrefix(db.sagaSteps[0], stepCommitSlot+":") || db.sagaSteps[0] == stepCommitSlot+":" {
+		t.Errorf("saga log %v, want a failed %s", db.sagaSteps, stepCommitSlot)
+	}
+	if len(d.sent("/orders/booking")) != 0 || len(d.sent("/notif/create")) != 0 {
+		t.Error("order or notification sent for an uncommitted slot")
+	}
+}
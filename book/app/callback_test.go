@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCallbacksRejectBadRequests(t *testing.T) {
+	newSagaDB(t, bookModel{ID: 7, UserID: 5, EventID: 3, Price: 3000, Quantity: 1, Status: statusNeedToPay})
+	useStubServices(t, nil)
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		body    string
+	}{
+		{"events, malformed body", callbackEvents, `{"book_id":`},
+		{"events, nonexistent book", callbackEvents, `{"book_id":8,"status":true}`},
+		{"events, wrong book id", callbackEvents, `{"book_id":0,"status":true}`},
+		{"payment, malformed body", callbackPayment, `[]`},
+		{"payment, nonexistent book", callbackPayment, `{"book_id":8,"user_id":5,"price":3000,"status":true}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := postCallback(tt.handler, tt.body); w.Code != http.StatusBadRequest {
+				t.Fatalf("answered %d, want 400", w.Code)
+			}
+		})
+	}
+}
+
+// TestCallbacksIgnoreStaleStatus checks callbacks of a known book that has
+// moved on are answered 200, so the sender stops retrying, and change
+// nothing.
+func TestCallbacksIgnoreStaleStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  BookStatus
+		handler http.HandlerFunc
+		body    string
+	}{
+		{"slot failure of a paid book", statusPaid, callbackEvents, `{"book_id":7,"status":false,"reason":"no_slots"}`},
+		{"slot failure of a cancelled book", statusCancelled, callbackEvents, `{"book_id":7,"status":false}`},
+		{"repeated slot of a book waiting for payment", statusNeedToPay, callbackEvents, `{"book_id":7,"price":3000,"status":true}`},
+		{"payment of a book waiting for a slot", statusNeedToOccupy, callbackPayment, `{"book_id":7,"user_id":5,"price":3000,"status":true}`},
+		{"repeated payment of a completed book", statusCompleted, callbackPayment, `{"book_id":7,"user_id":5,"price":3000,"status":true}`},
+		{"failed payment of a paid book", statusPaid, callbackPayment, `{"book_id":7,"user_id":5,"price":3000,"status":false}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newSagaDB(t, bookModel{ID: 7, UserID: 5, EventID: 3, Price: 3000, Quantity: 1, Status: tt.status})
+			d := useStubServices(t, nil)
+			if w := postCallback(tt.handler, tt.body); w.Code != http.StatusOK {
+				t.Fatalf("answered %d, want 200", w.Code)
+			}
+			if s := db.status(); s != tt.status {
+				t.Errorf("book moved to %s, want it left in %s", s, tt.status)
+			}
+			if len(d.reqs) != 0 {
+				t.Errorf("sent %d requests to other services", len(d.reqs))
+			}
+		})
+	}
+}
+
+// TestPaymentChargesLockedPrice changes the event price while the booking is
+// in flight: the hold and the capture must use the price locked by the occupy
+// callback, and a later callback with the new price must not change it.
+func TestPaymentChargesLockedPrice(t *testing.T) {
+	db := newSagaDB(t, bookModel{ID: 7, UserID: 5, EventID: 3, Quantity: 1, Status: statusNeedToOccupy})
+	d := useStubServices(t, map[string]stubResponse{
+		"/events/get/3":    {http.StatusOK, `{"id":3,"price":4500}`},
+		"/account/hold":    {http.StatusOK, ""},
+		"/account/capture": {http.StatusOK, ""},
+	})
+	if w := postCallback(callbackEvents, `{"book_id":7,"price":3000,"status":true}`); w.Code != http.StatusOK {
+		t.Fatalf("callback answered %d, want 200", w.Code)
+	}
+	if w := postCallback(callbackEvents, `{"book_id":7,"price":4500,"status":true}`); w.Code != http.StatusOK {
+		t.Fatalf("repeated callback answered %d, want 200", w.Code)
+	}
+	if s := db.status(); s != statusNeedToPay {
+		t.Fatalf("book is %s, want %s", s, statusNeedToPay)
+	}
+	if db.book.Price != 3000 {
+		t.Errorf("book price %d, want the locked 3000", db.book.Price)
+	}
+	for _, path := range []string{"/account/hold", "/account/capture"} {
+		reqs := d.sent(path)
+		if len(reqs) != 1 {
+			t.Fatalf("sent %d requests to %s, want 1", len(reqs), path)
+		}
+		if got := string(reqs[0].body); got != `{"book_id":7,"amount":3000}` {
+			t.Errorf("%s body %s, want the locked price", path, got)
+		}
+	}
+	if len(d.sent("/events/get/3")) != 0 {
+		t.Error("payment read the current event price")
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestServiceURLsFromEnv(t *testing.T) {
+	t.Setenv("EVENTS_URL", "http://localhost:9001")
+	t.Setenv("ACCOUNT_URL", "")
+	cfg := readConf()
+	if cfg.eventsURL != "http://localhost:9001" {
+		t.Fatalf("events url %q, want the override", cfg.eventsURL)
+	}
+	if cfg.accountURL != "http://account.saga.svc.cluster.local:9000" {
+		t.Errorf("account url %q, want the cluster default", cfg.accountURL)
+	}
+
+	d := useStubServices(t, map[string]stubResponse{
+		"/events/get/3": {http.StatusOK, `{"id":3,"price":1500}`},
+	})
+	setServiceURLs(cfg)
+	if _, err := fetchEvent(3, 5, ""); err != nil {
+		t.Fatal(err)
+	}
+	reqs := d.sent("/events/get/3")
+	if len(reqs) != 1 || reqs[0].host != "localhost:9001" {
+		t.Fatalf("requests %+v, want one to localhost:9001", reqs)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"contracts"
+)
+
+func TestCompletedBookingIsConfirmed(t *testing.T) {
+	tests := []struct {
+		name  string
+		event stubResponse
+		want  string
+	}{
+		{"with event", stubResponse{http.StatusOK, `{"id":3,"event_name":"Rock Concert","price":3000,"starts_at":"2030-06-01T19:00:00Z"}`}, "Rock Concert"},
+		{"events down", stubResponse{http.StatusServiceUnavailable, ""}, "[3]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newSagaDB(t, bookModel{ID: 7, UserID: 5, EventID: 3, Price: 3000, Quantity: 1, Status: statusNeedToPay})
+			d := useStubServices(t, map[string]stubResponse{
+				"/events/get/3":   tt.event,
+				"/events/commit":  {http.StatusOK, ""},
+				"/orders/booking": {http.StatusOK, `{"id":11}`},
+				"/notif/create":   {http.StatusOK, ""},
+			})
+			if w := postCallback(callbackPayment, `{"book_id":7,"user_id":5,"price":3000,"status":true}`); w.Code != http.StatusOK {
+				t.Fatalf("callback answered %d, want 200", w.Code)
+			}
+			if s := db.status(); s != statusCompleted {
+				t.Fatalf("book is %s, want %s", s, statusCompleted)
+			}
+			sent := d.sent("/notif/create")
+			if len(sent) != 1 {
+				t.Fatalf("sent %d notifications, want 1", len(sent))
+			}
+			n := contracts.Notification{}
+			if err := json.Unmarshal(sent[0].body, &n); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]string{"book_id": "7", "event": tt.want, "price": "3000"}
+			if n.UserID != 5 || n.Type != "booking_confirmed" || n.Channel != channelEmail || !reflect.DeepEqual(n.Params, want) {
+				t.Errorf("sent %s, want booking_confirmed by email with %v", sent[0].body, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"platform/fakedb"
+)
+
+// fakeResult is what the fake database answers to one statement.
+type fakeResult = fakedb.Result
+
+// queryHas reports whether query contains every part.
+var queryHas = fakedb.QueryHas
+
+// useFakeDB points dbConn and the prepared statements at a fake database
+// that answers every statement with h.
+func useFakeDB(t *testing.T, h fakedb.Handler) {
+	t.Helper()
+	db := fakedb.Open(t, h)
+	mustPrepareStmts(context.Background(), db)
+	dbConn.Set(db)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// getDetail asks for the detail of the booking as user uid.
+func getDetail(bid string, uid string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/book/"+bid+"/detail", nil)
+	r.Header.Set("X-User-Id", uid)
+	r = mux.SetURLVars(r, map[string]string{"id": bid})
+	w := httptest.NewRecorder()
+	detail(w, r)
+	return w
+}
+
+// sameJSON reports whether a and b hold the same JSON value.
+func sameJSON(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var va, vb interface{}
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+func TestDetailJoinsEvent(t *testing.T) {
+	c := useFakeClock(t)
+	newSagaDB(t, bookModel{ID: 7, UserID: 5, EventID: 3, Price: 1500, Status: statusNeedToPay, Quantity: 1})
+	d := useStubServices(t, map[string]stubResponse{
+		"/events/get/3": {http.StatusOK, `{"id":3,"event_name":"Rock Concert","price":1500,"starts_at":"2030-06-01T19:00:00Z"}`},
+	})
+	want := `{"id":7,"user_id":5,"event_id":3,"price":1500,"status":"need_to_pay","quantity":1,` +
+		`"event":{"id":3,"event_name":"Rock Concert","price":1500,"starts_at":"2030-06-01T19:00:00Z","free_slots":null,"closed":false,"allow_multiple":false}}`
+	for i := 0; i < 2; i++ {
+		w := getDetail("7", "5")
+		if w.Code != http.StatusOK || !sameJSON(t, w.Body.Bytes(), []byte(want)) {
+			t.Fatalf("detail answered %d %s, want 200 %s", w.Code, w.Body.String(), want)
+		}
+	}
+	if n := len(d.sent("/events/get/3")); n != 1 {
+		t.Errorf("fetched the event %d times, want 1 from the cache", n)
+	}
+	c.advance(eventCacheTTL + time.Second)
+	getDetail("7", "5")
+	if n := len(d.sent("/events/get/3")); n != 2 {
+		t.Errorf("fetched the event %d times, want a second fetch after the cache expired", n)
+	}
+
+	if w := getDetail("7", "6"); w.Code != http.StatusNotFound {
+		t.Errorf("detail of another user's booking answered %d, want 404", w.Code)
+	}
+	if w := getDetail("8", "5"); w.Code != http.StatusNotFound {
+		t.Errorf("detail of a missing booking answered %d, want 404", w.Code)
+	}
+}
+
+func TestDetailWithoutEventsReturnsBooking(t *testing.T) {
+	newSagaDB(t, bookModel{ID: 7, UserID: 5, EventID: 3, Price: 1500, Status: statusNeedToPay, Quantity: 1})
+	useStubServices(t, nil)
+	w := getDetail("7", "5")
+	want := `{"id":7,"user_id":5,"event_id":3,"price":1500,"status":"need_to_pay","quantity":1,"event":null}`
+	if w.Code != http.StatusOK || !sameJSON(t, w.Body.Bytes(), []byte(want)) {
+		t.Fatalf("detail answered %d %s, want 200 %s", w.Code, w.Body.String(), want)
+	}
+}
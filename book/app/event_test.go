@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestCachedFetchEventIsPerCaller checks a cached event priced for one user
+// or role is not served to another.
+func TestCachedFetchEventIsPerCaller(t *testing.T) {
+	d := useStubServices(t, map[string]stubResponse{
+		"/events/get/3": {http.StatusOK, `{"id":3,"price":1000}`},
+	})
+	calls := []struct {
+		uid  int
+		role string
+	}{{5, "vip"}, {5, "vip"}, {6, ""}, {5, ""}, {6, ""}}
+	for _, c := range calls {
+		if _, err := cachedFetchEvent(3, c.uid, c.role); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reqs := d.sent("/events/get/3")
+	if len(reqs) != 3 {
+		t.Fatalf("fetched the event %d times, want 3", len(reqs))
+	}
+	if got := reqs[0].header.Get("X-User-Role"); got != "vip" {
+		t.Errorf("X-User-Role %q, want vip", got)
+	}
+	if got := reqs[1].header.Get("X-User-Role"); got != "" {
+		t.Errorf("X-User-Role %q sent for a user without role", got)
+	}
+}
+
+// TestCreateForwardsRole checks the role of the user reaches events both
+// when create looks the event up and when it occupies the slot, events
+// prices the booking by it.
+func TestCreateForwardsRole(t *testing.T) {
+	db := &bookDB{}
+	useFakeDB(t, db.handle)
+	d := useStubServices(t, map[string]stubResponse{
+		"/events/get/3":  {http.StatusOK, `{"id":3,"price":1000}`},
+		"/events/occupy": {http.StatusOK, ""},
+	})
+	r := httptest.NewRequest(http.MethodPost, "/book/create", strings.NewReader(`{"event_id":3}`))
+	r.Header.Set("X-User-Id", "5")
+	r.Header.Set("X-User-Role", "vip")
+	w := httptest.NewRecorder()
+	create(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", w.Code, w.Body.String())
+	}
+	for _, path := range []string{"/events/get/3", "/events/occupy"} {
+		reqs := d.sent(path)
+		if len(reqs) != 1 || reqs[0].header.Get("X-User-Role") != "vip" {
+			t.Errorf("%s: role was not forwarded", path)
+		}
+	}
+}
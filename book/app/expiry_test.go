@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when the test advances it.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// useFakeClock puts a fakeClock into clk for the test.
+func useFakeClock(t *testing.T) *fakeClock {
+	c := &fakeClock{now: time.Date(2030, 5, 1, 12, 0, 0, 0, time.UTC)}
+	saved := clk
+	clk = c
+	t.Cleanup(func() { clk = saved })
+	return c
+}
+
+// TestBookingExpiresByClock creates a booking and drives it past its
+// deadline by advancing the clock only.
+func TestBookingExpiresByClock(t *testing.T) {
+	c := useFakeClock(t)
+	db := newSagaDB(t, bookModel{ID: 7, UserID: 5, EventID: 3, Price: 3000, Quantity: 1, Status: statusNeedToPay})
+	var expiresAt time.Time
+	useFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		switch {
+		case queryHas(query, "INSERT INTO book "):
+			expiresAt = args[3].(time.Time)
+			return fakeResult{Cols: []string{"id"}, Rows: [][]driver.Value{{int64(7)}}}
+		case queryHas(query, "expires_at < $3"):
+			cols := []string{"id", "user_id", "event_id", "price", "status", "quantity", "order_id"}
+			b := db.book
+			if !expiresAt.Before(args[2].(time.Time)) || db.status() != statusNeedToPay {
+				return fakeResult{Cols: cols}
+			}
+			return fakeResult{Cols: cols, Rows: [][]driver.Value{{int64(b.ID), int64(b.UserID), int64(b.EventID), int64(b.Price), int64(b.Status), int64(b.Quantity), int64(0)}}}
+		}
+		return db.handle(query, args)
+	})
+	d := useStubServices(t, map[string]stubResponse{
+		"/events/cancel":   {http.StatusOK, ""},
+		"/account/release": {http.StatusOK, ""},
+	})
+
+	if _, err := book(5, &bookModel{EventID: 3, Quantity: 1}, true); err != nil {
+		t.Fatal(err)
+	}
+	if want := c.Now().Add(bookTimeout); !expiresAt.Equal(want) {
+		t.Fatalf("expires at %s, want %s", expiresAt, want)
+	}
+
+	c.advance(bookTimeout - time.Second)
+	expireDueBooks()
+	if s := db.status(); s != statusNeedToPay {
+		t.Fatalf("book is %s before its deadline, want %s", s, statusNeedToPay)
+	}
+
+	c.advance(2 * time.Second)
+	expireDueBooks()
+	if s := db.status(); s != statusCancelled {
+		t.Fatalf("book is %s after its deadline, want %s", s, statusCancelled)
+	}
+	if len(d.sent("/events/cancel")) != 1 || len(d.sent("/account/release")) != 1 {
+		t.Error("slot or hold of the expired book was not released")
+	}
+}
+
+func TestEventCacheExpiresByClock(t *testing.T) {
+	c := useFakeClock(t)
+	d := useStubServices(t, map[string]stubResponse{
+		"/events/get/3": {http.StatusOK, `{"id":3,"price":1000}`},
+	})
+	for _, step := range []time.Duration{0, eventCacheTTL - time.Second, 2 * time.Second} {
+		c.advance(step)
+		if _, err := cachedFetchEvent(3, 5, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(d.sent("/events/get/3")); n != 2 {
+		t.Fatalf("fetched the event %d times, want 2", n)
+	}
+}
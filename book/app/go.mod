@@ -3,9 +3,11 @@ module app
 go 1.21.1
 
 require (
+	contracts v0.0.0
 	github.com/gorilla/mux v1.8.1
 	github.com/lib/pq v1.10.9
 	github.com/prometheus/client_golang v1.19.1
+	platform v0.0.0
 )
 
 require (
@@ -17,3 +19,6 @@ require (
 	golang.org/x/sys v0.17.0 // indirect
 	google.golang.org/protobuf v1.33.0 // indirect
 )
+
+replace contracts => ../../contracts
+replace platform => ../../platform
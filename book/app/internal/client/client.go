@@ -0,0 +1,253 @@
+// Package client calls the events, account, orders and notif services on
+// behalf of book. It keeps the paths and headers of those services in one
+// place, the payloads are the types of the shared contracts package.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"contracts"
+)
+
+const (
+	occupySlotPath  = "/events/occupy"
+	cancelSlotPath  = "/events/cancel"
+	commitSlotPath  = "/events/commit"
+	getEventPath    = "/events/get/"
+	holdPath        = "/account/hold"
+	capturePath     = "/account/capture"
+	releaseHoldPath = "/account/release"
+	refundPath      = "/account/refund"
+	getBalancePath  = "/account/get"
+	createOrderPath = "/orders/booking"
+	notifCreatePath = "/notif/create"
+
+	// getRetries is how many times a GET is tried when the service can't be
+	// reached. Other requests are not retried, they may not be idempotent.
+	getRetries = 2
+)
+
+const availabilityPath = "/events/availability"
+
+// MaxEventIDs is the most events GetEvents may ask for, events' own limit.
+const MaxEventIDs = 500
+
+// ErrNotFound is returned when the service answers 404.
+var ErrNotFound = errors.New("not found")
+
+// StatusError is an unexpected status code from a service.
+type StatusError struct {
+	Service string
+	Code    int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s responded with status [%d]", e.Service, e.Code)
+}
+
+// Doer sends HTTP requests. *http.Client implements it, tests can pass a stub
+// instead.
+type Doer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// Client calls the events service at EventsURL, the account service at
+// AccountURL, the orders service at OrdersURL and the notif service at
+// NotifURL. A non-empty Role is sent as the user's role.
+type Client struct {
+	HTTP       Doer
+	EventsURL  string
+	AccountURL string
+	OrdersURL  string
+	NotifURL   string
+	Role       string
+}
+
+// New returns a Client for the given base URLs using http.DefaultClient.
+func New(eventsURL, accountURL, ordersURL, notifURL string) *Client {
+	return &Client{HTTP: http.DefaultClient, EventsURL: eventsURL, AccountURL: accountURL, OrdersURL: ordersURL, NotifURL: notifURL}
+}
+
+// WithRole returns a copy of c that calls the services on behalf of a user
+// with role, events resolves the price tiers of the role from it.
+func (c *Client) WithRole(role string) *Client {
+	cc := *c
+	cc.Role = role
+	return &cc
+}
+
+// Event is the part of the events service's event that book needs. The json
+// names follow eventModel in events, contracts/testdata/event.json holds the
+// event both sides are tested against.
+type Event struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"event_name"`
+	Price     int       `json:"price"`
+	StartsAt  time.Time `json:"starts_at"`
+	FreeSlots *int      `json:"free_slots"`
+	Closed    bool      `json:"closed"`
+	// AllowMultiple lets a user hold several active bookings of the event.
+	AllowMultiple bool `json:"allow_multiple"`
+}
+
+// Availability is an event as events' availability returns it.
+type Availability = contracts.Availability
+
+// orderIDModel is the part of the order orders returns that book keeps.
+type orderIDModel struct {
+	ID int `json:"id"`
+}
+
+// GetEvent fetches the event as the user sees it.
+func (c *Client) GetEvent(eid, uid int) (*Event, error) {
+	e := &Event{}
+	if err := c.get("events", c.EventsURL+getEventPath+strconv.Itoa(eid), uid, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// GetEvents fetches the name, base price and slot counts of the events in
+// one call. Unknown and deleted events are left out. At most MaxEventIDs ids
+// may be asked at once.
+func (c *Client) GetEvents(eids []int, uid int) ([]Availability, error) {
+	res := []Availability{}
+	if err := c.send("events", c.EventsURL+availabilityPath, uid, contracts.EventIDs{IDs: eids}, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetBalance fetches the balance of the user's account.
+func (c *Client) GetBalance(uid int) (int, error) {
+	b := contracts.Balance{}
+	if err := c.get("account", c.AccountURL+getBalancePath, uid, &b); err != nil {
+		return 0, err
+	}
+	return int(b.Balance), nil
+}
+
+// OccupySlot asks events to occupy quantity slots of the event for the
+// booking. The result comes later in a callback.
+func (c *Client) OccupySlot(bid, eid, uid, quantity int) error {
+	return c.post("events", c.EventsURL+occupySlotPath, uid, contracts.SlotRequest{BookID: bid, EventID: eid, Quantity: quantity})
+}
+
+// CancelSlot frees the slot of the booking.
+func (c *Client) CancelSlot(bid, eid, uid int) error {
+	return c.post("events", c.EventsURL+cancelSlotPath, uid, contracts.SlotRequest{BookID: bid, EventID: eid})
+}
+
+// CommitSlot marks the slot of a paid booking as committed.
+func (c *Client) CommitSlot(bid, eid, uid int) error {
+	return c.post("events", c.EventsURL+commitSlotPath, uid, contracts.SlotRequest{BookID: bid, EventID: eid})
+}
+
+// Hold reserves amount on the user's account for the booking.
+func (c *Client) Hold(bid, uid, amount int) error {
+	return c.post("account", c.AccountURL+holdPath, uid, contracts.FundsRequest{BookID: bid, Amount: amount})
+}
+
+// Capture withdraws the held funds of the booking. The result comes later in
+// a callback.
+func (c *Client) Capture(bid, uid, amount int) error {
+	return c.post("account", c.AccountURL+capturePath, uid, contracts.FundsRequest{BookID: bid, Amount: amount})
+}
+
+// ReleaseHold frees the held funds of the booking. ErrNotFound means there
+// was no active hold.
+func (c *Client) ReleaseHold(bid, uid, amount int) error {
+	return c.post("account", c.AccountURL+releaseHoldPath, uid, contracts.FundsRequest{BookID: bid, Amount: amount})
+}
+
+// Refund pays back the captured funds of the booking, account refunds a
+// booking once however often it is asked. ErrNotFound means nothing was
+// captured.
+func (c *Client) Refund(bid, uid, amount int) error {
+	return c.post("account", c.AccountURL+refundPath, uid, contracts.FundsRequest{BookID: bid, Amount: amount})
+}
+
+// CreateOrder records the paid booking as an order of the user and returns
+// the order id. orders keeps one order per booking, so the call may be
+// repeated.
+func (c *Client) CreateOrder(bid, uid int, item string, amount int) (int, error) {
+	o := orderIDModel{}
+	if err := c.send("orders", c.OrdersURL+createOrderPath, uid, contracts.BookingOrder{BookID: bid, Item: item, Amount: amount}, &o); err != nil {
+		return 0, err
+	}
+	return o.ID, nil
+}
+
+// Notify asks notif to send the user a notification of the given type
+// through channel, the wording lives in notif.
+func (c *Client) Notify(uid int, typ, channel string, params map[string]string) error {
+	return c.post("notif", c.NotifURL+notifCreatePath, uid, contracts.Notification{UserID: uid, Type: typ, Params: params, Channel: channel})
+}
+
+func (c *Client) get(service, url string, uid int, v interface{}) error {
+	var resp *http.Response
+	var err error
+	for i := 0; i < getRetries; i++ {
+		if resp, err = c.do(http.MethodGet, url, uid, nil); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err = checkStatus(service, resp); err != nil {
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *Client) post(service, url string, uid int, v interface{}) error {
+	return c.send(service, url, uid, v, nil)
+}
+
+// send posts v and decodes the response into out unless it is nil.
+func (c *Client) send(service, url string, uid int, v, out interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(http.MethodPost, url, uid, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err = checkStatus(service, resp); err != nil || out == nil {
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *Client) do(method, url string, uid int, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-User-Id", strconv.Itoa(uid))
+	if c.Role != "" {
+		req.Header.Set("X-User-Role", c.Role)
+	}
+	return c.HTTP.Do(req)
+}
+
+func checkStatus(service string, resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return ErrNotFound
+	default:
+		return &StatusError{Service: service, Code: resp.StatusCode}
+	}
+}
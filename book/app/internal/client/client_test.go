@@ -0,0 +1,193 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// goldenDir holds the messages of the shared contracts package.
+const goldenDir = "../../../../contracts/testdata"
+
+func readGolden(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(goldenDir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// sameJSON reports whether a and b are the same json value regardless of
+// formatting and key order.
+func sameJSON(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var va, vb interface{}
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+// stubDoer records the requests and answers each of them with status and
+// body.
+type stubDoer struct {
+	status int
+	body   []byte
+	reqs   []*http.Request
+	bodies [][]byte
+}
+
+func (d *stubDoer) Do(req *http.Request) (*http.Response, error) {
+	body, _ := io.ReadAll(req.Body)
+	d.reqs = append(d.reqs, req)
+	d.bodies = append(d.bodies, body)
+	return &http.Response{StatusCode: d.status, Body: io.NopCloser(bytes.NewReader(d.body))}, nil
+}
+
+func newStubClient(status int, body []byte) (*Client, *stubDoer) {
+	d := &stubDoer{status: status, body: body}
+	c := New("http://events", "http://account", "http://orders", "http://notif")
+	c.HTTP = d
+	return c, d
+}
+
+func TestRequestsMatchContracts(t *testing.T) {
+	tests := []struct {
+		name   string
+		golden string
+		url    string
+		call   func(c *Client) error
+	}{
+		{"occupy", "slot_request.json", "http://events/events/occupy", func(c *Client) error { return c.OccupySlot(7, 3, 5, 2) }},
+		{"hold", "funds_request.json", "http://account/account/hold", func(c *Client) error { return c.Hold(7, 5, 3000) }},
+		{"capture", "funds_request.json", "http://account/account/capture", func(c *Client) error { return c.Capture(7, 5, 3000) }},
+		{"release", "funds_request.json", "http://account/account/release", func(c *Client) error { return c.ReleaseHold(7, 5, 3000) }},
+		{"refund", "funds_request.json", "http://account/account/refund", func(c *Client) error { return c.Refund(7, 5, 3000) }},
+		{"notify", "notification_email.json", "http://notif/notif/create", func(c *Client) error {
+			return c.Notify(5, "booking_confirmed", "email", map[string]string{"book_id": "7", "event": "Rock Concert", "price": "3000"})
+		}},
+		{"availability", "event_ids.json", "http://events/events/availability", func(c *Client) error {
+			_, err := c.GetEvents([]int{3, 4}, 5)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, d := newStubClient(http.StatusOK, []byte("[]"))
+			if err := tt.call(c); err != nil {
+				t.Fatal(err)
+			}
+			if len(d.reqs) != 1 {
+				t.Fatalf("sent %d requests, want 1", len(d.reqs))
+			}
+			if got := d.reqs[0].URL.String(); got != tt.url {
+				t.Errorf("url %s, want %s", got, tt.url)
+			}
+			if got := d.reqs[0].Header.Get("X-User-Id"); got != "5" {
+				t.Errorf("X-User-Id %q, want 5", got)
+			}
+			if golden := readGolden(t, tt.golden); !sameJSON(t, d.bodies[0], golden) {
+				t.Errorf("sent %s, want %s", d.bodies[0], golden)
+			}
+		})
+	}
+}
+
+func TestGetEventReadsContract(t *testing.T) {
+	c, _ := newStubClient(http.StatusOK, readGolden(t, "event.json"))
+	e, err := c.GetEvent(3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	free := 60
+	want := &Event{
+		ID:            3,
+		Name:          "Concert",
+		Price:         1500,
+		StartsAt:      time.Date(2030, 5, 1, 19, 0, 0, 0, time.UTC),
+		FreeSlots:     &free,
+		AllowMultiple: true,
+	}
+	if !reflect.DeepEqual(e, want) {
+		t.Fatalf("got %+v, want %+v", e, want)
+	}
+}
+
+func TestGetEventsReadsContract(t *testing.T) {
+	c, _ := newStubClient(http.StatusOK, readGolden(t, "availability.json"))
+	res, err := c.GetEvents([]int{3, 4}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Availability{
+		{ID: 3, Name: "Concert", Price: 1500, Total: 100, Occupied: 40, Available: 60},
+		{ID: 4, Name: "Lecture", Total: 30, Occupied: 30},
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Fatalf("got %+v, want %+v", res, want)
+	}
+}
+
+func TestGetBalanceReadsContract(t *testing.T) {
+	c, _ := newStubClient(http.StatusOK, readGolden(t, "balance.json"))
+	b, err := c.GetBalance(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b != 12000 {
+		t.Fatalf("balance %d, want 12000", b)
+	}
+}
+
+func TestCreateOrderMatchesContract(t *testing.T) {
+	c, d := newStubClient(http.StatusOK, readGolden(t, "order.json"))
+	oid, err := c.CreateOrder(7, 5, "Concert", 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oid != 11 {
+		t.Errorf("order id %d, want 11", oid)
+	}
+	if golden := readGolden(t, "booking_order.json"); !sameJSON(t, d.bodies[0], golden) {
+		t.Errorf("sent %s, want %s", d.bodies[0], golden)
+	}
+}
+
+func TestStatusErrors(t *testing.T) {
+	c, _ := newStubClient(http.StatusNotFound, nil)
+	if _, err := c.GetEvent(3, 5); err != ErrNotFound {
+		t.Errorf("404: got %v, want ErrNotFound", err)
+	}
+	c, _ = newStubClient(http.StatusServiceUnavailable, nil)
+	err := c.OccupySlot(7, 3, 5, 1)
+	se, ok := err.(*StatusError)
+	if !ok || se.Service != "events" || se.Code != http.StatusServiceUnavailable {
+		t.Errorf("503: got %v, want events StatusError", err)
+	}
+}
+
+func TestWithRoleSendsRole(t *testing.T) {
+	c, d := newStubClient(http.StatusOK, readGolden(t, "event.json"))
+	if _, err := c.WithRole("vip").GetEvent(3, 5); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetEvent(3, 5); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.reqs[0].Header.Get("X-User-Role"); got != "vip" {
+		t.Errorf("X-User-Role %q, want vip", got)
+	}
+	if _, ok := d.reqs[1].Header["X-User-Role"]; ok || c.Role != "" {
+		t.Error("WithRole changed the client it was called on")
+	}
+}
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	paymentsPath = "/payments"
+	capturePart  = "/capture"
+	cancelPart   = "/cancel"
+	refundPart   = "/refund"
+)
+
+// ErrDeclined is returned when the gateway declines the payment.
+var ErrDeclined = errors.New("payment declined")
+
+// Gateway calls an external payment gateway at URL. Payments are made in two
+// steps: Authorize reserves the amount on the payer's card and Capture takes
+// it, Void drops an authorization that is not needed anymore and Refund pays
+// back a captured one. Every payment is known by a reference chosen by the
+// caller, which is also sent as the idempotency key so a repeated call doesn't
+// charge twice.
+type Gateway struct {
+	HTTP     Doer
+	URL      string
+	Key      string
+	Currency string
+}
+
+// NewGateway returns a Gateway whose requests give up after timeout.
+func NewGateway(gatewayURL, key, currency string, timeout time.Duration) *Gateway {
+	return &Gateway{HTTP: &http.Client{Timeout: timeout}, URL: gatewayURL, Key: key, Currency: currency}
+}
+
+type paymentModel struct {
+	Reference string `json:"reference"`
+	Amount    int    `json:"amount"`
+	Currency  string `json:"currency"`
+	Capture   bool   `json:"capture"`
+}
+
+// Authorize reserves amount for the payment ref.
+func (g *Gateway) Authorize(ref string, amount int) error {
+	body, err := json.Marshal(paymentModel{Reference: ref, Amount: amount, Currency: g.Currency})
+	if err != nil {
+		return err
+	}
+	return g.post(g.URL+paymentsPath, ref+"-authorize", body)
+}
+
+// Capture takes the amount authorized for the payment ref.
+func (g *Gateway) Capture(ref string) error {
+	return g.post(g.URL+paymentsPath+"/"+url.PathEscape(ref)+capturePart, ref+"-capture", nil)
+}
+
+// Void drops the authorization of the payment ref. ErrNotFound means there
+// was none.
+func (g *Gateway) Void(ref string) error {
+	return g.post(g.URL+paymentsPath+"/"+url.PathEscape(ref)+cancelPart, ref+"-cancel", nil)
+}
+
+// Refund pays back amount of the captured payment ref.
+func (g *Gateway) Refund(ref string, amount int) error {
+	body, err := json.Marshal(paymentModel{Reference: ref, Amount: amount, Currency: g.Currency})
+	if err != nil {
+		return err
+	}
+	return g.post(g.URL+paymentsPath+"/"+url.PathEscape(ref)+refundPart, ref+"-refund", body)
+}
+
+func (g *Gateway) post(endpoint, key string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+g.Key)
+	req.Header.Set("Idempotency-Key", key)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := g.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusPaymentRequired {
+		return ErrDeclined
+	}
+	return checkStatus("payment gateway", resp)
+}
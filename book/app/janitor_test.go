@@ -0,0 +1,83 @@
+package main
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+)
+
+// agedBook is a booking in the fake table of the janitor.
+type agedBook struct {
+	id      int
+	status  BookStatus
+	updated time.Time
+	deleted bool
+}
+
+// useJanitorDB fakes the book table for cleanup and returns the bookings
+// not deleted and the number of delete statements run. A booking row is
+// never removed from the table, the test fails if cleanup tries.
+func useJanitorDB(t *testing.T, books []agedBook) (left func() []int, deletes *int) {
+	deletes = new(int)
+	useFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		if queryHas(query, "DELETE FROM book") {
+			t.Errorf("booking rows were removed: %s", query)
+			return fakeResult{}
+		}
+		if !queryHas(query, "UPDATE book SET deleted_at=now()", "deleted_at IS NULL") {
+			return fakeResult{}
+		}
+		*deletes++
+		before := time.Now().Add(-time.Duration(args[1].(float64) * float64(time.Second)))
+		n := int64(0)
+		for i, b := range books {
+			if n < args[2].(int64) && !b.deleted && int64(b.status) == args[0] && b.updated.Before(before) {
+				books[i].deleted = true
+				n++
+			}
+		}
+		return fakeResult{Affected: n}
+	})
+	left = func() []int {
+		ids := []int{}
+		for _, b := range books {
+			if !b.deleted {
+				ids = append(ids, b.id)
+			}
+		}
+		return ids
+	}
+	return left, deletes
+}
+
+func TestCleanupRemovesOnlyOldCancelledBookings(t *testing.T) {
+	now := time.Now()
+	left, _ := useJanitorDB(t, []agedBook{
+		{1, statusCancelled, now.Add(-40 * 24 * time.Hour), false},
+		{2, statusCancelled, now.Add(-24 * time.Hour), false},
+		{3, statusCompleted, now.Add(-40 * 24 * time.Hour), false},
+	})
+	n, err := cleanup(720 * time.Hour)
+	if err != nil || n != 1 {
+		t.Fatalf("cleaned %d, %v, want 1", n, err)
+	}
+	if ids := left(); len(ids) != 2 || ids[0] != 2 || ids[1] != 3 {
+		t.Errorf("left %v, want [2 3]", ids)
+	}
+}
+
+func TestCleanupDeletesInBatches(t *testing.T) {
+	old := time.Now().Add(-40 * 24 * time.Hour)
+	books := []agedBook{}
+	for i := 0; i < 2*cleanupBatchSize+1; i++ {
+		books = append(books, agedBook{i, statusCancelled, old, false})
+	}
+	left, deletes := useJanitorDB(t, books)
+	n, err := cleanup(720 * time.Hour)
+	if err != nil || n != int64(len(books)) {
+		t.Fatalf("cleaned %d, %v, want %d", n, err, len(books))
+	}
+	if len(left()) != 0 || *deletes != 3 {
+		t.Errorf("left %d bookings after %d deletes, want none after 3", len(left()), *deletes)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"contracts"
+
+	"app/internal/client"
+)
+
+// useBooksList fakes the book table with books for the books list and the
+// admin list, and returns how many times they were counted.
+func useBooksList(t *testing.T, books ...bookModel) *int {
+	counted := new(int)
+	// matching returns the books the user filter of the books list or the
+	// status filter of the admin list keeps.
+	matching := func(query string, args []driver.Value) []bookModel {
+		res := []bookModel{}
+		for _, b := range books {
+			switch {
+			case queryHas(query, "user_id=$1") && int64(b.UserID) != args[0]:
+			case queryHas(query, "status = $1") && args[0] != nil && int64(b.Status) != args[0]:
+			default:
+				res = append(res, b)
+			}
+		}
+		return res
+	}
+	useFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		switch {
+		case queryHas(query, "SELECT COUNT(1) FROM book WHERE deleted_at IS NULL"):
+			*counted++
+			return fakeResult{Cols: []string{"count"}, Rows: [][]driver.Value{{int64(len(matching(query, args)))}}}
+		case queryHas(query, "FROM book WHERE deleted_at IS NULL"):
+			found := matching(query, args)
+			if queryHas(query, "LIMIT $2 OFFSET $3") {
+				found = found[min(int(args[2].(int64)), len(found)):]
+				found = found[:min(int(args[1].(int64)), len(found))]
+			}
+			res := fakeResult{Cols: []string{"id", "user_id", "event_id", "price", "status", "quantity", "order_id"}}
+			for _, b := range found {
+				res.Rows = append(res.Rows, []driver.Value{int64(b.ID), int64(b.UserID), int64(b.EventID), int64(b.Price), int64(b.Status), int64(b.Quantity), int64(b.OrderID)})
+			}
+			return res
+		}
+		return fakeResult{}
+	})
+	return counted
+}
+
+// listBooks asks for the books list with query as user 5.
+func listBooks(query string) *httptest.ResponseRecorder {
+	return listBooksOf("5", query)
+}
+
+// listBooksOf asks for the books list with query as user uid.
+func listBooksOf(uid, query string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/book/get"+query, nil)
+	r.Header.Set("X-User-Id", uid)
+	w := httptest.NewRecorder()
+	get(w, r)
+	return w
+}
+
+func TestListShowsEventNameAndPrice(t *testing.T) {
+	useBooksList(t,
+		bookModel{ID: 7, UserID: 5, EventID: 3, Status: statusNeedToOccupy, Quantity: 1},
+		bookModel{ID: 8, UserID: 5, EventID: 4, Price: 1800, Status: statusNeedToPay, Quantity: 2},
+		bookModel{ID: 9, UserID: 5, EventID: 3, Price: 1500, Status: statusCompleted, Quantity: 1, OrderID: 11},
+	)
+	d := useStubServices(t, map[string]stubResponse{
+		"/events/availability": {http.StatusOK, `[{"id":3,"event_name":"Rock Concert","price":1500,"total":100,"occupied":1,"available":99},` +
+			`{"id":4,"event_name":"Hamlet","price":900,"total":50,"occupied":2,"available":48}]`},
+	})
+	w := listBooks("")
+	want := `[{"id":7,"user_id":5,"event_id":3,"status":"need_to_occupy","quantity":1,"event_name":"Rock Concert","event_price":1500},` +
+		`{"id":8,"user_id":5,"event_id":4,"price":1800,"status":"need_to_pay","quantity":2,"event_name":"Hamlet","event_price":900},` +
+		`{"id":9,"user_id":5,"event_id":3,"price":1500,"status":"completed","quantity":1,"order_id":11,"event_name":"Rock Concert","event_price":1500}]`
+	if w.Code != http.StatusOK || !sameJSON(t, w.Body.Bytes(), []byte(want)) {
+		t.Fatalf("list answered %d %s, want %s", w.Code, w.Body.String(), want)
+	}
+	sent := d.sent("/events/availability")
+	if len(sent) != 1 || !sameJSON(t, sent[0].body, []byte(`{"ids":[3,4]}`)) {
+		t.Errorf("asked events %d times, want once for [3 4]", len(sent))
+	}
+}
+
+// TestListShowsOwnBooksOnly lists and counts the books of two users and
+// checks neither sees the books of the other.
+func TestListShowsOwnBooksOnly(t *testing.T) {
+	useBooksList(t,
+		bookModel{ID: 7, UserID: 5, EventID: 3, Status: statusNeedToOccupy, Quantity: 1},
+		bookModel{ID: 8, UserID: 6, EventID: 3, Status: statusNeedToPay, Quantity: 2},
+		bookModel{ID: 9, UserID: 6, EventID: 4, Status: statusCompleted, Quantity: 1},
+	)
+	useStubServices(t, nil)
+	tests := []struct {
+		uid  string
+		want string
+	}{
+		{"5", `{"items":[{"id":7,"user_id":5,"event_id":3,"status":"need_to_occupy","quantity":1}],"total":1}`},
+		{"6", `{"items":[{"id":8,"user_id":6,"event_id":3,"status":"need_to_pay","quantity":2},{"id":9,"user_id":6,"event_id":4,"status":"completed","quantity":1}],"total":2}`},
+		{"7", `{"items":[],"total":0}`},
+	}
+	for _, tt := range tests {
+		if w := listBooksOf(tt.uid, "?count=true"); w.Code != http.StatusOK || !sameJSON(t, w.Body.Bytes(), []byte(tt.want)) {
+			t.Errorf("list of user %s answered %d %s, want %s", tt.uid, w.Code, w.Body.String(), tt.want)
+		}
+	}
+	if w := listBooksOf("", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("list without a user answered %d, want 401", w.Code)
+	}
+}
+
+func TestListWithoutEventsReturnsBooks(t *testing.T) {
+	useBooksList(t, bookModel{ID: 7, UserID: 5, EventID: 3, Status: statusNeedToOccupy, Quantity: 1})
+	useStubServices(t, nil)
+	w := listBooks("")
+	want := `[{"id":7,"user_id":5,"event_id":3,"status":"need_to_occupy","quantity":1}]`
+	if w.Code != http.StatusOK || !sameJSON(t, w.Body.Bytes(), []byte(want)) {
+		t.Fatalf("list answered %d %s, want 200 %s", w.Code, w.Body.String(), want)
+	}
+}
+
+// TestListAsksEventsInBatches lists books of more events than events takes
+// at once and checks every event is asked for in batches.
+func TestListAsksEventsInBatches(t *testing.T) {
+	books := []bookModel{}
+	for eid := 1; eid <= client.MaxEventIDs+1; eid++ {
+		books = append(books, bookModel{ID: eid, UserID: 5, EventID: eid, Status: statusNeedToOccupy, Quantity: 1})
+	}
+	useBooksList(t, books...)
+	d := useStubServices(t, map[string]stubResponse{"/events/availability": {http.StatusOK, `[]`}})
+	if w := listBooks(""); w.Code != http.StatusOK {
+		t.Fatalf("list answered %d", w.Code)
+	}
+	asked := 0
+	for _, r := range d.sent("/events/availability") {
+		ids := contracts.EventIDs{}
+		if err := json.Unmarshal(r.body, &ids); err != nil {
+			t.Fatal(err)
+		}
+		if len(ids.IDs) > client.MaxEventIDs {
+			t.Errorf("asked for %d events at once, want at most %d", len(ids.IDs), client.MaxEventIDs)
+		}
+		asked += len(ids.IDs)
+	}
+	if asked != len(books) {
+		t.Errorf("asked for %d events, want %d", asked, len(books))
+	}
+}
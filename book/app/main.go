@@ -3,99 +3,541 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"app/internal/client"
+	"contracts"
+	"platform/config"
+	"platform/database"
+	"platform/web"
 
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type bookModel struct {
-	ID      int `json:"id"`
-	UserID  int `json:"user_id"`
-	EventID int `json:"event_id"`
-	Price   int `json:"price,omitempty"`
-	Status  int `json:"status,omitempty"`
+	ID      int        `json:"id"`
+	UserID  int        `json:"user_id"`
+	EventID int        `json:"event_id"`
+	Price   int        `json:"price,omitempty"`
+	Status  BookStatus `json:"status,omitempty"`
+	// Quantity is how many slots of the event the booking occupies, 0 in a
+	// request means one. Price is for all of them.
+	Quantity int `json:"quantity,omitempty"`
+	// OrderID is the order orders keeps for the paid booking, 0 until
+	// linkOrder has created it.
+	OrderID int `json:"order_id,omitempty"`
+	// EventName and EventPrice describe the event in the books list, where
+	// Price stays 0 until a slot is occupied. They are left out if events
+	// can't be reached.
+	EventName  string `json:"event_name,omitempty"`
+	EventPrice int    `json:"event_price,omitempty"`
+}
+
+// callbackOccupyModel is the result of an occupy events sends back.
+type callbackOccupyModel = contracts.OccupyResult
+
+// callbackPaymentModel is the result of a payment account sends back.
+type callbackPaymentModel = contracts.PaymentResult
+
+// services calls events, account, orders and notif. Tests can put a stub into its
+// HTTP field.
+var services = client.New("", "", "", "")
+
+// clock tells the time for deadline and expiry checks. It is the real time,
+// tests can put a fake into clk and advance it instead of sleeping.
+type clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+var clk clock = realClock{}
+
+// paymentProvider takes the money for a booking. Hold reserves the price,
+// Capture takes it and Release gives a reservation back; releasing a booking
+// without one is not an error. Refund pays back a captured price, refunding a
+// booking again or one that was never captured is not an error either.
+type paymentProvider interface {
+	Hold(b *bookModel) error
+	// Capture reports settled when the booking is paid once it returns,
+	// otherwise the result comes later to callbackPayment.
+	Capture(b *bookModel) (settled bool, err error)
+	Release(b *bookModel) error
+	Refund(b *bookModel) error
+}
+
+// payments is the paymentProvider chosen by PAYMENT_PROVIDER.
+var payments paymentProvider = accountPayments{}
+
+// accountPayments pays from the user's balance in the account service.
+type accountPayments struct{}
+
+func (accountPayments) Hold(b *bookModel) error {
+	return services.Hold(b.ID, b.UserID, b.Price)
+}
+
+func (accountPayments) Capture(b *bookModel) (bool, error) {
+	return false, services.Capture(b.ID, b.UserID, b.Price)
+}
+
+func (accountPayments) Release(b *bookModel) error {
+	if err := services.ReleaseHold(b.ID, b.UserID, b.Price); !errors.Is(err, client.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (accountPayments) Refund(b *bookModel) error {
+	if err := services.Refund(b.ID, b.UserID, b.Price); !errors.Is(err, client.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// gatewayPayments pays through an external payment gateway. The booking id
+// is the payment reference, so retried steps hit the same payment.
+type gatewayPayments struct {
+	gw *client.Gateway
+}
+
+func paymentRef(b *bookModel) string {
+	return "book-" + strconv.Itoa(b.ID)
+}
+
+func (p gatewayPayments) Hold(b *bookModel) error {
+	return p.gw.Authorize(paymentRef(b), b.Price)
+}
+
+func (p gatewayPayments) Capture(b *bookModel) (bool, error) {
+	if err := p.gw.Capture(paymentRef(b)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (p gatewayPayments) Release(b *bookModel) error {
+	if err := p.gw.Void(paymentRef(b)); !errors.Is(err, client.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (p gatewayPayments) Refund(b *bookModel) error {
+	if err := p.gw.Refund(paymentRef(b), b.Price); !errors.Is(err, client.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// eventInfoModel is the part of the events service's event that book needs.
+type eventInfoModel = client.Event
+
+// bookDetailModel is a booking with its event. Event is null when the events
+// service could not be asked.
+type bookDetailModel struct {
+	bookModel
+	Event *eventInfoModel `json:"event"`
+}
+
+// quoteModel is what booking the event would cost right now.
+type quoteModel struct {
+	EventID   int  `json:"event_id"`
+	Price     int  `json:"price"`
+	Available bool `json:"available"`
+}
+
+// timelineEntryModel is a step of a booking's saga. Step is set for
+// compensations, Error for a failed step or the failure point that started
+// the compensation.
+type timelineEntryModel struct {
+	Status BookStatus `json:"status"`
+	Step   string     `json:"step,omitempty"`
+	Error  string     `json:"error,omitempty"`
+	At     time.Time  `json:"at"`
+}
+
+// eventCacheKey identifies a cached event lookup. events prices the event
+// for the user and the role, so a lookup is only shared by the same caller.
+type eventCacheKey struct {
+	eid  int
+	uid  int
+	role string
+}
+
+// cachedEvent is an event lookup kept for eventCacheTTL.
+type cachedEvent struct {
+	event   *eventInfoModel
+	expires time.Time
+}
+
+// validationModel is the verdict of validate. Reasons is empty when OK.
+type validationModel struct {
+	OK      bool     `json:"ok"`
+	Reasons []string `json:"reasons"`
 }
 
-type callbackOccupyModel struct {
-	BookID int  `json:"book_id"`
-	UserID int  `json:"user_id"`
-	Price  int  `json:"price"`
-	Status bool `json:"status"`
+type bookIDsModel struct {
+	IDs []int `json:"ids"`
 }
 
-type callbackPaymentModel struct {
-	BookID int  `json:"book_id"`
-	Status bool `json:"status"`
+// pageModel is the list returned instead of a bare array when the client asks
+// for the total count with count=true.
+type pageModel struct {
+	Items interface{} `json:"items"`
+	Total int         `json:"total"`
 }
 
 type configModel struct {
-	dbHost string
-	dbPort string
-	dbName string
-	dbUser string
-	dbPass string
-	host   string
-	port   string
+	web.ServerConfig
+	dbHost           string
+	dbPort           string
+	dbName           string
+	dbUser           string
+	dbPass           string
+	eventsURL        string
+	accountURL       string
+	janitorInterval  string
+	janitorRetention string
+	slowQuery        string
+	bookTimeout      string
+	ordersURL        string
+	origins          string
+	paymentProvider  string
+	gatewayURL       string
+	gatewayKey       string
+	gatewayTimeout   string
+	currency         string
+	notifURL         string
+	routePrefix      string
+	maintenance      string
+	numericStatus    string
+	dbWait           string
 }
 
+// BookStatus is the step of the saga a booking is at. In JSON it is the
+// status name unless STATUS_NUMERIC is set, then it is the number as it is
+// stored in the table. Both forms are accepted on input.
+type BookStatus int
+
 const (
-	statusCreated = iota
+	statusCreated BookStatus = iota
 	statusNeedToOccupy
 	statusOccupied
 	statusNeedToPay
-	StatusPaid
-	StatusNeetToNotify
+	statusPaid
+	statusNeedToNotify
 	statusCompleted
-	statusCancelled = -1
+	statusCancelled BookStatus = -1
+	// statusNeedToReleaseSlot is a failed booking whose compensations have
+	// not all run yet. It becomes statusCancelled once they have.
+	statusNeedToReleaseSlot BookStatus = -2
+	// statusCompensationFailed is a failed booking whose compensation kept
+	// failing compensationMaxAttempts times. It is left for manual handling.
+	statusCompensationFailed BookStatus = -3
+)
+
+var statusNames = map[BookStatus]string{
+	statusCreated:            "created",
+	statusNeedToOccupy:       "need_to_occupy",
+	statusOccupied:           "occupied",
+	statusNeedToPay:          "need_to_pay",
+	statusPaid:               "paid",
+	statusNeedToNotify:       "need_to_notify",
+	statusCompleted:          "completed",
+	statusCancelled:          "cancelled",
+	statusNeedToReleaseSlot:  "need_to_release_slot",
+	statusCompensationFailed: "compensation_failed",
+}
+
+// numericStatus makes BookStatus marshal to its number, for clients written
+// before statuses had names.
+var numericStatus bool
+
+func (s BookStatus) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return strconv.Itoa(int(s))
+}
+
+func (s BookStatus) MarshalJSON() ([]byte, error) {
+	if numericStatus {
+		return []byte(strconv.Itoa(int(s))), nil
+	}
+	return json.Marshal(s.String())
+}
+
+func (s *BookStatus) UnmarshalJSON(data []byte) error {
+	var n int
+	if err := json.Unmarshal(data, &n); err == nil {
+		*s = BookStatus(n)
+		return nil
+	}
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+	status, err := parseBookStatus(name)
+	if err != nil {
+		return err
+	}
+	*s = status
+	return nil
+}
+
+// parseBookStatus reads a status given by its name or its number.
+func parseBookStatus(v string) (BookStatus, error) {
+	if n, err := strconv.Atoi(v); err == nil {
+		return BookStatus(n), nil
+	}
+	for status, known := range statusNames {
+		if known == v {
+			return status, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown book status %q", v)
+}
+
+// Failure points of the saga, each has its own list of compensations.
+const (
+	failOccupy     = "occupy"
+	failRecordSlot = "record_slot"
+	failHold       = "hold"
+	failPayment    = "payment"
+	failExpired    = "expired"
+	// failSlotExpired is a booking whose slot events freed because it was
+	// not committed in time, there is no slot to cancel anymore.
+	failSlotExpired = "slot_expired"
+)
+
+// reasonSlotExpired is the reason events gives when it frees a slot that was
+// not committed in time.
+const reasonSlotExpired = "slot_expired"
+
+// channelEmail asks notif to email a notification rather than keep it
+// in-app only.
+const channelEmail = "email"
+
+// compensation is a step undoing a part of a failed booking.
+type compensation struct {
+	name string
+	run  func(b *bookModel) error
+}
+
+var (
+	compensateSlot   = compensation{"cancel_slot", cancelSlot}
+	compensateHold   = compensation{"release_hold", releaseHold}
+	compensateStatus = compensation{"cancel_book", func(b *bookModel) error { return cancelBook(b.ID) }}
+
+	// compensations lists what to undo at each failure point, in the order
+	// it's done. cancel_book goes last: the booking is cancelled only once
+	// everything else is given back.
+	compensations = map[string][]compensation{
+		failOccupy:      {compensateStatus},
+		failRecordSlot:  {compensateSlot, compensateStatus},
+		failHold:        {compensateSlot, compensateStatus},
+		failPayment:     {compensateSlot, compensateHold, compensateStatus},
+		failExpired:     {compensateSlot, compensateHold, compensateStatus},
+		failSlotExpired: {compensateHold, compensateStatus},
+	}
+)
+
+const (
+	cleanupTpl       = `UPDATE book SET deleted_at=now(), updated_at=now() WHERE id IN (SELECT id FROM book WHERE status=$1 AND updated_at < now() - make_interval(secs => $2) AND deleted_at IS NULL ORDER BY id LIMIT $3)`
+	cleanupBatchSize = 500
+)
+
+const (
+	reserveIdempotencyKeyTpl = `INSERT INTO idempotency_key (user_id, key, request_hash) VALUES ($1, $2, $3) ON CONFLICT (user_id, key) DO UPDATE SET request_hash=excluded.request_hash, status=0, body='', created_at=now() WHERE idempotency_key.created_at < now() - make_interval(secs => $4) RETURNING user_id`
+	getIdempotencyKeyTpl     = `SELECT request_hash, status, body FROM idempotency_key WHERE user_id=$1 AND key=$2`
+	saveIdempotencyKeyTpl    = `UPDATE idempotency_key SET status=$3, body=$4 WHERE user_id=$1 AND key=$2`
+	deleteIdempotencyKeyTpl  = `DELETE FROM idempotency_key WHERE user_id=$1 AND key=$2`
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotencyKeyTTL        = 24 * time.Hour
+)
+
+const (
+	createBookTpl   = `INSERT INTO book (user_id, event_id, price, status, expires_at, quantity) VALUES ($1, $2, 0, $3, $4, $5) returning id`
+	updateStatusTpl = `UPDATE book SET status=$2, version=version+1, updated_at=now() WHERE id=$1 AND version=$3 AND deleted_at IS NULL`
+	occupyBookTpl   = `UPDATE book SET status=$2, price=$3, version=version+1, updated_at=now() WHERE id=$1 AND status=$4 AND deleted_at IS NULL`
+	getStatusTpl    = `SELECT status, version FROM book WHERE id=$1 AND deleted_at IS NULL`
+	getBookTpl      = `SELECT id, user_id, event_id, price, status, quantity, coalesce(order_id, 0) FROM book WHERE id=$1 AND deleted_at IS NULL`
+	getBooksTpl     = `SELECT id, user_id, event_id, price, status, quantity, coalesce(order_id, 0) FROM book WHERE deleted_at IS NULL AND user_id=$1`
+	getStatusesTpl  = `SELECT id, status FROM book WHERE id = ANY($1) AND user_id=$2 AND deleted_at IS NULL`
+	maxStatusIDs    = 1000
+	maxUpdateTries  = 5
+	eventCacheTTL   = 30 * time.Second
+	releaseInterval = 10 * time.Second
+	releaseBatch    = 100
+	getByStatusTpl  = `SELECT id, user_id, event_id, price, status, quantity, coalesce(order_id, 0) FROM book WHERE status=$1 AND deleted_at IS NULL ORDER BY id LIMIT $2`
+	getExpiredTpl   = `SELECT id, user_id, event_id, price, status, quantity, coalesce(order_id, 0) FROM book WHERE status = ANY($1) AND expires_at < $3 AND deleted_at IS NULL ORDER BY id LIMIT $2`
+	expireInterval  = 30 * time.Second
+)
+
+const countBooksTpl = `SELECT COUNT(1) FROM book WHERE deleted_at IS NULL AND user_id=$1`
+
+// The admin list of all users' bookings, $1 is the status to filter by or
+// NULL for all.
+const (
+	adminBooksTpl      = `SELECT id, user_id, event_id, price, status, quantity, coalesce(order_id, 0) FROM book WHERE deleted_at IS NULL AND ($1::integer IS NULL OR status = $1) ORDER BY id LIMIT $2 OFFSET $3`
+	countAdminBooksTpl = `SELECT COUNT(1) FROM book WHERE deleted_at IS NULL AND ($1::integer IS NULL OR status = $1)`
+	defaultAdminLimit  = 20
+	maxAdminLimit      = 100
+)
+
+// A user may hold one active booking of an event unless the event allows
+// multiple. Cancelled, failed and completed bookings don't count. The
+// advisory lock keyed by the user and the event makes concurrent creates of
+// the same booking wait for each other.
+const (
+	lockUserEventTpl = `SELECT pg_advisory_xact_lock($1, $2)`
+	activeBooksTpl   = `SELECT COUNT(1) FROM book WHERE user_id=$1 AND event_id=$2 AND status >= 0 AND status <> $3 AND deleted_at IS NULL`
+)
+
+const (
+	startCompensationTpl    = `UPDATE book SET status=$2, failure=$3, version=version+1, updated_at=now() WHERE id=$1 AND status = ANY($4) AND deleted_at IS NULL`
+	getFailureTpl           = `SELECT failure FROM book WHERE id=$1`
+	sagaLogTpl              = `INSERT INTO book_saga_log (book_id, status, step, error) VALUES ($1, $2, $3, $4)`
+	compensationLogTpl      = `SELECT step, count(*) FILTER (WHERE error = ''), count(*) FILTER (WHERE error <> '') FROM book_saga_log WHERE book_id=$1 AND step <> '' GROUP BY step`
+	compensationMaxAttempts = 20
+	getTimelineTpl          = `SELECT status, step, error, created_at FROM book_saga_log WHERE book_id=$1 ORDER BY id`
+	roleAdmin               = "admin"
+)
+
+const (
+	setOrderTpl      = `UPDATE book SET order_id=$2, updated_at=now() WHERE id=$1`
+	getUnfinishedTpl = `SELECT id, user_id, event_id, price, status, quantity, coalesce(order_id, 0) FROM book b WHERE status=$1 AND deleted_at IS NULL AND (SELECT count(*) FROM book_saga_log l WHERE l.book_id=b.id AND l.step = ANY($2) AND l.error <> '') < $3 ORDER BY id LIMIT $4`
+	completeBookTpl  = `UPDATE book SET status=$2, version=version+1, updated_at=now() WHERE id=$1 AND status=$3 AND deleted_at IS NULL`
+	stepCreateOrder  = "create_order"
+	stepCommitSlot   = "commit_slot"
 )
 
 const (
-	createBookTpl       = `INSERT INTO book (user_id, event_id, price, status) VALUES ($1, $2, 0,0) returning id`
-	updateStatusTpl     = `UPDATE book SET status=$2 WHERE id=$1`
-	setPriceTpl         = `UPDATE book SET price=$2 WHERE id=$1`
-	getBookTpl          = `SELECT id, user_id, event_id, price, status FROM book WHERE id=$1`
-	getBooksTpl         = `SELECT id, user_id, event_id, price, status FROM book`
-	occupySlotEndpoint  = "http://events.saga.svc.cluster.local:9000/events/occupy"
-	cancelSlotEndpoint  = "http://events.saga.svc.cluster.local:9000/events/cancel"
-	paymentSlotEndpoint = "http://account.saga.svc.cluster.local:9000/account/withdrawal"
-	occupySlotTpl       = `{"book_id":%d,"event_id":%d}`
-	payTpl              = `{"book_id":%d,"withdrawal_sum":%d}`
+	getUnrefundedTpl = `SELECT id, user_id, event_id, price, status, quantity, coalesce(order_id, 0) FROM book b WHERE deleted_at IS NULL AND EXISTS (SELECT 1 FROM book_saga_log l WHERE l.book_id=b.id AND l.step=$1) AND NOT EXISTS (SELECT 1 FROM book_saga_log l WHERE l.book_id=b.id AND l.step=$1 AND l.error = '') AND (SELECT count(*) FROM book_saga_log l WHERE l.book_id=b.id AND l.step=$1) < $2 ORDER BY id LIMIT $3`
+	stepRefund       = "refund"
 )
 
 var (
-	createBookStmt   *sql.Stmt
-	updateStatusStmt *sql.Stmt
-	setPriceStmt     *sql.Stmt
-	getStatusStmt    *sql.Stmt
-	getBookStmt      *sql.Stmt
-	getBooksStmt     *sql.Stmt
+	createBookStmt            *sql.Stmt
+	updateStatusStmt          *sql.Stmt
+	occupyBookStmt            *sql.Stmt
+	getStatusStmt             *sql.Stmt
+	getBookStmt               *sql.Stmt
+	getBooksStmt              *sql.Stmt
+	getStatusesStmt           *sql.Stmt
+	countBooksStmt            *sql.Stmt
+	lockUserEventStmt         *sql.Stmt
+	activeBooksStmt           *sql.Stmt
+	adminBooksStmt            *sql.Stmt
+	countAdminBooksStmt       *sql.Stmt
+	getByStatusStmt           *sql.Stmt
+	getExpiredStmt            *sql.Stmt
+	startCompensationStmt     *sql.Stmt
+	getFailureStmt            *sql.Stmt
+	sagaLogStmt               *sql.Stmt
+	compensationLogStmt       *sql.Stmt
+	getTimelineStmt           *sql.Stmt
+	setOrderStmt              *sql.Stmt
+	getUnfinishedStmt         *sql.Stmt
+	completeBookStmt          *sql.Stmt
+	getUnrefundedStmt         *sql.Stmt
+	reserveIdempotencyKeyStmt *sql.Stmt
+	getIdempotencyKeyStmt     *sql.Stmt
+	saveIdempotencyKeyStmt    *sql.Stmt
+	deleteIdempotencyKeyStmt  *sql.Stmt
+	cleanupStmt               *sql.Stmt
+	dbConn                    = &database.Conn{Prepare: mustPrepareStmts}
+
+	errBookNotOccupiable = errors.New("book is not waiting for a slot")
+	errBookCancelled     = errors.New("book is cancelled")
+	errBookConflict      = errors.New("book is being modified concurrently")
+	errNotCompensable    = errors.New("book has nothing to compensate")
+	errEventNotFound     = errors.New("event not found")
+	errDuplicateBooking  = errors.New("user already has an active booking of the event")
+
+	eventCache   = map[eventCacheKey]cachedEvent{}
+	eventCacheMu sync.Mutex
+	// slowQueryThreshold is the duration after which a query is logged as
+	// slow, 0 turns the logging off
+	slowQueryThreshold time.Duration
+	// bookTimeout is how long a booking may stay unfinished before
+	// expireBooks cancels it
+	bookTimeout time.Duration
 )
 
+// setServiceURLs points services at the base urls of the other services
+// from cfg.
+func setServiceURLs(cfg *configModel) {
+	services.EventsURL, services.AccountURL, services.OrdersURL = cfg.eventsURL, cfg.accountURL, cfg.ordersURL
+	services.NotifURL = cfg.notifURL
+}
+
 func readConf() *configModel {
 	cfg := &configModel{
-		dbHost: "",
-		dbPort: "5432",
-		dbName: "",
-		dbUser: "",
-		dbPass: "",
-		host:   "0.0.0.0",
-		port:   "80",
-	}
-	dbHost := os.Getenv("DBHOST")
-	dbPort := os.Getenv("DBPORT")
-	dbName := os.Getenv("DBNAME")
-	dbUser := os.Getenv("DBUSER")
-	dbPass := os.Getenv("DBPASS")
-	host := os.Getenv("HOST")
-	port := os.Getenv("PORT")
+		dbHost:           "",
+		dbPort:           "5432",
+		dbName:           "",
+		dbUser:           "",
+		dbPass:           "",
+		ServerConfig:     web.DefaultServerConfig(),
+		eventsURL:        "http://events.saga.svc.cluster.local:9000",
+		accountURL:       "http://account.saga.svc.cluster.local:9000",
+		janitorRetention: "720h",
+		slowQuery:        "200ms",
+		bookTimeout:      "15m",
+		ordersURL:        "http://orders.saga.svc.cluster.local:9000",
+		paymentProvider:  "account",
+		gatewayTimeout:   "10s",
+		currency:         "usd",
+		notifURL:         "http://notif.saga.svc.cluster.local:9000",
+		numericStatus:    "false",
+		dbWait:           "60s",
+	}
+	dbHost := config.Getenv("DBHOST")
+	dbPort := config.Getenv("DBPORT")
+	dbName := config.Getenv("DBNAME")
+	dbUser := config.Getenv("DBUSER")
+	dbPass := config.Getenv("DBPASS")
+	host := config.Getenv("HOST")
+	port := config.Getenv("PORT")
+	eventsURL := config.Getenv("EVENTS_URL")
+	accountURL := config.Getenv("ACCOUNT_URL")
+	tlsCertFile := config.Getenv("TLS_CERT_FILE")
+	tlsKeyFile := config.Getenv("TLS_KEY_FILE")
+	janitorInterval := config.Getenv("JANITOR_INTERVAL")
+	janitorRetention := config.Getenv("JANITOR_RETENTION")
+	slowQuery := config.Getenv("SLOW_QUERY_THRESHOLD")
+	bookTimeout := config.Getenv("BOOK_TIMEOUT")
+	readTimeout := config.Getenv("READ_TIMEOUT")
+	writeTimeout := config.Getenv("WRITE_TIMEOUT")
+	idleTimeout := config.Getenv("IDLE_TIMEOUT")
+	ordersURL := config.Getenv("ORDERS_URL")
+	origins := config.Getenv("ALLOWED_ORIGINS")
+	paymentProvider := config.Getenv("PAYMENT_PROVIDER")
+	gatewayURL := config.Getenv("PAYMENT_GATEWAY_URL")
+	gatewayKey := config.Getenv("PAYMENT_GATEWAY_KEY")
+	gatewayTimeout := config.Getenv("PAYMENT_GATEWAY_TIMEOUT")
+	currency := config.Getenv("PAYMENT_CURRENCY")
+	notifURL := config.Getenv("NOTIF_URL")
+	routePrefix := config.Getenv("ROUTE_PREFIX")
+	maintenance := config.Getenv("MAINTENANCE")
+	numericStatus := config.Getenv("STATUS_NUMERIC")
+	dbWait := config.Getenv("DB_WAIT_TIMEOUT")
 
 	if dbHost != "" {
 		cfg.dbHost = dbHost
@@ -113,10 +555,79 @@ func readConf() *configModel {
 		cfg.dbPass = dbPass
 	}
 	if host != "" {
-		cfg.host = host
+		cfg.Host = host
 	}
 	if port != "" {
-		cfg.port = port
+		cfg.Port = port
+	}
+	if eventsURL != "" {
+		cfg.eventsURL = eventsURL
+	}
+	if accountURL != "" {
+		cfg.accountURL = accountURL
+	}
+	if tlsCertFile != "" {
+		cfg.TLSCertFile = tlsCertFile
+	}
+	if tlsKeyFile != "" {
+		cfg.TLSKeyFile = tlsKeyFile
+	}
+	if janitorInterval != "" {
+		cfg.janitorInterval = janitorInterval
+	}
+	if janitorRetention != "" {
+		cfg.janitorRetention = janitorRetention
+	}
+	if slowQuery != "" {
+		cfg.slowQuery = slowQuery
+	}
+	if bookTimeout != "" {
+		cfg.bookTimeout = bookTimeout
+	}
+	if readTimeout != "" {
+		cfg.ReadTimeout = readTimeout
+	}
+	if writeTimeout != "" {
+		cfg.WriteTimeout = writeTimeout
+	}
+	if idleTimeout != "" {
+		cfg.IdleTimeout = idleTimeout
+	}
+	if ordersURL != "" {
+		cfg.ordersURL = ordersURL
+	}
+	if origins != "" {
+		cfg.origins = origins
+	}
+	if paymentProvider != "" {
+		cfg.paymentProvider = paymentProvider
+	}
+	if gatewayURL != "" {
+		cfg.gatewayURL = gatewayURL
+	}
+	if gatewayKey != "" {
+		cfg.gatewayKey = gatewayKey
+	}
+	if gatewayTimeout != "" {
+		cfg.gatewayTimeout = gatewayTimeout
+	}
+	if currency != "" {
+		cfg.currency = currency
+	}
+	if notifURL != "" {
+		cfg.notifURL = notifURL
+	}
+	if routePrefix != "" {
+		cfg.routePrefix = routePrefix
+	}
+	if maintenance != "" {
+		cfg.maintenance = maintenance
+	}
+	if numericStatus != "" {
+		cfg.numericStatus = numericStatus
+	}
+	if dbWait != "" {
+		cfg.dbWait = dbWait
 	}
 	return cfg
 }
@@ -126,11 +637,29 @@ func makeDBConn(cfg *configModel) (*sql.DB, error) {
 		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		cfg.dbHost, cfg.dbPort, cfg.dbUser, cfg.dbPass, cfg.dbName,
 	)
-	log.Println("connection string: ", pgConnString)
+	log.Printf("Connecting to database host=%s port=%s dbname=%s\n", cfg.dbHost, cfg.dbPort, cfg.dbName)
 	db, err := sql.Open("postgres", pgConnString)
 	return db, err
 }
 
+// timed runs the query f and logs it under name when it takes longer than
+// slowQueryThreshold.
+func timed(name string, f func() error) error {
+	start := time.Now()
+	err := f()
+	if d := time.Since(start); slowQueryThreshold > 0 && d > slowQueryThreshold {
+		log.Printf("Slow query [%s] took %s\n", name, d)
+	}
+	return err
+}
+
+// maintenanceMode turns every request but health, version and the switch
+// itself away with 503. It starts from MAINTENANCE and is switched at runtime
+// by admins via maintenancePath.
+var maintenanceMode = &web.Maintenance{Health: []string{"/health"}}
+
+const maintenancePath = "/book/maintenance"
+
 func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -143,22 +672,160 @@ func main() {
 	}
 	defer db.Close()
 
-	if err = db.PingContext(ctx); err != nil {
+	dbWait, err := time.ParseDuration(cfg.dbWait)
+	if err != nil {
+		log.Fatal("Failed to parse DB_WAIT_TIMEOUT:", err)
+	}
+	if err = database.Wait(ctx, db, dbWait); err != nil {
 		log.Fatal("Failed to check db connection:", err)
 	}
 
 	mustPrepareStmts(ctx, db)
+	dbConn.Open = func() (*sql.DB, error) { return makeDBConn(cfg) }
+	dbConn.Set(db)
+	setServiceURLs(cfg)
+	if cfg.slowQuery != "" {
+		if slowQueryThreshold, err = time.ParseDuration(cfg.slowQuery); err != nil {
+			log.Fatal("Failed to parse SLOW_QUERY_THRESHOLD:", err)
+		}
+	}
+
+	if bookTimeout, err = time.ParseDuration(cfg.bookTimeout); err != nil {
+		log.Fatal("Failed to parse BOOK_TIMEOUT:", err)
+	}
+	if numericStatus, err = strconv.ParseBool(cfg.numericStatus); err != nil {
+		log.Fatal("Failed to parse STATUS_NUMERIC:", err)
+	}
+
+	switch cfg.paymentProvider {
+	case "account":
+	case "gateway":
+		if cfg.gatewayURL == "" {
+			log.Fatal("PAYMENT_GATEWAY_URL is required by the gateway payment provider")
+		}
+		timeout, err := time.ParseDuration(cfg.gatewayTimeout)
+		if err != nil {
+			log.Fatal("Failed to parse PAYMENT_GATEWAY_TIMEOUT:", err)
+		}
+		payments = gatewayPayments{client.NewGateway(cfg.gatewayURL, cfg.gatewayKey, cfg.currency, timeout)}
+	default:
+		log.Fatalf("Unknown PAYMENT_PROVIDER [%s], use account or gateway", cfg.paymentProvider)
+	}
+
+	go releaseSlots(ctx)
+	go completeBooks(ctx)
+	go refundBooks(ctx)
+	go expireBooks(ctx)
+
+	if cfg.janitorInterval != "" {
+		interval, err := time.ParseDuration(cfg.janitorInterval)
+		if err != nil {
+			log.Fatal("Failed to parse JANITOR_INTERVAL:", err)
+		}
+		retention, err := time.ParseDuration(cfg.janitorRetention)
+		if err != nil {
+			log.Fatal("Failed to parse JANITOR_RETENTION:", err)
+		}
+		go runJanitor(ctx, interval, retention)
+	}
+
+	if cfg.maintenance != "" {
+		on, err := strconv.ParseBool(cfg.maintenance)
+		if err != nil {
+			log.Fatal("Failed to parse MAINTENANCE:", err)
+		}
+		maintenanceMode.Set(on)
+	}
+
+	prefix := strings.TrimSuffix(cfg.routePrefix, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		log.Fatalf("ROUTE_PREFIX [%s] must start with /", cfg.routePrefix)
+	}
+	r := newRouter(prefix)
+
+	h := maintenanceMode.Middleware(prefix+maintenancePath, r)
+	h = web.RecoverPanics(web.CORS(web.ParseOrigins(cfg.origins), h))
+	if err := web.Serve(cfg.ServerConfig, h); err != nil {
+		log.Printf("Failed to bind on [%s:%s]: %s", cfg.Host, cfg.Port, err)
+	}
+}
 
+// newRouter registers the routes, the api ones under prefix if it isn't
+// empty.
+func newRouter(prefix string) *mux.Router {
 	r := mux.NewRouter()
 
-	r.HandleFunc("/book/get", reqlog(isAuthenticatedMiddleware(get))).Methods("GET")
-	r.HandleFunc("/book/create", reqlog(isAuthenticatedMiddleware(create))).Methods("POST")
-	r.HandleFunc("/book/callback/events", reqlog(isAuthenticatedMiddleware(callbackEvents))).Methods("POST")
-	r.HandleFunc("/book/callback/account", reqlog(isAuthenticatedMiddleware(callbackPayment))).Methods("POST")
+	r.HandleFunc("/health", health)
+	r.HandleFunc("/version", web.VersionInfo).Methods("GET")
+	api := r
+	if prefix != "" {
+		api = r.PathPrefix(prefix).Subrouter()
+	}
+	api.HandleFunc("/book/get", reqlog(web.Authenticated(get))).Methods("GET")
+	api.HandleFunc("/book/create", reqlog(web.Authenticated(idempotent(create)))).Methods("POST")
+	api.HandleFunc("/book/{id}/detail", reqlog(web.Authenticated(detail))).Methods("GET")
+	api.HandleFunc("/book/{id}/timeline", reqlog(web.Authenticated(timeline))).Methods("GET")
+	api.HandleFunc("/book/quote", reqlog(web.Authenticated(quote))).Methods("GET")
+	api.HandleFunc("/book/validate", reqlog(web.Authenticated(validate))).Methods("POST")
+	api.HandleFunc("/book/statuses", reqlog(web.Authenticated(statuses))).Methods("POST")
+	api.HandleFunc("/book/admin/list", reqlog(web.Authenticated(web.RequireRole(roleAdmin, adminList)))).Methods("GET")
+	api.HandleFunc("/book/callback/events", reqlog(web.Authenticated(callbackEvents))).Methods("POST")
+	api.HandleFunc("/book/callback/account", reqlog(web.Authenticated(callbackPayment))).Methods("POST")
+	api.HandleFunc(maintenancePath, reqlog(web.Authenticated(web.RequireRole(roleAdmin, maintenanceMode.Switch)))).Methods("GET", "PUT")
+	r.MethodNotAllowedHandler = web.MethodNotAllowed(r)
+	r.NotFoundHandler = http.HandlerFunc(web.NotFound)
+	return r
+}
+
+func health(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status": "OK"}`))
+}
+
+// runJanitor soft-deletes cancelled bookings older than retention every
+// interval. It is started only when JANITOR_INTERVAL is set.
+func runJanitor(ctx context.Context, interval, retention time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		n, err := cleanup(retention)
+		if err != nil {
+			log.Printf("Failed to clean up cancelled bookings: %s\n", err)
+		}
+		if n > 0 {
+			log.Printf("Cleaned up [%d] cancelled bookings\n", n)
+		}
+	}
+}
 
-	bindOn := fmt.Sprintf("%s:%s", cfg.host, cfg.port)
-	if err := http.ListenAndServe(bindOn, r); err != nil {
-		log.Printf("Failed to bind on [%s]: %s", bindOn, err)
+// cleanup soft-deletes bookings cancelled more than retention ago in batches
+// of cleanupBatchSize, every batch is a separate statement so locks are held
+// only briefly. The rows stay in the table with their saga log, as every
+// deleted booking does.
+func cleanup(retention time.Duration) (int64, error) {
+	var total int64
+	for {
+		var n int64
+		err := dbConn.Retry(func() error {
+			res, err := cleanupStmt.Exec(statusCancelled, retention.Seconds(), cleanupBatchSize)
+			if err != nil {
+				return err
+			}
+			n, err = res.RowsAffected()
+			return err
+		})
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n < cleanupBatchSize {
+			return total, nil
+		}
 	}
 }
 
@@ -170,12 +837,32 @@ func mustPrepareStmts(ctx context.Context, db *sql.DB) {
 		panic(err)
 	}
 
+	setOrderStmt, err = db.PrepareContext(ctx, setOrderTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	getUnfinishedStmt, err = db.PrepareContext(ctx, getUnfinishedTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	completeBookStmt, err = db.PrepareContext(ctx, completeBookTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	getUnrefundedStmt, err = db.PrepareContext(ctx, getUnrefundedTpl)
+	if err != nil {
+		panic(err)
+	}
+
 	updateStatusStmt, err = db.PrepareContext(ctx, updateStatusTpl)
 	if err != nil {
 		panic(err)
 	}
 
-	setPriceStmt, err = db.PrepareContext(ctx, setPriceTpl)
+	occupyBookStmt, err = db.PrepareContext(ctx, occupyBookTpl)
 	if err != nil {
 		panic(err)
 	}
@@ -189,85 +876,333 @@ func mustPrepareStmts(ctx context.Context, db *sql.DB) {
 		panic(err)
 	}
 
-}
+	countBooksStmt, err = db.PrepareContext(ctx, countBooksTpl)
+	if err != nil {
+		panic(err)
+	}
 
-func book(userID int, b *bookModel) (int, error) {
-	id := new(int)
-	err := createBookStmt.QueryRow(userID, b.EventID).Scan(id)
-	return *id, err
-}
+	lockUserEventStmt, err = db.PrepareContext(ctx, lockUserEventTpl)
+	if err != nil {
+		panic(err)
+	}
 
-func getBook(bid int) (*bookModel, error) {
-	b := bookModel{}
-	err := getBookStmt.QueryRow(bid).Scan(&b.ID, &b.UserID, &b.EventID, &b.Price, &b.Status)
-	return &b, err
-}
+	activeBooksStmt, err = db.PrepareContext(ctx, activeBooksTpl)
+	if err != nil {
+		panic(err)
+	}
 
-func cancelBook(bid int) error {
-	_, err := updateStatusStmt.Exec(bid, statusCancelled)
-	return err
-}
+	adminBooksStmt, err = db.PrepareContext(ctx, adminBooksTpl)
+	if err != nil {
+		panic(err)
+	}
 
-func modifyBookStatus(bid, status int) error {
-	_, err := updateStatusStmt.Exec(bid, status)
-	return err
-}
+	countAdminBooksStmt, err = db.PrepareContext(ctx, countAdminBooksTpl)
+	if err != nil {
+		panic(err)
+	}
 
-func setBookPrice(bid, price int) error {
-	_, err := setPriceStmt.Exec(bid, price)
-	return err
-}
+	getStatusesStmt, err = db.PrepareContext(ctx, getStatusesTpl)
+	if err != nil {
+		panic(err)
+	}
 
-func actionBookStatus(bid int) error {
-	b, err := getBook(bid)
+	getByStatusStmt, err = db.PrepareContext(ctx, getByStatusTpl)
 	if err != nil {
-		log.Printf("Failed to get book [%d]: %s\n", bid, err)
-		return err
+		panic(err)
 	}
-	switch b.Status {
-	case statusCreated:
-		log.Println("Book is created, now we need to occupy the slot")
-		modifyBookStatus(bid, statusNeedToOccupy)
-		if err = actionBookStatus(bid); err != nil {
-			if err = cancelBook(b.ID); err != nil {
-				log.Printf("Failed to cancel book [%d]\n", b.ID)
+	getExpiredStmt, err = db.PrepareContext(ctx, getExpiredTpl)
+	if err != nil {
+		panic(err)
+	}
+	startCompensationStmt, err = db.PrepareContext(ctx, startCompensationTpl)
+	if err != nil {
+		panic(err)
+	}
+	getFailureStmt, err = db.PrepareContext(ctx, getFailureTpl)
+	if err != nil {
+		panic(err)
+	}
+	sagaLogStmt, err = db.PrepareContext(ctx, sagaLogTpl)
+	if err != nil {
+		panic(err)
+	}
+	compensationLogStmt, err = db.PrepareContext(ctx, compensationLogTpl)
+	if err != nil {
+		panic(err)
+	}
+	getTimelineStmt, err = db.PrepareContext(ctx, getTimelineTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	reserveIdempotencyKeyStmt, err = db.PrepareContext(ctx, reserveIdempotencyKeyTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	getIdempotencyKeyStmt, err = db.PrepareContext(ctx, getIdempotencyKeyTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	saveIdempotencyKeyStmt, err = db.PrepareContext(ctx, saveIdempotencyKeyTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	deleteIdempotencyKeyStmt, err = db.PrepareContext(ctx, deleteIdempotencyKeyTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	cleanupStmt, err = db.PrepareContext(ctx, cleanupTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	getStatusStmt, err = db.PrepareContext(ctx, getStatusTpl)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// book inserts the booking already in statusNeedToOccupy, so a stored
+// booking always has its next saga step recorded with it. Unless multiple is
+// set it fails with errDuplicateBooking if the user has an active booking of
+// the event already.
+func book(userID int, b *bookModel, multiple bool) (int, error) {
+	id := new(int)
+	err := dbConn.Retry(func() error {
+		if multiple {
+			return createBookStmt.QueryRow(userID, b.EventID, statusNeedToOccupy, clk.Now().Add(bookTimeout), b.Quantity).Scan(id)
+		}
+		tx, err := dbConn.DB().Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err = tx.Stmt(lockUserEventStmt).Exec(userID, b.EventID); err != nil {
+			return err
+		}
+		active := 0
+		if err = tx.Stmt(activeBooksStmt).QueryRow(userID, b.EventID, statusCompleted).Scan(&active); err != nil {
+			return err
+		}
+		if active > 0 {
+			return errDuplicateBooking
+		}
+		if err = tx.Stmt(createBookStmt).QueryRow(userID, b.EventID, statusNeedToOccupy, clk.Now().Add(bookTimeout), b.Quantity).Scan(id); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err == nil {
+		logSaga(*id, statusNeedToOccupy, "", "")
+	}
+	return *id, err
+}
+
+func getBook(bid int) (*bookModel, error) {
+	b := bookModel{}
+	err := dbConn.Retry(func() error {
+		return timed("getBook", func() error {
+			return getBookStmt.QueryRow(bid).Scan(&b.ID, &b.UserID, &b.EventID, &b.Price, &b.Status, &b.Quantity, &b.OrderID)
+		})
+	})
+	return &b, err
+}
+
+func cancelBook(bid int) error {
+	return modifyBookStatus(bid, statusCancelled)
+}
+
+// modifyBookStatus moves the booking to status with optimistic locking: the
+// update applies only if the version read before is still current, otherwise
+// the booking is read again and the update is retried. A cancelled booking is
+// final, so a late callback can't bring it back.
+func modifyBookStatus(bid int, status BookStatus) error {
+	for i := 0; i < maxUpdateTries; i++ {
+		current, version := BookStatus(0), 0
+		err := dbConn.Retry(func() error {
+			return getStatusStmt.QueryRow(bid).Scan(&current, &version)
+		})
+		if err != nil {
+			return err
+		}
+		if current == status {
+			return nil
+		}
+		if current == statusCancelled {
+			log.Printf("Book [%d] is cancelled, status [%s] is not set\n", bid, status)
+			return errBookCancelled
+		}
+		if current == statusCompensationFailed {
+			log.Printf("Book [%d] failed to compensate, status [%s] is not set\n", bid, status)
+			return errBookCancelled
+		}
+		if current == statusNeedToReleaseSlot && status != statusCancelled && status != statusCompensationFailed {
+			log.Printf("Book [%d] is being cancelled, status [%s] is not set\n", bid, status)
+			return errBookCancelled
+		}
+		var res sql.Result
+		err = dbConn.Retry(func() (err error) {
+			res, err = updateStatusStmt.Exec(bid, status, version)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 1 {
+			logSaga(bid, status, "", "")
+			return nil
+		}
+		log.Printf("Book [%d] was modified concurrently, retrying to set status [%s]\n", bid, status)
+	}
+	return errBookConflict
+}
+
+// occupyBook moves the booking from statusNeedToOccupy to statusOccupied and
+// stores the price the events service reported at occupy time in the same
+// update. This is the only place the price is written: once the booking has
+// left statusNeedToOccupy its price is locked, and payForBook charges exactly
+// this stored price, never the current price of the event.
+func occupyBook(bid, price int) error {
+	var res sql.Result
+	err := dbConn.Retry(func() (err error) {
+		res, err = occupyBookStmt.Exec(bid, statusOccupied, price, statusNeedToOccupy)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return errBookNotOccupiable
+	}
+	logSaga(bid, statusOccupied, "", "")
+	return nil
+}
+
+// getBooks returns the books of user uid.
+func getBooks(uid int) ([]bookModel, error) {
+	books := make([]bookModel, 0)
+	err := dbConn.Retry(func() error {
+		books = books[:0]
+		rows, err := getBooksStmt.Query(uid)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			b := bookModel{}
+			if err := rows.Scan(&b.ID, &b.UserID, &b.EventID, &b.Price, &b.Status, &b.Quantity, &b.OrderID); err != nil {
+				log.Println("Failed to scan current row:", err)
+			}
+			books = append(books, b)
+		}
+		return rows.Err()
+	})
+	return books, err
+}
+
+// describeEvents fills the event name and price of the books, asking events
+// for all distinct events of each user in batches, as the price events
+// answers depends on the user who booked. A batch that fails is logged and
+// its books are left as they are.
+func describeEvents(books []bookModel) {
+	uids := []int{}
+	eids := map[int][]int{}
+	seen := map[[2]int]bool{}
+	for _, b := range books {
+		if _, ok := eids[b.UserID]; !ok {
+			uids = append(uids, b.UserID)
+		}
+		if key := [2]int{b.UserID, b.EventID}; !seen[key] {
+			seen[key] = true
+			eids[b.UserID] = append(eids[b.UserID], b.EventID)
+		}
+	}
+	events := map[[2]int]client.Availability{}
+	for _, uid := range uids {
+		ids := eids[uid]
+		for start := 0; start < len(ids); start += client.MaxEventIDs {
+			end := start + client.MaxEventIDs
+			if end > len(ids) {
+				end = len(ids)
+			}
+			res, err := services.GetEvents(ids[start:end], uid)
+			if err != nil {
+				log.Printf("Failed to get [%d] events of user [%d] for the books list: %s\n", end-start, uid, err)
+				continue
 			}
-			log.Printf("Failed to perform action for book [%d] with status [%d]:%s\n", bid, statusNeedToOccupy, err)
+			for _, e := range res {
+				events[[2]int{uid, e.ID}] = e
+			}
+		}
+	}
+	for i := range books {
+		if e, ok := events[[2]int{books[i].UserID, books[i].EventID}]; ok {
+			books[i].EventName, books[i].EventPrice = e.Name, e.Price
+		}
+	}
+}
+
+// countBooks counts the books getBooks returns for user uid.
+func countBooks(uid int) (int, error) {
+	total := 0
+	err := dbConn.Retry(func() error {
+		return countBooksStmt.QueryRow(uid).Scan(&total)
+	})
+	return total, err
+}
+
+func actionBookStatus(bid int) error {
+	b, err := getBook(bid)
+	if err != nil {
+		log.Printf("Failed to get book [%d]: %s\n", bid, err)
+		return err
+	}
+	switch b.Status {
+	case statusCreated:
+		log.Println("Book is created, now we need to occupy the slot")
+		modifyBookStatus(bid, statusNeedToOccupy)
+		if err = actionBookStatus(bid); err != nil {
+			log.Printf("Failed to perform action for book [%d] with status [%s]:%s\n", bid, statusNeedToOccupy, err)
 		}
 	case statusCancelled:
 		log.Println("Book is canceled, do nothing")
 	case statusNeedToOccupy:
 		log.Printf("Book [%d] is created, now need to occupy slot\n", b.ID)
-		if err = occupySlot(b.ID, b.EventID, b.UserID); err != nil {
+		if err = occupySlot(b.ID, b.EventID, b.UserID, b.Quantity, ""); err != nil {
 			log.Printf("Failed to occupy slot for event [%d] for user [%d], need to cancel book. Error: %s\n", b.EventID, b.UserID, err)
-			if err = cancelBook(b.ID); err != nil {
-				log.Printf("Failed to cancel book [%d]\n", b.ID)
-			}
+			compensate(b, failOccupy)
 		}
 	case statusOccupied:
-		log.Println("Slot is occupied, now we need to pay for book")
+		log.Println("Slot is occupied, now we need to hold funds and pay for book")
+		if err = holdFunds(b); err != nil {
+			log.Printf("Failed to hold funds for book [%d], need to cancel book: %s\n", b.ID, err)
+			compensate(b, failHold)
+			return err
+		}
 		modifyBookStatus(bid, statusNeedToPay)
 		if err = actionBookStatus(bid); err != nil {
-			if err = cancelBook(b.ID); err != nil {
-				log.Printf("Failed to cancel book [%d]\n", b.ID)
-			}
-			log.Printf("Failed to perform action for book [%d] with status [%d]:%s\n", bid, statusNeedToOccupy, err)
+			log.Printf("Failed to perform action for book [%d] with status [%s]:%s\n", bid, statusNeedToPay, err)
 		}
 	case statusNeedToPay:
 		log.Println("Event's slot is occupied, so we need to pay for event")
-		if err = payForBook(b); err != nil { // i need to know price for event, so i have to get it from events service
-			log.Printf("Failed to pay the for event [%d] for user [%d], need to cancel book\n", b.EventID, b.UserID)
-			// also we have to cancel slot, but not now
-			if err = cancelBook(b.ID); err != nil {
-				log.Printf("Failed to cancel book [%d]: %s\n", b.ID, err)
-			}
-			if err = cancelSlot(b); err != nil {
-				log.Printf("Failed to cancel slot [%d]: %s\n", b.ID, err)
-			}
+		settled, err := payForBook(b) // b.Price was locked by occupyBook
+		if err != nil {
+			log.Printf("Failed to pay the for event [%d] for user [%d], need to cancel book: %s\n", b.EventID, b.UserID, err)
+			compensate(b, failPayment)
+			return err
+		}
+		if settled {
+			markPaid(b.ID)
+		}
+	case statusPaid:
+		log.Println("Event's slot is paid, now we need to commit the slot and record the order")
+		if err = completeBook(b); err != nil {
+			log.Printf("Failed to complete book [%d], will retry: %s\n", b.ID, err)
 		}
-	case StatusPaid:
-		log.Println("Event's slot is paid, so the book is complete")
-		// need to notify here
 	default:
 		log.Println("This should not be happen never")
 	}
@@ -275,193 +1210,1092 @@ func actionBookStatus(bid int) error {
 }
 
 func get(w http.ResponseWriter, r *http.Request) {
-	// uid, err := getUserID(r)
-	// if err != nil {
-	// 	log.Printf("Failed to get user id:", err)
-	// 	w.WriteHeader(http.StatusInternalServerError)
-	// 	return
-	// }
-	// id, user_id, event_id, price, status
-	rows, err := getBooksStmt.Query()
-	if err != nil {
-		log.Printf("Failed to get books list: %s\n", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	uid, ok := web.MustUserID(w, r)
+	if !ok {
 		return
 	}
-	id := new(int)
-	user_id := new(int)
-	event_id := new(int)
-	price := new(int)
-	status := new(int)
-	books := make([]bookModel, 0)
-	for rows.Next() {
-		err := rows.Scan(id, user_id, event_id, price, status)
+	count := false
+	if v := r.URL.Query().Get("count"); v != "" {
+		var err error
+		if count, err = strconv.ParseBool(v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "wrong value of [count]: %q", v)
+			return
+		}
+	}
+	books, err := getBooks(uid)
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to get books list of user [%d]: %w", uid, err))
+		return
+	}
+	describeEvents(books)
+	if !count {
+		data, _ := json.Marshal(books)
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+		return
+	}
+	total, err := countBooks(uid)
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to count books of user [%d]: %w", uid, err))
+		return
+	}
+	data, _ := json.Marshal(pageModel{Items: books, Total: total})
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// adminList returns the bookings of all users, oldest first, to spot sagas
+// that got stuck. status filters by a status name or number, limit and offset
+// page through the list and count=true adds the total as in get. Bookings
+// carry their event's name and price like in get. Available to admins only.
+func adminList(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var status sql.NullInt64
+	if v := q.Get("status"); v != "" {
+		s, err := parseBookStatus(v)
 		if err != nil {
-			log.Println("Failed to scan current row:", err)
-		}
-		books = append(books, bookModel{
-			ID:      *id,
-			UserID:  *user_id,
-			EventID: *event_id,
-			Price:   *price,
-			Status:  *status,
-		})
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		status = sql.NullInt64{Int64: int64(s), Valid: true}
+	}
+	var err error
+	limit, offset := defaultAdminLimit, 0
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxAdminLimit {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "limit must be between 1 and %d", maxAdminLimit)
+			return
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "wrong value of [offset]: %q", v)
+			return
+		}
 	}
-	data, _ := json.Marshal(books)
+	count := false
+	if v := q.Get("count"); v != "" {
+		if count, err = strconv.ParseBool(v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "wrong value of [count]: %q", v)
+			return
+		}
+	}
+	books, err := queryBooks(adminBooksStmt, status, limit, offset)
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to get books for admin list: %w", err))
+		return
+	}
+	describeEvents(books)
+	if !count {
+		data, _ := json.Marshal(books)
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+		return
+	}
+	total := 0
+	err = dbConn.Retry(func() error {
+		return countAdminBooksStmt.QueryRow(status).Scan(&total)
+	})
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to count books for admin list: %w", err))
+		return
+	}
+	data, _ := json.Marshal(pageModel{Items: books, Total: total})
 	w.WriteHeader(http.StatusOK)
 	w.Write(data)
 }
 
-func create(w http.ResponseWriter, r *http.Request) {
-	headers := r.Header
-	userID, err := strconv.Atoi(headers.Get("X-User-Id"))
+// getStatuses returns statuses of those of the given books that belong to
+// the user. Other ids are silently skipped.
+func getStatuses(uid int, ids []int) (map[int]BookStatus, error) {
+	st := map[int]BookStatus{}
+	err := dbConn.Retry(func() error {
+		rows, err := getStatusesStmt.Query(pq.Array(ids), uid)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			id, status := 0, BookStatus(0)
+			if err = rows.Scan(&id, &status); err != nil {
+				return err
+			}
+			st[id] = status
+		}
+		return rows.Err()
+	})
+	return st, err
+}
+
+func statuses(w http.ResponseWriter, r *http.Request) {
+	uid, ok := web.MustUserID(w, r)
+	if !ok {
+		return
+	}
+	var err error
+	req := bookIDsModel{}
+	if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse request body user id [%d]: %s\n", uid, err)
+		return
+	}
+	if len(req.IDs) > maxStatusIDs {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Too many ids, max is %d", maxStatusIDs)
+		return
+	}
+	st, err := getStatuses(uid, req.IDs)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Got wrong header [X-User-Id]: %s", err)
+		web.InternalError(w, r, fmt.Errorf("failed to get book statuses for user [%d]: %w", uid, err))
 		return
 	}
+	data, _ := json.Marshal(st)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func create(w http.ResponseWriter, r *http.Request) {
+	userID, ok := web.MustUserID(w, r)
+	if !ok {
+		return
+	}
+	var err error
 	b := bookModel{}
 	if err = json.NewDecoder(r.Body).Decode(&b); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("Failed to parse request body user id []: %s\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse request body user id [%d]: %s\n", userID, err)
+		return
+	}
+	if b.Quantity == 0 {
+		b.Quantity = 1
+	}
+	if b.Quantity < 0 || b.Quantity > maxQuantity {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "quantity must be from 1 to %d", maxQuantity)
+		return
+	}
+	role := r.Header.Get("X-User-Role")
+	multiple := false
+	if e, err := cachedFetchEvent(b.EventID, userID, role); err == nil {
+		multiple = e.AllowMultiple
+	} else if !errors.Is(err, errEventNotFound) {
+		log.Printf("Failed to get event [%d], allowing one booking of it: %s\n", b.EventID, err)
+	}
+	id, err := book(userID, &b, multiple)
+	if errors.Is(err, errDuplicateBooking) {
+		log.Printf("User [%d] already has an active booking of event [%d]\n", userID, b.EventID)
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error":"you already have an active booking of this event"}`))
 		return
 	}
-	id, err := book(userID, &b)
 	if err != nil {
-		log.Printf("Failed to book event [%d] for user [%d]: %s\n", b.EventID, userID, err)
-		w.WriteHeader(http.StatusInternalServerError)
+		web.InternalError(w, r, fmt.Errorf("failed to book event [%d] for user [%d]: %w", b.EventID, userID, err))
 		return
 	}
 	log.Printf("Successfully booked events [%d] for user [%d]\n", b.EventID, userID)
+	if err = occupySlot(id, b.EventID, userID, b.Quantity, role); err != nil {
+		log.Printf("Failed to occupy slot for event [%d] for user [%d], need to cancel book. Error: %s\n", b.EventID, userID, err)
+		compensate(&bookModel{ID: id, UserID: userID, EventID: b.EventID, Quantity: b.Quantity}, failOccupy)
+		w.WriteHeader(http.StatusBadGateway)
+		data, _ := json.Marshal(bookModel{ID: id, UserID: userID, EventID: b.EventID, Status: statusCancelled, Quantity: b.Quantity})
+		w.Write(data)
+		return
+	}
+	bm, err := getBook(id)
+	if err != nil {
+		log.Printf("Failed to get book [%d]: %s\n", id, err)
+		bm = &bookModel{ID: id, UserID: userID, EventID: b.EventID, Status: statusNeedToOccupy, Quantity: b.Quantity}
+	}
+	data, _ := json.Marshal(bm)
 	w.WriteHeader(http.StatusOK)
-	if err = actionBookStatus(id); err != nil {
-		log.Printf("Failed to perform action based on book's status: %s\n", err)
+	w.Write(data)
+}
+
+// Reasons validate gives for a booking that would fail.
+const (
+	reasonEventNotFound     = "event_not_found"
+	reasonEventPast         = "event_past"
+	reasonNoSlots           = "no_slots"
+	reasonEventClosed       = "event_closed"
+	reasonInsufficientFunds = "insufficient_funds"
+)
+
+// maxQuantity is the most slots a single booking may occupy, events has the
+// same limit.
+const maxQuantity = 20
+
+// validate runs the checks a booking of the event would go through without
+// creating the booking, occupying a slot or charging anything.
+func validate(w http.ResponseWriter, r *http.Request) {
+	uid, ok := web.MustUserID(w, r)
+	if !ok {
+		return
 	}
+	var err error
+	b := bookModel{}
+	if err = json.NewDecoder(r.Body).Decode(&b); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse request body user id [%d]: %s\n", uid, err)
+		return
+	}
+	if b.Quantity <= 0 {
+		b.Quantity = 1
+	}
+	v := validationModel{Reasons: []string{}}
+	e, err := fetchEvent(b.EventID, uid, r.Header.Get("X-User-Role"))
+	switch {
+	case errors.Is(err, errEventNotFound):
+		v.Reasons = append(v.Reasons, reasonEventNotFound)
+	case err != nil:
+		log.Printf("Failed to get event [%d]: %s\n", b.EventID, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	default:
+		if !e.StartsAt.After(clk.Now()) {
+			v.Reasons = append(v.Reasons, reasonEventPast)
+		}
+		if e.Closed {
+			v.Reasons = append(v.Reasons, reasonEventClosed)
+		}
+		if e.FreeSlots != nil && *e.FreeSlots < b.Quantity {
+			v.Reasons = append(v.Reasons, reasonNoSlots)
+		}
+		// Only the account balance can be checked in advance, a gateway
+		// tells about missing funds when the payment is made.
+		if _, ok := payments.(accountPayments); !ok {
+			break
+		}
+		balance, err := fetchBalance(uid)
+		if err != nil {
+			log.Printf("Failed to get balance of user [%d]: %s\n", uid, err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if balance < e.Price*b.Quantity {
+			v.Reasons = append(v.Reasons, reasonInsufficientFunds)
+		}
+	}
+	v.OK = len(v.Reasons) == 0
+	data, _ := json.Marshal(v)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
 }
 
-func occupySlot(bid, eid, uid int) error {
-	bodyReader := bytes.NewReader([]byte(fmt.Sprintf(occupySlotTpl, bid, eid)))
-	req, err := http.NewRequest(http.MethodPost, occupySlotEndpoint, bodyReader)
+// quote returns the current price of the event and whether it can be booked,
+// without creating a booking. The event is fetched uncached, so the price is
+// the one the booking would get now.
+func quote(w http.ResponseWriter, r *http.Request) {
+	uid, ok := web.MustUserID(w, r)
+	if !ok {
+		return
+	}
+	eid, err := strconv.Atoi(r.URL.Query().Get("event_id"))
+	if err != nil || eid <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("event_id must be a positive number"))
+		return
+	}
+	e, err := fetchEvent(eid, uid, r.Header.Get("X-User-Role"))
+	if errors.Is(err, errEventNotFound) {
+		log.Printf("Could not find event [%d] to quote\n", eid)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 	if err != nil {
+		log.Printf("Failed to get event [%d]: %s\n", eid, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	q := quoteModel{
+		EventID:   eid,
+		Price:     e.Price,
+		Available: e.StartsAt.After(clk.Now()) && !e.Closed && (e.FreeSlots == nil || *e.FreeSlots > 0),
+	}
+	data, _ := json.Marshal(q)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// fetchEvent fetches the event as the user with role sees it, the price is
+// the one of the user's or the role's tier.
+func fetchEvent(eid, uid int, role string) (*eventInfoModel, error) {
+	e, err := services.WithRole(role).GetEvent(eid, uid)
+	if errors.Is(err, client.ErrNotFound) {
+		return nil, errEventNotFound
+	}
+	return e, err
+}
+
+// detail returns the user's booking together with the name and the price of
+// its event.
+func detail(w http.ResponseWriter, r *http.Request) {
+	uid, ok := web.MustUserID(w, r)
+	if !ok {
+		return
+	}
+	bid, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		log.Println("Failed to parse request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	b, err := getBook(bid)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && b.UserID != uid) {
+		log.Printf("Could not find book [%d] of user [%d]\n", bid, uid)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to get book [%d]: %w", bid, err))
+		return
+	}
+	d := bookDetailModel{bookModel: *b}
+	if d.Event, err = cachedFetchEvent(b.EventID, uid, r.Header.Get("X-User-Role")); err != nil {
+		log.Printf("Failed to get event [%d] of book [%d], returning book only: %s\n", b.EventID, bid, err)
+	}
+	data, _ := json.Marshal(d)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// timeline returns the saga log of the booking, oldest step first. Only the
+// owner of the booking and admins may see it.
+func timeline(w http.ResponseWriter, r *http.Request) {
+	uid, ok := web.MustUserID(w, r)
+	if !ok {
+		return
+	}
+	bid, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		log.Println("Failed to parse request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	b, err := getBook(bid)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && b.UserID != uid && r.Header.Get("X-User-Role") != roleAdmin) {
+		log.Printf("Could not find book [%d] of user [%d]\n", bid, uid)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to get book [%d]: %w", bid, err))
+		return
+	}
+	entries := []timelineEntryModel{}
+	err = dbConn.Retry(func() error {
+		entries = entries[:0]
+		rows, err := getTimelineStmt.Query(bid)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			e := timelineEntryModel{}
+			if err := rows.Scan(&e.Status, &e.Step, &e.Error, &e.At); err != nil {
+				return err
+			}
+			entries = append(entries, e)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to get timeline of book [%d]: %w", bid, err))
+		return
+	}
+	data, _ := json.Marshal(entries)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// cachedFetchEvent is fetchEvent with the result kept for eventCacheTTL.
+func cachedFetchEvent(eid, uid int, role string) (*eventInfoModel, error) {
+	key := eventCacheKey{eid: eid, uid: uid, role: role}
+	eventCacheMu.Lock()
+	c, ok := eventCache[key]
+	eventCacheMu.Unlock()
+	if ok && clk.Now().Before(c.expires) {
+		return c.event, nil
+	}
+	e, err := fetchEvent(eid, uid, role)
+	if err != nil {
+		return nil, err
+	}
+	eventCacheMu.Lock()
+	defer eventCacheMu.Unlock()
+	for k, c := range eventCache {
+		if clk.Now().After(c.expires) {
+			delete(eventCache, k)
+		}
+	}
+	eventCache[key] = cachedEvent{event: e, expires: clk.Now().Add(eventCacheTTL)}
+	return e, nil
+}
+
+func fetchBalance(uid int) (int, error) {
+	return services.GetBalance(uid)
+}
+
+// occupySlot asks events to occupy the slots of the booking. events prices
+// them for the user and role, an empty role gets the user's own or the base
+// price.
+func occupySlot(bid, eid, uid, quantity int, role string) error {
+	return services.WithRole(role).OccupySlot(bid, eid, uid, quantity)
+}
+
+// payForBook captures the funds held by holdFunds. Unless settled, the
+// result comes later to callbackPayment.
+func payForBook(b *bookModel) (settled bool, err error) {
+	return payments.Capture(b)
+}
+
+// holdFunds reserves the price of the booking.
+func holdFunds(b *bookModel) error {
+	return payments.Hold(b)
+}
+
+// releaseHold frees the funds held for the booking. A booking without an
+// active hold has nothing to release.
+func releaseHold(b *bookModel) error {
+	return payments.Release(b)
+}
+
+func cancelSlot(b *bookModel) error {
+	return services.CancelSlot(b.ID, b.EventID, b.UserID)
+}
+
+// commitSlot asks events to mark the slot of a paid booking as committed.
+func commitSlot(b *bookModel) error {
+	return services.CommitSlot(b.ID, b.EventID, b.UserID)
+}
+
+// completeBook runs the steps left after the payment: it commits the slot and
+// records the order, then moves the booking to statusCompleted and tells the
+// user. A failed step is written to the saga log and completeBooks retries
+// the booking later, both steps may be repeated. Only the call that completes
+// the booking sends the notification.
+func completeBook(b *bookModel) error {
+	if err := commitSlot(b); err != nil {
+		logSaga(b.ID, b.Status, stepCommitSlot, err.Error())
 		return err
 	}
-	req.Header.Set("X-User-Id", strconv.Itoa(uid))
-	c := http.Client{}
-	resp, err := c.Do(req)
+	if err := linkOrder(b); err != nil {
+		return err
+	}
+	var res sql.Result
+	err := dbConn.Retry(func() (err error) {
+		res, err = completeBookStmt.Exec(b.ID, statusCompleted, statusPaid)
+		return err
+	})
 	if err != nil {
 		return err
 	}
-	resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return errors.New("failed to occupy slot")
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return nil
 	}
+	b.Status = statusCompleted
+	logSaga(b.ID, statusCompleted, "", "")
+	notifyConfirmed(b)
 	return nil
 }
 
-func payForBook(b *bookModel) error {
-	bodyReader := bytes.NewReader([]byte(fmt.Sprintf(payTpl, b.ID, b.UserID, b.Price)))
-	req, err := http.NewRequest(http.MethodPut, paymentSlotEndpoint, bodyReader)
+// notifyConfirmed emails the user that the booking is paid, with the event's
+// name and the price. notif keeps it in-app if it can't send email. The
+// notification is best effort, a failure is only logged.
+func notifyConfirmed(b *bookModel) {
+	name := fmt.Sprintf("[%d]", b.EventID)
+	if e, err := cachedFetchEvent(b.EventID, b.UserID, ""); err == nil {
+		name = e.Name
+	} else {
+		log.Printf("Failed to get event [%d] for confirmation of book [%d]: %s\n", b.EventID, b.ID, err)
+	}
+	params := map[string]string{
+		"book_id": strconv.Itoa(b.ID),
+		"event":   name,
+		"price":   strconv.Itoa(b.Price),
+	}
+	if err := services.Notify(b.UserID, "booking_confirmed", channelEmail, params); err != nil {
+		log.Printf("Failed to notify user [%d] about book [%d]: %s\n", b.UserID, b.ID, err)
+	}
+}
+
+// linkOrder records the paid booking as an order in orders and stores the
+// order id on the booking. A failed attempt is written to the saga log and
+// completeBooks retries it: the booking is paid, so the payment is not undone
+// because its order is missing.
+func linkOrder(b *bookModel) error {
+	if b.OrderID != 0 {
+		return nil
+	}
+	item := fmt.Sprintf("Booking [%d] of event [%d]", b.ID, b.EventID)
+	oid, err := services.CreateOrder(b.ID, b.UserID, item, b.Price)
+	if err == nil {
+		err = dbConn.Retry(func() error {
+			_, err := setOrderStmt.Exec(b.ID, oid)
+			return err
+		})
+	}
 	if err != nil {
+		logSaga(b.ID, b.Status, stepCreateOrder, err.Error())
 		return err
 	}
-	req.Header.Set("X-User-Id", strconv.Itoa(b.UserID))
-	c := http.Client{}
-	resp, err := c.Do(req)
+	b.OrderID = oid
+	logSaga(b.ID, b.Status, stepCreateOrder, "")
+	return nil
+}
+
+// completeBooks retries completeBook for paid bookings every releaseInterval.
+// A booking whose slot commit or order failed compensationMaxAttempts times
+// is left for manual handling.
+func completeBooks(ctx context.Context) {
+	t := time.NewTicker(releaseInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		completeDueBooks()
+	}
+}
+
+// completeDueBooks retries completeBook for one batch of paid bookings.
+func completeDueBooks() {
+	steps := pq.Array([]string{stepCommitSlot, stepCreateOrder})
+	books, err := queryBooks(getUnfinishedStmt, statusPaid, steps, compensationMaxAttempts, releaseBatch)
 	if err != nil {
-		return err
+		log.Printf("Failed to get paid books: %s\n", err)
+		return
 	}
-	resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return errors.New("failed to pay for book")
+	for i := range books {
+		if err = completeBook(&books[i]); err != nil {
+			log.Printf("Failed to complete book [%d], will retry: %s\n", books[i].ID, err)
+			continue
+		}
+		log.Printf("Completed book [%d] with order [%d]\n", books[i].ID, books[i].OrderID)
 	}
-	return nil
 }
 
-func cancelSlot(b *bookModel) error {
-	bodyReader := bytes.NewReader([]byte(fmt.Sprintf(occupySlotTpl, b.ID, b.EventID)))
-	req, err := http.NewRequest(http.MethodPost, occupySlotEndpoint, bodyReader)
+// refundBook pays back the captured price of a cancelled booking. Every
+// attempt is written to the saga log, refundBooks retries the failed ones.
+func refundBook(b *bookModel) error {
+	err := payments.Refund(b)
+	errText := ""
 	if err != nil {
+		errText = err.Error()
+	}
+	logSaga(b.ID, b.Status, stepRefund, errText)
+	return err
+}
+
+// refundBooks retries refundBook every releaseInterval for bookings whose
+// refund has not succeeded yet. A refund failing compensationMaxAttempts
+// times is left for manual handling.
+func refundBooks(ctx context.Context) {
+	t := time.NewTicker(releaseInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		books, err := queryBooks(getUnrefundedStmt, stepRefund, compensationMaxAttempts, releaseBatch)
+		if err != nil {
+			log.Printf("Failed to get books to refund: %s\n", err)
+			continue
+		}
+		for i := range books {
+			if err = refundBook(&books[i]); err != nil {
+				log.Printf("Failed to refund book [%d], will retry: %s\n", books[i].ID, err)
+				continue
+			}
+			log.Printf("Refunded book [%d]\n", books[i].ID)
+		}
+	}
+}
+
+// compensate cancels a booking that failed at the given point. The booking is
+// marked statusNeedToReleaseSlot together with the failure point first, then
+// the compensations of that point run in order. If one of them fails
+// releaseSlots resumes from it later.
+func compensate(b *bookModel, failure string) {
+	if err := startCompensation(b.ID, failure); err != nil {
+		log.Printf("Failed to start compensation [%s] of book [%d]: %s\n", failure, b.ID, err)
+		return
+	}
+	if err := runCompensations(b, failure); err != nil {
+		log.Printf("Failed to compensate book [%d], will retry: %s\n", b.ID, err)
+	}
+}
+
+// startCompensation moves a booking that is still in progress to
+// statusNeedToReleaseSlot, a booking that is done or is being cancelled
+// already is left alone.
+func startCompensation(bid int, failure string) error {
+	pending := pq.Array([]int{int(statusNeedToOccupy), int(statusOccupied), int(statusNeedToPay)})
+	var res sql.Result
+	err := dbConn.Retry(func() (err error) {
+		res, err = startCompensationStmt.Exec(bid, statusNeedToReleaseSlot, failure, pending)
 		return err
+	})
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return errNotCompensable
 	}
-	req.Header.Set("X-User-Id", strconv.Itoa(b.UserID))
-	c := http.Client{}
-	resp, err := c.Do(req)
+	logSaga(bid, statusNeedToReleaseSlot, "", failure)
+	return nil
+}
+
+// runCompensations runs the compensations of the failure point that are not
+// done yet according to the saga log. Each attempt is logged; a step failing
+// compensationMaxAttempts times moves the booking to
+// statusCompensationFailed.
+func runCompensations(b *bookModel, failure string) error {
+	steps, ok := compensations[failure]
+	if !ok {
+		log.Printf("Book [%d] has unknown failure point [%s], running all compensations\n", b.ID, failure)
+		steps = compensations[failPayment]
+	}
+	done, failed, err := compensationLog(b.ID)
 	if err != nil {
 		return err
 	}
-	resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return errors.New("failed to cancel slot")
+	for _, c := range steps {
+		if done[c.name] {
+			continue
+		}
+		if err = c.run(b); err != nil {
+			logSaga(b.ID, statusNeedToReleaseSlot, c.name, err.Error())
+			if failed[c.name]+1 >= compensationMaxAttempts {
+				log.Printf("Giving up on compensation [%s] of book [%d] after [%d] attempts\n", c.name, b.ID, failed[c.name]+1)
+				if err := modifyBookStatus(b.ID, statusCompensationFailed); err != nil {
+					log.Printf("Failed to mark book [%d] as failed to compensate: %s\n", b.ID, err)
+				}
+			}
+			return fmt.Errorf("%s: %w", c.name, err)
+		}
+		logSaga(b.ID, statusNeedToReleaseSlot, c.name, "")
 	}
 	return nil
 }
 
+// compensationLog returns which compensations of the booking are done and
+// how many times each one failed.
+func compensationLog(bid int) (map[string]bool, map[string]int, error) {
+	done, failed := map[string]bool{}, map[string]int{}
+	err := dbConn.Retry(func() error {
+		rows, err := compensationLogStmt.Query(bid)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var step string
+			var ok, errs int
+			if err := rows.Scan(&step, &ok, &errs); err != nil {
+				return err
+			}
+			done[step], failed[step] = ok > 0, errs
+		}
+		return rows.Err()
+	})
+	return done, failed, err
+}
+
+// logSaga records a step of the booking's saga. A failure to record is only
+// logged, the saga goes on without it.
+func logSaga(bid int, status BookStatus, step, errText string) {
+	err := dbConn.Retry(func() error {
+		_, err := sagaLogStmt.Exec(bid, status, step, errText)
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to write saga log of book [%d]: %s\n", bid, err)
+	}
+}
+
+// expireBooks cancels bookings whose saga did not finish before expires_at,
+// so a lost callback can't hold a slot forever. The slot is released the same
+// way as for a failed payment.
+func expireBooks(ctx context.Context) {
+	t := time.NewTicker(expireInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		expireDueBooks()
+	}
+}
+
+// expireDueBooks cancels one batch of the bookings expired by clk.Now().
+func expireDueBooks() {
+	pending := pq.Array([]int{int(statusNeedToOccupy), int(statusOccupied), int(statusNeedToPay)})
+	books, err := queryBooks(getExpiredStmt, pending, releaseBatch, clk.Now())
+	if err != nil {
+		log.Printf("Failed to get expired books: %s\n", err)
+		return
+	}
+	for i := range books {
+		log.Printf("Book [%d] expired in status [%s], cancelling it\n", books[i].ID, books[i].Status)
+		compensate(&books[i], failExpired)
+	}
+}
+
+// queryBooks runs a statement selecting id, user_id, event_id, price, status,
+// quantity, order_id.
+func queryBooks(stmt *sql.Stmt, args ...interface{}) ([]bookModel, error) {
+	books := []bookModel{}
+	err := dbConn.Retry(func() error {
+		books = books[:0]
+		rows, err := stmt.Query(args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			b := bookModel{}
+			if err := rows.Scan(&b.ID, &b.UserID, &b.EventID, &b.Price, &b.Status, &b.Quantity, &b.OrderID); err != nil {
+				return err
+			}
+			books = append(books, b)
+		}
+		return rows.Err()
+	})
+	return books, err
+}
+
+// releaseSlots resumes the compensations of bookings left in
+// statusNeedToReleaseSlot every releaseInterval.
+func releaseSlots(ctx context.Context) {
+	t := time.NewTicker(releaseInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		releaseDueBooks()
+	}
+}
+
+// releaseDueBooks resumes the compensations of one batch of bookings in
+// statusNeedToReleaseSlot.
+func releaseDueBooks() {
+	books, err := queryBooks(getByStatusStmt, statusNeedToReleaseSlot, releaseBatch)
+	if err != nil {
+		log.Printf("Failed to get books waiting for slot release: %s\n", err)
+		return
+	}
+	for i := range books {
+		b := &books[i]
+		var failure string
+		err := dbConn.Retry(func() error {
+			return getFailureStmt.QueryRow(b.ID).Scan(&failure)
+		})
+		if err != nil {
+			log.Printf("Failed to get failure point of book [%d]: %s\n", b.ID, err)
+			continue
+		}
+		if err = runCompensations(b, failure); err != nil {
+			log.Printf("Failed to compensate book [%d], will retry: %s\n", b.ID, err)
+			continue
+		}
+		log.Printf("Compensated book [%d]\n", b.ID)
+	}
+}
+
+// callbackBook loads the booking a callback refers to. A callback for a book
+// that does not exist is rejected with 400, the sender has nothing to retry.
+func callbackBook(w http.ResponseWriter, bid int) (*bookModel, bool) {
+	if bid <= 0 {
+		log.Printf("Callback refers to a wrong book id [%d], rejecting it\n", bid)
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+	b, err := getBook(bid)
+	if errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Callback refers to an unknown book [%d], rejecting it\n", bid)
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Failed to get book [%d]: %s\n", bid, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+	return b, true
+}
+
+// hasStatus reports whether the book is in one of the statuses.
+func hasStatus(b *bookModel, statuses ...BookStatus) bool {
+	for _, s := range statuses {
+		if b.Status == s {
+			return true
+		}
+	}
+	return false
+}
+
 func callbackEvents(w http.ResponseWriter, r *http.Request) {
 	c := callbackOccupyModel{}
 	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusBadRequest)
 		log.Printf("Failed to parse request body user id []: %s\n", err)
 		return
 	}
+	b, ok := callbackBook(w, c.BookID)
+	if !ok {
+		return
+	}
+	// A repeated callback for a slot that is occupied already changes nothing.
+	if c.Status && hasStatus(b, statusOccupied, statusNeedToPay, statusPaid, statusCompleted) {
+		log.Printf("Book [%d] already has a slot, callback is ignored\n", c.BookID)
+		return
+	}
+	if !c.Status && c.Reason == reasonSlotExpired && hasStatus(b, statusOccupied, statusNeedToPay) {
+		log.Printf("Slot of book [%d] expired before payment, book will canceled\n", c.BookID)
+		compensate(b, failSlotExpired)
+		return
+	}
+	// A stale callback, for a book that moved on already, is answered 200 so
+	// that events does not send it again.
+	if b.Status != statusNeedToOccupy {
+		log.Printf("Book [%d] in status [%s] is not waiting for a slot, callback is ignored\n", c.BookID, b.Status)
+		return
+	}
+	if c.Status && c.Price < 0 {
+		log.Printf("Callback for book [%d] has a wrong price [%d], rejecting it\n", c.BookID, c.Price)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 	if c.Status {
-		if err := modifyBookStatus(c.BookID, statusOccupied); err != nil {
-			log.Printf("Failed to set book price:%s\n", err)
-		}
-		if err := setBookPrice(c.BookID, c.Price); err != nil {
+		if err := occupyBook(c.BookID, c.Price); errors.Is(err, errBookNotOccupiable) {
+			log.Printf("Book [%d] is not waiting for a slot, callback is ignored\n", c.BookID)
+			return
+		} else if err != nil {
 			log.Printf("Failed to set book price:%s Cancel the book\n", err)
-			_ = modifyBookStatus(c.BookID, statusCancelled)
+			compensate(b, failRecordSlot)
+			return
 		}
 		if err := actionBookStatus(c.BookID); err != nil {
 			log.Printf("Failed to action for current book's status\n")
 		}
 		return
 	}
-	log.Printf("Failed to occupy event's slot, book will canceled")
-	if err := cancelBook(c.BookID); err != nil {
-		log.Printf("Failed to cancel book [%d]\n", c.BookID)
-	}
+	log.Printf("Failed to occupy event's slot (reason [%s]), book will canceled", c.Reason)
+	compensate(b, failOccupy)
 }
 
 func callbackPayment(w http.ResponseWriter, r *http.Request) {
 	c := callbackPaymentModel{}
 	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusBadRequest)
 		log.Printf("Failed to parse request body user id []: %s\n", err)
 		return
 	}
+	b, ok := callbackBook(w, c.BookID)
+	if !ok {
+		return
+	}
+	switch {
+	case hasStatus(b, statusPaid, statusCompleted):
+		log.Printf("Book [%d] is paid already, callback is ignored\n", c.BookID)
+		return
+	case hasStatus(b, statusCancelled, statusNeedToReleaseSlot):
+		// Cancelled books still take the callback, a late payment has to be
+		// noticed and refunded.
+	case b.Status != statusNeedToPay:
+		// stale, answered 200 so that account does not send it again
+		log.Printf("Book [%d] in status [%s] is not waiting for a payment, callback is ignored\n", c.BookID, b.Status)
+		return
+	}
 	if c.Status {
-		modifyBookStatus(c.BookID, StatusPaid)
-		if err := actionBookStatus(c.BookID); err != nil {
-			log.Printf("Failed to action for current book's status\n")
-		}
+		markPaid(c.BookID)
 		return
 	}
 	log.Printf("Failed to pay event's slot, book will canceled")
-	if err := cancelBook(c.BookID); err != nil {
-		log.Printf("Failed to cancel book [%d]\n", c.BookID)
-	}
+	compensate(b, failPayment)
 }
 
-func isAuthenticatedMiddleware(h http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		headers := r.Header
-		if _, ok := headers["X-User-Id"]; !ok {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("Not authenticated"))
-			log.Println("Not authenticated")
+// markPaid moves the paid booking on to its post-payment steps. A booking
+// cancelled while its payment was captured, when it expired for instance, has
+// released its slot already, so the payment is refunded.
+func markPaid(bid int) {
+	if err := modifyBookStatus(bid, statusPaid); errors.Is(err, errBookCancelled) {
+		log.Printf("Book [%d] was paid after it had been cancelled, refunding the payment\n", bid)
+		b, err := getBook(bid)
+		if err != nil {
+			log.Printf("Failed to get book [%d] to refund: %s\n", bid, err)
 			return
 		}
-		h.ServeHTTP(w, r)
+		if err = refundBook(b); err != nil {
+			log.Printf("Failed to refund book [%d], will retry: %s\n", bid, err)
+		}
+		return
+	}
+	if err := actionBookStatus(bid); err != nil {
+		log.Printf("Failed to action for current book's status\n")
+	}
+}
+
+// statusRecorder remembers the status code and the size of the response
+// written by the wrapped handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
 	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
 }
 
 func reqlog(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Got request from: %s\n", r.Host)
-		h.ServeHTTP(w, r)
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		log.Printf("method=%s path=%s status=%d bytes=%d duration=%s request_id=%q host=%s\n",
+			r.Method, r.URL.Path, rec.status, rec.bytes, time.Since(start), r.Header.Get("X-Request-Id"), r.Host)
 	}
 }
 
-func getUserID(r *http.Request) (int, error) {
-	return strconv.Atoi(r.Header.Get("X-User-Id"))
+// idempotent makes retries of h with the same Idempotency-Key header safe.
+// The first response for a (user, key) pair is stored and replayed for
+// repeated requests within idempotencyKeyTTL instead of running h again.
+// Server errors are not stored so that the request can be retried.
+func idempotent(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		uid, ok := web.MustUserID(w, r)
+		if !ok {
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			log.Printf("Failed to read request body user id [%d]: %s\n", uid, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+		hash := hex.EncodeToString(sum[:])
+
+		reserved := false
+		err = dbConn.Retry(func() error {
+			err := reserveIdempotencyKeyStmt.QueryRow(uid, key, hash, idempotencyKeyTTL.Seconds()).Scan(new(int))
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+			reserved = err == nil
+			return err
+		})
+		if err != nil {
+			web.InternalError(w, r, fmt.Errorf("failed to reserve idempotency key [%s] for user id [%d]: %w", key, uid, err))
+			return
+		}
+		if !reserved {
+			replayIdempotent(w, uid, key, hash)
+			return
+		}
+
+		rec := &bodyRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		err = dbConn.Retry(func() error {
+			if rec.status >= http.StatusInternalServerError {
+				_, err := deleteIdempotencyKeyStmt.Exec(uid, key)
+				return err
+			}
+			_, err := saveIdempotencyKeyStmt.Exec(uid, key, rec.status, rec.body.String())
+			return err
+		})
+		if err != nil {
+			log.Printf("Failed to save response for idempotency key [%s] user id [%d]: %s\n", key, uid, err)
+		}
+	}
+}
+
+// replayIdempotent writes the stored response for the key. A request with a
+// different body or a request that is still being served gets a conflict.
+func replayIdempotent(w http.ResponseWriter, uid int, key, hash string) {
+	var storedHash, body string
+	status := 0
+	err := dbConn.Retry(func() error {
+		return getIdempotencyKeyStmt.QueryRow(uid, key).Scan(&storedHash, &status, &body)
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to get idempotency key [%s] for user id [%d]: %s\n", key, uid, err)
+		return
+	}
+	if storedHash != hash {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte("Idempotency-Key was already used with another request"))
+		return
+	}
+	if status == 0 {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("Request with this Idempotency-Key is in progress"))
+		return
+	}
+	log.Printf("Replaying response for idempotency key [%s] user id [%d]\n", key, uid)
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(status)
+	w.Write([]byte(body))
+}
+
+// bodyRecorder keeps a copy of the response so that idempotent can store it.
+type bodyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bodyRecorder) WriteHeader(code int) {
+	if b.status == 0 {
+		b.status = code
+	}
+	b.ResponseWriter.WriteHeader(code)
+}
+
+func (b *bodyRecorder) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	b.body.Write(p)
+	return b.ResponseWriter.Write(p)
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"contracts"
+)
+
+// TestPaidBookingGetsLinkedOrder pays a booking while orders is down and
+// checks completeDueBooks links it to an order once orders is back.
+func TestPaidBookingGetsLinkedOrder(t *testing.T) {
+	db := newSagaDB(t, bookModel{ID: 7, UserID: 5, EventID: 3, Price: 3000, Quantity: 1, Status: statusNeedToPay})
+	useStubServices(t, map[string]stubResponse{
+		"/events/commit":  {http.StatusOK, ""},
+		"/orders/booking": {http.StatusServiceUnavailable, ""},
+		"/notif/create":   {http.StatusOK, ""},
+	})
+	if w := postCallback(callbackPayment, `{"book_id":7,"user_id":5,"price":3000,"status":true}`); w.Code != http.StatusOK {
+		t.Fatalf("callback answered %d, want 200", w.Code)
+	}
+	if s := db.status(); s != statusPaid {
+		t.Fatalf("book is %s with orders down, want %s", s, statusPaid)
+	}
+	if log := db.steps(stepCreateOrder); len(log) != 1 || log[0].err == "" {
+		t.Fatalf("create_order log %+v, want one failure", log)
+	}
+
+	d := useStubServices(t, map[string]stubResponse{
+		"/events/commit":  {http.StatusOK, ""},
+		"/orders/booking": {http.StatusOK, `{"id":11}`},
+		"/notif/create":   {http.StatusOK, ""},
+	})
+	completeDueBooks()
+	if s := db.status(); s != statusCompleted {
+		t.Fatalf("book is %s after the retry, want %s", s, statusCompleted)
+	}
+	db.mu.Lock()
+	oid := db.book.OrderID
+	db.mu.Unlock()
+	if oid != 11 {
+		t.Errorf("book is linked to order %d, want 11", oid)
+	}
+	sent := d.sent("/orders/booking")
+	if len(sent) != 1 {
+		t.Fatalf("asked orders %d times, want 1", len(sent))
+	}
+	o := contracts.BookingOrder{}
+	if err := json.Unmarshal(sent[0].body, &o); err != nil {
+		t.Fatal(err)
+	}
+	if o.BookID != 7 || o.Amount != 3000 {
+		t.Errorf("asked orders for %+v, want book 7 of 3000", o)
+	}
+
+	completeDueBooks()
+	if n := len(d.sent("/orders/booking")); n != 1 {
+		t.Errorf("completed book asked orders again, %d times", n)
+	}
+}
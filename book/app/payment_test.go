@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+
+	"app/internal/client"
+)
+
+// fakePayments is a paymentProvider whose capture answers with captureErr,
+// or settles the payment at once when captureErr is nil.
+type fakePayments struct {
+	mu         sync.Mutex
+	captureErr error
+	calls      []string
+}
+
+func (p *fakePayments) record(call string, b *bookModel) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls = append(p.calls, fmt.Sprintf("%s %d", call, b.Price))
+}
+
+func (p *fakePayments) Hold(b *bookModel) error {
+	p.record("hold", b)
+	return nil
+}
+
+func (p *fakePayments) Capture(b *bookModel) (bool, error) {
+	p.record("capture", b)
+	return p.captureErr == nil, p.captureErr
+}
+
+func (p *fakePayments) Release(b *bookModel) error {
+	p.record("release", b)
+	return nil
+}
+
+func (p *fakePayments) Refund(b *bookModel) error {
+	p.record("refund", b)
+	return nil
+}
+
+// usePayments makes p the paymentProvider of the saga for the test.
+func usePayments(t *testing.T, p paymentProvider) {
+	saved := payments
+	payments = p
+	t.Cleanup(func() { payments = saved })
+}
+
+func TestPaymentProviderOutcomes(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status BookStatus
+		calls  []string
+	}{
+		{"success", nil, statusCompleted, []string{"hold 3000", "capture 3000"}},
+		{"decline", client.ErrDeclined, statusCancelled, []string{"hold 3000", "capture 3000", "release 3000"}},
+		{"timeout", fmt.Errorf("gateway: %w", context.DeadlineExceeded), statusCancelled, []string{"hold 3000", "capture 3000", "release 3000"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newSagaDB(t, bookModel{ID: 7, UserID: 5, EventID: 3, Price: 3000, Quantity: 1, Status: statusOccupied})
+			d := useStubServices(t, map[string]stubResponse{
+				"/events/commit":  {http.StatusOK, ""},
+				"/events/cancel":  {http.StatusOK, ""},
+				"/orders/booking": {http.StatusOK, `{"id":11}`},
+				"/notif/create":   {http.StatusOK, ""},
+			})
+			p := &fakePayments{captureErr: tt.err}
+			usePayments(t, p)
+
+			actionBookStatus(7)
+			if s := db.status(); s != tt.status {
+				t.Errorf("book is %s, want %s", s, tt.status)
+			}
+			if !reflect.DeepEqual(p.calls, tt.calls) {
+				t.Errorf("provider got %v, want %v", p.calls, tt.calls)
+			}
+			if paid := tt.err == nil; (len(d.sent("/events/cancel")) == 0) != paid {
+				t.Errorf("slot cancelled %d times with payment %s", len(d.sent("/events/cancel")), tt.name)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// getQuote asks user 5's quote for booking the event.
+func getQuote(eid string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/book/quote?event_id="+eid, nil)
+	r.Header.Set("X-User-Id", "5")
+	w := httptest.NewRecorder()
+	quote(w, r)
+	return w
+}
+
+func TestQuote(t *testing.T) {
+	useFakeClock(t)
+	var queries []string
+	useFakeDB(t, func(query string, _ []driver.Value) fakeResult {
+		queries = append(queries, query)
+		return fakeResult{Affected: 1}
+	})
+	useStubServices(t, map[string]stubResponse{
+		"/events/get/3": {http.StatusOK, `{"id":3,"event_name":"Rock Concert","price":1500,"starts_at":"2030-06-01T19:00:00Z","free_slots":5}`},
+		"/events/get/4": {http.StatusOK, `{"id":4,"event_name":"Play","price":900,"starts_at":"2030-06-01T19:00:00Z","free_slots":0}`},
+		"/events/get/5": {http.StatusOK, `{"id":5,"event_name":"Jazz","price":500,"starts_at":"2030-06-01T19:00:00Z","closed":true}`},
+		"/events/get/6": {http.StatusOK, `{"id":6,"event_name":"Meetup","price":0,"starts_at":"2030-04-01T19:00:00Z","free_slots":5}`},
+		"/events/get/7": {http.StatusNotFound, ""},
+	})
+	tests := []struct {
+		name, eid string
+		code      int
+		want      string
+	}{
+		{"available", "3", http.StatusOK, `{"event_id":3,"price":1500,"available":true}`},
+		{"sold out", "4", http.StatusOK, `{"event_id":4,"price":900,"available":false}`},
+		{"closed", "5", http.StatusOK, `{"event_id":5,"price":500,"available":false}`},
+		{"started", "6", http.StatusOK, `{"event_id":6,"price":0,"available":false}`},
+		{"unknown", "7", http.StatusNotFound, ""},
+		{"bad id", "x", http.StatusBadRequest, "event_id must be a positive number"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := getQuote(tt.eid); w.Code != tt.code || w.Body.String() != tt.want {
+				t.Errorf("quote answered %d %s, want %d %s", w.Code, w.Body.String(), tt.code, tt.want)
+			}
+		})
+	}
+	if len(queries) != 0 {
+		t.Errorf("quoting ran %q, want nothing stored", queries)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// TestFailedSlotCancelIsRetried fails the payment of a booking while events
+// can't cancel the slot, then lets releaseDueBooks retry once events is back.
+func TestFailedSlotCancelIsRetried(t *testing.T) {
+	db := newSagaDB(t, bookModel{ID: 7, UserID: 5, EventID: 3, Price: 3000, Quantity: 1, Status: statusNeedToPay})
+	useStubServices(t, map[string]stubResponse{
+		"/events/cancel":   {http.StatusServiceUnavailable, ""},
+		"/account/release": {http.StatusOK, ""},
+	})
+	b := db.book
+	compensate(&b, failPayment)
+	if s := db.status(); s != statusNeedToReleaseSlot {
+		t.Fatalf("book is %s after the slot cancel failed, want %s", s, statusNeedToReleaseSlot)
+	}
+	if log := db.steps(compensateSlot.name); len(log) != 1 || log[0].err == "" {
+		t.Fatalf("cancel_slot saga log %+v, want one failed attempt", log)
+	}
+	if log := db.steps(compensateHold.name); len(log) != 0 {
+		t.Fatalf("hold was released before the slot: %+v", log)
+	}
+
+	d := useStubServices(t, map[string]stubResponse{
+		"/events/cancel":   {http.StatusOK, ""},
+		"/account/release": {http.StatusOK, ""},
+	})
+	releaseDueBooks()
+	if s := db.status(); s != statusCancelled {
+		t.Fatalf("book is %s after the retry, want %s", s, statusCancelled)
+	}
+	for _, step := range []string{compensateSlot.name, compensateHold.name, compensateStatus.name} {
+		log := db.steps(step)
+		if len(log) == 0 || log[len(log)-1].err != "" {
+			t.Errorf("%s saga log %+v, want it to end with a success", step, log)
+		}
+	}
+
+	releaseDueBooks()
+	if n := len(d.sent("/events/cancel")); n != 1 {
+		t.Errorf("slot cancelled %d times after the retry, want 1", n)
+	}
+}
+
+// TestCompensationResumesAfterMiddleStep fails the hold release, the middle
+// compensation of a failed payment, and checks the retry runs only what is
+// left.
+func TestCompensationResumesAfterMiddleStep(t *testing.T) {
+	db := newSagaDB(t, bookModel{ID: 7, UserID: 5, EventID: 3, Price: 3000, Quantity: 1, Status: statusNeedToPay})
+	useStubServices(t, map[string]stubResponse{
+		"/events/cancel":   {http.StatusOK, ""},
+		"/account/release": {http.StatusServiceUnavailable, ""},
+	})
+	b := db.book
+	compensate(&b, failPayment)
+	if s := db.status(); s != statusNeedToReleaseSlot {
+		t.Fatalf("book is %s after the hold release failed, want %s", s, statusNeedToReleaseSlot)
+	}
+	if log := db.steps(compensateStatus.name); len(log) != 0 {
+		t.Fatalf("booking was cancelled before its hold was released: %+v", log)
+	}
+
+	d := useStubServices(t, map[string]stubResponse{
+		"/events/cancel":   {http.StatusOK, ""},
+		"/account/release": {http.StatusOK, ""},
+	})
+	releaseDueBooks()
+	if s := db.status(); s != statusCancelled {
+		t.Fatalf("book is %s after the retry, want %s", s, statusCancelled)
+	}
+	if n := len(d.sent("/events/cancel")); n != 0 {
+		t.Errorf("retry cancelled the slot again %d times", n)
+	}
+	if n := len(d.sent("/account/release")); n != 1 {
+		t.Errorf("retry released the hold %d times, want 1", n)
+	}
+	var steps []string
+	for _, e := range db.log {
+		if e.step != "" {
+			steps = append(steps, fmt.Sprintf("%s:%t", e.step, e.err == ""))
+		}
+	}
+	want := []string{"cancel_slot:true", "release_hold:false", "release_hold:true", "cancel_book:true"}
+	if !reflect.DeepEqual(steps, want) {
+		t.Errorf("saga log %v, want %v", steps, want)
+	}
+}
+
+// TestCompensationGivesUp checks a step that keeps failing moves the booking
+// to statusCompensationFailed after compensationMaxAttempts.
+func TestCompensationGivesUp(t *testing.T) {
+	db := newSagaDB(t, bookModel{ID: 7, UserID: 5, EventID: 3, Price: 3000, Quantity: 1, Status: statusNeedToPay})
+	useStubServices(t, map[string]stubResponse{
+		"/events/cancel": {http.StatusOK, ""},
+	})
+	b := db.book
+	compensate(&b, failPayment)
+	for i := 1; i < compensationMaxAttempts; i++ {
+		if s := db.status(); s != statusNeedToReleaseSlot {
+			t.Fatalf("book is %s after %d attempts, want %s", s, i, statusNeedToReleaseSlot)
+		}
+		releaseDueBooks()
+	}
+	if s := db.status(); s != statusCompensationFailed {
+		t.Fatalf("book is %s after %d attempts, want %s", s, compensationMaxAttempts, statusCompensationFailed)
+	}
+	if n := len(db.steps(compensateHold.name)); n != compensationMaxAttempts {
+		t.Errorf("released the hold %d times, want %d", n, compensationMaxAttempts)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sagaDB fakes the book table holding one booking and its saga log, enough
+// for the saga steps and compensations to run against it.
+type sagaDB struct {
+	mu      sync.Mutex
+	book    bookModel
+	version int64
+	failure string
+	log     []sagaEntry
+}
+
+type sagaEntry struct {
+	status BookStatus
+	step   string
+	err    string
+	at     time.Time
+}
+
+// sagaEpoch is when the first saga log entry is written; every next one is
+// a second later.
+var sagaEpoch = time.Date(2030, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func newSagaDB(t *testing.T, b bookModel) *sagaDB {
+	db := &sagaDB{book: b}
+	useFakeDB(t, db.handle)
+	return db
+}
+
+func (db *sagaDB) handle(query string, args []driver.Value) fakeResult {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	b := &db.book
+	switch {
+	case queryHas(query, "INSERT INTO book (user_id, event_id"):
+		b.UserID, b.EventID, b.Status, b.Quantity = int(args[0].(int64)), int(args[1].(int64)), BookStatus(args[2].(int64)), int(args[4].(int64))
+		return fakeResult{Cols: []string{"id"}, Rows: [][]driver.Value{{int64(b.ID)}}}
+	case queryHas(query, "SELECT status, version FROM book"):
+		if args[0] != int64(b.ID) {
+			return fakeResult{Cols: []string{"status", "version"}}
+		}
+		return fakeResult{Cols: []string{"status", "version"}, Rows: [][]driver.Value{{int64(b.Status), db.version}}}
+	case queryHas(query, "SELECT failure FROM book WHERE id=$1"):
+		if args[0] != int64(b.ID) {
+			return fakeResult{Cols: []string{"failure"}}
+		}
+		return fakeResult{Cols: []string{"failure"}, Rows: [][]driver.Value{{db.failure}}}
+	case queryHas(query, "SELECT id, user_id, event_id, price, status, quantity", "l.step = ANY($2)"):
+		cols := []string{"id", "user_id", "event_id", "price", "status", "quantity", "order_id"}
+		failed := int64(0)
+		for _, e := range db.log {
+			if e.step != "" && e.err != "" && strings.Contains(args[1].(string), e.step) {
+				failed++
+			}
+		}
+		if args[0] != int64(b.Status) || failed >= args[2].(int64) {
+			return fakeResult{Cols: cols}
+		}
+		return fakeResult{Cols: cols, Rows: [][]driver.Value{{int64(b.ID), int64(b.UserID), int64(b.EventID), int64(b.Price), int64(b.Status), int64(b.Quantity), int64(b.OrderID)}}}
+	case queryHas(query, "UPDATE book SET order_id=$2"):
+		b.OrderID = int(args[1].(int64))
+		return fakeResult{Affected: 1}
+	case queryHas(query, "SELECT id, user_id, event_id, price, status, quantity", "WHERE status=$1"):
+		cols := []string{"id", "user_id", "event_id", "price", "status", "quantity", "order_id"}
+		if args[0] != int64(b.Status) {
+			return fakeResult{Cols: cols}
+		}
+		return fakeResult{Cols: cols, Rows: [][]driver.Value{{int64(b.ID), int64(b.UserID), int64(b.EventID), int64(b.Price), int64(b.Status), int64(b.Quantity), int64(b.OrderID)}}}
+	case queryHas(query, "SELECT id, user_id, event_id, price, status, quantity", "WHERE id=$1"):
+		cols := []string{"id", "user_id", "event_id", "price", "status", "quantity", "order_id"}
+		if args[0] != int64(b.ID) {
+			return fakeResult{Cols: cols}
+		}
+		return fakeResult{Cols: cols, Rows: [][]driver.Value{{int64(b.ID), int64(b.UserID), int64(b.EventID), int64(b.Price), int64(b.Status), int64(b.Quantity), int64(b.OrderID)}}}
+	case queryHas(query, "UPDATE book SET status=$2, failure=$3"):
+		if !strings.Contains(args[3].(string), fmt.Sprint(int(b.Status))) {
+			return fakeResult{}
+		}
+		b.Status, db.failure = BookStatus(args[1].(int64)), args[2].(string)
+		db.version++
+		return fakeResult{Affected: 1}
+	case queryHas(query, "UPDATE book SET status=$2", "version=$3"):
+		if args[2] != db.version {
+			return fakeResult{}
+		}
+		b.Status = BookStatus(args[1].(int64))
+		db.version++
+		return fakeResult{Affected: 1}
+	case queryHas(query, "UPDATE book SET status=$2", "status=$3"):
+		if BookStatus(args[2].(int64)) != b.Status {
+			return fakeResult{}
+		}
+		b.Status = BookStatus(args[1].(int64))
+		db.version++
+		return fakeResult{Affected: 1}
+	case queryHas(query, "UPDATE book SET status=$2, price=$3"):
+		if BookStatus(args[3].(int64)) != b.Status {
+			return fakeResult{}
+		}
+		b.Status, b.Price = BookStatus(args[1].(int64)), int(args[2].(int64))
+		db.version++
+		return fakeResult{Affected: 1}
+	case queryHas(query, "INSERT INTO book_saga_log"):
+		at := sagaEpoch.Add(time.Duration(len(db.log)) * time.Second)
+		db.log = append(db.log, sagaEntry{BookStatus(args[1].(int64)), args[2].(string), args[3].(string), at})
+		return fakeResult{Affected: 1}
+	case queryHas(query, "SELECT status, step, error, created_at FROM book_saga_log"):
+		res := fakeResult{Cols: []string{"status", "step", "error", "created_at"}}
+		if args[0] != int64(b.ID) {
+			return res
+		}
+		for _, e := range db.log {
+			res.Rows = append(res.Rows, []driver.Value{int64(e.status), e.step, e.err, e.at})
+		}
+		return res
+	case queryHas(query, "SELECT step, count(*)"):
+		ok, failed := map[string]int64{}, map[string]int64{}
+		for _, e := range db.log {
+			if e.step == "" {
+				continue
+			}
+			if e.err == "" {
+				ok[e.step]++
+			} else {
+				failed[e.step]++
+			}
+		}
+		res := fakeResult{Cols: []string{"step", "ok", "failed"}}
+		for step := range mergeKeys(ok, failed) {
+			res.Rows = append(res.Rows, []driver.Value{step, ok[step], failed[step]})
+		}
+		return res
+	}
+	return fakeResult{Affected: 1}
+}
+
+func mergeKeys(a, b map[string]int64) map[string]bool {
+	keys := map[string]bool{}
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	return keys
+}
+
+func (db *sagaDB) status() BookStatus {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.book.Status
+}
+
+// steps returns the saga log entries of step.
+func (db *sagaDB) steps(step string) []sagaEntry {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var res []sagaEntry
+	for _, e := range db.log {
+		if e.step == step {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// postCallback sends body to the callback handler h as the other service
+// would.
+func postCallback(h http.HandlerFunc, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/book/callback", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+// TestLateCaptureAfterExpiryIsRefunded plays account capturing the payment
+// while the booking expires: the hold can't be released anymore, so the
+// capture callback that comes after the cancellation has to refund it.
+func TestLateCaptureAfterExpiryIsRefunded(t *testing.T) {
+	db := newSagaDB(t, bookModel{ID: 7, UserID: 5, EventID: 3, Price: 3000, Quantity: 1, Status: statusNeedToPay})
+	d := useStubServices(t, map[string]stubResponse{
+		"/events/cancel":   {http.StatusOK, ""},
+		"/account/release": {http.StatusNotFound, ""},
+		"/account/refund":  {http.StatusOK, ""},
+	})
+
+	b := db.book
+	compensate(&b, failExpired)
+	if s := db.status(); s != statusCancelled {
+		t.Fatalf("expired book is %s, want %s", s, statusCancelled)
+	}
+
+	w := postCallback(callbackPayment, `{"book_id":7,"user_id":5,"price":3000,"status":true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("callback answered %d, want 200", w.Code)
+	}
+	if s := db.status(); s != statusCancelled {
+		t.Errorf("late capture moved the book to %s", s)
+	}
+	refunds := d.sent("/account/refund")
+	if len(refunds) != 1 {
+		t.Fatalf("sent %d refunds, want 1", len(refunds))
+	}
+	if got := string(refunds[0].body); got != `{"book_id":7,"amount":3000}` {
+		t.Errorf("refund body %s", got)
+	}
+	if log := db.steps(stepRefund); len(log) != 1 || log[0].err != "" {
+		t.Errorf("refund saga log %+v, want one successful attempt", log)
+	}
+}
+
+// TestFailedRefundIsLoggedForRetry checks a refund account could not take is
+// left in the saga log as failed, which is what refundBooks picks up.
+func TestFailedRefundIsLoggedForRetry(t *testing.T) {
+	db := newSagaDB(t, bookModel{ID: 7, UserID: 5, EventID: 3, Price: 3000, Quantity: 1, Status: statusCancelled})
+	useStubServices(t, map[string]stubResponse{
+		"/account/refund": {http.StatusServiceUnavailable, ""},
+	})
+	markPaid(7)
+	log := db.steps(stepRefund)
+	if len(log) != 1 || log[0].err == "" {
+		t.Fatalf("refund saga log %+v, want one failed attempt", log)
+	}
+
+	useStubServices(t, map[string]stubResponse{
+		"/account/refund": {http.StatusOK, ""},
+	})
+	b := db.book
+	if err := refundBook(&b); err != nil {
+		t.Fatal(err)
+	}
+	if log = db.steps(stepRefund); len(log) != 2 || log[1].err != "" {
+		t.Fatalf("refund saga log %+v, want the retry to succeed", log)
+	}
+}
+
+// TestCaptureBeforeExpiryCompletes checks a capture that comes in time is
+// not refunded.
+func TestCaptureBeforeExpiryCompletes(t *testing.T) {
+	db := newSagaDB(t, bookModel{ID: 7, UserID: 5, EventID: 3, Price: 3000, Quantity: 1, Status: statusNeedToPay})
+	d := useStubServices(t, map[string]stubResponse{
+		"/events/commit":  {http.StatusOK, ""},
+		"/orders/booking": {http.StatusOK, `{"id":11}`},
+		"/notif/create":   {http.StatusOK, ""},
+	})
+	w := postCallback(callbackPayment, `{"book_id":7,"user_id":5,"price":3000,"status":true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("callback answered %d, want 200", w.Code)
+	}
+	if s := db.status(); s != statusCompleted {
+		t.Errorf("book is %s, want %s", s, statusCompleted)
+	}
+	if len(d.sent("/account/refund")) != 0 {
+		t.Error("paid book was refunded")
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+
+	"app/internal/client"
+)
+
+// stubResponse is what a stubbed service answers to a path.
+type stubResponse struct {
+	status int
+	body   string
+}
+
+// stubRequest is a request book sent to a stubbed service.
+type stubRequest struct {
+	host   string
+	path   string
+	header http.Header
+	body   []byte
+}
+
+// stubDoer answers the requests to the other services by path, a path
+// without a response gets 500.
+type stubDoer struct {
+	mu     sync.Mutex
+	routes map[string]stubResponse
+	reqs   []stubRequest
+}
+
+func (d *stubDoer) Do(req *http.Request) (*http.Response, error) {
+	body, _ := io.ReadAll(req.Body)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.reqs = append(d.reqs, stubRequest{host: req.URL.Host, path: req.URL.Path, header: req.Header, body: body})
+	res, ok := d.routes[req.URL.Path]
+	if !ok {
+		res = stubResponse{status: http.StatusInternalServerError}
+	}
+	return &http.Response{StatusCode: res.status, Body: io.NopCloser(bytes.NewBufferString(res.body))}, nil
+}
+
+// sent returns the requests sent to path.
+func (d *stubDoer) sent(path string) []stubRequest {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var reqs []stubRequest
+	for _, r := range d.reqs {
+		if r.path == path {
+			reqs = append(reqs, r)
+		}
+	}
+	return reqs
+}
+
+// useStubServices points services at a stubDoer with routes and empties the
+// event cache.
+func useStubServices(t *testing.T, routes map[string]stubResponse) *stubDoer {
+	t.Helper()
+	d := &stubDoer{routes: routes}
+	saved := services
+	services = client.New("http://events", "http://account", "http://orders", "http://notif")
+	services.HTTP = d
+	eventCacheMu.Lock()
+	eventCache = map[eventCacheKey]cachedEvent{}
+	eventCacheMu.Unlock()
+	t.Cleanup(func() { services = saved })
+	return d
+}
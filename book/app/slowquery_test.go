@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useSlowQueryLog sets slowQueryThreshold and collects the log for the test.
+func useSlowQueryLog(t *testing.T, threshold time.Duration) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	saved := slowQueryThreshold
+	slowQueryThreshold = threshold
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		slowQueryThreshold = saved
+	})
+	return &buf
+}
+
+func TestSlowQueryIsLogged(t *testing.T) {
+	delay := 30 * time.Millisecond
+	useFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		if queryHas(query, "FROM book WHERE id=$1") {
+			time.Sleep(delay)
+		}
+		return fakeResult{Cols: []string{"id", "user_id", "event_id", "price", "status", "quantity", "order_id"}, Rows: [][]driver.Value{{int64(7), int64(5), int64(3), int64(0), int64(statusNeedToPay), int64(1), int64(0)}}}
+	})
+
+	buf := useSlowQueryLog(t, 10*time.Millisecond)
+	getBook(7)
+	if !strings.Contains(buf.String(), "Slow query [getBook] took") {
+		t.Fatalf("logged %q, want the slow getBook", buf.String())
+	}
+
+	buf = useSlowQueryLog(t, time.Second)
+	getBook(7)
+	if strings.Contains(buf.String(), "Slow query") {
+		t.Errorf("logged %q for a query under the threshold", buf.String())
+	}
+}
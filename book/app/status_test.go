@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// useNumericStatus sets numericStatus as STATUS_NUMERIC does.
+func useNumericStatus(t *testing.T, on bool) {
+	saved := numericStatus
+	numericStatus = on
+	t.Cleanup(func() { numericStatus = saved })
+}
+
+func TestBookStatusString(t *testing.T) {
+	for status, want := range map[BookStatus]string{
+		statusCreated:            "created",
+		statusNeedToOccupy:       "need_to_occupy",
+		statusOccupied:           "occupied",
+		statusNeedToPay:          "need_to_pay",
+		statusPaid:               "paid",
+		statusNeedToNotify:       "need_to_notify",
+		statusCompleted:          "completed",
+		statusCancelled:          "cancelled",
+		statusNeedToReleaseSlot:  "need_to_release_slot",
+		statusCompensationFailed: "compensation_failed",
+		BookStatus(42):           "42",
+	} {
+		if got := status.String(); got != want {
+			t.Errorf("status %d is %q, want %q", int(status), got, want)
+		}
+	}
+}
+
+func TestBookStatusJSON(t *testing.T) {
+	useNumericStatus(t, false)
+	b := bookModel{ID: 7, UserID: 5, EventID: 3, Status: statusOccupied}
+	data, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"id":7,"user_id":5,"event_id":3,"status":"occupied"}`; string(data) != want {
+		t.Errorf("marshaled %s, want %s", data, want)
+	}
+
+	useNumericStatus(t, true)
+	if data, _ = json.Marshal(b); string(data) != `{"id":7,"user_id":5,"event_id":3,"status":2}` {
+		t.Errorf("marshaled %s with numeric statuses, want status 2", data)
+	}
+	if data, _ = json.Marshal(statusCancelled); string(data) != "-1" {
+		t.Errorf("marshaled cancelled to %s with numeric statuses, want -1", data)
+	}
+
+	for in, want := range map[string]BookStatus{
+		`"need_to_pay"`: statusNeedToPay,
+		`3`:             statusNeedToPay,
+		`"cancelled"`:   statusCancelled,
+		`-1`:            statusCancelled,
+	} {
+		var got BookStatus
+		if err := json.Unmarshal([]byte(in), &got); err != nil || got != want {
+			t.Errorf("unmarshaled %s to %v, %v, want %v", in, got, err, want)
+		}
+	}
+	var got BookStatus
+	if err := json.Unmarshal([]byte(`"lost"`), &got); err == nil {
+		t.Error("unmarshaled an unknown status name")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// ownedBook is a row of the fake book table for statuses.
+type ownedBook struct {
+	id, uid int
+	status  BookStatus
+}
+
+// useStatusesDB fakes the statuses query over books: it answers the rows
+// whose id is in the array argument and that belong to the user argument.
+func useStatusesDB(t *testing.T, books ...ownedBook) {
+	useFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		if !queryHas(query, "SELECT id, status FROM book WHERE id = ANY($1)") {
+			return fakeResult{}
+		}
+		ids := map[int64]bool{}
+		for _, s := range strings.Split(strings.Trim(args[0].(string), "{}"), ",") {
+			if id, err := strconv.ParseInt(s, 10, 64); err == nil {
+				ids[id] = true
+			}
+		}
+		res := fakeResult{Cols: []string{"id", "status"}}
+		for _, b := range books {
+			if ids[int64(b.id)] && int64(b.uid) == args[1] {
+				res.Rows = append(res.Rows, []driver.Value{int64(b.id), int64(b.status)})
+			}
+		}
+		return res
+	})
+}
+
+func TestStatusesOnlyOfCallersBooks(t *testing.T) {
+	useStatusesDB(t,
+		ownedBook{3, 5, statusNeedToPay},
+		ownedBook{4, 6, statusCompleted},
+		ownedBook{7, 5, statusCancelled},
+	)
+	r := httptest.NewRequest(http.MethodPost, "/book/statuses", strings.NewReader(`{"ids":[3,4,7,8]}`))
+	r.Header.Set("X-User-Id", "5")
+	w := httptest.NewRecorder()
+	statuses(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("answered %d %s", w.Code, w.Body.String())
+	}
+	got := map[int]BookStatus{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]BookStatus{3: statusNeedToPay, 7: statusCancelled}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
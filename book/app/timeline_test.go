@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// getTimeline asks for the timeline of the booking as user uid with role.
+func getTimeline(bid, uid, role string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/book/"+bid+"/timeline", nil)
+	r.Header.Set("X-User-Id", uid)
+	if role != "" {
+		r.Header.Set("X-User-Role", role)
+	}
+	r = mux.SetURLVars(r, map[string]string{"id": bid})
+	w := httptest.NewRecorder()
+	timeline(w, r)
+	return w
+}
+
+// TestTimelineFollowsSaga creates a booking, drives it to a failed payment
+// and checks the timeline lists every transition in order.
+func TestTimelineFollowsSaga(t *testing.T) {
+	newSagaDB(t, bookModel{ID: 7})
+	useStubServices(t, map[string]stubResponse{
+		"/events/cancel":   {http.StatusOK, ""},
+		"/account/release": {http.StatusServiceUnavailable, ""},
+	})
+	b := bookModel{EventID: 3, Quantity: 1}
+	bid, err := book(5, &b, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.ID, b.UserID = bid, 5
+	if err := occupyBook(bid, 1500); err != nil {
+		t.Fatal(err)
+	}
+	if err := modifyBookStatus(bid, statusNeedToPay); err != nil {
+		t.Fatal(err)
+	}
+	compensate(&b, failPayment)
+
+	want := `[
+		{"status":"need_to_occupy","at":"2030-05-01T12:00:00Z"},
+		{"status":"occupied","at":"2030-05-01T12:00:01Z"},
+		{"status":"need_to_pay","at":"2030-05-01T12:00:02Z"},
+		{"status":"need_to_release_slot","error":"payment","at":"2030-05-01T12:00:03Z"},
+		{"status":"need_to_release_slot","step":"cancel_slot","at":"2030-05-01T12:00:04Z"},
+		{"status":"need_to_release_slot","step":"release_hold","error":"account responded with status [503]","at":"2030-05-01T12:00:05Z"}
+	]`
+	w := getTimeline("7", "5", "")
+	if w.Code != http.StatusOK || !sameJSON(t, w.Body.Bytes(), []byte(want)) {
+		t.Fatalf("timeline answered %d %s, want 200 %s", w.Code, w.Body.String(), want)
+	}
+	if w := getTimeline("7", "6", ""); w.Code != http.StatusNotFound {
+		t.Errorf("timeline of another user answered %d, want 404", w.Code)
+	}
+	if w := getTimeline("7", "6", roleAdmin); w.Code != http.StatusOK || !sameJSON(t, w.Body.Bytes(), []byte(want)) {
+		t.Errorf("timeline for an admin answered %d %s, want 200 %s", w.Code, w.Body.String(), want)
+	}
+	if w := getTimeline("8", "5", ""); w.Code != http.StatusNotFound {
+		t.Errorf("timeline of a missing booking answered %d, want 404", w.Code)
+	}
+}
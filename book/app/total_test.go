@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// TestTotalMatchesListedBooks lists the books with count=true and checks the
+// total counts every listed booking, while a list without it stays a bare
+// array and counts nothing.
+func TestTotalMatchesListedBooks(t *testing.T) {
+	useStubServices(t, nil)
+	counted := useBooksList(t,
+		bookModel{ID: 7, UserID: 5, EventID: 3, Price: 1500, Status: statusNeedToPay, Quantity: 1},
+		bookModel{ID: 8, UserID: 5, EventID: 3, Price: 1500, Status: statusCompleted, Quantity: 2, OrderID: 11},
+		bookModel{ID: 9, UserID: 5, EventID: 4, Price: 900, Status: statusCancelled, Quantity: 1},
+	)
+
+	w := listBooks("?count=true")
+	page := struct {
+		Items []bookModel `json:"items"`
+		Total int         `json:"total"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("list answered %d %s", w.Code, w.Body.String())
+	}
+	if page.Total != 3 || len(page.Items) != page.Total {
+		t.Errorf("listed %s, want the 3 books counted", w.Body.String())
+	}
+
+	*counted = 0
+	w = listBooks("")
+	books := []bookModel{}
+	if err := json.Unmarshal(w.Body.Bytes(), &books); err != nil || len(books) != 3 {
+		t.Errorf("list without count answered %s, want a bare array of 3", w.Body.String())
+	}
+	if *counted != 0 {
+		t.Error("list without count=true counted the books")
+	}
+	if w := listBooks("?count=maybe"); w.Code != http.StatusBadRequest {
+		t.Errorf("count=maybe answered %d, want 400", w.Code)
+	}
+}
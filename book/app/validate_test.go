@@ -0,0 +1,56 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	const event = `{"id":3,"event_name":"Concert","price":1500,"starts_at":"2030-05-01T19:00:00Z","free_slots":60}`
+	tests := []struct {
+		name    string
+		event   stubResponse
+		balance string
+		body    string
+		want    string
+	}{
+		{"all clear", stubResponse{http.StatusOK, event}, `{"balance":3000}`, `{"event_id":3,"quantity":2}`, `{"ok":true,"reasons":[]}`},
+		{"no event", stubResponse{http.StatusNotFound, ""}, `{"balance":3000}`, `{"event_id":3}`, `{"ok":false,"reasons":["event_not_found"]}`},
+		{"event started", stubResponse{http.StatusOK, strings.Replace(event, "19:00", "11:00", 1)}, `{"balance":3000}`, `{"event_id":3}`, `{"ok":false,"reasons":["event_past"]}`},
+		{"event closed", stubResponse{http.StatusOK, strings.Replace(event, `"free_slots"`, `"closed":true,"free_slots"`, 1)}, `{"balance":3000}`, `{"event_id":3}`, `{"ok":false,"reasons":["event_closed"]}`},
+		{"no slots", stubResponse{http.StatusOK, strings.Replace(event, `"free_slots":60`, `"free_slots":1`, 1)}, `{"balance":3000}`, `{"event_id":3,"quantity":2}`, `{"ok":false,"reasons":["no_slots"]}`},
+		{"no funds", stubResponse{http.StatusOK, event}, `{"balance":2999}`, `{"event_id":3,"quantity":2}`, `{"ok":false,"reasons":["insufficient_funds"]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeClock(t)
+			queries := 0
+			useFakeDB(t, func(string, []driver.Value) fakeResult {
+				queries++
+				return fakeResult{}
+			})
+			d := useStubServices(t, map[string]stubResponse{
+				"/events/get/3": tt.event,
+				"/account/get":  {http.StatusOK, tt.balance},
+			})
+			r := httptest.NewRequest(http.MethodPost, "/book/validate", strings.NewReader(tt.body))
+			r.Header.Set("X-User-Id", "5")
+			w := httptest.NewRecorder()
+			validate(w, r)
+			if w.Code != http.StatusOK || w.Body.String() != tt.want {
+				t.Fatalf("answered %d %s, want 200 %s", w.Code, w.Body.String(), tt.want)
+			}
+			if queries != 0 {
+				t.Errorf("ran %d statements", queries)
+			}
+			for _, req := range d.reqs {
+				if req.path != "/events/get/3" && req.path != "/account/get" {
+					t.Errorf("sent a request to %s", req.path)
+				}
+			}
+		})
+	}
+}
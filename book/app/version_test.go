@@ -0,0 +1,67 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// TestStaleUpdateRereadsStatus lets another writer cancel the booking right
+// after modifyBookStatus has read it: the stale update must not apply, and
+// the booking must stay cancelled.
+func TestStaleUpdateRereadsStatus(t *testing.T) {
+	db := &sagaDB{book: bookModel{ID: 7, UserID: 5, EventID: 3, Quantity: 1, Status: statusNeedToOccupy}}
+	raced := false
+	useFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		res := db.handle(query, args)
+		if !raced && queryHas(query, "SELECT status, version FROM book") {
+			raced = true
+			db.mu.Lock()
+			db.book.Status = statusCancelled
+			db.version++
+			db.mu.Unlock()
+		}
+		return res
+	})
+	if err := modifyBookStatus(7, statusOccupied); !errors.Is(err, errBookCancelled) {
+		t.Fatalf("got %v, want errBookCancelled", err)
+	}
+	if s := db.status(); s != statusCancelled {
+		t.Fatalf("book is %s, want %s", s, statusCancelled)
+	}
+}
+
+// TestConcurrentStatusUpdates races callbacks moving the booking on with a
+// cancel. Whatever the order, a cancelled booking stays cancelled and every
+// applied update bumped the version once.
+func TestConcurrentStatusUpdates(t *testing.T) {
+	db := newSagaDB(t, bookModel{ID: 7, UserID: 5, EventID: 3, Quantity: 1, Status: statusNeedToOccupy})
+	var wg sync.WaitGroup
+	var cancelErr error
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i == 10 {
+				cancelErr = modifyBookStatus(7, statusCancelled)
+				return
+			}
+			modifyBookStatus(7, []BookStatus{statusOccupied, statusNeedToPay}[i%2])
+		}(i)
+	}
+	wg.Wait()
+	if cancelErr == nil && db.status() != statusCancelled {
+		t.Fatalf("cancel succeeded but the book is %s", db.status())
+	}
+	cancelled := false
+	for _, e := range db.steps("") {
+		if cancelled {
+			t.Fatalf("book moved to %s after it was cancelled, log %+v", e.status, db.log)
+		}
+		cancelled = e.status == statusCancelled
+	}
+	if int(db.version) != len(db.steps("")) {
+		t.Errorf("version %d after %d applied updates", db.version, len(db.steps("")))
+	}
+}
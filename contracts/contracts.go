@@ -0,0 +1,94 @@
+// Package contracts holds the bodies the services send each other. The
+// producer and the consumer of a message both use the type from here, so a
+// json name can't change on one side only. The expected wire form of every
+// message is kept in testdata and checked by the tests of this package.
+package contracts
+
+// SlotRequest asks events to occupy, cancel or commit the slots of an event
+// held for a booking. Quantity is sent with an occupy only, 0 means one slot.
+type SlotRequest struct {
+	BookID   int `json:"book_id"`
+	EventID  int `json:"event_id"`
+	Quantity int `json:"quantity,omitempty"`
+}
+
+// OccupyResult is the callback events sends to book once an occupy is done.
+// Price is for all the slots, Reason tells why a failed occupy failed.
+type OccupyResult struct {
+	BookID int    `json:"book_id"`
+	UserID int    `json:"user_id"`
+	Price  int    `json:"price"`
+	Status bool   `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// FundsRequest asks account to hold, capture or release funds for a booking.
+// On capture Amount may be less than the hold, 0 captures the whole hold.
+type FundsRequest struct {
+	BookID int `json:"book_id"`
+	Amount int `json:"amount"`
+}
+
+// PaymentResult is the callback account sends to book once the payment of a
+// booking is done.
+type PaymentResult struct {
+	BookID int  `json:"book_id"`
+	UserID int  `json:"user_id"`
+	Price  int  `json:"price"`
+	Status bool `json:"status"`
+}
+
+// BookingOrder asks orders to record a paid booking as an order of the user.
+type BookingOrder struct {
+	BookID int    `json:"book_id"`
+	Item   string `json:"item"`
+	Amount int    `json:"amount"`
+}
+
+// Withdrawal takes WithDrawSum from the user's account. Reason is kept with
+// the operation.
+type Withdrawal struct {
+	BookID      int    `json:"book_id"`
+	WithDrawSum int    `json:"withdrawal_sum"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// Deposit adds Delta to the user's account.
+type Deposit struct {
+	Delta int `json:"delta"`
+}
+
+// Balance is the available balance of the user as account reports it.
+type Balance struct {
+	Balance int64 `json:"balance"`
+}
+
+// Notification asks notif to notify a user. Either Message is set, or Type
+// and Params that notif renders in Locale. Priority is low, normal or high,
+// notif takes normal if it is not set. Channel is inapp or email, notif takes
+// inapp if it is not set and when it can't send email.
+type Notification struct {
+	UserID   int               `json:"userid"`
+	Message  string            `json:"message,omitempty"`
+	Type     string            `json:"type,omitempty"`
+	Params   map[string]string `json:"params,omitempty"`
+	Locale   string            `json:"locale,omitempty"`
+	Priority string            `json:"priority,omitempty"`
+	Channel  string            `json:"channel,omitempty"`
+}
+
+// EventIDs lists the events to get the availability of.
+type EventIDs struct {
+	IDs []int `json:"ids"`
+}
+
+// Availability is how many slots of an event are taken and how many are
+// left.
+type Availability struct {
+	ID        int    `json:"id"`
+	Name      string `json:"event_name"`
+	Price     int    `json:"price"`
+	Total     int    `json:"total"`
+	Occupied  int    `json:"occupied"`
+	Available int    `json:"available"`
+}
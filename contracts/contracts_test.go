@@ -0,0 +1,92 @@
+package contracts
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestGolden decodes every golden message into its type, compares it with
+// the expected value and encodes it back to the same json. A renamed field
+// or a changed type fails one of the two directions.
+func TestGolden(t *testing.T) {
+	tests := []struct {
+		file string
+		got  interface{}
+		want interface{}
+	}{
+		{"slot_request.json", &SlotRequest{}, &SlotRequest{BookID: 7, EventID: 3, Quantity: 2}},
+		{"occupy_result.json", &OccupyResult{}, &OccupyResult{BookID: 7, UserID: 5, Price: 3000, Reason: "no free slots"}},
+		{"funds_request.json", &FundsRequest{}, &FundsRequest{BookID: 7, Amount: 3000}},
+		{"payment_result.json", &PaymentResult{}, &PaymentResult{BookID: 7, UserID: 5, Price: 3000, Status: true}},
+		{"booking_order.json", &BookingOrder{}, &BookingOrder{BookID: 7, Item: "Concert", Amount: 3000}},
+		{"withdrawal.json", &Withdrawal{}, &Withdrawal{BookID: 7, WithDrawSum: 3000, Reason: "order 11"}},
+		{"deposit.json", &Deposit{}, &Deposit{Delta: 3000}},
+		{"balance.json", &Balance{}, &Balance{Balance: 12000}},
+		{"notification.json", &Notification{}, &Notification{
+			UserID:   5,
+			Type:     "order_failed",
+			Params:   map[string]string{"reason": "Not enough funds on your account"},
+			Locale:   "en",
+			Priority: "high",
+		}},
+		{"notification_message.json", &Notification{}, &Notification{UserID: 5, Message: "Your balance is below 100"}},
+		{"notification_email.json", &Notification{}, &Notification{
+			UserID:  5,
+			Type:    "booking_confirmed",
+			Params:  map[string]string{"book_id": "7", "event": "Rock Concert", "price": "3000"},
+			Channel: "email",
+		}},
+		{"event_ids.json", &EventIDs{}, &EventIDs{IDs: []int{3, 4}}},
+		{"availability.json", &[]Availability{}, &[]Availability{
+			{ID: 3, Name: "Concert", Price: 1500, Total: 100, Occupied: 40, Available: 60},
+			{ID: 4, Name: "Lecture", Total: 30, Occupied: 30},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			golden := readGolden(t, tt.file)
+			dec := json.NewDecoder(bytes.NewReader(golden))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(tt.got); err != nil {
+				t.Fatalf("decode: %s", err)
+			}
+			if !reflect.DeepEqual(tt.got, tt.want) {
+				t.Fatalf("decoded %+v, want %+v", tt.got, tt.want)
+			}
+			data, err := json.Marshal(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameJSON(t, data, golden) {
+				t.Fatalf("encoded %s, want %s", data, golden)
+			}
+		})
+	}
+}
+
+func readGolden(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// sameJSON reports whether a and b are the same json value regardless of
+// formatting and key order.
+func sameJSON(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var va, vb interface{}
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(va, vb)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAvailabilityOfManyEvents(t *testing.T) {
+	db := newEventsDB(t,
+		eventModel{ID: 3, Name: "Concert", Price: 1500, TotalSlots: 10},
+		eventModel{ID: 4, Name: "Play", Price: 900, TotalSlots: 2},
+		eventModel{ID: 5, Name: "Jazz", Price: 500, TotalSlots: 10, OverbookPct: 20},
+		eventModel{ID: 6, Name: "Meetup", Price: 0, TotalSlots: 5},
+	)
+	for _, s := range []slotRow{
+		{eventID: 3, bookID: 1}, {eventID: 3, bookID: 1}, {eventID: 3, bookID: 2},
+		{eventID: 3, bookID: 9, freed: true},
+		{eventID: 4, bookID: 3}, {eventID: 4, bookID: 4},
+		{eventID: 5, bookID: 5},
+	} {
+		s := s
+		db.slots = append(db.slots, &s)
+	}
+
+	w := send(availability, http.MethodPost, "/events/availability", `{"ids":[5,3,99,4,6]}`, nil)
+	want := `[
+		{"id":3,"event_name":"Concert","price":1500,"total":10,"occupied":3,"available":7},
+		{"id":4,"event_name":"Play","price":900,"total":2,"occupied":2,"available":0},
+		{"id":5,"event_name":"Jazz","price":500,"total":12,"occupied":1,"available":11},
+		{"id":6,"event_name":"Meetup","price":0,"total":5,"occupied":0,"available":5}
+	]`
+	if w.Code != http.StatusOK || !sameJSON(t, w.Body.Bytes(), []byte(want)) {
+		t.Fatalf("availability answered %d %s, want 200 %s", w.Code, w.Body.String(), want)
+	}
+	if n := len(db.queries); n != 1 {
+		t.Errorf("availability ran %d queries, want 1", n)
+	}
+
+	w = send(availability, http.MethodPost, "/events/availability", `{"ids":[99]}`, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "[]" {
+		t.Errorf("availability of an unknown event answered %d %s, want 200 []", w.Code, w.Body.String())
+	}
+}
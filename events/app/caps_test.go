@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestCreateCaps(t *testing.T) {
+	useCaps(t, 1000, 50000)
+	db := newEventsDB(t)
+	tests := []struct {
+		name         string
+		slots, price int
+		want         int
+	}{
+		{"below", 999, 49999, http.StatusOK},
+		{"at", 1000, 50000, http.StatusOK},
+		{"slots above", 1001, 50000, http.StatusBadRequest},
+		{"price above", 1000, 50001, http.StatusBadRequest},
+		{"far above", 1 << 40, 1 << 40, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		body := fmt.Sprintf(`{"event_name":"Concert","price":%d,"total_slots":%d,"starts_at":"2030-06-01T19:00:00Z"}`, tt.price, tt.slots)
+		if w := send(create, http.MethodPost, "/events/create", body, nil); w.Code != tt.want {
+			t.Errorf("%s the caps answered %d %s, want %d", tt.name, w.Code, w.Body.String(), tt.want)
+		}
+	}
+	if len(db.rows) != 2 {
+		t.Errorf("stored %d events, want the 2 within the caps", len(db.rows))
+	}
+}
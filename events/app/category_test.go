@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestCreateWithCategoryAndFilter(t *testing.T) {
+	db := newEventsDB(t)
+	useCaps(t, 100000, 10000000)
+	for _, body := range []string{
+		`{"event_name":"Rock Concert","price":1500,"total_slots":100,"category":"concert","starts_at":"2030-05-01T19:00:00Z"}`,
+		`{"event_name":"Hamlet","price":900,"total_slots":50,"category":"theatre","starts_at":"2030-05-02T19:00:00Z"}`,
+		`{"event_name":"Jazz","price":500,"total_slots":30,"category":"concert","starts_at":"2030-05-03T19:00:00Z"}`,
+		`{"event_name":"Meetup","price":0,"total_slots":30,"starts_at":"2030-05-04T19:00:00Z"}`,
+	} {
+		if w := send(create, http.MethodPost, "/events/create", body, nil); w.Code != http.StatusOK {
+			t.Fatalf("create answered %d %s", w.Code, w.Body.String())
+		}
+	}
+	w := send(create, http.MethodPost, "/events/create", `{"event_name":"Rave","price":100,"total_slots":30,"category":"party","starts_at":"2030-05-04T19:00:00Z"}`, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown category answered %d, want 400", w.Code)
+	}
+	categories := []string{}
+	for _, r := range db.rows {
+		categories = append(categories, r.Category)
+	}
+	if want := []string{"concert", "theatre", "concert", defaultEventCategory}; !reflect.DeepEqual(categories, want) {
+		t.Fatalf("stored categories %v, want %v", categories, want)
+	}
+
+	if ids := listIDs(t, "?category=concert"); !reflect.DeepEqual(ids, []int{3, 5}) {
+		t.Errorf("concerts listed %v, want [3 5]", ids)
+	}
+	if ids := listIDs(t, "?category=theatre"); !reflect.DeepEqual(ids, []int{4}) {
+		t.Errorf("theatre listed %v, want [4]", ids)
+	}
+	if w := send(get, http.MethodGet, "/events/get?category=party", "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown category filter answered %d, want 400", w.Code)
+	}
+}
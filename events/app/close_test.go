@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestClosedAndSoldOutAreDistinct closes an event, then fills it, and checks
+// occupy tells the two refusals apart.
+func TestClosedAndSoldOutAreDistinct(t *testing.T) {
+	c := useFakeClock(t)
+	useOccupyLimiter(t, 0)
+	db := newEventsDB(t, eventModel{ID: 3, Name: "Concert", Price: 1500, TotalSlots: 2, StartsAt: c.Now().Add(time.Hour)})
+	vars := map[string]string{"id": "3"}
+
+	if w := send(setClosed(true), http.MethodPost, "/events/3/close", "", vars); w.Code != http.StatusOK {
+		t.Fatalf("close answered %d", w.Code)
+	}
+	steps := []struct {
+		name     string
+		run      func() int
+		callback string
+	}{
+		{"closed", func() int { return occupyFor(7, 1) }, `{"book_id":7,"user_id":5,"price":0,"status":false,"reason":"event_closed"}`},
+		{"reopened", func() int {
+			if w := send(setClosed(false), http.MethodPost, "/events/3/open", "", vars); w.Code != http.StatusOK {
+				t.Fatalf("open answered %d", w.Code)
+			}
+			return occupyFor(8, 2)
+		}, `{"book_id":8,"user_id":5,"price":3000,"status":true}`},
+		{"full", func() int { return occupyFor(9, 1) }, `{"book_id":9,"user_id":5,"price":1500,"status":false,"reason":"sold_out"}`},
+	}
+	for _, s := range steps {
+		cb := useCallbackRecorder(t)
+		if code := s.run(); code != http.StatusOK {
+			t.Fatalf("%s: occupy answered %d", s.name, code)
+		}
+		if sent := cb.sent(); len(sent) != 1 || !sameJSON(t, []byte(sent[0]), []byte(s.callback)) {
+			t.Errorf("%s: callbacks %v, want %s", s.name, sent, s.callback)
+		}
+	}
+	for _, s := range db.taken(3) {
+		if s.bookID != 8 {
+			t.Errorf("book %d holds a slot, want only book 8", s.bookID)
+		}
+	}
+
+	if w := send(setClosed(true), http.MethodPost, "/events/4/close", "", map[string]string{"id": "4"}); w.Code != http.StatusNotFound {
+		t.Errorf("closing an unknown event answered %d, want 404", w.Code)
+	}
+}
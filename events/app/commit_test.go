@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestOccupyThenCommit(t *testing.T) {
+	c := useFakeClock(t)
+	useOccupyLimiter(t, 0)
+	useCallbackRecorder(t)
+	db := newEventsDB(t, eventModel{ID: 3, Name: "Concert", Price: 1500, TotalSlots: 10, StartsAt: c.Now().Add(time.Hour)})
+	if code := postOccupy(3, 2); code != http.StatusOK {
+		t.Fatalf("occupy answered %d", code)
+	}
+	for _, s := range db.taken(3) {
+		if s.status != int64(statusOccupied) {
+			t.Fatalf("occupied slot has status %d, want %d", s.status, statusOccupied)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := send(commitSlot, http.MethodPost, "/events/commit", `{"book_id":7,"event_id":3}`, nil); w.Code != http.StatusOK {
+			t.Fatalf("commit answered %d, want 200", w.Code)
+		}
+	}
+	slots := db.taken(3)
+	if len(slots) != 2 {
+		t.Fatalf("event holds %d slots after commit, want 2", len(slots))
+	}
+	for _, s := range slots {
+		if s.status != int64(statusCommited) {
+			t.Errorf("slot has status %d after commit, want %d", s.status, statusCommited)
+		}
+	}
+
+	if w := send(commitSlot, http.MethodPost, "/events/commit", `{"book_id":8,"event_id":3}`, nil); w.Code != http.StatusNotFound {
+		t.Errorf("commit without an occupied slot answered %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// goldenDir holds the messages of the shared contracts package.
+const goldenDir = "../../contracts/testdata"
+
+func readGolden(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(goldenDir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// sameJSON reports whether a and b are the same json value regardless of
+// formatting and key order.
+func sameJSON(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var va, vb interface{}
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+// TestEventMatchesContract checks the event book reads from events get.
+func TestEventMatchesContract(t *testing.T) {
+	free := 60
+	e := eventModel{
+		ID:            3,
+		Name:          "Concert",
+		Price:         1500,
+		TotalSlots:    100,
+		Category:      "music",
+		StartsAt:      time.Date(2030, 5, 1, 19, 0, 0, 0, time.UTC),
+		Description:   "Open air",
+		AllowMultiple: true,
+		FreeSlots:     &free,
+		Tags:          []string{"live"},
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if golden := readGolden(t, "event.json"); !sameJSON(t, data, golden) {
+		t.Fatalf("encoded %s, want %s", data, golden)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDuplicateStartsEmpty(t *testing.T) {
+	c := useFakeClock(t)
+	useCaps(t, 1000, 100000)
+	start := c.Now().Add(24 * time.Hour)
+	orig := eventModel{ID: 3, Name: "Jazz night", Price: 1500, TotalSlots: 10, Category: "concert", StartsAt: start,
+		Description: "Weekly jam", ImageURI: "https://img.example.com/jazz.png", OverbookPct: 10}
+	db := newEventsDB(t, orig)
+	db.slots = []*slotRow{
+		{eventID: 3, bookID: 7, userID: 5, status: int64(statusOccupied)},
+		{eventID: 3, bookID: 8, userID: 6, status: int64(statusCommited)},
+	}
+
+	w := send(duplicateEvent, http.MethodPost, "/events/3/duplicate", `{"starts_at":"2030-05-09T19:00:00Z"}`, map[string]string{"id": "3"})
+	if w.Code != http.StatusOK || w.Body.String() != `{"id":4}` {
+		t.Fatalf("duplicate answered %d %s, want 200 with the new id 4", w.Code, w.Body.String())
+	}
+	want := orig
+	want.ID, want.Name, want.StartsAt = 4, "Jazz night (2030-05-09 19:00)", time.Date(2030, 5, 9, 19, 0, 0, 0, time.UTC)
+	if got := db.rows[1].eventModel; !got.StartsAt.Equal(want.StartsAt) || got.Name != want.Name || got.Price != want.Price ||
+		got.TotalSlots != want.TotalSlots || got.Category != want.Category || got.Description != want.Description ||
+		got.ImageURI != want.ImageURI || got.OverbookPct != want.OverbookPct {
+		t.Errorf("stored copy %+v, want %+v", got, want)
+	}
+	if n := len(db.taken(4)); n != 0 {
+		t.Errorf("copy holds %d slots, want none", n)
+	}
+	if n := len(db.taken(3)); n != 2 {
+		t.Errorf("original holds %d slots after the copy, want 2", n)
+	}
+
+	w = send(get, http.MethodGet, "/events/get/4", "", map[string]string{"id": "4"})
+	got := eventModel{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.FreeSlots == nil || *got.FreeSlots != capacity(&want) {
+		t.Errorf("copy reports free slots %v, want %d", got.FreeSlots, capacity(&want))
+	}
+
+	if w := send(duplicateEvent, http.MethodPost, "/events/9/duplicate", "", map[string]string{"id": "9"}); w.Code != http.StatusNotFound {
+		t.Errorf("duplicate of a missing event answered %d, want 404", w.Code)
+	}
+}
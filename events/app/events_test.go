@@ -0,0 +1,429 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// eventRow is an event as the fake events table keeps it.
+type eventRow struct {
+	eventModel
+	deleted bool
+}
+
+// slotRow is a slot as the fake slots table keeps it.
+type slotRow struct {
+	eventID, bookID, userID int64
+	status                  int64
+	freed                   bool
+	expiresAt               time.Time
+}
+
+// eventsDB fakes the events table for the statements listing, reading,
+// updating, tagging, closing and deleting events, and the slots table for
+// occupying, committing, cancelling, expiring and counting slots. The list
+// query is built at runtime, so its conditions are matched one by one.
+type eventsDB struct {
+	mu      sync.Mutex
+	rows    []*eventRow
+	tags    map[int][]string
+	slots   []*slotRow
+	queries []string
+}
+
+// newEventsDB holds the events es, starting on 2030-05-01 by default, and
+// empties the occupancy cache.
+func newEventsDB(t *testing.T, es ...eventModel) *eventsDB {
+	db := &eventsDB{tags: map[int][]string{}}
+	occupancyMu.Lock()
+	occupancy = map[int]int{}
+	occupancyMu.Unlock()
+	for _, e := range es {
+		if e.StartsAt.IsZero() {
+			e.StartsAt = time.Date(2030, 5, 1, 19, 0, 0, 0, time.UTC)
+		}
+		if e.Category == "" {
+			e.Category = defaultEventCategory
+		}
+		db.rows = append(db.rows, &eventRow{eventModel: e})
+	}
+	useFakeDB(t, db.handle)
+	return db
+}
+
+var (
+	nameCond     = regexp.MustCompile(`event_name ILIKE \$(\d+)`)
+	categoryCond = regexp.MustCompile(`category = \$(\d+)`)
+	tagCond      = regexp.MustCompile(`tag = \$(\d+)`)
+	minPriceCond = regexp.MustCompile(`price >= \$(\d+)`)
+	maxPriceCond = regexp.MustCompile(`price <= \$(\d+)`)
+	limitCond    = regexp.MustCompile(`LIMIT \$(\d+)`)
+	offsetCond   = regexp.MustCompile(`OFFSET \$(\d+)`)
+)
+
+// param returns the argument the placeholder cond captured in query, or nil
+// if query has no such condition.
+func param(cond *regexp.Regexp, query string, args []driver.Value) driver.Value {
+	m := cond.FindStringSubmatch(query)
+	if m == nil {
+		return nil
+	}
+	n, _ := strconv.Atoi(m[1])
+	return args[n-1]
+}
+
+// matches reports whether the row satisfies the conditions of query.
+func (db *eventsDB) matches(r *eventRow, query string, args []driver.Value) bool {
+	if r.deleted && strings.Contains(query, "deleted_at IS NULL") {
+		return false
+	}
+	if v := param(nameCond, query, args); v != nil {
+		name := strings.Trim(strings.ReplaceAll(v.(string), `\`, ""), "%")
+		if !strings.Contains(strings.ToLower(r.Name), strings.ToLower(name)) {
+			return false
+		}
+	}
+	if v := param(categoryCond, query, args); v != nil && r.Category != v {
+		return false
+	}
+	if v := param(tagCond, query, args); v != nil && !contains(db.tags[r.ID], v.(string)) {
+		return false
+	}
+	if v := param(minPriceCond, query, args); v != nil && int64(r.Price) < v.(int64) {
+		return false
+	}
+	if v := param(maxPriceCond, query, args); v != nil && int64(r.Price) > v.(int64) {
+		return false
+	}
+	return true
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func eventValues(e eventModel) []driver.Value {
+	return []driver.Value{int64(e.ID), e.Name, int64(e.Price), int64(e.TotalSlots), e.Category, e.StartsAt, e.Description, e.ImageURI, int64(e.OverbookPct), e.Closed, e.AllowMultiple}
+}
+
+var eventColumns = []string{"id", "event_name", "price", "total_slots", "category", "starts_at", "description", "image_uri", "overbook_pct", "closed", "allow_multiple"}
+
+func (db *eventsDB) handle(query string, args []driver.Value) fakeResult {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.queries = append(db.queries, query)
+	switch {
+	case queryHas(query, "INSERT INTO event_tags"):
+		eid := int(args[0].(int64))
+		for _, r := range db.rows {
+			if r.ID == eid && !r.deleted && !contains(db.tags[eid], args[1].(string)) {
+				db.tags[eid] = append(db.tags[eid], args[1].(string))
+				return fakeResult{Affected: 1}
+			}
+		}
+		return fakeResult{}
+	case queryHas(query, "DELETE FROM event_tags"):
+		eid := int(args[0].(int64))
+		for i, tag := range db.tags[eid] {
+			if tag == args[1] {
+				db.tags[eid] = append(db.tags[eid][:i:i], db.tags[eid][i+1:]...)
+				return fakeResult{Affected: 1}
+			}
+		}
+		return fakeResult{}
+	case queryHas(query, "SELECT closed FROM events WHERE id=$1 FOR UPDATE"):
+		res := fakeResult{Cols: []string{"closed"}}
+		for _, r := range db.rows {
+			if int64(r.ID) == args[0] {
+				res.Rows = [][]driver.Value{{r.Closed}}
+			}
+		}
+		return res
+	case queryHas(query, "UPDATE events SET closed=$2"):
+		for _, r := range db.rows {
+			if int64(r.ID) == args[0] && !r.deleted {
+				r.Closed = args[1].(bool)
+				return fakeResult{Affected: 1}
+			}
+		}
+		return fakeResult{}
+	case queryHas(query, "INSERT INTO events (event_name"):
+		e := eventModel{
+			ID:            len(db.rows) + 3,
+			Name:          args[0].(string),
+			Price:         int(args[1].(int64)),
+			TotalSlots:    int(args[2].(int64)),
+			Category:      args[3].(string),
+			StartsAt:      args[4].(time.Time),
+			Description:   args[5].(string),
+			ImageURI:      args[6].(string),
+			OverbookPct:   int(args[7].(int64)),
+			AllowMultiple: args[8].(bool),
+		}
+		db.rows = append(db.rows, &eventRow{eventModel: e})
+		return fakeResult{Cols: []string{"id"}, Rows: [][]driver.Value{{int64(e.ID)}}}
+	case queryHas(query, "UPDATE events SET description=$2"):
+		for _, r := range db.rows {
+			if int64(r.ID) == args[0] && !r.deleted {
+				r.Description, r.ImageURI = args[1].(string), args[2].(string)
+				r.OverbookPct, r.AllowMultiple = int(args[3].(int64)), args[4].(bool)
+				return fakeResult{Affected: 1}
+			}
+		}
+		return fakeResult{}
+	case queryHas(query, "UPDATE events SET deleted_at"):
+		for _, r := range db.rows {
+			if int64(r.ID) == args[0] && !r.deleted {
+				r.deleted = true
+				return fakeResult{Affected: 1}
+			}
+		}
+		return fakeResult{}
+	case queryHas(query, "SELECT COUNT(1) FROM events WHERE"):
+		n := int64(0)
+		for _, r := range db.rows {
+			if db.matches(r, query, args) {
+				n++
+			}
+		}
+		return fakeResult{Cols: []string{"count"}, Rows: [][]driver.Value{{n}}}
+	case queryHas(query, "FROM events WHERE id=$1"):
+		res := fakeResult{Cols: eventColumns}
+		for _, r := range db.rows {
+			if int64(r.ID) == args[0] && db.matches(r, query, args) {
+				res.Rows = append(res.Rows, eventValues(r.eventModel))
+			}
+		}
+		return res
+	case queryHas(query, "FROM events WHERE", "ORDER BY id"):
+		res := fakeResult{Cols: eventColumns}
+		for _, r := range db.rows {
+			if db.matches(r, query, args) {
+				res.Rows = append(res.Rows, eventValues(r.eventModel))
+			}
+		}
+		if v := param(offsetCond, query, args); v != nil {
+			res.Rows = res.Rows[min(int(v.(int64)), len(res.Rows)):]
+		}
+		if v := param(limitCond, query, args); v != nil {
+			res.Rows = res.Rows[:min(int(v.(int64)), len(res.Rows))]
+		}
+		return res
+	case queryHas(query, "SELECT tag FROM event_tags"):
+		res := fakeResult{Cols: []string{"tag"}}
+		for _, tag := range db.tags[int(args[0].(int64))] {
+			res.Rows = append(res.Rows, []driver.Value{tag})
+		}
+		return res
+	case queryHas(query, "SELECT COUNT(1) FROM slots WHERE event_id=$1"):
+		n := int64(0)
+		for _, s := range db.slots {
+			if s.eventID == args[0] && !s.freed {
+				n++
+			}
+		}
+		return fakeResult{Cols: []string{"count"}, Rows: [][]driver.Value{{n}}}
+	case queryHas(query, "FROM events e LEFT JOIN slots s", "GROUP BY e.id"):
+		res := fakeResult{Cols: []string{"id", "event_name", "price", "total_slots", "overbook_pct", "count"}}
+		ids := strings.Split(strings.Trim(args[0].(string), "{}"), ",")
+		for _, r := range db.rows {
+			if r.deleted || !contains(ids, strconv.Itoa(r.ID)) {
+				continue
+			}
+			n := int64(0)
+			for _, s := range db.slots {
+				if s.eventID == int64(r.ID) && !s.freed {
+					n++
+				}
+			}
+			res.Rows = append(res.Rows, []driver.Value{int64(r.ID), r.Name, int64(r.Price), int64(r.TotalSlots), int64(r.OverbookPct), n})
+		}
+		return res
+	case queryHas(query, "INSERT INTO slots"):
+		for i := int64(0); i < args[5].(int64); i++ {
+			expiresAt, _ := args[4].(time.Time)
+			db.slots = append(db.slots, &slotRow{eventID: args[0].(int64), bookID: args[1].(int64), userID: args[2].(int64), status: args[3].(int64), expiresAt: expiresAt})
+		}
+		return fakeResult{Affected: args[5].(int64)}
+	case queryHas(query, "UPDATE slots SET status=$2, deleted_at=now()", "WHERE book_id=$1"):
+		res := fakeResult{Cols: []string{"event_id"}}
+		for _, s := range db.slots {
+			if s.bookID == args[0] && !s.freed {
+				s.status, s.freed = args[1].(int64), true
+				res.Rows = append(res.Rows, []driver.Value{s.eventID})
+			}
+		}
+		return res
+	case queryHas(query, "UPDATE slots SET status=$1, deleted_at=now()", "expires_at < $4"):
+		res := fakeResult{Cols: []string{"book_id", "event_id", "user_id"}}
+		for _, s := range db.slots {
+			if !s.freed && s.status == args[1] && !s.expiresAt.IsZero() && s.expiresAt.Before(args[3].(time.Time)) {
+				s.status, s.freed = args[0].(int64), true
+				res.Rows = append(res.Rows, []driver.Value{s.bookID, s.eventID, s.userID})
+			}
+		}
+		return res
+	case queryHas(query, "UPDATE slots SET status=$2, expires_at=NULL"):
+		n := int64(0)
+		for _, s := range db.slots {
+			if s.bookID == args[0] && !s.freed && (s.status == args[1] || s.status == args[2]) {
+				s.status, s.expiresAt = args[1].(int64), time.Time{}
+				n++
+			}
+		}
+		return fakeResult{Affected: n}
+	}
+	return fakeResult{}
+}
+
+// taken returns the slots of the event that are not freed.
+func (db *eventsDB) taken(eid int) []slotRow {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	res := []slotRow{}
+	for _, s := range db.slots {
+		if s.eventID == int64(eid) && !s.freed {
+			res = append(res, *s)
+		}
+	}
+	return res
+}
+
+// ran reports whether a statement containing every part was run.
+func (db *eventsDB) ran(parts ...string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, q := range db.queries {
+		if queryHas(q, parts...) {
+			return true
+		}
+	}
+	return false
+}
+
+// send sends a request with the given route vars to h as user 5 and returns
+// the recorded answer.
+func send(h http.HandlerFunc, method, target, body string, vars map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("X-User-Id", "5")
+	if vars != nil {
+		r = mux.SetURLVars(r, vars)
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+// useCaps sets the caps of new events as main does with the defaults.
+func useCaps(t *testing.T, slots, price int) {
+	savedSlots, savedPrice := maxTotalSlots, maxPrice
+	maxTotalSlots, maxPrice = slots, price
+	t.Cleanup(func() { maxTotalSlots, maxPrice = savedSlots, savedPrice })
+}
+
+// listIDs lists the events matching query and returns their ids.
+func listIDs(t *testing.T, query string) []int {
+	t.Helper()
+	w := send(get, http.MethodGet, "/events/get"+query, "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("list answered %d %s", w.Code, w.Body.String())
+	}
+	es := []eventModel{}
+	if err := json.Unmarshal(w.Body.Bytes(), &es); err != nil {
+		t.Fatal(err)
+	}
+	ids := []int{}
+	for _, e := range es {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+func TestDeletedEventLeavesListButStaysInTable(t *testing.T) {
+	db := newEventsDB(t, eventModel{ID: 3, Name: "Concert"}, eventModel{ID: 4, Name: "Lecture"})
+	if ids := listIDs(t, ""); len(ids) != 2 {
+		t.Fatalf("listed %v before the delete, want both events", ids)
+	}
+	if w := send(deleteEvent, http.MethodDelete, "/events/delete/3", "", map[string]string{"id": "3"}); w.Code != http.StatusOK {
+		t.Fatalf("delete answered %d", w.Code)
+	}
+	if ids := listIDs(t, ""); len(ids) != 1 || ids[0] != 4 {
+		t.Fatalf("listed %v after the delete, want [4]", ids)
+	}
+	if w := send(get, http.MethodGet, "/events/get/3", "", map[string]string{"id": "3"}); w.Code != http.StatusNotFound {
+		t.Errorf("get of the deleted event answered %d, want 404", w.Code)
+	}
+	if len(db.rows) != 2 || !db.rows[0].deleted {
+		t.Error("deleted event is not kept in the table")
+	}
+	if db.ran("DELETE FROM events") {
+		t.Error("event row was deleted")
+	}
+	if w := send(deleteEvent, http.MethodDelete, "/events/delete/3", "", map[string]string{"id": "3"}); w.Code != http.StatusNotFound {
+		t.Errorf("second delete answered %d, want 404", w.Code)
+	}
+}
+
+func TestListFilters(t *testing.T) {
+	newEventsDB(t,
+		eventModel{ID: 3, Name: "Rock Concert", Price: 1500},
+		eventModel{ID: 4, Name: "Jazz concert", Price: 500},
+		eventModel{ID: 5, Name: "Lecture", Price: 800},
+		eventModel{ID: 6, Name: "100% Comedy", Price: 700},
+	)
+	tests := []struct {
+		name  string
+		query string
+		want  []int
+	}{
+		{"name matches any case", "?q=CONCERT", []int{3, 4}},
+		{"name wildcards are literal", "?q=100%25", []int{6}},
+		{"no name matches", "?q=opera", []int{}},
+		{"min price", "?min_price=800", []int{3, 5}},
+		{"max price", "?max_price=700", []int{4, 6}},
+		{"price range", "?min_price=600&max_price=900", []int{5, 6}},
+		{"name and price", "?q=concert&max_price=1000", []int{4}},
+		{"name, price and page", "?q=c&min_price=600&limit=2&offset=1", []int{5, 6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ids := listIDs(t, tt.query); !reflect.DeepEqual(ids, tt.want) {
+				t.Fatalf("listed %v, want %v", ids, tt.want)
+			}
+		})
+	}
+	for _, q := range []string{"?min_price=-1", "?max_price=x"} {
+		if w := send(get, http.MethodGet, "/events/get"+q, "", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%s answered %d, want 400", q, w.Code)
+		}
+	}
+}
+
+// TestListFailureAnswers500 checks a failing list is not answered as an
+// empty one.
+func TestListFailureAnswers500(t *testing.T) {
+	useFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		return fakeResult{Err: errors.New("relation \"events\" does not exist")}
+	})
+	w := send(get, http.MethodGet, "/events/get", "", nil)
+	if w.Code != http.StatusInternalServerError || w.Body.String() != `{"error":"internal error"}` {
+		t.Errorf("answered %d %s, want 500 with the error body", w.Code, w.Body.String())
+	}
+}
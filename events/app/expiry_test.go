@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"app/internal/client"
+)
+
+// fakeClock is a clock that only moves when the test advances it.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// useFakeClock puts a fakeClock into clk for the test.
+func useFakeClock(t *testing.T) *fakeClock {
+	c := &fakeClock{now: time.Date(2030, 5, 1, 12, 0, 0, 0, time.UTC)}
+	saved := clk
+	clk = c
+	t.Cleanup(func() { clk = saved })
+	return c
+}
+
+// callbackRecorder answers every callback to book with 200 and keeps the
+// bodies.
+type callbackRecorder struct {
+	mu     sync.Mutex
+	bodies []string
+}
+
+func (d *callbackRecorder) Do(req *http.Request) (*http.Response, error) {
+	body, _ := io.ReadAll(req.Body)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.bodies = append(d.bodies, string(body))
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(nil))}, nil
+}
+
+// useCallbackRecorder points the callbacks to book at a callbackRecorder.
+func useCallbackRecorder(t *testing.T) *callbackRecorder {
+	cb := &callbackRecorder{}
+	saved := services
+	services = client.New("http://book")
+	services.HTTP = cb
+	t.Cleanup(func() { services = saved })
+	return cb
+}
+
+// sent returns the callbacks sent so far.
+func (d *callbackRecorder) sent() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.bodies...)
+}
+
+// TestSlotExpiresByClock occupies a slot and drives it past its hold by
+// advancing the clock only.
+func TestSlotExpiresByClock(t *testing.T) {
+	c := useFakeClock(t)
+	savedTimeout := slotHoldTimeout
+	slotHoldTimeout = 30 * time.Minute
+	t.Cleanup(func() { slotHoldTimeout = savedTimeout })
+	cb := useCallbackRecorder(t)
+
+	var mu sync.Mutex
+	var expiresAt time.Time
+	freed := false
+	useFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case queryHas(query, "SELECT closed FROM events"):
+			return fakeResult{Cols: []string{"closed"}, Rows: [][]driver.Value{{false}}}
+		case queryHas(query, "SELECT COUNT(1) FROM slots"):
+			return fakeResult{Cols: []string{"count"}, Rows: [][]driver.Value{{int64(0)}}}
+		case queryHas(query, "INSERT INTO slots"):
+			expiresAt = args[4].(time.Time)
+			return fakeResult{Affected: 1}
+		case queryHas(query, "expires_at < $4"):
+			cols := []string{"book_id", "event_id", "user_id"}
+			if freed || !expiresAt.Before(args[3].(time.Time)) {
+				return fakeResult{Cols: cols}
+			}
+			freed = true
+			return fakeResult{Cols: cols, Rows: [][]driver.Value{{int64(7), int64(3), int64(5)}}}
+		}
+		return fakeResult{Affected: 1}
+	})
+
+	if err := occupySlot(3, 7, 5, 1, 10); err != nil {
+		t.Fatal(err)
+	}
+	if want := c.Now().Add(slotHoldTimeout); !expiresAt.Equal(want) {
+		t.Fatalf("slot expires at %s, want %s", expiresAt, want)
+	}
+
+	c.advance(slotHoldTimeout - time.Second)
+	expireDueSlots()
+	if freed || len(cb.bodies) != 0 {
+		t.Fatal("slot was freed before its hold expired")
+	}
+
+	c.advance(2 * time.Second)
+	expireDueSlots()
+	if !freed {
+		t.Fatal("slot was not freed after its hold expired")
+	}
+	if len(cb.bodies) != 1 || !sameJSON(t, []byte(cb.bodies[0]), []byte(`{"book_id":7,"user_id":5,"price":0,"status":false,"reason":"slot_expired"}`)) {
+		t.Errorf("callbacks %v, want one slot_expired", cb.bodies)
+	}
+}
+
+// TestOnlyUncommittedSlotsExpire occupies slots for two bookings, commits one
+// and checks only the other is freed once the hold runs out.
+func TestOnlyUncommittedSlotsExpire(t *testing.T) {
+	c := useFakeClock(t)
+	useOccupyLimiter(t, 0)
+	cb := useCallbackRecorder(t)
+	db := newEventsDB(t, eventModel{ID: 3, Name: "Concert", Price: 1500, TotalSlots: 10, StartsAt: c.Now().Add(24 * time.Hour)})
+	if code := occupyFor(1, 2); code != http.StatusOK {
+		t.Fatalf("occupy for book 1 answered %d", code)
+	}
+	if code := occupyFor(2, 1); code != http.StatusOK {
+		t.Fatalf("occupy for book 2 answered %d", code)
+	}
+	if w := send(commitSlot, http.MethodPost, "/events/commit", `{"book_id":2,"event_id":3}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("commit answered %d", w.Code)
+	}
+	cb.mu.Lock()
+	cb.bodies = nil
+	cb.mu.Unlock()
+
+	c.advance(slotHoldTimeout + time.Second)
+	expireDueSlots()
+	slots := db.taken(3)
+	if len(slots) != 1 || slots[0].bookID != 2 || slots[0].status != int64(statusCommited) {
+		t.Fatalf("event holds %+v after expiry, want the committed slot of book 2", slots)
+	}
+	if occ, _ := cachedOccupied(db, 3); occ != 1 {
+		t.Errorf("cache holds %d occupied after expiry, want 1", occ)
+	}
+	sent := cb.sent()
+	if len(sent) != 1 || !sameJSON(t, []byte(sent[0]), []byte(`{"book_id":1,"user_id":5,"price":0,"status":false,"reason":"slot_expired"}`)) {
+		t.Errorf("callbacks %v, want one slot_expired for book 1", sent)
+	}
+}
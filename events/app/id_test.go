@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestIDRoutesTellMalformedFromMissing(t *testing.T) {
+	newEventsDB(t, eventModel{ID: 3, Name: "Concert"})
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		id      string
+		want    int
+	}{
+		{"get existing", get, http.MethodGet, "3", http.StatusOK},
+		{"get missing", get, http.MethodGet, "99", http.StatusNotFound},
+		{"get malformed", get, http.MethodGet, "x", http.StatusBadRequest},
+		{"delete missing", deleteEvent, http.MethodDelete, "99", http.StatusNotFound},
+		{"delete malformed", deleteEvent, http.MethodDelete, "3x", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(tt.handler, tt.method, "/events/"+tt.id, "", map[string]string{"id": tt.id})
+			if w.Code != tt.want {
+				t.Fatalf("answered %d %s, want %d", w.Code, w.Body.String(), tt.want)
+			}
+		})
+	}
+}
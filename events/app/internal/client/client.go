@@ -0,0 +1,67 @@
+// Package client calls book on behalf of events. It keeps the path and
+// headers of book's callback in one place, the payload is the type of the
+// shared contracts package.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"contracts"
+)
+
+const slotCallbackPath = "/book/callback/events"
+
+// StatusError is an unexpected status code from a service.
+type StatusError struct {
+	Service string
+	Code    int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s responded with status [%d]", e.Service, e.Code)
+}
+
+// Doer sends HTTP requests. *http.Client implements it, tests can pass a stub
+// instead.
+type Doer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// Client calls the book service at BookURL.
+type Client struct {
+	HTTP    Doer
+	BookURL string
+}
+
+// New returns a Client for the given base URL using http.DefaultClient.
+func New(bookURL string) *Client {
+	return &Client{HTTP: http.DefaultClient, BookURL: bookURL}
+}
+
+// SlotResult reports to book whether the slots of the booking were occupied.
+// Anything but 200 from book is an error, the caller keeps the result to
+// send it again.
+func (c *Client) SlotResult(r contracts.OccupyResult) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.BookURL+slotCallbackPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-User-Id", strconv.Itoa(r.UserID))
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{Service: "book", Code: resp.StatusCode}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"contracts"
+)
+
+// goldenDir holds the messages of the shared contracts package.
+const goldenDir = "../../../../contracts/testdata"
+
+func readGolden(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(goldenDir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// sameJSON reports whether a and b are the same json value regardless of
+// formatting and key order.
+func sameJSON(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var va, vb interface{}
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+// stubDoer records the requests and answers each of them with status.
+type stubDoer struct {
+	status int
+	reqs   []*http.Request
+	bodies [][]byte
+}
+
+func (d *stubDoer) Do(req *http.Request) (*http.Response, error) {
+	body, _ := io.ReadAll(req.Body)
+	d.reqs = append(d.reqs, req)
+	d.bodies = append(d.bodies, body)
+	return &http.Response{StatusCode: d.status, Body: io.NopCloser(bytes.NewReader(nil))}, nil
+}
+
+func newStubClient(status int) (*Client, *stubDoer) {
+	d := &stubDoer{status: status}
+	c := New("http://book")
+	c.HTTP = d
+	return c, d
+}
+
+func TestSlotResultMatchesContract(t *testing.T) {
+	golden := readGolden(t, "occupy_result.json")
+	r := contracts.OccupyResult{}
+	if err := json.Unmarshal(golden, &r); err != nil {
+		t.Fatal(err)
+	}
+	c, d := newStubClient(http.StatusOK)
+	if err := c.SlotResult(r); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.reqs) != 1 {
+		t.Fatalf("sent %d requests, want 1", len(d.reqs))
+	}
+	if got := d.reqs[0].URL.String(); got != "http://book/book/callback/events" {
+		t.Errorf("url %s", got)
+	}
+	if got, want := d.reqs[0].Header.Get("X-User-Id"), "5"; got != want {
+		t.Errorf("X-User-Id %q, want %q", got, want)
+	}
+	if !sameJSON(t, d.bodies[0], golden) {
+		t.Errorf("sent %s, want %s", d.bodies[0], golden)
+	}
+}
+
+func TestSlotResultStatusError(t *testing.T) {
+	c, _ := newStubClient(http.StatusBadRequest)
+	err := c.SlotResult(contracts.OccupyResult{BookID: 7, UserID: 5})
+	se, ok := err.(*StatusError)
+	if !ok || se.Service != "book" || se.Code != http.StatusBadRequest {
+		t.Fatalf("got %v, want book StatusError 400", err)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+)
+
+func TestCleanupRemovesOnlyOldFreedSlots(t *testing.T) {
+	now := time.Now()
+	// deleted holds when each slot was freed, a zero time is a taken slot
+	deleted := map[int]time.Time{1: now.Add(-40 * 24 * time.Hour), 2: now.Add(-time.Hour), 3: {}}
+	useFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		if !queryHas(query, "DELETE FROM slots WHERE id IN") {
+			return fakeResult{}
+		}
+		before := now.Add(-time.Duration(args[0].(float64) * float64(time.Second)))
+		n := int64(0)
+		for id, at := range deleted {
+			if !at.IsZero() && at.Before(before) && n < args[1].(int64) {
+				delete(deleted, id)
+				n++
+			}
+		}
+		return fakeResult{Affected: n}
+	})
+	n, err := cleanup(720 * time.Hour)
+	if err != nil || n != 1 {
+		t.Fatalf("cleaned %d, %v, want 1", n, err)
+	}
+	if _, ok := deleted[1]; ok || len(deleted) != 2 {
+		t.Errorf("left slots %v, want 2 and 3", deleted)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useOccupyWait sets how long an occupy waits for its turn.
+func useOccupyWait(t *testing.T, wait time.Duration) {
+	saved := occupyWait
+	occupyWait = wait
+	t.Cleanup(func() { occupyWait = saved })
+}
+
+// TestLimiterCapsFloodedEvent floods one event with occupies and checks no
+// more than the limit insert slots at once, while every request is still
+// served once its turn comes.
+func TestLimiterCapsFloodedEvent(t *testing.T) {
+	const limit, requests = 3, 20
+	useOccupyLimiter(t, limit)
+	useOccupyWait(t, 5*time.Second)
+	useCallbackRecorder(t)
+	db := newEventsDB(t, eventModel{ID: 3, Name: "Flash Sale", Price: 1500, TotalSlots: 100})
+	var mu sync.Mutex
+	running, most := 0, 0
+	useFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		if !queryHas(query, "INSERT INTO slots") {
+			return db.handle(query, args)
+		}
+		mu.Lock()
+		running++
+		most = max(most, running)
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return db.handle(query, args)
+	})
+
+	codes := make([]int, requests)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = occupyFor(i+1, 1)
+		}(i)
+	}
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("occupy for book %d answered %d, want 200", i+1, code)
+		}
+	}
+	if most > limit {
+		t.Errorf("%d occupies ran at once, want at most %d", most, limit)
+	}
+	if n := len(db.taken(3)); n != requests {
+		t.Errorf("event holds %d slots, want %d", n, requests)
+	}
+}
+
+// TestLimiterRejectsAfterWait holds the only place of an event and checks an
+// occupy gets 503 with Retry-After and no callback, while other events are
+// not held up.
+func TestLimiterRejectsAfterWait(t *testing.T) {
+	useOccupyLimiter(t, 1)
+	useOccupyWait(t, 10*time.Millisecond)
+	cb := useCallbackRecorder(t)
+	db := newEventsDB(t,
+		eventModel{ID: 3, Name: "Flash Sale", Price: 1500, TotalSlots: 10},
+		eventModel{ID: 4, Name: "Lecture", Price: 500, TotalSlots: 10},
+	)
+	if !occupyLimiter.acquire(3, 0) {
+		t.Fatal("the first place of event 3 was not given")
+	}
+
+	w := send(occupy, http.MethodPost, "/events/occupy", `{"book_id":7,"event_id":3}`, nil)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != occupyRetryAfter {
+		t.Fatalf("occupy of a busy event answered %d with Retry-After %q, want 503 with %q", w.Code, w.Header().Get("Retry-After"), occupyRetryAfter)
+	}
+	if sent := cb.sent(); len(sent) != 0 || len(db.taken(3)) != 0 {
+		t.Fatalf("rejected occupy sent %v and took %d slots, want nothing", sent, len(db.taken(3)))
+	}
+	if code := postOccupy(4, 1); code != http.StatusOK {
+		t.Errorf("occupy of another event answered %d, want 200", code)
+	}
+
+	occupyLimiter.release(3)
+	if code := postOccupy(3, 1); code != http.StatusOK {
+		t.Errorf("occupy after the place freed answered %d, want 200", code)
+	}
+	if n := len(db.taken(3)); n != 1 {
+		t.Errorf("event holds %d slots, want 1", n)
+	}
+}
@@ -1,47 +1,257 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"app/internal/client"
+	"contracts"
+	"platform/config"
+	"platform/database"
+	"platform/web"
 
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type eventModel struct {
-	ID         int    `json:"id,omitempty"`
-	Name       string `json:"event_name"`
-	Price      int    `json:"price"`
-	TotalSlots int    `json:"total_slots"`
+	ID          int       `json:"id,omitempty"`
+	Name        string    `json:"event_name"`
+	Price       int       `json:"price"`
+	TotalSlots  int       `json:"total_slots"`
+	Category    string    `json:"category"`
+	StartsAt    time.Time `json:"starts_at"`
+	Description string    `json:"description"`
+	ImageURI    string    `json:"image_uri"`
+	OverbookPct int       `json:"overbook_pct"`
+	// Closed events take no more bookings.
+	Closed bool `json:"closed"`
+	// AllowMultiple lets a user hold several active bookings of the event,
+	// book rejects a second one otherwise.
+	AllowMultiple bool `json:"allow_multiple"`
+	// FreeSlots and Tags are filled for a single event only.
+	FreeSlots *int     `json:"free_slots,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+}
+
+type tagsModel struct {
+	Tags []string `json:"tags"`
+}
+
+type availabilityRequestModel = contracts.EventIDs
+
+// availabilityModel is the slot counts of an event. Total includes the
+// allowed overbooking. Name and Price let book describe many events with one
+// call, Price is the base price of a slot.
+type availabilityModel = contracts.Availability
+
+// fieldError is a problem with one field of a request.
+type fieldError struct {
+	Field string `json:"field"`
+	Msg   string `json:"msg"`
+}
+
+// validationErrors collects every field problem of a request, so the client
+// gets all of them in one response instead of one at a time.
+type validationErrors []fieldError
+
+func (v *validationErrors) add(field, msg string) {
+	*v = append(*v, fieldError{Field: field, Msg: msg})
+}
+
+// write answers 400 with the collected errors as
+// {"errors":[{"field":...,"msg":...}]}. It reports whether there were any.
+func (v validationErrors) write(w http.ResponseWriter) bool {
+	if len(v) == 0 {
+		return false
+	}
+	data, err := json.Marshal(struct {
+		Errors validationErrors `json:"errors"`
+	}{v})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to marshal validation errors: %s\n", err)
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(data)
+	return true
+}
+
+// duplicateRequestModel overrides fields of a duplicated event. Both are
+// optional.
+type duplicateRequestModel struct {
+	Name     string     `json:"event_name"`
+	StartsAt *time.Time `json:"starts_at"`
+}
+
+// eventMetaModel is the part of an event that can be changed after create.
+type eventMetaModel struct {
+	Description string `json:"description"`
+	ImageURI    string `json:"image_uri"`
+	OverbookPct int    `json:"overbook_pct"`
+	// AllowMultiple is eventModel.AllowMultiple.
+	AllowMultiple bool `json:"allow_multiple"`
+}
+
+// occupyRequestModel asks for Quantity slots of the event for the booking,
+// 0 means one.
+type occupyRequestModel = contracts.SlotRequest
+
+// occupiedResponseModel is the callback sent to book.
+type occupiedResponseModel = contracts.OccupyResult
+
+// eventFilter narrows the events list. Nil fields and zero limit mean no
+// restriction.
+type eventFilter struct {
+	name     string
+	category string
+	tag      string
+	minPrice *int
+	maxPrice *int
+	limit    int
+	offset   int
+	count    bool
+}
+
+// pageModel is the list returned instead of a bare array when the client asks
+// for the total count with count=true. Total counts all items matching the
+// filters, not only the ones on the page.
+type pageModel struct {
+	Items interface{} `json:"items"`
+	Total int         `json:"total"`
+}
+
+// eventLimiter caps the number of occupy transactions running at once for
+// every event, so a hot event doesn't pile up FOR UPDATE waiters in
+// Postgres. A semaphore is kept only while someone holds or waits for it.
+type eventLimiter struct {
+	mu    sync.Mutex
+	limit int
+	sems  map[int]*eventSem
+}
+
+type eventSem struct {
+	slots chan struct{}
+	users int
+}
+
+func newEventLimiter(limit int) *eventLimiter {
+	return &eventLimiter{limit: limit, sems: map[int]*eventSem{}}
+}
+
+// acquire takes a place for the event, waiting up to wait for one to free.
+// It returns false if none did, then release must not be called. A limit
+// of 0 means no limit.
+func (l *eventLimiter) acquire(eid int, wait time.Duration) bool {
+	if l.limit <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	s, ok := l.sems[eid]
+	if !ok {
+		s = &eventSem{slots: make(chan struct{}, l.limit)}
+		l.sems[eid] = s
+	}
+	s.users++
+	l.mu.Unlock()
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		select {
+		case s.slots <- struct{}{}:
+			return true
+		case <-t.C:
+		}
+	}
+	l.leave(eid, s)
+	return false
 }
 
-type occupyRequestModel struct {
-	BookID  int `json:"book_id"`
-	EventID int `json:"event_id"`
+// release frees the place taken by acquire.
+func (l *eventLimiter) release(eid int) {
+	if l.limit <= 0 {
+		return
+	}
+	l.mu.Lock()
+	s := l.sems[eid]
+	l.mu.Unlock()
+	<-s.slots
+	l.leave(eid, s)
+}
+
+func (l *eventLimiter) leave(eid int, s *eventSem) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s.users--; s.users == 0 {
+		delete(l.sems, eid)
+	}
+}
+
+// dlqCallback is a callback to book that failed and waits in callback_dlq to
+// be sent again.
+type dlqCallback struct {
+	id        int
+	userID    int
+	payload   string
+	attempts  int
+	createdAt time.Time
 }
 
-type occupiedResponseModel struct {
-	BookID int  `json:"book_id"`
-	UserID int  `json:"user_id"`
-	Price  int  `json:"price"`
-	Status bool `json:"status"`
+// services calls book. Tests can put a stub into its HTTP field.
+var services = client.New("")
+
+// clock tells the time for deadline and expiry checks. It is the real time,
+// tests can put a fake into clk and advance it instead of sleeping.
+type clock interface {
+	Now() time.Time
 }
 
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+var clk clock = realClock{}
+
 type configModel struct {
-	dbHost string
-	dbPort string
-	dbName string
-	dbUser string
-	dbPass string
-	host   string
-	port   string
+	web.ServerConfig
+	dbHost           string
+	dbPort           string
+	dbName           string
+	dbUser           string
+	dbPass           string
+	bookURL          string
+	janitorInterval  string
+	janitorRetention string
+	slowQuery        string
+	maxTotalSlots    string
+	maxPrice         string
+	slotHoldTimeout  string
+	origins          string
+	routePrefix      string
+	occupyLimit      string
+	occupyWait       string
+	maintenance      string
+	dbWait           string
 }
 
 const (
@@ -52,42 +262,216 @@ const (
 	statusCancelled = -1
 )
 
+// Reasons of a negative occupy callback.
+const (
+	reasonSoldOut   = "sold_out"
+	reasonEventPast = "event_past"
+	// reasonBadQuantity is sent for a booking asking for no slots or more
+	// than maxQuantity.
+	reasonBadQuantity = "bad_quantity"
+	// reasonEventClosed is sent for an event an admin has closed.
+	reasonEventClosed = "event_closed"
+	// reasonSlotExpired is sent by expireSlots for an occupied slot that
+	// was not committed in time.
+	reasonSlotExpired = "slot_expired"
+)
+
+// maxQuantity is the most slots a single booking may occupy.
+const maxQuantity = 20
+
+// lockEventTpl serializes occupying slots of the event, so the capacity check
+// and the insert of the slots see the same count and a concurrent close.
+const lockEventTpl = `SELECT closed FROM events WHERE id=$1 FOR UPDATE`
+
+const setClosedTpl = `UPDATE events SET closed=$2, updated_at=now() WHERE id=$1 AND deleted_at IS NULL`
+
+var (
+	errNoSlots     = errors.New("not enough free slots")
+	errEventClosed = errors.New("event is closed")
+)
+
+// Occupied slots not committed within slotHoldTimeout are freed by
+// expireSlots every expireSlotsInterval.
+const (
+	expireSlotsTpl      = `UPDATE slots SET status=$1, deleted_at=now(), updated_at=now() WHERE book_id IN (SELECT book_id FROM slots WHERE status=$2 AND expires_at < $4 AND deleted_at IS NULL GROUP BY book_id ORDER BY min(id) LIMIT $3) AND status=$2 AND deleted_at IS NULL RETURNING book_id, event_id, user_id`
+	expireSlotsInterval = 30 * time.Second
+	expireSlotsBatch    = 100
+)
+
+// occupancyReconcileInterval is how often the cached occupancy is dropped
+// so it is read from the database again.
+const occupancyReconcileInterval = time.Minute
+
+// Replicas tell each other about changed events over LISTEN/NOTIFY on
+// changesChannel, the payload is "<event id> <replica>".
+const (
+	changesChannel       = "events_changed"
+	notifyChangeTpl      = `SELECT pg_notify($1, $2)`
+	listenerMinReconnect = 10 * time.Second
+	listenerMaxReconnect = time.Minute
+)
+
+const (
+	cleanupTpl       = `DELETE FROM slots WHERE id IN (SELECT id FROM slots WHERE deleted_at < now() - make_interval(secs => $1) ORDER BY id LIMIT $2)`
+	cleanupBatchSize = 500
+)
+
+const (
+	dlqPollInterval = 5 * time.Second
+	dlqBaseDelay    = time.Second
+	dlqMaxDelay     = 5 * time.Minute
+	dlqMaxAge       = 24 * time.Hour
+	dlqBatchSize    = 100
+)
+
+const (
+	enqueueCallbackTpl  = `INSERT INTO callback_dlq (user_id, payload, next_attempt_at) VALUES ($1, $2, now() + make_interval(secs => $3))`
+	dueCallbacksTpl     = `SELECT id, user_id, payload, attempts, created_at FROM callback_dlq WHERE next_attempt_at <= now() ORDER BY id LIMIT $1`
+	scheduleCallbackTpl = `UPDATE callback_dlq SET attempts=$2, next_attempt_at=now() + make_interval(secs => $3) WHERE id=$1`
+	deleteCallbackTpl   = `DELETE FROM callback_dlq WHERE id=$1`
+)
+
+const (
+	createEventTpl   = `INSERT INTO events (event_name, price, total_slots, category, starts_at, description, image_uri, overbook_pct, allow_multiple) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id`
+	occupySlotTpl    = `INSERT INTO slots (event_id, book_id, user_id, status, expires_at) SELECT $1, $2, $3, $4, $5 FROM generate_series(1, $6)`
+	cancelSlotTpl    = `UPDATE slots SET status=$2, deleted_at=now(), updated_at=now() WHERE book_id=$1 AND deleted_at IS NULL RETURNING event_id`
+	commitSlotTpl    = `UPDATE slots SET status=$2, expires_at=NULL, updated_at=now() WHERE book_id=$1 AND status IN ($2, $3) AND deleted_at IS NULL`
+	occupiedSlotsTpl = `SELECT COUNT(1) FROM slots WHERE event_id=$1 AND deleted_at IS NULL`
+	getEventTpl      = `SELECT id, event_name, price, total_slots, category, starts_at, description, image_uri, overbook_pct, closed, allow_multiple FROM events WHERE id=$1 AND deleted_at IS NULL`
+	getEventsTpl     = `SELECT id, event_name, price, total_slots, category, starts_at, description, image_uri, overbook_pct, closed, allow_multiple FROM events WHERE %s ORDER BY id`
+	updateEventTpl   = `UPDATE events SET description=$2, image_uri=$3, overbook_pct=$4, allow_multiple=$5, updated_at=now() WHERE id=$1 AND deleted_at IS NULL`
+	deleteEventTpl   = `UPDATE events SET deleted_at=now(), updated_at=now() WHERE id=$1 AND deleted_at IS NULL`
+	maxEventsLimit   = 100
+	roleAdmin        = "admin"
+	maxOverbookPct   = 100
+	addTagTpl        = `INSERT INTO event_tags (event_id, tag) SELECT id, $2 FROM events WHERE id=$1 AND deleted_at IS NULL ON CONFLICT DO NOTHING`
+	removeTagTpl     = `DELETE FROM event_tags WHERE event_id=$1 AND tag=$2`
+	getTagsTpl       = `SELECT tag FROM event_tags WHERE event_id=$1 ORDER BY tag`
+)
+
+const countEventsTpl = `SELECT COUNT(1) FROM events WHERE %s`
+
+// resolvePriceTpl picks the cheapest tier of the event matching the user or
+// their role, NULL when none does.
+const resolvePriceTpl = `SELECT MIN(price) FROM pricing WHERE event_id=$1 AND (user_id=$2 OR role=$3)`
+
 const (
-	createEventTpl       = `INSERT INTO events (event_name, price, total_slots) VALUES ($1, $2, $3)`
-	occupySlotTpl        = `INSERT INTO slots (event_id, book_id) VALUES ($1, $2)`
-	cancelSlotTpl        = `DELETE FROM slots WHERE book_id = $1`
-	occupiedSlotsTpl     = `SELECT COUNT(1) FROM slots WHERE event_id=$1`
-	getEventTpl          = `SELECT id, event_name, price, total_slots FROM events WHERE id=$1`
-	getEventsTpl         = `SELECT id, event_name, price, total_slots FROM events`
-	bookCallbackEndpoint = "http://book.saga.svc.cluster.local:9000/book/callback/events"
+	availabilityTpl    = `SELECT e.id, e.event_name, e.price, e.total_slots, e.overbook_pct, COUNT(s.id) FROM events e LEFT JOIN slots s ON s.event_id = e.id AND s.deleted_at IS NULL WHERE e.id = ANY($1) AND e.deleted_at IS NULL GROUP BY e.id ORDER BY e.id`
+	maxAvailabilityIDs = 500
+)
+
+// eventCategories is the set of categories an event can be created with.
+var eventCategories = map[string]bool{
+	"concert":    true,
+	"theatre":    true,
+	"sport":      true,
+	"exhibition": true,
+	"other":      true,
+}
+
+const defaultEventCategory = "other"
+
+// tagRe is what a tag may look like, tags are lowercased before the check.
+var tagRe = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+var (
+	createEventStmt      *sql.Stmt
+	occupySlotStmt       *sql.Stmt
+	cancelSlotStmt       *sql.Stmt
+	commitSlotStmt       *sql.Stmt
+	addTagStmt           *sql.Stmt
+	removeTagStmt        *sql.Stmt
+	getTagsStmt          *sql.Stmt
+	availabilityStmt     *sql.Stmt
+	resolvePriceStmt     *sql.Stmt
+	occupiedSlotsStmt    *sql.Stmt
+	getEventStmt         *sql.Stmt
+	updateEventStmt      *sql.Stmt
+	deleteEventStmt      *sql.Stmt
+	enqueueCallbackStmt  *sql.Stmt
+	dueCallbacksStmt     *sql.Stmt
+	scheduleCallbackStmt *sql.Stmt
+	deleteCallbackStmt   *sql.Stmt
+	cleanupStmt          *sql.Stmt
+	dbConn               = &database.Conn{Prepare: mustPrepareStmts}
+	// slowQueryThreshold is the duration after which a query is logged as
+	// slow, 0 turns the logging off
+	slowQueryThreshold time.Duration
+	// occupancy caches the number of occupied slots per event. It is kept in
+	// sync on occupy and cancel and dropped by reconcileOccupancy.
+	occupancy   = map[int]int{}
+	occupancyMu sync.Mutex
+
+	notifyChangeStmt *sql.Stmt
+	expireSlotsStmt  *sql.Stmt
+	lockEventStmt    *sql.Stmt
+	setClosedStmt    *sql.Stmt
+	// replica tells this replica's notifications from the others', its own
+	// cache is kept up to date by addOccupied
+	replica = fmt.Sprintf("%s-%d", hostname(), os.Getpid())
+	// maxTotalSlots and maxPrice cap the values an event can be created with
+	maxTotalSlots int
+	maxPrice      int
+	// slotHoldTimeout is how long an occupied slot waits to be committed
+	slotHoldTimeout time.Duration
 )
 
 var (
-	createEventStmt   *sql.Stmt
-	occupySlotStmt    *sql.Stmt
-	cancelSlotStmt    *sql.Stmt
-	occupiedSlotsStmt *sql.Stmt
-	getEventStmt      *sql.Stmt
-	getEventsStmt     *sql.Stmt
+	// occupyLimiter caps concurrent occupy transactions per event, a request
+	// that waits longer than occupyWait for its turn gets 503
+	occupyLimiter *eventLimiter
+	occupyWait    time.Duration
 )
 
+// occupyRetryAfter is the Retry-After, in seconds, of an occupy rejected by
+// occupyLimiter.
+const occupyRetryAfter = "1"
+
 func readConf() *configModel {
 	cfg := &configModel{
-		dbHost: "",
-		dbPort: "5432",
-		dbName: "",
-		dbUser: "",
-		dbPass: "",
-		host:   "0.0.0.0",
-		port:   "80",
-	}
-	dbHost := os.Getenv("DBHOST")
-	dbPort := os.Getenv("DBPORT")
-	dbName := os.Getenv("DBNAME")
-	dbUser := os.Getenv("DBUSER")
-	dbPass := os.Getenv("DBPASS")
-	host := os.Getenv("HOST")
-	port := os.Getenv("PORT")
+		dbHost:           "",
+		dbPort:           "5432",
+		dbName:           "",
+		dbUser:           "",
+		dbPass:           "",
+		ServerConfig:     web.DefaultServerConfig(),
+		bookURL:          "http://book.saga.svc.cluster.local:9000",
+		janitorRetention: "720h",
+		slowQuery:        "200ms",
+		maxTotalSlots:    "100000",
+		maxPrice:         "10000000",
+		slotHoldTimeout:  "30m",
+		occupyLimit:      "10",
+		occupyWait:       "1s",
+		dbWait:           "60s",
+	}
+	dbHost := config.Getenv("DBHOST")
+	dbPort := config.Getenv("DBPORT")
+	dbName := config.Getenv("DBNAME")
+	dbUser := config.Getenv("DBUSER")
+	dbPass := config.Getenv("DBPASS")
+	host := config.Getenv("HOST")
+	port := config.Getenv("PORT")
+	bookURL := config.Getenv("BOOK_URL")
+	tlsCertFile := config.Getenv("TLS_CERT_FILE")
+	tlsKeyFile := config.Getenv("TLS_KEY_FILE")
+	janitorInterval := config.Getenv("JANITOR_INTERVAL")
+	janitorRetention := config.Getenv("JANITOR_RETENTION")
+	slowQuery := config.Getenv("SLOW_QUERY_THRESHOLD")
+	maxTotalSlots := config.Getenv("MAX_TOTAL_SLOTS")
+	maxPrice := config.Getenv("MAX_PRICE")
+	readTimeout := config.Getenv("READ_TIMEOUT")
+	writeTimeout := config.Getenv("WRITE_TIMEOUT")
+	idleTimeout := config.Getenv("IDLE_TIMEOUT")
+	slotHoldTimeout := config.Getenv("SLOT_HOLD_TIMEOUT")
+	origins := config.Getenv("ALLOWED_ORIGINS")
+	routePrefix := config.Getenv("ROUTE_PREFIX")
+	occupyLimit := config.Getenv("OCCUPY_CONCURRENCY")
+	occupyWait := config.Getenv("OCCUPY_QUEUE_TIMEOUT")
+	maintenance := config.Getenv("MAINTENANCE")
+	dbWait := config.Getenv("DB_WAIT_TIMEOUT")
 
 	if dbHost != "" {
 		cfg.dbHost = dbHost
@@ -105,24 +489,100 @@ func readConf() *configModel {
 		cfg.dbPass = dbPass
 	}
 	if host != "" {
-		cfg.host = host
+		cfg.Host = host
 	}
 	if port != "" {
-		cfg.port = port
+		cfg.Port = port
+	}
+	if bookURL != "" {
+		cfg.bookURL = bookURL
+	}
+	if tlsCertFile != "" {
+		cfg.TLSCertFile = tlsCertFile
+	}
+	if tlsKeyFile != "" {
+		cfg.TLSKeyFile = tlsKeyFile
+	}
+	if janitorInterval != "" {
+		cfg.janitorInterval = janitorInterval
+	}
+	if janitorRetention != "" {
+		cfg.janitorRetention = janitorRetention
+	}
+	if slowQuery != "" {
+		cfg.slowQuery = slowQuery
+	}
+	if maxTotalSlots != "" {
+		cfg.maxTotalSlots = maxTotalSlots
+	}
+	if maxPrice != "" {
+		cfg.maxPrice = maxPrice
+	}
+	if readTimeout != "" {
+		cfg.ReadTimeout = readTimeout
+	}
+	if writeTimeout != "" {
+		cfg.WriteTimeout = writeTimeout
+	}
+	if idleTimeout != "" {
+		cfg.IdleTimeout = idleTimeout
+	}
+	if slotHoldTimeout != "" {
+		cfg.slotHoldTimeout = slotHoldTimeout
+	}
+	if origins != "" {
+		cfg.origins = origins
+	}
+	if routePrefix != "" {
+		cfg.routePrefix = routePrefix
+	}
+	if occupyLimit != "" {
+		cfg.occupyLimit = occupyLimit
+	}
+	if occupyWait != "" {
+		cfg.occupyWait = occupyWait
+	}
+	if maintenance != "" {
+		cfg.maintenance = maintenance
+	}
+	if dbWait != "" {
+		cfg.dbWait = dbWait
 	}
 	return cfg
 }
 
 func makeDBConn(cfg *configModel) (*sql.DB, error) {
-	pgConnString := fmt.Sprintf(
+	pgConnString := connString(cfg)
+	log.Printf("Connecting to database host=%s port=%s dbname=%s\n", cfg.dbHost, cfg.dbPort, cfg.dbName)
+	db, err := sql.Open("postgres", pgConnString)
+	return db, err
+}
+
+func connString(cfg *configModel) string {
+	return fmt.Sprintf(
 		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		cfg.dbHost, cfg.dbPort, cfg.dbUser, cfg.dbPass, cfg.dbName,
 	)
-	log.Println("connection string: ", pgConnString)
-	db, err := sql.Open("postgres", pgConnString)
-	return db, err
 }
 
+// timed runs the query f and logs it under name when it takes longer than
+// slowQueryThreshold.
+func timed(name string, f func() error) error {
+	start := time.Now()
+	err := f()
+	if d := time.Since(start); slowQueryThreshold > 0 && d > slowQueryThreshold {
+		log.Printf("Slow query [%s] took %s\n", name, d)
+	}
+	return err
+}
+
+// maintenanceMode turns every request but health, version and the switch
+// itself away with 503. It starts from MAINTENANCE and is switched at runtime
+// by admins via maintenancePath.
+var maintenanceMode = &web.Maintenance{Health: []string{"/health"}}
+
+const maintenancePath = "/events/maintenance"
+
 func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -135,23 +595,159 @@ func main() {
 	}
 	defer db.Close()
 
-	if err = db.PingContext(ctx); err != nil {
+	dbWait, err := time.ParseDuration(cfg.dbWait)
+	if err != nil {
+		log.Fatal("Failed to parse DB_WAIT_TIMEOUT:", err)
+	}
+	if err = database.Wait(ctx, db, dbWait); err != nil {
 		log.Fatal("Failed to check db connection:", err)
 	}
 
 	mustPrepareStmts(ctx, db)
+	dbConn.Open = func() (*sql.DB, error) { return makeDBConn(cfg) }
+	dbConn.Set(db)
+	if cfg.slowQuery != "" {
+		if slowQueryThreshold, err = time.ParseDuration(cfg.slowQuery); err != nil {
+			log.Fatal("Failed to parse SLOW_QUERY_THRESHOLD:", err)
+		}
+	}
+	if maxTotalSlots, err = strconv.Atoi(cfg.maxTotalSlots); err != nil {
+		log.Fatal("Failed to parse MAX_TOTAL_SLOTS:", err)
+	}
+	if maxPrice, err = strconv.Atoi(cfg.maxPrice); err != nil {
+		log.Fatal("Failed to parse MAX_PRICE:", err)
+	}
+	services.BookURL = cfg.bookURL
 
+	if slotHoldTimeout, err = time.ParseDuration(cfg.slotHoldTimeout); err != nil {
+		log.Fatal("Failed to parse SLOT_HOLD_TIMEOUT:", err)
+	}
+	occupyLimit, err := strconv.Atoi(cfg.occupyLimit)
+	if err != nil || occupyLimit < 0 {
+		log.Fatal("Failed to parse OCCUPY_CONCURRENCY:", cfg.occupyLimit)
+	}
+	occupyLimiter = newEventLimiter(occupyLimit)
+	if occupyWait, err = time.ParseDuration(cfg.occupyWait); err != nil {
+		log.Fatal("Failed to parse OCCUPY_QUEUE_TIMEOUT:", err)
+	}
+
+	go retryCallbacks(ctx)
+	go expireSlots(ctx)
+	go reconcileOccupancy(ctx)
+	go listenChanges(ctx, cfg)
+
+	if cfg.janitorInterval != "" {
+		interval, err := time.ParseDuration(cfg.janitorInterval)
+		if err != nil {
+			log.Fatal("Failed to parse JANITOR_INTERVAL:", err)
+		}
+		retention, err := time.ParseDuration(cfg.janitorRetention)
+		if err != nil {
+			log.Fatal("Failed to parse JANITOR_RETENTION:", err)
+		}
+		go runJanitor(ctx, interval, retention)
+	}
+
+	if cfg.maintenance != "" {
+		on, err := strconv.ParseBool(cfg.maintenance)
+		if err != nil {
+			log.Fatal("Failed to parse MAINTENANCE:", err)
+		}
+		maintenanceMode.Set(on)
+	}
+
+	prefix := strings.TrimSuffix(cfg.routePrefix, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		log.Fatalf("ROUTE_PREFIX [%s] must start with /", cfg.routePrefix)
+	}
+	r := newRouter(prefix)
+
+	h := maintenanceMode.Middleware(prefix+maintenancePath, r)
+	h = web.RecoverPanics(web.CORS(web.ParseOrigins(cfg.origins), h))
+	if err := web.Serve(cfg.ServerConfig, h); err != nil {
+		log.Printf("Failed to bind on [%s:%s]: %s", cfg.Host, cfg.Port, err)
+	}
+}
+
+// newRouter registers the routes, the api ones under prefix if it isn't
+// empty.
+func newRouter(prefix string) *mux.Router {
 	r := mux.NewRouter()
 
-	r.HandleFunc("/events/create", reqlog(isAuthenticatedMiddleware(create))).Methods("POST")
-	r.HandleFunc("/events/get", reqlog(isAuthenticatedMiddleware(get))).Methods("GET")
-	r.HandleFunc("/events/get/{id}", reqlog(isAuthenticatedMiddleware(get))).Methods("GET")
-	r.HandleFunc("/events/occupy", reqlog(isAuthenticatedMiddleware(occupy))).Methods("POST")
-	r.HandleFunc("/events/cancel", reqlog(isAuthenticatedMiddleware(cancelSlot))).Methods("POST")
+	r.HandleFunc("/health", health)
+	r.HandleFunc("/version", web.VersionInfo).Methods("GET")
+	api := r
+	if prefix != "" {
+		api = r.PathPrefix(prefix).Subrouter()
+	}
+	api.HandleFunc("/events/create", reqlog(web.Authenticated(web.RequireRole(roleAdmin, create)))).Methods("POST")
+	api.HandleFunc("/events/get", reqlog(web.Authenticated(get))).Methods("GET")
+	api.HandleFunc("/events/get/{id}", reqlog(web.Authenticated(get))).Methods("GET")
+	api.HandleFunc("/events/availability", reqlog(web.Authenticated(availability))).Methods("POST")
+	api.HandleFunc("/events/occupy", reqlog(web.Authenticated(occupy))).Methods("POST")
+	api.HandleFunc("/events/cancel", reqlog(web.Authenticated(cancelSlot))).Methods("POST")
+	api.HandleFunc("/events/commit", reqlog(web.Authenticated(commitSlot))).Methods("POST")
+	api.HandleFunc("/events/{id}/tags", reqlog(web.Authenticated(web.RequireRole(roleAdmin, addTags)))).Methods("POST")
+	api.HandleFunc("/events/{id}/tags/{tag}", reqlog(web.Authenticated(web.RequireRole(roleAdmin, removeTag)))).Methods("DELETE")
+	api.HandleFunc("/events/{id}/close", reqlog(web.Authenticated(web.RequireRole(roleAdmin, setClosed(true))))).Methods("POST")
+	api.HandleFunc("/events/{id}/open", reqlog(web.Authenticated(web.RequireRole(roleAdmin, setClosed(false))))).Methods("POST")
+	api.HandleFunc("/events/{id}/duplicate", reqlog(web.Authenticated(web.RequireRole(roleAdmin, duplicateEvent)))).Methods("POST")
+	api.HandleFunc("/events/update/{id}", reqlog(web.Authenticated(web.RequireRole(roleAdmin, updateEvent)))).Methods("PUT")
+	api.HandleFunc("/events/delete/{id}", reqlog(web.Authenticated(web.RequireRole(roleAdmin, deleteEvent)))).Methods("DELETE")
+	api.HandleFunc(maintenancePath, reqlog(web.Authenticated(web.RequireRole(roleAdmin, maintenanceMode.Switch)))).Methods("GET", "PUT")
+	r.MethodNotAllowedHandler = web.MethodNotAllowed(r)
+	r.NotFoundHandler = http.HandlerFunc(web.NotFound)
+	return r
+}
+
+func health(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status": "OK"}`))
+}
+
+// runJanitor removes freed slots older than retention every interval. It is
+// started only when JANITOR_INTERVAL is set.
+func runJanitor(ctx context.Context, interval, retention time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		n, err := cleanup(retention)
+		if err != nil {
+			log.Printf("Failed to clean up freed slots: %s\n", err)
+		}
+		if n > 0 {
+			log.Printf("Cleaned up [%d] freed slots\n", n)
+		}
+	}
+}
 
-	bindOn := fmt.Sprintf("%s:%s", cfg.host, cfg.port)
-	if err := http.ListenAndServe(bindOn, r); err != nil {
-		log.Printf("Failed to bind on [%s]: %s", bindOn, err)
+// cleanup deletes slots freed more than retention ago in batches of
+// cleanupBatchSize, every batch is a separate statement so locks are held
+// only briefly.
+func cleanup(retention time.Duration) (int64, error) {
+	var total int64
+	for {
+		var n int64
+		err := dbConn.Retry(func() error {
+			res, err := cleanupStmt.Exec(retention.Seconds(), cleanupBatchSize)
+			if err != nil {
+				return err
+			}
+			n, err = res.RowsAffected()
+			return err
+		})
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n < cleanupBatchSize {
+			return total, nil
+		}
 	}
 }
 
@@ -167,12 +763,54 @@ func mustPrepareStmts(ctx context.Context, db *sql.DB) {
 	if err != nil {
 		panic(err)
 	}
+	notifyChangeStmt, err = db.PrepareContext(ctx, notifyChangeTpl)
+	if err != nil {
+		panic(err)
+	}
+	expireSlotsStmt, err = db.PrepareContext(ctx, expireSlotsTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	lockEventStmt, err = db.PrepareContext(ctx, lockEventTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	setClosedStmt, err = db.PrepareContext(ctx, setClosedTpl)
+	if err != nil {
+		panic(err)
+	}
 
 	cancelSlotStmt, err = db.PrepareContext(ctx, cancelSlotTpl)
 	if err != nil {
 		panic(err)
 	}
 
+	commitSlotStmt, err = db.PrepareContext(ctx, commitSlotTpl)
+	if err != nil {
+		panic(err)
+	}
+	addTagStmt, err = db.PrepareContext(ctx, addTagTpl)
+	if err != nil {
+		panic(err)
+	}
+	removeTagStmt, err = db.PrepareContext(ctx, removeTagTpl)
+	if err != nil {
+		panic(err)
+	}
+	getTagsStmt, err = db.PrepareContext(ctx, getTagsTpl)
+	if err != nil {
+		panic(err)
+	}
+	availabilityStmt, err = db.PrepareContext(ctx, availabilityTpl)
+	if err != nil {
+		panic(err)
+	}
+	resolvePriceStmt, err = db.PrepareContext(ctx, resolvePriceTpl)
+	if err != nil {
+		panic(err)
+	}
 	occupiedSlotsStmt, err = db.PrepareContext(ctx, occupiedSlotsTpl)
 	if err != nil {
 		panic(err)
@@ -182,16 +820,48 @@ func mustPrepareStmts(ctx context.Context, db *sql.DB) {
 	if err != nil {
 		panic(err)
 	}
-	getEventsStmt, err = db.PrepareContext(ctx, getEventsTpl)
+	updateEventStmt, err = db.PrepareContext(ctx, updateEventTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	deleteEventStmt, err = db.PrepareContext(ctx, deleteEventTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	enqueueCallbackStmt, err = db.PrepareContext(ctx, enqueueCallbackTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	dueCallbacksStmt, err = db.PrepareContext(ctx, dueCallbacksTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	scheduleCallbackStmt, err = db.PrepareContext(ctx, scheduleCallbackTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	deleteCallbackStmt, err = db.PrepareContext(ctx, deleteCallbackTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	cleanupStmt, err = db.PrepareContext(ctx, cleanupTpl)
 	if err != nil {
 		panic(err)
 	}
 }
 
-func createEvent(name string, price, totalSlots int) error {
-	_, err := createEventStmt.Exec(name, price, totalSlots)
+func createEvent(e *eventModel) error {
+	err := dbConn.Retry(func() error {
+		return createEventStmt.QueryRow(e.Name, e.Price, e.TotalSlots, e.Category, e.StartsAt, e.Description, e.ImageURI, e.OverbookPct, e.AllowMultiple).Scan(&e.ID)
+	})
 	if err != nil {
-		log.Printf("Failed to create event with name [%s]: %s", name, err)
+		log.Printf("Failed to create event with name [%s]: %s", e.Name, err)
 		return err
 	}
 	return nil
@@ -200,68 +870,421 @@ func createEvent(name string, price, totalSlots int) error {
 func create(w http.ResponseWriter, r *http.Request) {
 	e := eventModel{}
 	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("Failed to parse request body user id []: %s\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse request body of event: %s\n", err)
 		return
 	}
-	if err := createEvent(e.Name, e.Price, e.TotalSlots); err != nil {
-		log.Printf("Failed to create event with name [%s] price [%d] slots [%d]: %s\n", e.Name, e.Price, e.TotalSlots, err)
-		w.WriteHeader(http.StatusInternalServerError)
+	if e.Category == "" {
+		e.Category = defaultEventCategory
+	}
+	if validateEvent(&e).write(w) {
+		log.Printf("Got invalid event with name [%s]\n", e.Name)
+		return
+	}
+	if err := createEvent(&e); err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to create event with name [%s] price [%d] slots [%d]: %w", e.Name, e.Price, e.TotalSlots, err))
 		return
 	}
 	log.Printf("Successfully created event with name [%s] price [%d] slots [%d]\n", e.Name, e.Price, e.TotalSlots)
 	w.WriteHeader(http.StatusOK)
 }
 
-func getTotalSlots(id int) int {
-	e, err := getEvent(id)
-	if err != nil {
-		log.Printf("Failed to get event id [%d]: %s\n", id, err)
-		return 0
+// validateEvent checks the fields of a new event.
+func validateEvent(e *eventModel) validationErrors {
+	var errs validationErrors
+	if strings.TrimSpace(e.Name) == "" {
+		errs.add("event_name", "required")
+	}
+	if e.Price < 0 {
+		errs.add("price", "must not be negative")
+	} else if e.Price > maxPrice {
+		errs.add("price", fmt.Sprintf("must not exceed %d", maxPrice))
+	}
+	if e.TotalSlots <= 0 {
+		errs.add("total_slots", "must be positive")
+	} else if e.TotalSlots > maxTotalSlots {
+		errs.add("total_slots", fmt.Sprintf("must not exceed %d", maxTotalSlots))
 	}
-	return e.TotalSlots
+	if !eventCategories[e.Category] {
+		errs.add("category", fmt.Sprintf("unknown category %q", e.Category))
+	}
+	if !e.StartsAt.After(clk.Now()) {
+		errs.add("starts_at", "must be in the future")
+	}
+	errs = append(errs, validateMeta(&eventMetaModel{ImageURI: e.ImageURI, OverbookPct: e.OverbookPct})...)
+	return errs
 }
 
-func getOccupiedSlots(id int) int {
-	row := occupiedSlotsStmt.QueryRow(id)
-	occ := new(int)
-	if err := row.Scan(&occ); err != nil {
-		log.Printf("Failed to get occupied slots for event id [%d]:%s\n", id, err)
-		return 0
+// validateMeta checks the fields of an event that can be changed after
+// create.
+func validateMeta(m *eventMetaModel) validationErrors {
+	var errs validationErrors
+	if !validImageURI(m.ImageURI) {
+		errs.add("image_uri", "must be an absolute http or https url")
+	}
+	if m.OverbookPct < 0 || m.OverbookPct > maxOverbookPct {
+		errs.add("overbook_pct", fmt.Sprintf("must be between 0 and %d", maxOverbookPct))
 	}
-	return *occ
+	return errs
 }
 
-func getEvent(id int) (*eventModel, error) {
-	row := getEventStmt.QueryRow(id)
-	e := &eventModel{ID: id}
-	err := row.Scan(&e.ID, &e.Name, &e.Price, &e.TotalSlots)
-	if err != nil {
-		return nil, err
+// validImageURI allows an empty uri, the image is optional.
+func validImageURI(s string) bool {
+	if s == "" {
+		return true
 	}
-	return e, nil
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
 }
 
-func getEvents() ([]eventModel, error) {
-	rows, err := getEventsStmt.Query()
+// updateEvent changes the description and the image of the event.
+func updateEvent(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		return nil, err
+		log.Println("Failed to parse request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
-	es := []eventModel{}
-	e := eventModel{}
-	for rows.Next() {
-		err := rows.Scan(&e.ID, &e.Name, &e.Price, &e.TotalSlots)
-		if err != nil {
-			log.Printf("Failed to get values: %s", err)
-			break
-		}
-		es = append(es, e)
+	m := eventMetaModel{}
+	if err = json.NewDecoder(r.Body).Decode(&m); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse request body event id [%d]: %s\n", id, err)
+		return
 	}
-	return es, nil
-}
-
-func get(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
+	if validateMeta(&m).write(w) {
+		log.Printf("Got invalid update of event [%d]\n", id)
+		return
+	}
+	var res sql.Result
+	err = dbConn.Retry(func() (err error) {
+		res, err = updateEventStmt.Exec(id, m.Description, m.ImageURI, m.OverbookPct, m.AllowMultiple)
+		return err
+	})
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to update event [%d]: %w", id, err))
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		log.Printf("Could not find any event with id [%d]\n", id)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	publishChange(id)
+	log.Printf("Successfully updated event [%d]\n", id)
+	w.WriteHeader(http.StatusOK)
+}
+
+// setClosed returns the handler closing the event for bookings or opening it
+// again. Slots occupied already are kept.
+func setClosed(closed bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			log.Println("Failed to parse request")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var res sql.Result
+		err = dbConn.Retry(func() (err error) {
+			res, err = setClosedStmt.Exec(id, closed)
+			return err
+		})
+		if err != nil {
+			web.InternalError(w, r, fmt.Errorf("failed to set closed [%t] on event [%d]: %w", closed, id, err))
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			log.Printf("Could not find any event with id [%d]\n", id)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		publishChange(id)
+		log.Printf("Event [%d] is set closed [%t]\n", id, closed)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// resolvePrice returns the price of the event for the user: the cheapest
+// tier in pricing for the user id or the role, or the base price when no
+// tier matches. If the tiers can't be read the base price is used too.
+func resolvePrice(e *eventModel, uid int, role string) int {
+	var price sql.NullInt64
+	err := dbConn.Retry(func() error {
+		return resolvePriceStmt.QueryRow(e.ID, uid, role).Scan(&price)
+	})
+	if err != nil {
+		log.Printf("Failed to resolve price of event [%d] for user [%d], using base price: %s\n", e.ID, uid, err)
+		return e.Price
+	}
+	if !price.Valid {
+		return e.Price
+	}
+	return int(price.Int64)
+}
+
+// capacity is the number of slots that may be occupied, total_slots plus
+// the allowed overbooking.
+func capacity(e *eventModel) int {
+	return e.TotalSlots + e.TotalSlots*e.OverbookPct/100
+}
+
+// getOccupiedSlots returns the number of occupied slots of the event from
+// occupancy, counting them in the database on a cache miss.
+func getOccupiedSlots(id int) int {
+	occupancyMu.Lock()
+	occ, ok := occupancy[id]
+	occupancyMu.Unlock()
+	if ok {
+		return occ
+	}
+	err := dbConn.Retry(func() error {
+		return timed("occupiedSlots", func() error {
+			return occupiedSlotsStmt.QueryRow(id).Scan(&occ)
+		})
+	})
+	if err != nil {
+		log.Printf("Failed to get occupied slots for event id [%d]:%s\n", id, err)
+		return 0
+	}
+	occupancyMu.Lock()
+	if _, ok = occupancy[id]; !ok {
+		occupancy[id] = occ
+	}
+	occupancyMu.Unlock()
+	return occ
+}
+
+// addOccupied changes the cached occupancy of the event by delta. An event
+// that is not cached is left alone, it is counted on the next read.
+func addOccupied(id, delta int) {
+	occupancyMu.Lock()
+	defer occupancyMu.Unlock()
+	if occ, ok := occupancy[id]; ok {
+		occupancy[id] = occ + delta
+	}
+}
+
+// reconcileOccupancy drops the cached occupancy every
+// occupancyReconcileInterval, so drift caused by other replicas or lost
+// updates is corrected from the database.
+func reconcileOccupancy(ctx context.Context) {
+	t := time.NewTicker(occupancyReconcileInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		occupancyMu.Lock()
+		occupancy = map[int]int{}
+		occupancyMu.Unlock()
+	}
+}
+
+// dropOccupancy removes the event from the occupancy cache.
+func dropOccupancy(id int) {
+	occupancyMu.Lock()
+	delete(occupancy, id)
+	occupancyMu.Unlock()
+}
+
+// publishChange tells the other replicas that the event has changed and
+// their cached data must be dropped. A lost notification is
+// corrected by reconcileOccupancy.
+func publishChange(id int) {
+	err := dbConn.Retry(func() error {
+		_, err := notifyChangeStmt.Exec(changesChannel, fmt.Sprintf("%d %s", id, replica))
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to publish change of event [%d]: %s\n", id, err)
+	}
+}
+
+// listenChanges drops cached data of the events other replicas report as
+// changed. If LISTEN can't be set up the cache falls back to expiring every
+// occupancyReconcileInterval.
+func listenChanges(ctx context.Context, cfg *configModel) {
+	l := pq.NewListener(connString(cfg), listenerMinReconnect, listenerMaxReconnect, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Listener of [%s] event [%d]: %s\n", changesChannel, ev, err)
+		}
+	})
+	defer l.Close()
+	if err := l.Listen(changesChannel); err != nil {
+		log.Printf("Failed to listen on [%s], cached occupancy only expires: %s\n", changesChannel, err)
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-l.Notify:
+			handleChange(n)
+		}
+	}
+}
+
+// handleChange drops the cached data of the event in the notification. A nil
+// notification comes after the listener reconnected, notifications may have
+// been missed meanwhile, so the whole cache is dropped.
+func handleChange(n *pq.Notification) {
+	if n == nil {
+		occupancyMu.Lock()
+		occupancy = map[int]int{}
+		occupancyMu.Unlock()
+		return
+	}
+	var id int
+	var from string
+	if _, err := fmt.Sscanf(n.Extra, "%d %s", &id, &from); err != nil {
+		log.Printf("Got wrong payload [%s] on [%s]\n", n.Extra, n.Channel)
+		return
+	}
+	if from != replica {
+		dropOccupancy(id)
+	}
+}
+
+func hostname() string {
+	h, _ := os.Hostname()
+	return h
+}
+
+func getEvent(id int) (*eventModel, error) {
+	e := &eventModel{ID: id}
+	err := dbConn.Retry(func() error {
+		return getEventStmt.QueryRow(id).Scan(&e.ID, &e.Name, &e.Price, &e.TotalSlots, &e.Category, &e.StartsAt, &e.Description, &e.ImageURI, &e.OverbookPct, &e.Closed, &e.AllowMultiple)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// getEvents returns the page of events matching f. The total is counted only
+// if f.count is set, otherwise it's zero.
+func getEvents(f eventFilter) ([]eventModel, int, error) {
+	where := []string{"deleted_at IS NULL"}
+	args := []interface{}{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if f.name != "" {
+		where = append(where, "event_name ILIKE "+arg("%"+likeEscaper.Replace(f.name)+"%"))
+	}
+	if f.category != "" {
+		where = append(where, "category = "+arg(f.category))
+	}
+	if f.tag != "" {
+		where = append(where, "id IN (SELECT event_id FROM event_tags WHERE tag = "+arg(f.tag)+")")
+	}
+	if f.minPrice != nil {
+		where = append(where, "price >= "+arg(*f.minPrice))
+	}
+	if f.maxPrice != nil {
+		where = append(where, "price <= "+arg(*f.maxPrice))
+	}
+	total := 0
+	if f.count {
+		err := dbConn.Retry(func() error {
+			return dbConn.DB().QueryRow(fmt.Sprintf(countEventsTpl, strings.Join(where, " AND ")), args...).Scan(&total)
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	query := fmt.Sprintf(getEventsTpl, strings.Join(where, " AND "))
+	if f.limit > 0 {
+		query += " LIMIT " + arg(f.limit)
+	}
+	if f.offset > 0 {
+		query += " OFFSET " + arg(f.offset)
+	}
+	es := []eventModel{}
+	err := dbConn.Retry(func() error {
+		es = es[:0]
+		rows, err := dbConn.DB().Query(query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		e := eventModel{}
+		for rows.Next() {
+			err := rows.Scan(&e.ID, &e.Name, &e.Price, &e.TotalSlots, &e.Category, &e.StartsAt, &e.Description, &e.ImageURI, &e.OverbookPct, &e.Closed, &e.AllowMultiple)
+			if err != nil {
+				log.Printf("Failed to get values: %s", err)
+				break
+			}
+			es = append(es, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return es, total, nil
+}
+
+// parseEventFilter reads q, category, tag, min_price, max_price, limit, offset
+// and count from the query string.
+func parseEventFilter(q url.Values) (eventFilter, error) {
+	f := eventFilter{name: q.Get("q"), category: q.Get("category")}
+	if f.category != "" && !eventCategories[f.category] {
+		return f, fmt.Errorf("unknown category [%s]", f.category)
+	}
+	if tag := q.Get("tag"); tag != "" {
+		if f.tag = strings.ToLower(tag); !tagRe.MatchString(f.tag) {
+			return f, fmt.Errorf("wrong tag [%s]", tag)
+		}
+	}
+	intParam := func(name string) (*int, error) {
+		v := q.Get(name)
+		if v == "" {
+			return nil, nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("wrong value of [%s]: %q", name, v)
+		}
+		return &n, nil
+	}
+	var err error
+	if f.minPrice, err = intParam("min_price"); err != nil {
+		return f, err
+	}
+	if f.maxPrice, err = intParam("max_price"); err != nil {
+		return f, err
+	}
+	limit, err := intParam("limit")
+	if err != nil {
+		return f, err
+	}
+	if limit != nil {
+		if *limit == 0 || *limit > maxEventsLimit {
+			return f, fmt.Errorf("limit must be between 1 and %d", maxEventsLimit)
+		}
+		f.limit = *limit
+	}
+	offset, err := intParam("offset")
+	if err != nil {
+		return f, err
+	}
+	if offset != nil {
+		f.offset = *offset
+	}
+	if v := q.Get("count"); v != "" {
+		if f.count, err = strconv.ParseBool(v); err != nil {
+			return f, fmt.Errorf("wrong value of [count]: %q", v)
+		}
+	}
+	return f, nil
+}
+
+func get(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
 	if id_, ok := vars["id"]; ok {
 		id, err := strconv.Atoi(id_)
 		if err != nil {
@@ -270,37 +1293,331 @@ func get(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		e, err := getEvent(id)
-		if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
 			log.Printf("Could not find any event with id [%d]\n", id)
-			w.WriteHeader(http.StatusBadRequest)
+			w.WriteHeader(http.StatusNotFound)
 			return
 		}
+		if err != nil {
+			web.InternalError(w, r, fmt.Errorf("failed to get event [%d]: %w", id, err))
+			return
+		}
+		free := capacity(e) - getOccupiedSlots(id)
+		if free < 0 {
+			free = 0
+		}
+		e.FreeSlots = &free
+		if uid, err := web.UserID(r); err == nil {
+			e.Price = resolvePrice(e, uid, r.Header.Get("X-User-Role"))
+		}
+		if e.Tags, err = getTags(id); err != nil {
+			log.Printf("Failed to get tags of event [%d]: %s\n", id, err)
+		}
 		data, _ := json.Marshal(e)
 		w.WriteHeader(http.StatusOK)
 		w.Write(data)
 		return
 	}
-	es, err := getEvents()
+	f, err := parseEventFilter(r.URL.Query())
+	if err != nil {
+		log.Println("Failed to parse request:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	es, total, err := getEvents(f)
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to get event's list: %w", err))
+		return
+	}
+	var data []byte
+	if f.count {
+		data, _ = json.Marshal(pageModel{Items: es, Total: total})
+	} else {
+		data, _ = json.Marshal(es)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// duplicateEvent creates a new event from an existing one, e.g. for the next
+// week of a recurring event. Slots are not copied. Unless the request gives a
+// name, the copy is named after the original and its start time since event
+// names must be unique.
+func duplicateEvent(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		log.Println("Failed to parse request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	d := duplicateRequestModel{}
+	if err = json.NewDecoder(r.Body).Decode(&d); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse request body event id [%d]: %s\n", id, err)
+		return
+	}
+	e, err := getEvent(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Could not find any event with id [%d]\n", id)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to get event [%d]: %w", id, err))
+		return
+	}
+	if d.StartsAt != nil {
+		e.StartsAt = *d.StartsAt
+	}
+	if d.Name == "" {
+		d.Name = fmt.Sprintf("%s (%s)", e.Name, e.StartsAt.Format("2006-01-02 15:04"))
+	}
+	e.Name = d.Name
+	if validateEvent(e).write(w) {
+		log.Printf("Got invalid duplicate of event [%d]\n", id)
+		return
+	}
+	if err = createEvent(e); err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "Event with name [%s] already exists", e.Name)
+			return
+		}
+		web.InternalError(w, r, fmt.Errorf("failed to duplicate event [%d]: %w", id, err))
+		return
+	}
+	log.Printf("Duplicated event [%d] as [%d]\n", id, e.ID)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"id":%d}`, e.ID)
+}
+
+// availability returns the slot counts of the given events in one query.
+// Unknown and deleted events are left out of the response.
+func availability(w http.ResponseWriter, r *http.Request) {
+	req := availabilityRequestModel{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("Failed to parse data:", err)
+		return
+	}
+	if len(req.IDs) > maxAvailabilityIDs {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Too many event ids, at most %d are allowed", maxAvailabilityIDs)
+		return
+	}
+	res := make([]availabilityModel, 0, len(req.IDs))
+	err := dbConn.Retry(func() error {
+		res = res[:0]
+		rows, err := availabilityStmt.Query(pq.Array(req.IDs))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var e eventModel
+			var a availabilityModel
+			if err = rows.Scan(&e.ID, &a.Name, &a.Price, &e.TotalSlots, &e.OverbookPct, &a.Occupied); err != nil {
+				return err
+			}
+			a.ID, a.Total = e.ID, capacity(&e)
+			if a.Available = a.Total - a.Occupied; a.Available < 0 {
+				a.Available = 0
+			}
+			res = append(res, a)
+		}
+		return rows.Err()
+	})
 	if err != nil {
-		log.Printf("Failed to get event's list: %s", err)
+		web.InternalError(w, r, fmt.Errorf("failed to get availability of [%d] events: %w", len(req.IDs), err))
+		return
+	}
+	data, err := json.Marshal(res)
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to marshal availability: %w", err))
+		return
 	}
-	data, _ := json.Marshal(es)
 	w.WriteHeader(http.StatusOK)
 	w.Write(data)
 }
 
-func occupySlot(eid, oid int) error {
-	_, err := occupySlotStmt.Exec(eid, oid)
+// addTags tags the event. Tags are lowercased, adding a tag the event already
+// has is a no-op.
+func addTags(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		log.Println("Failed to parse request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	t := tagsModel{}
+	if err = json.NewDecoder(r.Body).Decode(&t); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse request body event id [%d]: %s\n", id, err)
+		return
+	}
+	var errs validationErrors
+	for i, tag := range t.Tags {
+		t.Tags[i] = strings.ToLower(tag)
+		if !tagRe.MatchString(t.Tags[i]) {
+			errs.add("tags", fmt.Sprintf("wrong tag %q, use up to 32 letters, digits and dashes", tag))
+		}
+	}
+	if errs.write(w) {
+		return
+	}
+	var added int64
+	err = dbConn.Retry(func() error {
+		tx, err := dbConn.DB().Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		stmt := tx.Stmt(addTagStmt)
+		added = 0
+		for _, tag := range t.Tags {
+			res, err := stmt.Exec(id, tag)
+			if err != nil {
+				return err
+			}
+			n, _ := res.RowsAffected()
+			added += n
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to tag event [%d]: %w", id, err))
+		return
+	}
+	if _, err = getEvent(id); errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Could not find any event with id [%d]\n", id)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	log.Printf("Added [%d] tags to event [%d]\n", added, id)
+	w.WriteHeader(http.StatusOK)
+}
+
+// removeTag takes the tag off the event.
+func removeTag(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		log.Println("Failed to parse request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	tag := strings.ToLower(vars["tag"])
+	var res sql.Result
+	err = dbConn.Retry(func() (err error) {
+		res, err = removeTagStmt.Exec(id, tag)
+		return err
+	})
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to remove tag [%s] of event [%d]: %w", tag, id, err))
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func getTags(id int) ([]string, error) {
+	tags := []string{}
+	err := dbConn.Retry(func() error {
+		tags = tags[:0]
+		rows, err := getTagsStmt.Query(id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var tag string
+			if err := rows.Scan(&tag); err != nil {
+				return err
+			}
+			tags = append(tags, tag)
+		}
+		return rows.Err()
+	})
+	return tags, err
+}
+
+// deleteEvent marks the event as deleted. The row and its slots stay in the
+// table for history, but the event disappears from get results.
+func deleteEvent(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		log.Println("Failed to parse request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var res sql.Result
+	err = dbConn.Retry(func() (err error) {
+		res, err = deleteEventStmt.Exec(id)
+		return err
+	})
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to delete event [%d]: %w", id, err))
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		log.Printf("Could not find any event with id [%d]\n", id)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	publishChange(id)
+	log.Printf("Successfully deleted event [%d]\n", id)
+	w.WriteHeader(http.StatusOK)
+}
+
+// occupySlot occupies quantity slots of the event for the booking until
+// slotHoldTimeout, when expireSlots frees them unless they were committed.
+// The slots are occupied all at once or, if fewer than quantity of total are
+// left, not at all and errNoSlots is returned. errEventClosed is returned
+// for a closed event.
+func occupySlot(eid, oid, uid, quantity, total int) error {
+	err := dbConn.Retry(func() error {
+		tx, err := dbConn.DB().Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		closed := false
+		if err = tx.Stmt(lockEventStmt).QueryRow(eid).Scan(&closed); err != nil {
+			return err
+		}
+		if closed {
+			return errEventClosed
+		}
+		occupied := 0
+		if err = tx.Stmt(occupiedSlotsStmt).QueryRow(eid).Scan(&occupied); err != nil {
+			return err
+		}
+		if occupied+quantity > total {
+			return errNoSlots
+		}
+		if _, err = tx.Stmt(occupySlotStmt).Exec(eid, oid, uid, statusOccupied, clk.Now().Add(slotHoldTimeout), quantity); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err == nil {
+		addOccupied(eid, quantity)
+		publishChange(eid)
+	}
 	return err
 }
 
 func occupy(w http.ResponseWriter, r *http.Request) {
-	uid, err := getUserID(r)
-	if err != nil {
-		log.Printf("Failed to get User ID: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	uid, ok := web.MustUserID(w, r)
+	if !ok {
 		return
 	}
+	var err error
 	o := occupyRequestModel{}
 	if err = json.NewDecoder(r.Body).Decode(&o); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -314,24 +1631,65 @@ func occupy(w http.ResponseWriter, r *http.Request) {
 	}
 	e := &eventModel{}
 	if e, err = getEvent(o.EventID); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("Failed to get event [%d]: %s\n", o.EventID, err)
+		web.InternalError(w, r, fmt.Errorf("failed to get event [%d]: %w", o.EventID, err))
+		sendCallback(ro)
+		return
+	}
+	if e.Closed {
+		w.WriteHeader(http.StatusOK)
+		log.Printf("Slot was not occupied due to event [%d] is closed\n", o.EventID)
+		ro.Reason = reasonEventClosed
+		sendCallback(ro)
+		return
+	}
+	quantity := o.Quantity
+	if quantity == 0 {
+		quantity = 1
+	}
+	if quantity < 0 || quantity > maxQuantity {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Slots were not occupied due to wrong quantity [%d] for book [%d]\n", quantity, o.BookID)
+		ro.Reason = reasonBadQuantity
+		sendCallback(ro)
+		return
+	}
+	ro.Price = resolvePrice(e, uid, r.Header.Get("X-User-Role")) * quantity
+	if !e.StartsAt.After(clk.Now()) {
+		w.WriteHeader(http.StatusOK)
+		log.Printf("Slot was not occupied due to event [%d] has already started\n", o.EventID)
+		ro.Reason = reasonEventPast
 		sendCallback(ro)
 		return
 	}
-	ro.Price = e.Price
-	total := getTotalSlots(o.EventID)
-	occupied := getOccupiedSlots(o.EventID)
-	if total > occupied {
-		if err = occupySlot(o.EventID, o.BookID); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			sendCallback(ro)
-			log.Printf("Failed to occupy slot on events [%d] for book [%d]: %s\n", o.EventID, o.BookID, err)
+	total := capacity(e)
+	err = errNoSlots
+	if getOccupiedSlots(o.EventID)+quantity <= total {
+		// book cancels the booking on the error itself, so no callback
+		if !occupyLimiter.acquire(o.EventID, occupyWait) {
+			log.Printf("Too many concurrent occupies of event [%d], rejecting book [%d]\n", o.EventID, o.BookID)
+			w.Header().Set("Retry-After", occupyRetryAfter)
+			w.WriteHeader(http.StatusServiceUnavailable)
 			return
 		}
-	} else {
+		err = occupySlot(o.EventID, o.BookID, uid, quantity, total)
+		occupyLimiter.release(o.EventID)
+	}
+	if errors.Is(err, errNoSlots) {
+		w.WriteHeader(http.StatusOK)
+		log.Printf("Slots were not occupied due to there are less than [%d] available slots\n", quantity)
+		ro.Reason = reasonSoldOut
+		sendCallback(ro)
+		return
+	}
+	if errors.Is(err, errEventClosed) {
 		w.WriteHeader(http.StatusOK)
-		log.Println("Slot was not occupied due to there is no available slots any more")
+		log.Printf("Slot was not occupied due to event [%d] is closed\n", o.EventID)
+		ro.Reason = reasonEventClosed
+		sendCallback(ro)
+		return
+	}
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to occupy slot on events [%d] for book [%d]: %w", o.EventID, o.BookID, err))
 		sendCallback(ro)
 		return
 	}
@@ -348,53 +1706,274 @@ func cancelSlot(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Failed to parse request body user id []: %s\n", err)
 		return
 	}
-	if _, err := cancelSlotStmt.Exec(o.BookID); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Println("Failed to cancel slot occuping:", err)
+	var events []int
+	err := dbConn.Retry(func() error {
+		events = events[:0]
+		rows, err := cancelSlotStmt.Query(o.BookID, statusCancelled)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var eid int
+			if err = rows.Scan(&eid); err != nil {
+				return err
+			}
+			events = append(events, eid)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to cancel slot occuping: %w", err))
+		return
+	}
+	for _, eid := range events {
+		addOccupied(eid, -1)
+		publishChange(eid)
 	}
 }
 
-func sendCallback(r *occupiedResponseModel) {
-	data, err := json.Marshal(r)
+// expireSlots frees occupied slots whose hold has expired and tells book
+// that they are gone, so a booking that was never paid doesn't hold a slot
+// forever. Committed slots have no expiry and are never freed.
+func expireSlots(ctx context.Context) {
+	t := time.NewTicker(expireSlotsInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		expireDueSlots()
+	}
+}
+
+// expireDueSlots frees one batch of the slots whose hold expired by
+// clk.Now().
+func expireDueSlots() {
+	var expired []occupiedResponseModel
+	var events []int
+	err := dbConn.Retry(func() error {
+		expired, events = expired[:0], events[:0]
+		rows, err := expireSlotsStmt.Query(statusCancelled, statusOccupied, expireSlotsBatch, clk.Now())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			ro := occupiedResponseModel{Reason: reasonSlotExpired}
+			var eid int
+			var uid sql.NullInt64
+			if err = rows.Scan(&ro.BookID, &eid, &uid); err != nil {
+				return err
+			}
+			ro.UserID = int(uid.Int64)
+			expired = append(expired, ro)
+			events = append(events, eid)
+		}
+		return rows.Err()
+	})
 	if err != nil {
-		log.Printf("Failed to parse data: %s\n", err)
+		log.Printf("Failed to expire slots: %s\n", err)
 		return
 	}
-	reqBody := bytes.NewReader(data)
-	req, err := http.NewRequest("POST", bookCallbackEndpoint, reqBody)
-	if err != nil {
-		log.Printf("Failed callback request: %s\n", err)
+	// All slots of a booking expire together, book is told once.
+	told := map[int]bool{}
+	for i := range expired {
+		addOccupied(events[i], -1)
+		publishChange(events[i])
+		if told[expired[i].BookID] {
+			continue
+		}
+		told[expired[i].BookID] = true
+		log.Printf("Slots of book [%d] expired, freeing them\n", expired[i].BookID)
+		sendCallback(&expired[i])
+	}
+}
+
+// commitSlot marks the occupied slot of a paid booking as committed. Committing
+// an already committed slot is a no-op, so book may safely retry it.
+func commitSlot(w http.ResponseWriter, r *http.Request) {
+	o := occupyRequestModel{}
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse request body: %s\n", err)
 		return
 	}
-	req.Header.Set("X-User-Id", strconv.Itoa(r.UserID))
-	c := http.Client{}
-	resp, err := c.Do(req)
+	var n int64
+	err := dbConn.Retry(func() error {
+		res, err := commitSlotStmt.Exec(o.BookID, statusCommited, statusOccupied)
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
 	if err != nil {
-		log.Printf("Failed to call back book endpoint: %s\n", err)
+		web.InternalError(w, r, fmt.Errorf("failed to commit slot for book [%d]: %w", o.BookID, err))
+		return
+	}
+	if n == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		log.Printf("Failed to commit slot for book [%d]: no occupied slot\n", o.BookID)
 		return
 	}
-	defer resp.Body.Close()
+	log.Printf("Slot for book [%d] is committed\n", o.BookID)
 }
 
-func isAuthenticatedMiddleware(h http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		headers := r.Header
-		if _, ok := headers["X-User-Id"]; !ok {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("Not authenticated"))
+// sendCallback reports the result to book. If book can't be reached the
+// callback is saved to callback_dlq and sent again by retryCallbacks.
+func sendCallback(r *occupiedResponseModel) {
+	if err := services.SlotResult(*r); err != nil {
+		log.Printf("Failed to call back book endpoint, will retry later: %s\n", err)
+		data, err := json.Marshal(r)
+		if err != nil {
+			log.Printf("Failed to parse data: %s\n", err)
 			return
 		}
-		h.ServeHTTP(w, r)
+		enqueueCallback(r.UserID, data)
 	}
 }
 
-func reqlog(h http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Got request from: %s\n", r.Host)
-		h.ServeHTTP(w, r)
+// enqueueCallback puts the failed callback into callback_dlq so that
+// retryCallbacks sends it again later.
+func enqueueCallback(uid int, data []byte) {
+	err := dbConn.Retry(func() error {
+		_, err := enqueueCallbackStmt.Exec(uid, string(data), callbackBackoff(0).Seconds())
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to save callback for user [%d], callback is lost: %s: %s\n", uid, data, err)
+	}
+}
+
+// retryCallbacks resends callbacks from callback_dlq until book accepts them.
+// The delay between attempts doubles up to dlqMaxDelay, callbacks older than
+// dlqMaxAge are dropped.
+func retryCallbacks(ctx context.Context) {
+	t := time.NewTicker(dlqPollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		retryDueCallbacks()
+	}
+}
+
+func retryDueCallbacks() {
+	cbs := []dlqCallback{}
+	err := dbConn.Retry(func() error {
+		cbs = cbs[:0]
+		rows, err := dueCallbacksStmt.Query(dlqBatchSize)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			c := dlqCallback{}
+			if err := rows.Scan(&c.id, &c.userID, &c.payload, &c.attempts, &c.createdAt); err != nil {
+				return err
+			}
+			cbs = append(cbs, c)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		log.Printf("Failed to get callbacks to retry: %s\n", err)
+		return
+	}
+	for _, c := range cbs {
+		if clk.Now().Sub(c.createdAt) > dlqMaxAge {
+			log.Printf("Giving up on callback [%d] for user [%d] after [%d] attempts: %s\n", c.id, c.userID, c.attempts, c.payload)
+			deleteCallback(c.id)
+			continue
+		}
+		if err := resendCallback(c.payload); err != nil {
+			c.attempts++
+			log.Printf("Failed to resend callback [%d] for user [%d], attempt [%d]: %s\n", c.id, c.userID, c.attempts, err)
+			err = dbConn.Retry(func() error {
+				_, err := scheduleCallbackStmt.Exec(c.id, c.attempts, callbackBackoff(c.attempts).Seconds())
+				return err
+			})
+			if err != nil {
+				log.Printf("Failed to reschedule callback [%d]: %s\n", c.id, err)
+			}
+			continue
+		}
+		log.Printf("Successfully resent callback [%d] for user [%d]\n", c.id, c.userID)
+		deleteCallback(c.id)
+	}
+}
+
+// resendCallback sends a callback saved in callback_dlq to book again.
+func resendCallback(payload string) error {
+	r := occupiedResponseModel{}
+	if err := json.Unmarshal([]byte(payload), &r); err != nil {
+		return err
 	}
+	return services.SlotResult(r)
 }
 
-func getUserID(r *http.Request) (int, error) {
-	return strconv.Atoi(r.Header.Get("X-User-Id"))
+func deleteCallback(id int) {
+	err := dbConn.Retry(func() error {
+		_, err := deleteCallbackStmt.Exec(id)
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to delete callback [%d]: %s\n", id, err)
+	}
+}
+
+// callbackBackoff is the delay before the next attempt after the given number
+// of failed attempts.
+func callbackBackoff(attempts int) time.Duration {
+	d := dlqBaseDelay
+	for i := 0; i < attempts && d < dlqMaxDelay; i++ {
+		d *= 2
+	}
+	if d > dlqMaxDelay {
+		d = dlqMaxDelay
+	}
+	return d
+}
+
+// statusRecorder remembers the status code and the size of the response
+// written by the wrapped handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+func reqlog(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		log.Printf("method=%s path=%s status=%d bytes=%d duration=%s request_id=%q host=%s\n",
+			r.Method, r.URL.Path, rec.status, rec.bytes, time.Since(start), r.Header.Get("X-Request-Id"), r.Host)
+	}
 }
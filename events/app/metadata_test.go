@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestCreateWithMetadata(t *testing.T) {
+	db := newEventsDB(t)
+	useCaps(t, 100000, 10000000)
+	for _, body := range []string{
+		`{"event_name":"Rock Concert","price":1500,"total_slots":100,"starts_at":"2030-05-01T19:00:00Z","description":"Open air","image_uri":"https://img.example.com/rock.png"}`,
+		`{"event_name":"Jazz","price":500,"total_slots":30,"starts_at":"2030-05-03T19:00:00Z"}`,
+	} {
+		if w := send(create, http.MethodPost, "/events/create", body, nil); w.Code != http.StatusOK {
+			t.Fatalf("create answered %d %s", w.Code, w.Body.String())
+		}
+	}
+	if len(db.rows) != 2 {
+		t.Fatalf("stored %d events, want 2", len(db.rows))
+	}
+
+	for _, want := range []struct {
+		id          string
+		description string
+		imageURI    string
+	}{
+		{"3", "Open air", "https://img.example.com/rock.png"},
+		{"4", "", ""},
+	} {
+		w := send(get, http.MethodGet, "/events/get/"+want.id, "", map[string]string{"id": want.id})
+		if w.Code != http.StatusOK {
+			t.Fatalf("get %s answered %d", want.id, w.Code)
+		}
+		var e eventModel
+		if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Description != want.description || e.ImageURI != want.imageURI {
+			t.Errorf("event %s has description %q image %q, want %q %q", want.id, e.Description, e.ImageURI, want.description, want.imageURI)
+		}
+	}
+}
+
+func TestBadImageURIIsRejected(t *testing.T) {
+	db := newEventsDB(t, eventModel{ID: 3, Name: "Concert"})
+	useCaps(t, 100000, 10000000)
+	for _, uri := range []string{"not a url", "/rock.png", "ftp://img.example.com/rock.png", "https://"} {
+		body := `{"event_name":"Rock Concert","price":1500,"total_slots":100,"starts_at":"2030-05-01T19:00:00Z","image_uri":"` + uri + `"}`
+		w := send(create, http.MethodPost, "/events/create", body, nil)
+		if w.Code != http.StatusBadRequest || !sameJSON(t, w.Body.Bytes(), []byte(`{"errors":[{"field":"image_uri","msg":"must be an absolute http or https url"}]}`)) {
+			t.Errorf("create with image %q answered %d %s, want 400 on image_uri", uri, w.Code, w.Body.String())
+		}
+		w = send(updateEvent, http.MethodPut, "/events/update/3", `{"image_uri":"`+uri+`"}`, map[string]string{"id": "3"})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("update with image %q answered %d, want 400", uri, w.Code)
+		}
+	}
+	if len(db.rows) != 1 || db.rows[0].ImageURI != "" {
+		t.Errorf("a bad image got stored: %+v", db.rows)
+	}
+}
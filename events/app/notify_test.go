@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// TestNotifyDropsCachedEvent simulates the notifications of the other
+// replicas and checks only the changed event leaves the cache.
+func TestNotifyDropsCachedEvent(t *testing.T) {
+	c := useFakeClock(t)
+	useOccupyLimiter(t, 0)
+	useCallbackRecorder(t)
+	db := newEventsDB(t,
+		eventModel{ID: 3, Name: "Concert", Price: 1500, TotalSlots: 10, StartsAt: c.Now().Add(time.Hour)},
+		eventModel{ID: 4, Name: "Play", Price: 900, TotalSlots: 10, StartsAt: c.Now().Add(time.Hour)},
+	)
+	getOccupiedSlots(3)
+	getOccupiedSlots(4)
+
+	if code := occupyFor(1, 2); code != http.StatusOK {
+		t.Fatalf("occupy answered %d", code)
+	}
+	if !db.ran("pg_notify") {
+		t.Error("occupying did not notify the other replicas")
+	}
+
+	handleChange(&pq.Notification{Channel: changesChannel, Extra: "3 " + replica})
+	if _, cached := cachedOccupied(db, 3); !cached {
+		t.Error("own notification dropped the cache entry")
+	}
+	handleChange(&pq.Notification{Channel: changesChannel, Extra: "garbage"})
+	if _, cached := cachedOccupied(db, 3); !cached {
+		t.Error("notification with a wrong payload dropped the cache entry")
+	}
+
+	handleChange(&pq.Notification{Channel: changesChannel, Extra: "3 other-replica"})
+	if _, cached := cachedOccupied(db, 3); cached {
+		t.Error("notification from another replica kept the cache entry")
+	}
+	if _, cached := cachedOccupied(db, 4); !cached {
+		t.Error("notification about event 3 dropped event 4")
+	}
+
+	// After the listener reconnects it gets a nil notification, anything
+	// may have been missed.
+	handleChange(nil)
+	if _, cached := cachedOccupied(db, 4); cached {
+		t.Error("reconnecting kept the cache")
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// cachedOccupied reads the occupancy of the event and reports whether it
+// came from the cache, without a query.
+func cachedOccupied(db *eventsDB, eid int) (int, bool) {
+	db.mu.Lock()
+	before := len(db.queries)
+	db.mu.Unlock()
+	occ := getOccupiedSlots(eid)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return occ, len(db.queries) == before
+}
+
+// occupyFor occupies quantity slots of event 3 for the booking.
+func occupyFor(bid, quantity int) int {
+	body := fmt.Sprintf(`{"book_id":%d,"event_id":3,"quantity":%d}`, bid, quantity)
+	return send(occupy, http.MethodPost, "/events/occupy", body, nil).Code
+}
+
+// cancelFor cancels the slots of the booking.
+func cancelFor(bid int) int {
+	return send(cancelSlot, http.MethodPost, "/events/cancel", fmt.Sprintf(`{"book_id":%d,"event_id":3}`, bid), nil).Code
+}
+
+func TestCachedOccupancyMatchesDB(t *testing.T) {
+	c := useFakeClock(t)
+	useOccupyLimiter(t, 0)
+	useCallbackRecorder(t)
+	db := newEventsDB(t, eventModel{ID: 3, Name: "Concert", Price: 1500, TotalSlots: 10, StartsAt: c.Now().Add(time.Hour)})
+	if occ, _ := cachedOccupied(db, 3); occ != 0 {
+		t.Fatalf("empty event has %d occupied", occ)
+	}
+
+	steps := []struct {
+		name string
+		run  func() int
+	}{
+		{"occupy 2 for book 1", func() int { return occupyFor(1, 2) }},
+		{"occupy 1 for book 2", func() int { return occupyFor(2, 1) }},
+		{"cancel book 1", func() int { return cancelFor(1) }},
+		{"occupy 3 for book 3", func() int { return occupyFor(3, 3) }},
+		{"cancel unknown book 9", func() int { return cancelFor(9) }},
+		{"cancel book 2", func() int { return cancelFor(2) }},
+	}
+	for _, s := range steps {
+		if code := s.run(); code != http.StatusOK {
+			t.Fatalf("%s answered %d", s.name, code)
+		}
+		occ, cached := cachedOccupied(db, 3)
+		if !cached {
+			t.Errorf("after %s the occupancy was counted in the database", s.name)
+		}
+		if want := len(db.taken(3)); occ != want {
+			t.Fatalf("after %s the cache holds %d, the database %d", s.name, occ, want)
+		}
+	}
+
+	// Another replica occupies a slot, its notification drops the entry.
+	db.mu.Lock()
+	db.slots = append(db.slots, &slotRow{eventID: 3, bookID: 4, userID: 6, status: int64(statusOccupied)})
+	db.mu.Unlock()
+	handleChange(&pq.Notification{Channel: changesChannel, Extra: "3 other-replica"})
+	if occ, cached := cachedOccupied(db, 3); cached || occ != 4 {
+		t.Errorf("after a change from another replica got %d (cached %t), want 4 from the database", occ, cached)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// useOccupyLimiter sets the limiter main builds from OCCUPY_CONCURRENCY.
+func useOccupyLimiter(t *testing.T, limit int) {
+	saved := occupyLimiter
+	occupyLimiter = newEventLimiter(limit)
+	t.Cleanup(func() { occupyLimiter = saved })
+}
+
+// postOccupy asks for quantity slots of event eid for book 7 as book does.
+func postOccupy(eid, quantity int) int {
+	body := fmt.Sprintf(`{"book_id":7,"event_id":%d,"quantity":%d}`, eid, quantity)
+	return send(occupy, http.MethodPost, "/events/occupy", body, nil).Code
+}
+
+func TestOccupyRejectsStartedEvent(t *testing.T) {
+	c := useFakeClock(t)
+	useOccupyLimiter(t, 0)
+	db := newEventsDB(t,
+		eventModel{ID: 3, Name: "Future", Price: 1500, TotalSlots: 10, StartsAt: c.Now().Add(time.Hour)},
+		eventModel{ID: 4, Name: "Past", Price: 1500, TotalSlots: 10, StartsAt: c.Now().Add(-time.Hour)},
+		eventModel{ID: 5, Name: "Now", Price: 1500, TotalSlots: 10, StartsAt: c.Now()},
+	)
+	tests := []struct {
+		name     string
+		eid      int
+		callback string
+	}{
+		{"future", 3, `{"book_id":7,"user_id":5,"price":1500,"status":true}`},
+		{"past", 4, `{"book_id":7,"user_id":5,"price":1500,"status":false,"reason":"event_past"}`},
+		{"starting now", 5, `{"book_id":7,"user_id":5,"price":1500,"status":false,"reason":"event_past"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cb := useCallbackRecorder(t)
+			if code := postOccupy(tt.eid, 1); code != http.StatusOK {
+				t.Fatalf("occupy answered %d", code)
+			}
+			if sent := cb.sent(); len(sent) != 1 || !sameJSON(t, []byte(sent[0]), []byte(tt.callback)) {
+				t.Errorf("callbacks %v, want %s", sent, tt.callback)
+			}
+		})
+	}
+	if n := len(db.taken(4)) + len(db.taken(5)); n != 0 {
+		t.Errorf("started events got %d slots", n)
+	}
+}
+
+func TestCreateRejectsPastStart(t *testing.T) {
+	c := useFakeClock(t)
+	useCaps(t, 100000, 10000000)
+	db := newEventsDB(t)
+	for start, want := range map[time.Time]int{
+		c.Now().Add(time.Hour):  http.StatusOK,
+		c.Now():                 http.StatusBadRequest,
+		c.Now().Add(-time.Hour): http.StatusBadRequest,
+	} {
+		body := fmt.Sprintf(`{"event_name":"Concert","price":1500,"total_slots":10,"starts_at":%q}`, start.Format(time.RFC3339))
+		if w := send(create, http.MethodPost, "/events/create", body, nil); w.Code != want {
+			t.Errorf("event starting at %s answered %d, want %d", start, w.Code, want)
+		}
+	}
+	if len(db.rows) != 1 {
+		t.Errorf("created %d events, want 1", len(db.rows))
+	}
+}
+
+// TestMultiSlotOccupyIsAllOrNothing books several slots at once: a booking
+// that fits gets every slot at the whole price, one that doesn't gets none.
+func TestMultiSlotOccupyIsAllOrNothing(t *testing.T) {
+	c := useFakeClock(t)
+	useOccupyLimiter(t, 0)
+	db := newEventsDB(t, eventModel{ID: 3, Name: "Concert", Price: 1500, TotalSlots: 10, StartsAt: c.Now().Add(time.Hour)})
+	for i := 0; i < 4; i++ {
+		db.slots = append(db.slots, &slotRow{eventID: 3, bookID: 1, userID: 6, status: int64(statusOccupied)})
+	}
+
+	tests := []struct {
+		name     string
+		bid      int
+		quantity int
+		code     int
+		callback string
+		taken    int
+	}{
+		{"fits", 7, 4, http.StatusOK, `{"book_id":7,"user_id":5,"price":6000,"status":true}`, 8},
+		{"exceeds", 8, 3, http.StatusOK, `{"book_id":8,"user_id":5,"price":4500,"status":false,"reason":"sold_out"}`, 8},
+		{"fills up", 9, 2, http.StatusOK, `{"book_id":9,"user_id":5,"price":3000,"status":true}`, 10},
+		{"too many", 10, maxQuantity + 1, http.StatusBadRequest, `{"book_id":10,"user_id":5,"price":0,"status":false,"reason":"bad_quantity"}`, 10},
+	}
+	for _, tt := range tests {
+		cb := useCallbackRecorder(t)
+		if code := occupyFor(tt.bid, tt.quantity); code != tt.code {
+			t.Fatalf("%s: occupy answered %d, want %d", tt.name, code, tt.code)
+		}
+		if sent := cb.sent(); len(sent) != 1 || !sameJSON(t, []byte(sent[0]), []byte(tt.callback)) {
+			t.Errorf("%s: callbacks %v, want %s", tt.name, sent, tt.callback)
+		}
+		if n := len(db.taken(3)); n != tt.taken {
+			t.Errorf("%s: event holds %d slots, want %d", tt.name, n, tt.taken)
+		}
+	}
+	for _, s := range db.taken(3) {
+		if s.bookID == 8 || s.bookID == 10 {
+			t.Errorf("refused book %d holds a slot", s.bookID)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestOverbookingAllowsExtraSlots(t *testing.T) {
+	c := useFakeClock(t)
+	useOccupyLimiter(t, 0)
+	tests := []struct {
+		name    string
+		pct     int
+		granted int
+	}{
+		{"no overbooking", 0, 10},
+		{"10% overbooking", 10, 11},
+		{"rounds down", 15, 11},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newEventsDB(t, eventModel{ID: 3, Name: "Concert", Price: 100, TotalSlots: 10, OverbookPct: tt.pct, StartsAt: c.Now().Add(time.Hour)})
+			cb := useCallbackRecorder(t)
+			body := `{"book_id":1,"event_id":3,"quantity":8}`
+			if w := send(occupy, http.MethodPost, "/events/occupy", body, nil); w.Code != http.StatusOK {
+				t.Fatalf("occupy answered %d", w.Code)
+			}
+			for bid := 2; bid <= 5; bid++ {
+				body = fmt.Sprintf(`{"book_id":%d,"event_id":3,"quantity":1}`, bid)
+				if w := send(occupy, http.MethodPost, "/events/occupy", body, nil); w.Code != http.StatusOK {
+					t.Fatalf("occupy answered %d", w.Code)
+				}
+			}
+			if n := len(db.taken(3)); n != tt.granted {
+				t.Fatalf("event holds %d slots, want %d", n, tt.granted)
+			}
+			for i, sent := range cb.sent() {
+				r := occupiedResponseModel{}
+				if err := json.Unmarshal([]byte(sent), &r); err != nil {
+					t.Fatal(err)
+				}
+				want := 8+i <= tt.granted
+				if r.Status != want || (!want && r.Reason != reasonSoldOut) {
+					t.Errorf("book %d got %s, want granted %t", r.BookID, sent, want)
+				}
+			}
+		})
+	}
+}
+
+func TestOverbookPctRange(t *testing.T) {
+	db := newEventsDB(t, eventModel{ID: 3, Name: "Concert", OverbookPct: 5})
+	for pct, want := range map[int]int{-1: http.StatusBadRequest, 0: http.StatusOK, maxOverbookPct: http.StatusOK, maxOverbookPct + 1: http.StatusBadRequest} {
+		body := fmt.Sprintf(`{"overbook_pct":%d}`, pct)
+		if w := send(updateEvent, http.MethodPut, "/events/update/3", body, map[string]string{"id": "3"}); w.Code != want {
+			t.Errorf("update with overbook_pct %d answered %d, want %d", pct, w.Code, want)
+		}
+		if got := db.rows[0].OverbookPct; got < 0 || got > maxOverbookPct {
+			t.Fatalf("overbook_pct %d got stored", got)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"testing"
+)
+
+// usePricing fakes the pricing tiers of event 3: 1200 for user 5 and 1000
+// for the vip role.
+func usePricing(t *testing.T) {
+	useFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		if !queryHas(query, "SELECT MIN(price) FROM pricing") {
+			return fakeResult{}
+		}
+		if args[0] != int64(3) {
+			return fakeResult{Err: errors.New("unexpected event")}
+		}
+		var price driver.Value
+		switch {
+		case args[2] == "vip":
+			price = int64(1000)
+		case args[1] == int64(5):
+			price = int64(1200)
+		}
+		return fakeResult{Cols: []string{"min"}, Rows: [][]driver.Value{{price}}}
+	})
+}
+
+func TestResolvePrice(t *testing.T) {
+	usePricing(t)
+	tests := []struct {
+		name string
+		uid  int
+		role string
+		want int
+	}{
+		{"no tier gets the base price", 6, "", 1500},
+		{"role without a tier gets the base price", 6, "user", 1500},
+		{"user tier", 5, "", 1200},
+		{"role tier", 6, "vip", 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolvePrice(&eventModel{ID: 3, Price: 1500}, tt.uid, tt.role); got != tt.want {
+				t.Fatalf("price %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolvePriceFallsBackToBase(t *testing.T) {
+	usePricing(t)
+	if got := resolvePrice(&eventModel{ID: 4, Price: 1500}, 5, "vip"); got != 1500 {
+		t.Fatalf("price %d, want the base price 1500 when tiers can't be read", got)
+	}
+}
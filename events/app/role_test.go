@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"platform/web"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRequireRoleAdmin(t *testing.T) {
+	tests := []struct {
+		name string
+		role string
+		code int
+	}{
+		{"admin", roleAdmin, http.StatusOK},
+		{"user", "user", http.StatusForbidden},
+		{"no role", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newEventsDB(t, eventModel{ID: 3, Name: "Concert"})
+			r := httptest.NewRequest(http.MethodDelete, "/events/delete/3", strings.NewReader(""))
+			r.Header.Set("X-User-Id", "5")
+			if tt.role != "" {
+				r.Header.Set("X-User-Role", tt.role)
+			}
+			r = mux.SetURLVars(r, map[string]string{"id": "3"})
+			w := httptest.NewRecorder()
+			web.RequireRole(roleAdmin, deleteEvent)(w, r)
+			if w.Code != tt.code {
+				t.Fatalf("answered %d, want %d", w.Code, tt.code)
+			}
+			if deleted := db.rows[0].deleted; deleted != (tt.code == http.StatusOK) {
+				t.Errorf("event deleted: %v", deleted)
+			}
+		})
+	}
+}
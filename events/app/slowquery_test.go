@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useSlowQueryLog sets slowQueryThreshold and collects the log for the test.
+func useSlowQueryLog(t *testing.T, threshold time.Duration) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	saved := slowQueryThreshold
+	slowQueryThreshold = threshold
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		slowQueryThreshold = saved
+	})
+	return &buf
+}
+
+func TestSlowQueryIsLogged(t *testing.T) {
+	delay := 30 * time.Millisecond
+	newEventsDB(t) // empties the occupancy cache
+	useFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		if queryHas(query, "SELECT COUNT(1) FROM slots WHERE event_id=$1") {
+			time.Sleep(delay)
+		}
+		return fakeResult{Cols: []string{"count"}, Rows: [][]driver.Value{{int64(2)}}}
+	})
+
+	buf := useSlowQueryLog(t, 10*time.Millisecond)
+	getOccupiedSlots(3)
+	if !strings.Contains(buf.String(), "Slow query [occupiedSlots] took") {
+		t.Fatalf("logged %q, want the slow occupiedSlots", buf.String())
+	}
+
+	buf = useSlowQueryLog(t, time.Second)
+	getOccupiedSlots(4)
+	if strings.Contains(buf.String(), "Slow query") {
+		t.Errorf("logged %q for a query under the threshold", buf.String())
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// tag adds the tags in body to the event id.
+func tag(id, body string) int {
+	return send(addTags, http.MethodPost, "/events/"+id+"/tags", body, map[string]string{"id": id}).Code
+}
+
+func TestTagAndFilterByTag(t *testing.T) {
+	newEventsDB(t,
+		eventModel{ID: 3, Name: "Jazz night"},
+		eventModel{ID: 4, Name: "Rock night"},
+		eventModel{ID: 5, Name: "Jazz brunch"},
+	)
+	for id, body := range map[string]string{
+		"3": `{"tags":["jazz","live"]}`,
+		"4": `{"tags":["rock","live"]}`,
+		"5": `{"tags":["Jazz","jazz"]}`,
+	} {
+		if code := tag(id, body); code != http.StatusOK {
+			t.Fatalf("tagging event %s answered %d", id, code)
+		}
+	}
+	if ids := listIDs(t, "?tag=jazz"); !reflect.DeepEqual(ids, []int{3, 5}) {
+		t.Errorf("jazz listed %v, want [3 5]", ids)
+	}
+	if ids := listIDs(t, "?tag=live"); !reflect.DeepEqual(ids, []int{3, 4}) {
+		t.Errorf("live listed %v, want [3 4]", ids)
+	}
+
+	w := send(get, http.MethodGet, "/events/get/5", "", map[string]string{"id": "5"})
+	e := eventModel{}
+	if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(e.Tags, []string{"jazz"}) {
+		t.Errorf("event 5 has tags %v, want [jazz] once", e.Tags)
+	}
+
+	if w := send(removeTag, http.MethodDelete, "/events/3/tags/jazz", "", map[string]string{"id": "3", "tag": "JAZZ"}); w.Code != http.StatusOK {
+		t.Fatalf("removing the tag answered %d", w.Code)
+	}
+	if ids := listIDs(t, "?tag=jazz"); !reflect.DeepEqual(ids, []int{5}) {
+		t.Errorf("jazz listed %v after the tag was removed from 3, want [5]", ids)
+	}
+	if w := send(removeTag, http.MethodDelete, "/events/3/tags/jazz", "", map[string]string{"id": "3", "tag": "jazz"}); w.Code != http.StatusNotFound {
+		t.Errorf("removing a missing tag answered %d, want 404", w.Code)
+	}
+	if code := tag("9", `{"tags":["jazz"]}`); code != http.StatusNotFound {
+		t.Errorf("tagging a missing event answered %d, want 404", code)
+	}
+}
+
+func TestWrongTagsAreRejected(t *testing.T) {
+	db := newEventsDB(t, eventModel{ID: 3, Name: "Jazz night"})
+	for _, body := range []string{
+		`{"tags":["two words"]}`,
+		`{"tags":["jazz","semi;colon"]}`,
+		`{"tags":[""]}`,
+		`{"tags":["aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"]}`,
+	} {
+		if code := tag("3", body); code != http.StatusBadRequest {
+			t.Errorf("%s answered %d, want 400", body, code)
+		}
+	}
+	if len(db.tags[3]) != 0 {
+		t.Errorf("stored tags %v from a rejected request", db.tags[3])
+	}
+}
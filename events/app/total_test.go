@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// listPage lists events with query asking for count=true and returns the page.
+func listPage(t *testing.T, query string) (ids []int, total int) {
+	t.Helper()
+	w := send(get, http.MethodGet, "/events/get"+query+"&count=true", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("list answered %d %s", w.Code, w.Body.String())
+	}
+	page := struct {
+		Items []eventModel `json:"items"`
+		Total int          `json:"total"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatalf("list answered %s: %s", w.Body.String(), err)
+	}
+	ids = []int{}
+	for _, e := range page.Items {
+		ids = append(ids, e.ID)
+	}
+	return ids, page.Total
+}
+
+// TestTotalMatchesAcrossPages pages through the concerts two at a time and
+// checks every page counts all of them, while a list without count=true
+// stays a bare array and counts nothing.
+func TestTotalMatchesAcrossPages(t *testing.T) {
+	db := newEventsDB(t,
+		eventModel{ID: 3, Name: "Rock", Category: "concert"},
+		eventModel{ID: 4, Name: "Hamlet", Category: "theatre"},
+		eventModel{ID: 5, Name: "Jazz", Category: "concert"},
+		eventModel{ID: 6, Name: "Blues", Category: "concert"},
+	)
+	seen := []int{}
+	for _, page := range []struct {
+		query string
+		ids   []int
+	}{
+		{"?category=concert&limit=2", []int{3, 5}},
+		{"?category=concert&limit=2&offset=2", []int{6}},
+		{"?category=concert&limit=2&offset=4", []int{}},
+	} {
+		ids, total := listPage(t, page.query)
+		if total != 3 {
+			t.Errorf("%s counted %d, want 3", page.query, total)
+		}
+		if !reflect.DeepEqual(ids, page.ids) {
+			t.Errorf("%s listed %v, want %v", page.query, ids, page.ids)
+		}
+		seen = append(seen, ids...)
+	}
+	if len(seen) != 3 {
+		t.Errorf("pages listed %v, want the 3 concerts once each", seen)
+	}
+
+	db.mu.Lock()
+	db.queries = nil
+	db.mu.Unlock()
+	if ids := listIDs(t, "?category=concert&limit=2"); !reflect.DeepEqual(ids, []int{3, 5}) {
+		t.Errorf("list without count listed %v, want [3 5]", ids)
+	}
+	if db.ran("SELECT COUNT(1) FROM events") {
+		t.Error("list without count=true counted the events")
+	}
+	if w := send(get, http.MethodGet, "/events/get?count=maybe", "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("count=maybe answered %d, want 400", w.Code)
+	}
+}
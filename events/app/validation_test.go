@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCreateReportsAllFieldErrors(t *testing.T) {
+	useFakeClock(t)
+	useCaps(t, 100, 10000)
+	db := newEventsDB(t)
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			"every field wrong",
+			`{"event_name":" ","price":-1,"total_slots":0,"category":"party","starts_at":"2030-04-01T12:00:00Z","image_uri":"rock.png","overbook_pct":-5}`,
+			`{"errors":[{"field":"event_name","msg":"required"},{"field":"price","msg":"must not be negative"},{"field":"total_slots","msg":"must be positive"},{"field":"category","msg":"unknown category \"party\""},{"field":"starts_at","msg":"must be in the future"},{"field":"image_uri","msg":"must be an absolute http or https url"},{"field":"overbook_pct","msg":"must be between 0 and 100"}]}`,
+		},
+		{
+			"over the caps",
+			`{"event_name":"Concert","price":10001,"total_slots":101,"starts_at":"2030-06-01T12:00:00Z"}`,
+			`{"errors":[{"field":"price","msg":"must not exceed 10000"},{"field":"total_slots","msg":"must not exceed 100"}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(create, http.MethodPost, "/events/create", tt.body, nil)
+			if w.Code != http.StatusBadRequest || !sameJSON(t, w.Body.Bytes(), []byte(tt.want)) {
+				t.Errorf("answered %d %s, want 400 %s", w.Code, w.Body.String(), tt.want)
+			}
+		})
+	}
+	if len(db.rows) != 0 {
+		t.Errorf("stored %d invalid events", len(db.rows))
+	}
+}
+
+func TestCreateRejectsMalformedBody(t *testing.T) {
+	db := newEventsDB(t)
+	if w := send(create, http.MethodPost, "/events/create", `{"event_name":`, nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if len(db.rows) != 0 {
+		t.Error("malformed event was stored")
+	}
+}
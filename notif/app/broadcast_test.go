@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"platform/web"
+)
+
+// postBroadcast broadcasts body as user 1 with role.
+func postBroadcast(role, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/notif/broadcast", strings.NewReader(body))
+	r.Header.Set("X-User-Id", "1")
+	r.Header.Set("X-User-Role", role)
+	w := httptest.NewRecorder()
+	web.Authenticated(web.RequireRole(roleAdmin, broadcast))(w, r)
+	return w
+}
+
+func TestBroadcastToList(t *testing.T) {
+	db := useNotifDB(t)
+	w := postBroadcast(roleAdmin, `{"message":"Concert is cancelled","user_ids":[3,4,6]}`)
+	if w.Code != http.StatusOK || w.Body.String() != `{"count":3}` {
+		t.Fatalf("answered %d %s, want 200 with count 3", w.Code, w.Body.String())
+	}
+	for _, uid := range []int{3, 4, 6} {
+		if got := db.received(uid); !reflect.DeepEqual(got, []string{"Concert is cancelled"}) {
+			t.Errorf("user %d got %q", uid, got)
+		}
+	}
+	if got := db.received(5); len(got) != 0 {
+		t.Errorf("user 5 outside the list got %q", got)
+	}
+}
+
+func TestBroadcastToKnownUsers(t *testing.T) {
+	db := useNotifDB(t)
+	postBroadcast(roleAdmin, `{"message":"Hello","user_ids":[3,4]}`)
+	w := postBroadcast(roleAdmin, `{"message":"Maintenance tonight"}`)
+	if w.Code != http.StatusOK || w.Body.String() != `{"count":2}` {
+		t.Fatalf("answered %d %s, want 200 with count 2", w.Code, w.Body.String())
+	}
+	for _, uid := range []int{3, 4} {
+		if got := db.received(uid); !reflect.DeepEqual(got, []string{"Hello", "Maintenance tonight"}) {
+			t.Errorf("user %d got %q", uid, got)
+		}
+	}
+}
+
+func TestBroadcastNeedsAdmin(t *testing.T) {
+	db := useNotifDB(t)
+	if w := postBroadcast("user", `{"message":"Hello","user_ids":[3]}`); w.Code != http.StatusForbidden {
+		t.Errorf("answered %d, want 403", w.Code)
+	}
+	if w := postBroadcast(roleAdmin, `{"user_ids":[3]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("empty message answered %d, want 400", w.Code)
+	}
+	if n := len(db.messages()); n != 0 {
+		t.Errorf("created %d notifications", n)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// goldenDir holds the messages of the shared contracts package.
+const goldenDir = "../../contracts/testdata"
+
+func readGolden(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(goldenDir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// TestNotificationMatchesContract sends the golden notifications to create
+// and checks what is stored.
+func TestNotificationMatchesContract(t *testing.T) {
+	tests := []struct {
+		golden   string
+		message  string
+		priority string
+	}{
+		{"notification.json", "", priorityHigh},
+		{"notification_message.json", "Your balance is below 100", priorityNormal},
+		{"notification_email.json", "Your booking [7] for Rock Concert is confirmed, 3000 is paid", priorityNormal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			var args []driver.Value
+			useFakeDB(t, func(query string, a []driver.Value) fakeResult {
+				if queryHas(query, "INSERT INTO notif ") {
+					args = a
+					return fakeResult{Cols: []string{"id"}, Rows: [][]driver.Value{{int64(1)}}}
+				}
+				return fakeResult{Cols: []string{"id"}}
+			})
+			r := httptest.NewRequest(http.MethodPost, "/notif/create", bytes.NewReader(readGolden(t, tt.golden)))
+			r.Header.Set("X-User-Id", "5")
+			w := httptest.NewRecorder()
+			create(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d, want 200: %s", w.Code, w.Body.String())
+			}
+			if len(args) != 3 || args[0] != int64(5) || args[2] != tt.priority {
+				t.Fatalf("stored %v, want user 5 with priority %s", args, tt.priority)
+			}
+			if msg, _ := args[1].(string); msg == "" || tt.message != "" && msg != tt.message {
+				t.Errorf("stored message %q, want %q", msg, tt.message)
+			}
+		})
+	}
+}
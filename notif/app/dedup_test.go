@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// useDedupWindow sets dedupWindow for the test.
+func useDedupWindow(t *testing.T, d time.Duration) {
+	saved := dedupWindow
+	dedupWindow = d
+	t.Cleanup(func() { dedupWindow = saved })
+}
+
+func TestDuplicateWithinWindowIsSuppressed(t *testing.T) {
+	useDedupWindow(t, time.Minute)
+	db := useNotifDB(t)
+	for _, want := range []string{`{"id":1}`, `{"id":1}`} {
+		w := postNotif(`{"message":"Your booking is confirmed"}`, nil)
+		if w.Code != http.StatusOK || w.Body.String() != want {
+			t.Fatalf("create answered %d %s, want 200 %s", w.Code, w.Body.String(), want)
+		}
+	}
+	if got := db.received(5); len(got) != 1 {
+		t.Fatalf("stored %v, want the duplicate suppressed", got)
+	}
+	if w := postNotif(`{"message":"Your booking is cancelled"}`, nil); w.Body.String() != `{"id":2}` {
+		t.Errorf("another message answered %s, want a new id", w.Body.String())
+	}
+
+	db.mu.Lock()
+	db.rows[0].created = time.Now().Add(-2 * time.Minute)
+	db.mu.Unlock()
+	if w := postNotif(`{"message":"Your booking is confirmed"}`, nil); w.Body.String() != `{"id":3}` {
+		t.Errorf("the same message outside the window answered %s, want a new id", w.Body.String())
+	}
+	if got := db.received(5); len(got) != 3 {
+		t.Errorf("stored %v, want 3 notifications", got)
+	}
+}
+
+func TestDuplicatesKeptWithoutWindow(t *testing.T) {
+	useDedupWindow(t, 0)
+	db := useNotifDB(t)
+	postNotif(`{"message":"Your booking is confirmed"}`, nil)
+	postNotif(`{"message":"Your booking is confirmed"}`, nil)
+	if got := db.received(5); len(got) != 2 {
+		t.Errorf("stored %v, want both notifications", got)
+	}
+}
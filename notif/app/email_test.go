@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// mailRequest is what the mail gateway got.
+type mailRequest struct {
+	uid  string
+	body []byte
+}
+
+// useMailGateway starts a mail gateway and points httpClient at it. The
+// gateway is used for email only if the test sets emailURL to its url.
+func useMailGateway(t *testing.T) (*httptest.Server, chan mailRequest) {
+	got := make(chan mailRequest, 4)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- mailRequest{uid: r.Header.Get("X-User-Id"), body: body}
+	}))
+	t.Cleanup(s.Close)
+	savedClient, savedURL := httpClient, emailURL
+	httpClient = s.Client()
+	t.Cleanup(func() { httpClient, emailURL = savedClient, savedURL })
+	return s, got
+}
+
+func TestEmailChannelIsSent(t *testing.T) {
+	db := useNotifDB(t)
+	gw, got := useMailGateway(t)
+	emailURL = gw.URL
+
+	if w := postNotif(`{"message":"Your booking is confirmed","channel":"email"}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("create answered %d %s", w.Code, w.Body.String())
+	}
+	select {
+	case m := <-got:
+		n := notifModel{}
+		if err := json.Unmarshal(m.body, &n); err != nil || m.uid != "5" || n.UserID != 5 || n.Message != "Your booking is confirmed" {
+			t.Errorf("gateway got %s for user %q", m.body, m.uid)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("email was not sent")
+	}
+
+	if w := postNotif(`{"message":"New events this week"}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("create answered %d %s", w.Code, w.Body.String())
+	}
+	if w := postNotif(`{"message":"Hurry","channel":"sms"}`, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown channel answered %d, want 400", w.Code)
+	}
+	select {
+	case m := <-got:
+		t.Errorf("in-app notification was emailed: %s", m.body)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if want := []string{"Your booking is confirmed", "New events this week"}; !reflect.DeepEqual(db.messages(), want) {
+		t.Errorf("kept %v in-app, want %v", db.messages(), want)
+	}
+}
+
+func TestEmailFallsBackToInApp(t *testing.T) {
+	db := useNotifDB(t)
+	_, got := useMailGateway(t)
+	emailURL = ""
+
+	if w := postNotif(`{"message":"Your booking is confirmed","channel":"email"}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("create answered %d %s", w.Code, w.Body.String())
+	}
+	select {
+	case m := <-got:
+		t.Errorf("email was sent without a gateway: %s", m.body)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if want := []string{"Your booking is confirmed"}; !reflect.DeepEqual(db.messages(), want) {
+		t.Errorf("kept %v in-app, want %v", db.messages(), want)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// postIdempotent creates a notification for user 5 through idempotent with
+// key, no key sends none.
+func postIdempotent(key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/notif/create", strings.NewReader(body))
+	r.Header.Set("X-User-Id", "5")
+	if key != "" {
+		r.Header.Set(idempotencyKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	idempotent(create)(w, r)
+	return w
+}
+
+func TestIdempotencyKeyReplaysCreate(t *testing.T) {
+	db := useNotifDB(t)
+	body := `{"message":"Your booking is confirmed"}`
+	first := postIdempotent("k1", body)
+	if first.Code != http.StatusOK {
+		t.Fatalf("first create answered %d", first.Code)
+	}
+	again := postIdempotent("k1", body)
+	if again.Code != first.Code || again.Body.String() != first.Body.String() {
+		t.Errorf("replay answered %d %s, want %d %s", again.Code, again.Body.String(), first.Code, first.Body.String())
+	}
+	if again.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("replay is not marked as replayed")
+	}
+	if n := len(db.messages()); n != 1 {
+		t.Fatalf("created %d notifications, want 1", n)
+	}
+
+	if w := postIdempotent("k1", `{"message":"Something else"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("key reused with another body answered %d, want 422", w.Code)
+	}
+	postIdempotent("k2", body)
+	if n := len(db.messages()); n != 2 {
+		t.Errorf("a new key created %d notifications in total, want 2", n)
+	}
+}
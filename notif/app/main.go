@@ -1,59 +1,239 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"os"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"contracts"
+	"platform/config"
+	"platform/database"
+	"platform/web"
 
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
+// pageModel is the list returned instead of a bare array when the client asks
+// for the total count with count=true. Total counts all matching
+// notifications, not only the ones on the page.
+type pageModel struct {
+	Items interface{} `json:"items"`
+	Total int         `json:"total"`
+}
+
+// notifModel is either a ready message or a type from notifTemplates with
+// the params to render it.
 type notifModel struct {
-	UserID  int    `json:"userid"`
-	Message string `json:"message"`
+	ID      int               `json:"id,omitempty"`
+	UserID  int               `json:"userid"`
+	Message string            `json:"message"`
+	Type    string            `json:"type,omitempty"`
+	Params  map[string]string `json:"params,omitempty"`
+	Locale  string            `json:"locale,omitempty"`
+	// Priority is low, normal or high, normal if not set.
+	Priority string `json:"priority,omitempty"`
+	// Channel is inapp or email, inapp if not set.
+	Channel string `json:"channel,omitempty"`
+}
+
+// Priorities of a notification. The list can be filtered by them.
+const (
+	priorityLow    = "low"
+	priorityNormal = "normal"
+	priorityHigh   = "high"
+)
+
+var notifPriorities = map[string]bool{priorityLow: true, priorityNormal: true, priorityHigh: true}
+
+// Channels a notification is delivered through. Every notification is kept
+// in-app, one for email is also sent to emailURL if it is set.
+const (
+	channelInApp = "inapp"
+	channelEmail = "email"
+)
+
+var notifChannels = map[string]bool{channelInApp: true, channelEmail: true}
+
+// broadcastModel is a notification for many users at once. An empty UserIDs
+// means all users known to the service.
+type broadcastModel struct {
+	notifModel
+	UserIDs []int `json:"user_ids"`
 }
 
+type webhookModel struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret,omitempty"`
+}
+
+// doer sends HTTP requests. *http.Client implements it, tests can put a stub
+// into httpClient instead.
+type doer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+var httpClient doer = &http.Client{Timeout: 10 * time.Second}
+
 type configModel struct {
-	dbHost string
-	dbPort string
-	dbName string
-	dbUser string
-	dbPass string
-	host   string
-	port   string
+	web.ServerConfig
+	dbHost         string
+	dbPort         string
+	dbName         string
+	dbUser         string
+	dbPass         string
+	dedupWindow    string
+	resendInterval string
+	origins        string
+	routePrefix    string
+	maintenance    string
+	dbWait         string
+	emailURL       string
 }
 
 const (
-	createNotifTpl = `INSERT INTO notif (userid, message) VALUES ($1, $2) returning id`
+	createNotifTpl     = `INSERT INTO notif (userid, message, priority) VALUES ($1, $2, $3) returning id`
+	findDuplicateTpl   = `SELECT id FROM notif WHERE userid=$1 AND message=$2 AND created_at > now() - make_interval(secs => $3) ORDER BY id DESC LIMIT 1`
+	setWebhookTpl      = `INSERT INTO notif_webhook (user_id, url, secret) VALUES ($1, $2, $3) ON CONFLICT (user_id) DO UPDATE SET url = excluded.url, secret = excluded.secret`
+	getWebhookTpl      = `SELECT url, secret FROM notif_webhook WHERE user_id=$1`
+	deleteWebhookTpl   = `DELETE FROM notif_webhook WHERE user_id=$1`
+	getNotifsTpl       = `SELECT id, userid, message, priority FROM notif WHERE userid=$1 AND ($4 = '' OR priority = $4) ORDER BY id DESC LIMIT $2 OFFSET $3`
+	searchNotifsTpl    = `SELECT id, userid, message, priority FROM notif, plainto_tsquery('simple', $2) query WHERE userid=$1 AND message_tsv @@ query AND ($5 = '' OR priority = $5) ORDER BY ts_rank(message_tsv, query) DESC, id DESC LIMIT $3 OFFSET $4`
+	broadcastNotifTpl  = `INSERT INTO notif (userid, message) SELECT unnest($1::integer[]), $2`
+	knownUsersTpl      = `SELECT userid FROM notif WHERE userid IS NOT NULL UNION SELECT user_id FROM notif_webhook`
+	broadcastBatchSize = 1000
+	roleAdmin          = "admin"
+	signatureHeader    = "X-Signature"
+	defaultNotifsLimit = 20
+	maxNotifsLimit     = 100
+	defaultLocale      = "en"
+	streamHeartbeat    = 15 * time.Second
+	streamBuffer       = 16
 )
 
+const (
+	countNotifsTpl       = `SELECT COUNT(1) FROM notif WHERE userid=$1 AND ($2 = '' OR priority = $2)`
+	countSearchNotifsTpl = `SELECT COUNT(1) FROM notif WHERE userid=$1 AND message_tsv @@ plainto_tsquery('simple', $2) AND ($3 = '' OR priority = $3)`
+)
+
+const (
+	reserveIdempotencyKeyTpl = `INSERT INTO idempotency_key (user_id, key, request_hash) VALUES ($1, $2, $3) ON CONFLICT (user_id, key) DO UPDATE SET request_hash=excluded.request_hash, status=0, body='', created_at=now() WHERE idempotency_key.created_at < now() - make_interval(secs => $4) RETURNING user_id`
+	getIdempotencyKeyTpl     = `SELECT request_hash, status, body FROM idempotency_key WHERE user_id=$1 AND key=$2`
+	saveIdempotencyKeyTpl    = `UPDATE idempotency_key SET status=$3, body=$4 WHERE user_id=$1 AND key=$2`
+	deleteIdempotencyKeyTpl  = `DELETE FROM idempotency_key WHERE user_id=$1 AND key=$2`
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotencyKeyTTL        = 24 * time.Hour
+)
+
+const (
+	resendNotifTpl = `UPDATE notif SET resent_at=now() WHERE id=$1 AND userid=$2 AND (resent_at IS NULL OR resent_at < now() - make_interval(secs => $3)) RETURNING message`
+	getResentAtTpl = `SELECT coalesce(resent_at, created_at) FROM notif WHERE id=$1 AND userid=$2`
+)
+
+// notifTemplates holds the wording of notifications by locale and type.
+// Params sent along with the type are available by name, e.g. {{.item}}.
+// A type missing in a locale falls back to defaultLocale.
+var notifTemplates = map[string]map[string]string{
+	defaultLocale: {
+		"booking_confirmed": "Your booking [{{.book_id}}] for {{.event}} is confirmed, {{.price}} is paid",
+		"booking_cancelled": "Your booking [{{.book_id}}] is cancelled",
+		"order_created":     "Successfully created order with {{.item}}",
+		"order_failed":      "Failed to create order. {{.reason}}",
+		"order_cancelled":   "Your order with {{.item}} is cancelled, {{.amount}} is returned to your account",
+	},
+	"ru": {
+		"booking_confirmed": "Ваше бронирование [{{.book_id}}] на {{.event}} подтверждено, оплачено {{.price}}",
+		"booking_cancelled": "Ваше бронирование [{{.book_id}}] отменено",
+		"order_created":     "Заказ {{.item}} успешно создан",
+		"order_failed":      "Не удалось создать заказ. {{.reason}}",
+		"order_cancelled":   "Заказ {{.item}} отменен, {{.amount}} возвращено на ваш счет",
+	},
+}
+
+var parsedNotifTemplates = mustParseTemplates(notifTemplates)
+
 var (
-	createNotifStmt *sql.Stmt
+	errUnknownNotifType = errors.New("unknown notification type")
+	errNotifParams      = errors.New("wrong notification params")
+)
+
+var errResendTooSoon = errors.New("notification was resent recently")
+
+var (
+	createNotifStmt           *sql.Stmt
+	findDuplicateStmt         *sql.Stmt
+	setWebhookStmt            *sql.Stmt
+	getWebhookStmt            *sql.Stmt
+	deleteWebhookStmt         *sql.Stmt
+	getNotifsStmt             *sql.Stmt
+	searchNotifsStmt          *sql.Stmt
+	countNotifsStmt           *sql.Stmt
+	countSearchNotifsStmt     *sql.Stmt
+	reserveIdempotencyKeyStmt *sql.Stmt
+	getIdempotencyKeyStmt     *sql.Stmt
+	saveIdempotencyKeyStmt    *sql.Stmt
+	deleteIdempotencyKeyStmt  *sql.Stmt
+	broadcastNotifStmt        *sql.Stmt
+	knownUsersStmt            *sql.Stmt
+	resendNotifStmt           *sql.Stmt
+	getResentAtStmt           *sql.Stmt
+	dbConn                    = &database.Conn{Prepare: mustPrepareStmts}
+	// dedupWindow is how long an identical notification to the same user
+	// is suppressed, 0 turns de-duplication off
+	dedupWindow time.Duration
+	// resendInterval is how often the same notification may be resent
+	resendInterval time.Duration
+	// emailURL is the mail gateway that sends email notifications to the
+	// user's address, empty keeps them in-app only
+	emailURL string
 )
 
 func readConf() *configModel {
 	cfg := &configModel{
-		dbHost: "notif-postgresql",
-		dbPort: "5432",
-		dbName: "notifdb",
-		dbUser: "notifuser",
-		dbPass: "notifpasswd",
-		host:   "0.0.0.0",
-		port:   "80",
-	}
-	dbHost := os.Getenv("DBHOST")
-	dbPort := os.Getenv("DBPORT")
-	dbName := os.Getenv("DBNAME")
-	dbUser := os.Getenv("DBUSER")
-	dbPass := os.Getenv("DBPASS")
-	host := os.Getenv("HOST")
-	port := os.Getenv("PORT")
+		dbHost:         "notif-postgresql",
+		dbPort:         "5432",
+		dbName:         "notifdb",
+		dbUser:         "notifuser",
+		dbPass:         "notifpasswd",
+		ServerConfig:   web.DefaultServerConfig(),
+		resendInterval: "5m",
+		dbWait:         "60s",
+	}
+	dbHost := config.Getenv("DBHOST")
+	dbPort := config.Getenv("DBPORT")
+	dbName := config.Getenv("DBNAME")
+	dbUser := config.Getenv("DBUSER")
+	dbPass := config.Getenv("DBPASS")
+	host := config.Getenv("HOST")
+	port := config.Getenv("PORT")
+	tlsCertFile := config.Getenv("TLS_CERT_FILE")
+	tlsKeyFile := config.Getenv("TLS_KEY_FILE")
+	dedupWindow := config.Getenv("NOTIF_DEDUP_WINDOW")
+	readTimeout := config.Getenv("READ_TIMEOUT")
+	writeTimeout := config.Getenv("WRITE_TIMEOUT")
+	idleTimeout := config.Getenv("IDLE_TIMEOUT")
+	resendInterval := config.Getenv("NOTIF_RESEND_INTERVAL")
+	origins := config.Getenv("ALLOWED_ORIGINS")
+	routePrefix := config.Getenv("ROUTE_PREFIX")
+	maintenance := config.Getenv("MAINTENANCE")
+	dbWait := config.Getenv("DB_WAIT_TIMEOUT")
+	emailURL := config.Getenv("NOTIF_EMAIL_URL")
 
 	if dbHost != "" {
 		cfg.dbHost = dbHost
@@ -71,10 +251,46 @@ func readConf() *configModel {
 		cfg.dbPass = dbPass
 	}
 	if host != "" {
-		cfg.host = host
+		cfg.Host = host
 	}
 	if port != "" {
-		cfg.port = port
+		cfg.Port = port
+	}
+	if tlsCertFile != "" {
+		cfg.TLSCertFile = tlsCertFile
+	}
+	if tlsKeyFile != "" {
+		cfg.TLSKeyFile = tlsKeyFile
+	}
+	if dedupWindow != "" {
+		cfg.dedupWindow = dedupWindow
+	}
+	if readTimeout != "" {
+		cfg.ReadTimeout = readTimeout
+	}
+	if writeTimeout != "" {
+		cfg.WriteTimeout = writeTimeout
+	}
+	if idleTimeout != "" {
+		cfg.IdleTimeout = idleTimeout
+	}
+	if resendInterval != "" {
+		cfg.resendInterval = resendInterval
+	}
+	if origins != "" {
+		cfg.origins = origins
+	}
+	if routePrefix != "" {
+		cfg.routePrefix = routePrefix
+	}
+	if maintenance != "" {
+		cfg.maintenance = maintenance
+	}
+	if dbWait != "" {
+		cfg.dbWait = dbWait
+	}
+	if emailURL != "" {
+		cfg.emailURL = emailURL
 	}
 	return cfg
 }
@@ -84,11 +300,18 @@ func makeDBConn(cfg *configModel) (*sql.DB, error) {
 		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		cfg.dbHost, cfg.dbPort, cfg.dbUser, cfg.dbPass, cfg.dbName,
 	)
-	log.Println("connection string: ", pgConnString)
+	log.Printf("Connecting to database host=%s port=%s dbname=%s\n", cfg.dbHost, cfg.dbPort, cfg.dbName)
 	db, err := sql.Open("postgres", pgConnString)
 	return db, err
 }
 
+// maintenanceMode turns every request but health, version and the switch
+// itself away with 503. It starts from MAINTENANCE and is switched at runtime
+// by admins via maintenancePath.
+var maintenanceMode = &web.Maintenance{Health: []string{"/health"}}
+
+const maintenancePath = "/notif/maintenance"
+
 func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -101,22 +324,78 @@ func main() {
 	}
 	defer db.Close()
 
-	if err = db.PingContext(ctx); err != nil {
+	dbWait, err := time.ParseDuration(cfg.dbWait)
+	if err != nil {
+		log.Fatal("Failed to parse DB_WAIT_TIMEOUT:", err)
+	}
+	if err = database.Wait(ctx, db, dbWait); err != nil {
 		log.Fatal("Failed to check db connection:", err)
 	}
 
 	mustPrepareStmts(ctx, db)
+	dbConn.Open = func() (*sql.DB, error) { return makeDBConn(cfg) }
+	dbConn.Set(db)
+	if cfg.dedupWindow != "" {
+		if dedupWindow, err = time.ParseDuration(cfg.dedupWindow); err != nil {
+			log.Fatal("Failed to parse NOTIF_DEDUP_WINDOW:", err)
+		}
+	}
+	if resendInterval, err = time.ParseDuration(cfg.resendInterval); err != nil {
+		log.Fatal("Failed to parse NOTIF_RESEND_INTERVAL:", err)
+	}
+	emailURL = cfg.emailURL
 
-	r := mux.NewRouter()
+	if cfg.maintenance != "" {
+		on, err := strconv.ParseBool(cfg.maintenance)
+		if err != nil {
+			log.Fatal("Failed to parse MAINTENANCE:", err)
+		}
+		maintenanceMode.Set(on)
+	}
 
-	r.HandleFunc("/notif/create", isAuthenticatedMiddleware(create)).Methods("POST")
+	prefix := strings.TrimSuffix(cfg.routePrefix, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		log.Fatalf("ROUTE_PREFIX [%s] must start with /", cfg.routePrefix)
+	}
+	r := newRouter(prefix)
 
-	bindOn := fmt.Sprintf("%s:%s", cfg.host, cfg.port)
-	if err := http.ListenAndServe(bindOn, r); err != nil {
-		log.Printf("Failed to bind on [%s]: %s", bindOn, err)
+	h := maintenanceMode.Middleware(prefix+maintenancePath, r)
+	h = web.RecoverPanics(web.CORS(web.ParseOrigins(cfg.origins), h))
+	if err := web.Serve(cfg.ServerConfig, h); err != nil {
+		log.Printf("Failed to bind on [%s:%s]: %s", cfg.Host, cfg.Port, err)
 	}
 }
 
+// newRouter registers the routes, the api ones under prefix if it isn't
+// empty.
+func newRouter(prefix string) *mux.Router {
+	r := mux.NewRouter()
+
+	r.HandleFunc("/health", health)
+	r.HandleFunc("/version", web.VersionInfo).Methods("GET")
+	api := r
+	if prefix != "" {
+		api = r.PathPrefix(prefix).Subrouter()
+	}
+	api.HandleFunc("/notif/create", reqlog(web.Authenticated(idempotent(create)))).Methods("POST")
+	api.HandleFunc("/notif/broadcast", reqlog(web.Authenticated(web.RequireRole(roleAdmin, broadcast)))).Methods("POST")
+	api.HandleFunc("/notif/stream", reqlog(web.Authenticated(stream))).Methods("GET")
+	api.HandleFunc("/notif/get", reqlog(web.Authenticated(get))).Methods("GET")
+	api.HandleFunc("/notif/{id:[0-9]+}/resend", reqlog(web.Authenticated(resend))).Methods("POST")
+	api.HandleFunc("/notif/webhook", reqlog(web.Authenticated(setWebhook))).Methods("POST")
+	api.HandleFunc("/notif/webhook", reqlog(web.Authenticated(getWebhook))).Methods("GET")
+	api.HandleFunc("/notif/webhook", reqlog(web.Authenticated(deleteWebhook))).Methods("DELETE")
+	api.HandleFunc(maintenancePath, reqlog(web.Authenticated(web.RequireRole(roleAdmin, maintenanceMode.Switch)))).Methods("GET", "PUT")
+	r.MethodNotAllowedHandler = web.MethodNotAllowed(r)
+	r.NotFoundHandler = http.HandlerFunc(web.NotFound)
+	return r
+}
+
+func health(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status": "OK"}`))
+}
+
 func mustPrepareStmts(ctx context.Context, db *sql.DB) {
 	var err error
 
@@ -125,49 +404,892 @@ func mustPrepareStmts(ctx context.Context, db *sql.DB) {
 		panic(err)
 	}
 
+	setWebhookStmt, err = db.PrepareContext(ctx, setWebhookTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	getWebhookStmt, err = db.PrepareContext(ctx, getWebhookTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	deleteWebhookStmt, err = db.PrepareContext(ctx, deleteWebhookTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	getNotifsStmt, err = db.PrepareContext(ctx, getNotifsTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	searchNotifsStmt, err = db.PrepareContext(ctx, searchNotifsTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	countNotifsStmt, err = db.PrepareContext(ctx, countNotifsTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	countSearchNotifsStmt, err = db.PrepareContext(ctx, countSearchNotifsTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	reserveIdempotencyKeyStmt, err = db.PrepareContext(ctx, reserveIdempotencyKeyTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	getIdempotencyKeyStmt, err = db.PrepareContext(ctx, getIdempotencyKeyTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	saveIdempotencyKeyStmt, err = db.PrepareContext(ctx, saveIdempotencyKeyTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	deleteIdempotencyKeyStmt, err = db.PrepareContext(ctx, deleteIdempotencyKeyTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	broadcastNotifStmt, err = db.PrepareContext(ctx, broadcastNotifTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	knownUsersStmt, err = db.PrepareContext(ctx, knownUsersTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	findDuplicateStmt, err = db.PrepareContext(ctx, findDuplicateTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	resendNotifStmt, err = db.PrepareContext(ctx, resendNotifTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	getResentAtStmt, err = db.PrepareContext(ctx, getResentAtTpl)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func mustParseTemplates(bundles map[string]map[string]string) map[string]map[string]*template.Template {
+	parsed := make(map[string]map[string]*template.Template, len(bundles))
+	for locale, tpls := range bundles {
+		parsed[locale] = make(map[string]*template.Template, len(tpls))
+		for name, text := range tpls {
+			t := template.New(locale + "/" + name).Option("missingkey=error")
+			parsed[locale][name] = template.Must(t.Parse(text))
+		}
+	}
+	return parsed
+}
+
+// renderNotif returns the message of n. A raw message is used as is,
+// otherwise the template of n.Type in n.Locale is rendered with n.Params.
+func renderNotif(n notifModel) (string, error) {
+	if n.Type == "" {
+		return n.Message, nil
+	}
+	t, ok := parsedNotifTemplates[n.Locale][n.Type]
+	if !ok {
+		t, ok = parsedNotifTemplates[defaultLocale][n.Type]
+	}
+	if !ok {
+		return "", fmt.Errorf("%w [%s]", errUnknownNotifType, n.Type)
+	}
+	b := strings.Builder{}
+	if err := t.Execute(&b, n.Params); err != nil {
+		return "", fmt.Errorf("%w for [%s]: %s", errNotifParams, n.Type, err)
+	}
+	return b.String(), nil
 }
 
-func createNotif(id int, message string) error {
-	_, err := createNotifStmt.Query(id, message)
+// parseLocale returns the primary language of the first tag in an
+// Accept-Language header, e.g. "ru" for "ru-RU,ru;q=0.9,en;q=0.8".
+func parseLocale(header string) string {
+	tag := strings.TrimSpace(strings.SplitN(header, ",", 2)[0])
+	tag = strings.SplitN(tag, ";", 2)[0]
+	tag = strings.SplitN(tag, "-", 2)[0]
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// findDuplicate returns the id of the same notification created for the user
+// within dedupWindow, or 0 if there is none.
+func findDuplicate(id int, message string) (int, error) {
+	if dedupWindow <= 0 {
+		return 0, nil
+	}
+	nid := 0
+	err := dbConn.Retry(func() error {
+		return findDuplicateStmt.QueryRow(id, message, dedupWindow.Seconds()).Scan(&nid)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return nid, err
+}
+
+func createNotif(id int, message, priority string) (int, error) {
+	nid := 0
+	err := dbConn.Retry(func() error {
+		return createNotifStmt.QueryRow(id, message, priority).Scan(&nid)
+	})
 	if err != nil {
 		log.Printf("Failed to create notification for user id [%d]: %s", id, err)
-		return err
+		return 0, err
 	}
-	return nil
+	return nid, nil
 }
 
 func create(w http.ResponseWriter, r *http.Request) {
-	headers := r.Header
-	id, err := strconv.Atoi(headers.Get("X-User-Id"))
+	id, ok := web.MustUserID(w, r)
+	if !ok {
+		return
+	}
+	var err error
+	req := contracts.Notification{}
+	if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse request body user id [%d]: %s\n", id, err)
+		return
+	}
+	n := notifModel{UserID: req.UserID, Message: req.Message, Type: req.Type, Params: req.Params, Locale: req.Locale, Priority: req.Priority, Channel: req.Channel}
+	if n.Locale == "" {
+		n.Locale = parseLocale(r.Header.Get("Accept-Language"))
+	}
+	if n.Priority == "" {
+		n.Priority = priorityNormal
+	}
+	if !notifPriorities[n.Priority] {
+		log.Printf("Got notification of unknown priority [%s] for user id [%d]\n", n.Priority, id)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "unknown priority [%s]", n.Priority)
+		return
+	}
+	if n.Channel == "" {
+		n.Channel = channelInApp
+	}
+	if !notifChannels[n.Channel] {
+		log.Printf("Got notification of unknown channel [%s] for user id [%d]\n", n.Channel, id)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "unknown channel [%s]", n.Channel)
+		return
+	}
+	msg, err := renderNotif(n)
+	if errors.Is(err, errUnknownNotifType) {
+		log.Printf("Failed to render notification for user id [%d]: %s\n", id, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "unknown notification type [%s]", n.Type)
+		return
+	}
+	if errors.Is(err, errNotifParams) {
+		log.Printf("Failed to render notification for user id [%d]: %s\n", id, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "missing params for notification type [%s]", n.Type)
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Got wrong header [X-User-Id]: %s", err)
+		web.InternalError(w, r, fmt.Errorf("failed to render notification for user id [%d]: %w", id, err))
+		return
+	}
+	nid, err := findDuplicate(id, msg)
+	if err != nil {
+		log.Printf("Failed to look for duplicate notification for user id [%d]: %s\n", id, err)
+	}
+	if nid != 0 {
+		log.Printf("Notification for user id [%d] duplicates [%d], skipped\n", id, nid)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"id":%d}`, nid)
+		return
+	}
+	nid, err = createNotif(id, msg, n.Priority)
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to create notification for user id [%d]: %w", id, err))
+		return
+	}
+	log.Printf("Successfully created notification for user id [%d]\n", id)
+	hub.publish(notifModel{ID: nid, UserID: id, Message: msg, Priority: n.Priority})
+	go deliverWebhook(id, msg)
+	if n.Channel == channelEmail {
+		go deliverEmail(emailURL, id, msg)
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"id":%d}`, nid)
+}
+
+// resendNotif marks the user's notification as resent and returns its
+// message. errResendTooSoon means it was resent less than resendInterval
+// ago, retryAfter tells when it may be resent again.
+func resendNotif(nid, uid int) (message string, retryAfter time.Duration, err error) {
+	err = dbConn.Retry(func() error {
+		return resendNotifStmt.QueryRow(nid, uid, resendInterval.Seconds()).Scan(&message)
+	})
+	if !errors.Is(err, sql.ErrNoRows) {
+		return message, 0, err
+	}
+	var last time.Time
+	err = dbConn.Retry(func() error {
+		return getResentAtStmt.QueryRow(nid, uid).Scan(&last)
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return "", time.Until(last.Add(resendInterval)), errResendTooSoon
+}
+
+// resend dispatches the user's notification again to the stream and the
+// webhook. A notification can't be resent more often than resendInterval.
+func resend(w http.ResponseWriter, r *http.Request) {
+	uid, ok := web.MustUserID(w, r)
+	if !ok {
+		return
+	}
+	nid, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		log.Println("Failed to parse request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	msg, retryAfter, err := resendNotif(nid, uid)
+	if errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Could not find notification [%d] of user [%d]\n", nid, uid)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errResendTooSoon) {
+		log.Printf("Notification [%d] of user [%d] was resent recently\n", nid, uid)
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to resend notification [%d] of user [%d]: %w", nid, uid, err))
+		return
+	}
+	log.Printf("Resending notification [%d] to user id [%d]\n", nid, uid)
+	hub.publish(notifModel{ID: nid, UserID: uid, Message: msg})
+	go deliverWebhook(uid, msg)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"id":%d}`, nid)
+}
+
+// getNotifs returns the user's notifications, newest first. With a non
+// empty q only notifications matching it are returned, best matches first,
+// with a non empty priority only those of the priority.
+func getNotifs(uid int, q, priority string, limit, offset int) ([]notifModel, error) {
+	ns := []notifModel{}
+	err := dbConn.Retry(func() error {
+		ns = ns[:0]
+		var rows *sql.Rows
+		var err error
+		if q != "" {
+			rows, err = searchNotifsStmt.Query(uid, q, limit, offset, priority)
+		} else {
+			rows, err = getNotifsStmt.Query(uid, limit, offset, priority)
+		}
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			n := notifModel{}
+			if err = rows.Scan(&n.ID, &n.UserID, &n.Message, &n.Priority); err != nil {
+				return err
+			}
+			ns = append(ns, n)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+// countNotifs counts all the notifications getNotifs pages through for the
+// same uid, q and priority.
+func countNotifs(uid int, q, priority string) (int, error) {
+	total := 0
+	err := dbConn.Retry(func() error {
+		if q != "" {
+			return countSearchNotifsStmt.QueryRow(uid, q, priority).Scan(&total)
+		}
+		return countNotifsStmt.QueryRow(uid, priority).Scan(&total)
+	})
+	return total, err
+}
+
+func get(w http.ResponseWriter, r *http.Request) {
+	id, ok := web.MustUserID(w, r)
+	if !ok {
+		return
+	}
+	var err error
+	q := r.URL.Query()
+	limit, offset := defaultNotifsLimit, 0
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxNotifsLimit {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "limit must be between 1 and %d", maxNotifsLimit)
+			return
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "wrong value of [offset]: %q", v)
+			return
+		}
+	}
+	count := false
+	if v := q.Get("count"); v != "" {
+		if count, err = strconv.ParseBool(v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "wrong value of [count]: %q", v)
+			return
+		}
+	}
+	priority := q.Get("priority")
+	if priority != "" && !notifPriorities[priority] {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "unknown priority [%s]", priority)
+		return
+	}
+	search := strings.TrimSpace(q.Get("q"))
+	ns, err := getNotifs(id, search, priority, limit, offset)
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to get notifications for user id [%d]: %w", id, err))
+		return
+	}
+	if !count {
+		data, _ := json.Marshal(ns)
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+		return
+	}
+	total, err := countNotifs(id, search, priority)
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to count notifications for user id [%d]: %w", id, err))
+		return
+	}
+	data, _ := json.Marshal(pageModel{Items: ns, Total: total})
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// broadcastNotif creates the message for every user in uids. All
+// notifications are inserted in one transaction, broadcastBatchSize users
+// per statement.
+func broadcastNotif(uids []int, message string) (int64, error) {
+	var total int64
+	err := dbConn.Retry(func() error {
+		total = 0
+		tx, err := dbConn.DB().Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		stmt := tx.Stmt(broadcastNotifStmt)
+		for start := 0; start < len(uids); start += broadcastBatchSize {
+			end := start + broadcastBatchSize
+			if end > len(uids) {
+				end = len(uids)
+			}
+			res, err := stmt.Exec(pq.Array(uids[start:end]), message)
+			if err != nil {
+				return err
+			}
+			n, _ := res.RowsAffected()
+			total += n
+		}
+		return tx.Commit()
+	})
+	return total, err
+}
+
+func knownUsers() ([]int, error) {
+	uids := []int{}
+	err := dbConn.Retry(func() error {
+		uids = uids[:0]
+		rows, err := knownUsersStmt.Query()
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			uid := 0
+			if err = rows.Scan(&uid); err != nil {
+				return err
+			}
+			uids = append(uids, uid)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return uids, nil
+}
+
+func broadcast(w http.ResponseWriter, r *http.Request) {
+	b := broadcastModel{}
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse broadcast request: %s\n", err)
+		return
+	}
+	if b.Locale == "" {
+		b.Locale = parseLocale(r.Header.Get("Accept-Language"))
+	}
+	msg, err := renderNotif(b.notifModel)
+	if err != nil || msg == "" {
+		log.Printf("Failed to render broadcast notification: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("message or a known type is required"))
+		return
+	}
+	uids := b.UserIDs
+	if len(uids) == 0 {
+		if uids, err = knownUsers(); err != nil {
+			web.InternalError(w, r, fmt.Errorf("failed to get users to broadcast to: %w", err))
+			return
+		}
+	}
+	n, err := broadcastNotif(uids, msg)
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to broadcast notification: %w", err))
 		return
 	}
-	n := notifModel{}
-	if err = json.NewDecoder(r.Body).Decode(&n); err != nil {
+	for _, uid := range uids {
+		hub.publish(notifModel{UserID: uid, Message: msg})
+	}
+	log.Printf("Successfully broadcasted notification to [%d] users\n", n)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"count":%d}`, n)
+}
+
+// notifHub passes created notifications to the open streams of their user.
+type notifHub struct {
+	mu   sync.Mutex
+	subs map[int]map[chan notifModel]struct{}
+}
+
+var hub = &notifHub{subs: map[int]map[chan notifModel]struct{}{}}
+
+func (h *notifHub) subscribe(uid int) chan notifModel {
+	ch := make(chan notifModel, streamBuffer)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[uid] == nil {
+		h.subs[uid] = map[chan notifModel]struct{}{}
+	}
+	h.subs[uid][ch] = struct{}{}
+	return ch
+}
+
+func (h *notifHub) unsubscribe(uid int, ch chan notifModel) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs[uid], ch)
+	if len(h.subs[uid]) == 0 {
+		delete(h.subs, uid)
+	}
+}
+
+// publish never blocks, a stream that does not keep up loses notifications.
+func (h *notifHub) publish(n notifModel) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[n.UserID] {
+		select {
+		case ch <- n:
+		default:
+			log.Printf("Stream of user id [%d] is full, notification [%d] is dropped\n", n.UserID, n.ID)
+		}
+	}
+}
+
+// stream sends the user's new notifications as server-sent events until the
+// client goes away. A comment line is sent every streamHeartbeat to keep
+// the connection open through proxies.
+func stream(w http.ResponseWriter, r *http.Request) {
+	id, ok := web.MustUserID(w, r)
+	if !ok {
+		return
+	}
+	var err error
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Println("Streaming is not supported by the response writer")
 		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ch := hub.subscribe(id)
+	defer hub.unsubscribe(id, ch)
+
+	// the stream lives longer than WRITE_TIMEOUT allows a response to
+	if err = http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Failed to clear write deadline of the stream: %s\n", err)
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err = fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case n := <-ch:
+			data, _ := json.Marshal(n)
+			if _, err = fmt.Fprintf(w, "event: notification\ndata: %s\n\n", data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func setWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := web.MustUserID(w, r)
+	if !ok {
+		return
+	}
+	var err error
+	wh := webhookModel{}
+	if err = json.NewDecoder(r.Body).Decode(&wh); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
 		log.Printf("Failed to parse request body user id [%d]: %s\n", id, err)
 		return
 	}
-	if err = createNotif(id, n.Message); err != nil {
-		log.Printf("Failed to create notification for user id [%d]: %s\n", id, err)
-		w.WriteHeader(http.StatusInternalServerError)
+	if u, err := url.Parse(wh.URL); err != nil || u.Scheme != "https" || u.Host == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Webhook url must be an absolute https url"))
 		return
 	}
-	log.Printf("Successfully created notification for user id [%d]\n", id)
+	if wh.Secret, err = newWebhookSecret(); err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to generate webhook secret for user id [%d]: %w", id, err))
+		return
+	}
+	err = dbConn.Retry(func() error {
+		_, err := setWebhookStmt.Exec(id, wh.URL, wh.Secret)
+		return err
+	})
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to save webhook for user id [%d]: %w", id, err))
+		return
+	}
+	data, _ := json.Marshal(wh)
 	w.WriteHeader(http.StatusOK)
+	w.Write(data)
 }
 
-func isAuthenticatedMiddleware(h http.HandlerFunc) http.HandlerFunc {
+func getWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := web.MustUserID(w, r)
+	if !ok {
+		return
+	}
+	wh, err := webhookFor(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to get webhook for user id [%d]: %w", id, err))
+		return
+	}
+	wh.Secret = ""
+	data, _ := json.Marshal(wh)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := web.MustUserID(w, r)
+	if !ok {
+		return
+	}
+	var err error
+	err = dbConn.Retry(func() error {
+		_, err := deleteWebhookStmt.Exec(id)
+		return err
+	})
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to delete webhook for user id [%d]: %w", id, err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func webhookFor(id int) (*webhookModel, error) {
+	wh := &webhookModel{}
+	err := dbConn.Retry(func() error {
+		return getWebhookStmt.QueryRow(id).Scan(&wh.URL, &wh.Secret)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return wh, nil
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// signPayload returns the value of the signature header: hex encoded
+// HMAC-SHA256 of the body keyed with the user's webhook secret.
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverWebhook posts the notification to the user's webhook if one is
+// registered. Delivery is best effort, failures are only logged.
+func deliverWebhook(id int, message string) {
+	wh, err := webhookFor(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to get webhook for user id [%d]: %s\n", id, err)
+		return
+	}
+	data, err := json.Marshal(notifModel{UserID: id, Message: message})
+	if err != nil {
+		log.Printf("Failed to marshal notification for user id [%d]: %s\n", id, err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, wh.URL, bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Failed webhook request for user id [%d]: %s\n", id, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(signatureHeader, signPayload(wh.Secret, data))
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		log.Printf("Failed to deliver webhook for user id [%d]: %s\n", id, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		log.Printf("Webhook for user id [%d] responded with status [%d]\n", id, resp.StatusCode)
+	}
+}
+
+// deliverEmail posts the notification to the mail gateway at url, which
+// sends it to the user's address. Without a gateway the notification stays
+// in-app only. Delivery is best effort, failures are only logged.
+func deliverEmail(url string, id int, message string) {
+	if url == "" {
+		log.Printf("Email is not configured, notification for user id [%d] is in-app only\n", id)
+		return
+	}
+	data, err := json.Marshal(notifModel{UserID: id, Message: message, Channel: channelEmail})
+	if err != nil {
+		log.Printf("Failed to marshal email for user id [%d]: %s\n", id, err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Failed email request for user id [%d]: %s\n", id, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-User-Id", strconv.Itoa(id))
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		log.Printf("Failed to send email for user id [%d]: %s\n", id, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		log.Printf("Mail gateway for user id [%d] responded with status [%d]\n", id, resp.StatusCode)
+	}
+}
+
+// statusRecorder remembers the status code and the size of the response
+// written by the wrapped handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func reqlog(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		log.Printf("method=%s path=%s status=%d bytes=%d duration=%s request_id=%q host=%s\n",
+			r.Method, r.URL.Path, rec.status, rec.bytes, time.Since(start), r.Header.Get("X-Request-Id"), r.Host)
+	}
+}
+
+// idempotent makes retries of h with the same Idempotency-Key header safe.
+// The first response for a (user, key) pair is stored and replayed for
+// repeated requests within idempotencyKeyTTL instead of running h again.
+// Server errors are not stored so that the request can be retried.
+func idempotent(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		headers := r.Header
-		fmt.Println(headers)
-		if _, ok := headers["X-User-Id"]; !ok {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("Not authenticated"))
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		uid, ok := web.MustUserID(w, r)
+		if !ok {
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			log.Printf("Failed to read request body user id [%d]: %s\n", uid, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+		hash := hex.EncodeToString(sum[:])
+
+		reserved := false
+		err = dbConn.Retry(func() error {
+			err := reserveIdempotencyKeyStmt.QueryRow(uid, key, hash, idempotencyKeyTTL.Seconds()).Scan(new(int))
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+			reserved = err == nil
+			return err
+		})
+		if err != nil {
+			web.InternalError(w, r, fmt.Errorf("failed to reserve idempotency key [%s] for user id [%d]: %w", key, uid, err))
+			return
+		}
+		if !reserved {
+			replayIdempotent(w, uid, key, hash)
 			return
 		}
-		h.ServeHTTP(w, r)
+
+		rec := &bodyRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		err = dbConn.Retry(func() error {
+			if rec.status >= http.StatusInternalServerError {
+				_, err := deleteIdempotencyKeyStmt.Exec(uid, key)
+				return err
+			}
+			_, err := saveIdempotencyKeyStmt.Exec(uid, key, rec.status, rec.body.String())
+			return err
+		})
+		if err != nil {
+			log.Printf("Failed to save response for idempotency key [%s] user id [%d]: %s\n", key, uid, err)
+		}
+	}
+}
+
+// replayIdempotent writes the stored response for the key. A request with a
+// different body or a request that is still being served gets a conflict.
+func replayIdempotent(w http.ResponseWriter, uid int, key, hash string) {
+	var storedHash, body string
+	status := 0
+	err := dbConn.Retry(func() error {
+		return getIdempotencyKeyStmt.QueryRow(uid, key).Scan(&storedHash, &status, &body)
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to get idempotency key [%s] for user id [%d]: %s\n", key, uid, err)
+		return
+	}
+	if storedHash != hash {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte("Idempotency-Key was already used with another request"))
+		return
+	}
+	if status == 0 {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("Request with this Idempotency-Key is in progress"))
+		return
+	}
+	log.Printf("Replaying response for idempotency key [%s] user id [%d]\n", key, uid)
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(status)
+	w.Write([]byte(body))
+}
+
+// bodyRecorder keeps a copy of the response so that idempotent can store it.
+type bodyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bodyRecorder) WriteHeader(code int) {
+	if b.status == 0 {
+		b.status = code
+	}
+	b.ResponseWriter.WriteHeader(code)
+}
+
+func (b *bodyRecorder) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
 	}
+	b.body.Write(p)
+	return b.ResponseWriter.Write(p)
 }
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// notifRow is a notification in the fake notif table.
+type notifRow struct {
+	id       int64
+	uid      int64
+	message  string
+	priority string
+	created  time.Time
+	resent   time.Time
+}
+
+// storedResponse is a row of the fake idempotency_key table.
+type storedResponse struct {
+	hash   string
+	status int64
+	body   string
+}
+
+// notifDB fakes the notif table for creating, listing and resending
+// notifications, and the idempotency_key table.
+type notifDB struct {
+	mu   sync.Mutex
+	rows []notifRow
+	keys map[string]*storedResponse
+}
+
+func useNotifDB(t *testing.T) *notifDB {
+	db := &notifDB{keys: map[string]*storedResponse{}}
+	useFakeDB(t, db.handle)
+	return db
+}
+
+func (db *notifDB) handle(query string, args []driver.Value) fakeResult {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	switch {
+	case queryHas(query, "INSERT INTO notif (userid, message, priority)"):
+		r := notifRow{id: int64(len(db.rows) + 1), uid: args[0].(int64), message: args[1].(string), priority: args[2].(string), created: time.Now()}
+		db.rows = append(db.rows, r)
+		return fakeResult{Cols: []string{"id"}, Rows: [][]driver.Value{{r.id}}}
+	case queryHas(query, "SELECT id FROM notif WHERE userid=$1 AND message=$2"):
+		since := time.Now().Add(-time.Duration(args[2].(float64) * float64(time.Second)))
+		res := fakeResult{Cols: []string{"id"}}
+		for i := len(db.rows) - 1; i >= 0; i-- {
+			if r := db.rows[i]; r.uid == args[0] && r.message == args[1] && r.created.After(since) {
+				res.Rows = [][]driver.Value{{r.id}}
+				break
+			}
+		}
+		return res
+	case queryHas(query, "SELECT id, userid, message, priority FROM notif WHERE userid=$1"):
+		return db.page(db.list(args[0], "", args[3]), args[1], args[2])
+	case queryHas(query, "SELECT id, userid, message, priority FROM notif, plainto_tsquery"):
+		return db.page(db.list(args[0], args[1].(string), args[4]), args[2], args[3])
+	case queryHas(query, "SELECT COUNT(1) FROM notif WHERE userid=$1 AND ($2"):
+		return fakeResult{Cols: []string{"count"}, Rows: [][]driver.Value{{int64(len(db.list(args[0], "", args[1])))}}}
+	case queryHas(query, "SELECT COUNT(1) FROM notif WHERE userid=$1 AND message_tsv"):
+		return fakeResult{Cols: []string{"count"}, Rows: [][]driver.Value{{int64(len(db.list(args[0], args[1].(string), args[2])))}}}
+	case queryHas(query, "INSERT INTO notif (userid, message) SELECT unnest"):
+		n := int64(0)
+		for _, v := range strings.Split(strings.Trim(args[0].(string), "{}"), ",") {
+			uid, _ := strconv.ParseInt(v, 10, 64)
+			db.rows = append(db.rows, notifRow{id: int64(len(db.rows) + 1), uid: uid, message: args[1].(string), priority: priorityNormal, created: time.Now()})
+			n++
+		}
+		return fakeResult{Affected: n}
+	case queryHas(query, "SELECT userid FROM notif WHERE userid IS NOT NULL"):
+		res, seen := fakeResult{Cols: []string{"userid"}}, map[int64]bool{}
+		for _, r := range db.rows {
+			if !seen[r.uid] {
+				seen[r.uid] = true
+				res.Rows = append(res.Rows, []driver.Value{r.uid})
+			}
+		}
+		return res
+	case queryHas(query, "UPDATE notif SET resent_at=now()"):
+		res := fakeResult{Cols: []string{"message"}}
+		since := time.Now().Add(-time.Duration(args[2].(float64) * float64(time.Second)))
+		for i := range db.rows {
+			if r := &db.rows[i]; r.id == args[0] && r.uid == args[1] && r.resent.Before(since) {
+				r.resent = time.Now()
+				res.Rows = [][]driver.Value{{r.message}}
+			}
+		}
+		return res
+	case queryHas(query, "SELECT coalesce(resent_at, created_at) FROM notif"):
+		res := fakeResult{Cols: []string{"coalesce"}}
+		for _, r := range db.rows {
+			if r.id == args[0] && r.uid == args[1] {
+				last := r.resent
+				if last.IsZero() {
+					last = r.created
+				}
+				res.Rows = [][]driver.Value{{last}}
+			}
+		}
+		return res
+	case queryHas(query, "INSERT INTO idempotency_key"):
+		k := fmt.Sprint(args[0], "/", args[1])
+		if _, ok := db.keys[k]; ok {
+			return fakeResult{Cols: []string{"user_id"}}
+		}
+		db.keys[k] = &storedResponse{hash: args[2].(string)}
+		return fakeResult{Cols: []string{"user_id"}, Rows: [][]driver.Value{{args[0]}}}
+	case queryHas(query, "SELECT request_hash, status, body FROM idempotency_key"):
+		res := fakeResult{Cols: []string{"request_hash", "status", "body"}}
+		if r, ok := db.keys[fmt.Sprint(args[0], "/", args[1])]; ok {
+			res.Rows = [][]driver.Value{{r.hash, r.status, r.body}}
+		}
+		return res
+	case queryHas(query, "UPDATE idempotency_key"):
+		if r, ok := db.keys[fmt.Sprint(args[0], "/", args[1])]; ok {
+			r.status, r.body = args[2].(int64), args[3].(string)
+		}
+		return fakeResult{Affected: 1}
+	case queryHas(query, "DELETE FROM idempotency_key"):
+		delete(db.keys, fmt.Sprint(args[0], "/", args[1]))
+		return fakeResult{Affected: 1}
+	}
+	return fakeResult{}
+}
+
+// list returns the rows of the user with the priority, or any priority if
+// it is empty, newest first. With q only the rows holding every word of q
+// are returned, as the full-text search would.
+func (db *notifDB) list(uid driver.Value, q string, priority driver.Value) []notifRow {
+	res := []notifRow{}
+	for i := len(db.rows) - 1; i >= 0; i-- {
+		r := db.rows[i]
+		if r.uid != uid || (priority != "" && r.priority != priority) {
+			continue
+		}
+		match := true
+		for _, word := range strings.Fields(strings.ToLower(q)) {
+			match = match && strings.Contains(strings.ToLower(r.message), word)
+		}
+		if match {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// page answers the rows from offset up to limit of them.
+func (db *notifDB) page(rows []notifRow, limit, offset driver.Value) fakeResult {
+	rows = rows[min(int(offset.(int64)), len(rows)):]
+	rows = rows[:min(int(limit.(int64)), len(rows))]
+	res := fakeResult{Cols: []string{"id", "userid", "message", "priority"}}
+	for _, r := range rows {
+		res.Rows = append(res.Rows, []driver.Value{r.id, r.uid, r.message, r.priority})
+	}
+	return res
+}
+
+// received returns the messages of the user in the order they were created.
+func (db *notifDB) received(uid int) []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	res := []string{}
+	for _, r := range db.rows {
+		if r.uid == int64(uid) {
+			res = append(res, r.message)
+		}
+	}
+	return res
+}
+
+// messages returns the stored messages in the order they were created.
+func (db *notifDB) messages() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	res := []string{}
+	for _, r := range db.rows {
+		res = append(res, r.message)
+	}
+	return res
+}
+
+// listNotifs lists the notifications of user 5 with query and returns
+// their messages.
+func listNotifs(t *testing.T, query string) []string {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/notif/get"+query, nil)
+	r.Header.Set("X-User-Id", "5")
+	w := httptest.NewRecorder()
+	get(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("list answered %d %s", w.Code, w.Body.String())
+	}
+	ns := []notifModel{}
+	if err := json.Unmarshal(w.Body.Bytes(), &ns); err != nil {
+		t.Fatal(err)
+	}
+	res := []string{}
+	for _, n := range ns {
+		res = append(res, n.Message)
+	}
+	return res
+}
+
+// postNotif creates a notification with body for user 5, as the other
+// services do.
+func postNotif(body string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/notif/create", strings.NewReader(body))
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	r.Header.Set("X-User-Id", "5")
+	w := httptest.NewRecorder()
+	create(w, r)
+	return w
+}
+
+func TestCreateRejectsMalformedBody(t *testing.T) {
+	db := useNotifDB(t)
+	if w := postNotif(`{"user_id":`, nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if len(db.messages()) != 0 {
+		t.Error("malformed notification was stored")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// listPriorities lists the notifications of user 5 with query and returns
+// their priorities.
+func listPriorities(t *testing.T, query string) []string {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/notif/get"+query, nil)
+	r.Header.Set("X-User-Id", "5")
+	w := httptest.NewRecorder()
+	get(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("list answered %d %s", w.Code, w.Body.String())
+	}
+	ns := []notifModel{}
+	if err := json.Unmarshal(w.Body.Bytes(), &ns); err != nil {
+		t.Fatal(err)
+	}
+	res := []string{}
+	for _, n := range ns {
+		res = append(res, n.Priority)
+	}
+	return res
+}
+
+func TestCreateWithPriority(t *testing.T) {
+	db := useNotifDB(t)
+	for _, body := range []string{
+		`{"message":"Payment failed","priority":"high"}`,
+		`{"message":"Order created"}`,
+		`{"message":"New events this week","priority":"low"}`,
+	} {
+		if w := postNotif(body, nil); w.Code != http.StatusOK {
+			t.Fatalf("create %s answered %d %s", body, w.Code, w.Body.String())
+		}
+	}
+	if w := postNotif(`{"message":"Hurry","priority":"urgent"}`, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown priority answered %d, want 400", w.Code)
+	}
+	stored := []string{}
+	for _, r := range db.rows {
+		stored = append(stored, r.priority)
+	}
+	if want := []string{priorityHigh, priorityNormal, priorityLow}; !reflect.DeepEqual(stored, want) {
+		t.Fatalf("stored priorities %v, want %v", stored, want)
+	}
+	if got, want := listPriorities(t, ""), []string{priorityLow, priorityNormal, priorityHigh}; !reflect.DeepEqual(got, want) {
+		t.Errorf("listed priorities %v, want %v", got, want)
+	}
+}
+
+func TestFilterByPriority(t *testing.T) {
+	useNotifDB(t)
+	for _, body := range []string{
+		`{"message":"Payment failed for Concert","priority":"high"}`,
+		`{"message":"Order created for Concert"}`,
+		`{"message":"Payment failed for Book","priority":"high"}`,
+	} {
+		postNotif(body, nil)
+	}
+	if got, want := listNotifs(t, "?priority=high"), []string{"Payment failed for Book", "Payment failed for Concert"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("high listed %q, want %q", got, want)
+	}
+	if got, want := listNotifs(t, "?priority=normal"), []string{"Order created for Concert"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("normal listed %q, want %q", got, want)
+	}
+	if got := listNotifs(t, "?priority=low"); len(got) != 0 {
+		t.Errorf("low listed %q, want none", got)
+	}
+	if got, want := listNotifs(t, "?priority=high&q=book"), []string{"Payment failed for Book"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("high matching book listed %q, want %q", got, want)
+	}
+	if got, total := listPage(t, "?priority=high"); len(got) != 2 || total != 2 {
+		t.Errorf("high with count listed %q of %d, want 2 of 2", got, total)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/notif/get?priority=urgent", nil)
+	r.Header.Set("X-User-Id", "5")
+	w := httptest.NewRecorder()
+	get(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown priority filter answered %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// postResend asks to resend the notification nid as user uid.
+func postResend(nid, uid string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/notif/"+nid+"/resend", nil)
+	r.Header.Set("X-User-Id", uid)
+	r = mux.SetURLVars(r, map[string]string{"id": nid})
+	w := httptest.NewRecorder()
+	resend(w, r)
+	return w
+}
+
+func TestResend(t *testing.T) {
+	db := useNotifDB(t)
+	saved := resendInterval
+	resendInterval = 5 * time.Minute
+	t.Cleanup(func() { resendInterval = saved })
+	if w := postNotif(`{"message":"Your booking is confirmed"}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("create answered %d", w.Code)
+	}
+	ch := hub.subscribe(5)
+	defer hub.unsubscribe(5, ch)
+
+	w := postResend("1", "5")
+	if w.Code != http.StatusOK || w.Body.String() != `{"id":1}` {
+		t.Fatalf("resend answered %d %s, want 200", w.Code, w.Body.String())
+	}
+	select {
+	case n := <-ch:
+		if n.ID != 1 || n.Message != "Your booking is confirmed" {
+			t.Errorf("stream got %+v", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("resent notification did not reach the stream")
+	}
+
+	w = postResend("1", "5")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second resend answered %d, want 429", w.Code)
+	}
+	if s, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || s < 1 || s > 301 {
+		t.Errorf("Retry-After is %q, want up to the resend interval", w.Header().Get("Retry-After"))
+	}
+
+	db.mu.Lock()
+	db.rows[0].resent = time.Now().Add(-resendInterval - time.Second)
+	db.mu.Unlock()
+	if w := postResend("1", "5"); w.Code != http.StatusOK {
+		t.Errorf("resend after the interval answered %d, want 200", w.Code)
+	}
+
+	for _, tt := range []struct{ name, nid, uid string }{
+		{"another user's", "1", "6"},
+		{"unknown", "9", "5"},
+	} {
+		if w := postResend(tt.nid, tt.uid); w.Code != http.StatusNotFound {
+			t.Errorf("resend of %s notification answered %d, want 404", tt.name, w.Code)
+		}
+	}
+	if got := len(ch); got != 1 {
+		t.Errorf("stream got %d more notifications, want the one resent after the interval", got)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSearchNotifications(t *testing.T) {
+	useNotifDB(t)
+	for _, m := range []string{"Your booking [7] is cancelled", "Successfully created order with Book", "Your booking [8] is cancelled"} {
+		postNotif(`{"message":"`+m+`"}`, nil)
+	}
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"no query", "", []string{"Your booking [8] is cancelled", "Successfully created order with Book", "Your booking [7] is cancelled"}},
+		{"matching", "?q=cancelled", []string{"Your booking [8] is cancelled", "Your booking [7] is cancelled"}},
+		{"matching, paged", "?q=booking+cancelled&limit=1&offset=1", []string{"Your booking [7] is cancelled"}},
+		{"not matching", "?q=refund", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := listNotifs(t, tt.query); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("listed %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
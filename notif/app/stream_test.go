@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// subscribers returns the number of open streams of the user.
+func (h *notifHub) subscribers(uid int) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs[uid])
+}
+
+func TestStreamReceivesCreatedNotification(t *testing.T) {
+	useNotifDB(t)
+	srv := httptest.NewServer(http.HandlerFunc(stream))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	req.Header.Set("X-User-Id", "5")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); res.StatusCode != http.StatusOK || ct != "text/event-stream" {
+		t.Fatalf("stream answered %d %s", res.StatusCode, ct)
+	}
+
+	lines := make(chan string)
+	go func() {
+		s := bufio.NewScanner(res.Body)
+		for s.Scan() {
+			lines <- s.Text()
+		}
+		close(lines)
+	}()
+	postNotif(`{"message":"Your booking is confirmed"}`, nil)
+
+	want := []string{"event: notification", `data: {"id":1,"userid":5,"message":"Your booking is confirmed","priority":"normal"}`}
+	for _, w := range want {
+		select {
+		case got := <-lines:
+			if got != w {
+				t.Fatalf("stream sent %q, want %q", got, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("stream sent nothing, want %q", w)
+		}
+	}
+
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for hub.subscribers(5) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("stream is still subscribed after the client went away")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStreamGetsOnlyOwnNotifications(t *testing.T) {
+	ch := hub.subscribe(5)
+	defer hub.unsubscribe(5, ch)
+	hub.publish(notifModel{UserID: 6, Message: "For someone else"})
+	hub.publish(notifModel{UserID: 5, Message: "For you"})
+	if n := <-ch; n.Message != "For you" {
+		t.Fatalf("got %q", n.Message)
+	}
+	select {
+	case n := <-ch:
+		t.Fatalf("got %q too", n.Message)
+	default:
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestRenderNotifTemplates(t *testing.T) {
+	tests := []struct {
+		typ    string
+		params map[string]string
+		want   string
+	}{
+		{"booking_confirmed", map[string]string{"book_id": "7", "event": "Concert", "price": "3000"}, "Your booking [7] for Concert is confirmed, 3000 is paid"},
+		{"booking_cancelled", map[string]string{"book_id": "7"}, "Your booking [7] is cancelled"},
+		{"order_created", map[string]string{"item": "Book"}, "Successfully created order with Book"},
+		{"order_failed", map[string]string{"reason": "Not enough funds"}, "Failed to create order. Not enough funds"},
+		{"order_cancelled", map[string]string{"item": "Book", "amount": "500"}, "Your order with Book is cancelled, 500 is returned to your account"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.typ, func(t *testing.T) {
+			got, err := renderNotif(notifModel{Type: tt.typ, Params: tt.params, Locale: defaultLocale})
+			if err != nil || got != tt.want {
+				t.Fatalf("rendered %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+	if len(tests) != len(notifTemplates[defaultLocale]) {
+		t.Errorf("tested %d templates of %d", len(tests), len(notifTemplates[defaultLocale]))
+	}
+	if got, _ := renderNotif(notifModel{Message: "Hello"}); got != "Hello" {
+		t.Errorf("raw message rendered as %q", got)
+	}
+}
+
+func TestCreateFromTemplate(t *testing.T) {
+	db := useNotifDB(t)
+	if w := postNotif(`{"message":"Hello"}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("raw message answered %d", w.Code)
+	}
+	if w := postNotif(`{"type":"order_created","params":{"item":"Book"}}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("typed message answered %d", w.Code)
+	}
+	for _, body := range []string{
+		`{"type":"no_such_type"}`,
+		`{"type":"order_created"}`,
+		`{"type":"booking_cancelled","params":{"item":"Book"}}`,
+	} {
+		if w := postNotif(body, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%s answered %d, want 400", body, w.Code)
+		}
+	}
+	if got, want := db.messages(), []string{"Hello", "Successfully created order with Book"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("stored %q, want %q", got, want)
+	}
+}
+
+func TestRenderNotifLocales(t *testing.T) {
+	saved := parsedNotifTemplates
+	parsedNotifTemplates = mustParseTemplates(map[string]map[string]string{
+		defaultLocale: {"order_created": "Created order with {{.item}}", "greeting": "Hello"},
+		"ru":          {"order_created": "Создан заказ {{.item}}"},
+	})
+	t.Cleanup(func() { parsedNotifTemplates = saved })
+	params := map[string]string{"item": "Book"}
+	tests := []struct {
+		name   string
+		typ    string
+		locale string
+		want   string
+	}{
+		{"english", "order_created", defaultLocale, "Created order with Book"},
+		{"russian", "order_created", "ru", "Создан заказ Book"},
+		{"unknown locale", "order_created", "de", "Created order with Book"},
+		{"no locale", "order_created", "", "Created order with Book"},
+		{"no translation", "greeting", "ru", "Hello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderNotif(notifModel{Type: tt.typ, Params: params, Locale: tt.locale})
+			if err != nil || got != tt.want {
+				t.Fatalf("rendered %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateTakesLocaleFromAcceptLanguage(t *testing.T) {
+	db := useNotifDB(t)
+	body := `{"type":"booking_cancelled","params":{"book_id":"7"}}`
+	postNotif(body, http.Header{"Accept-Language": {"ru-RU,ru;q=0.9,en;q=0.8"}})
+	postNotif(body, http.Header{"Accept-Language": {"de-DE"}})
+	postNotif(`{"type":"booking_cancelled","params":{"book_id":"8"},"locale":"ru"}`, http.Header{"Accept-Language": {"en"}})
+	want := []string{"Ваше бронирование [7] отменено", "Your booking [7] is cancelled", "Ваше бронирование [8] отменено"}
+	if got := db.messages(); !reflect.DeepEqual(got, want) {
+		t.Errorf("stored %q, want %q", got, want)
+	}
+}
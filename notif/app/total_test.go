@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// listPage lists the notifications of user 5 with query asking for
+// count=true and returns the messages of the page and the total.
+func listPage(t *testing.T, query string) (messages []string, total int) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/notif/get"+query+"&count=true", nil)
+	r.Header.Set("X-User-Id", "5")
+	w := httptest.NewRecorder()
+	get(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("list answered %d %s", w.Code, w.Body.String())
+	}
+	page := struct {
+		Items []notifModel `json:"items"`
+		Total int          `json:"total"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatalf("list answered %s: %s", w.Body.String(), err)
+	}
+	messages = []string{}
+	for _, n := range page.Items {
+		messages = append(messages, n.Message)
+	}
+	return messages, page.Total
+}
+
+// TestTotalMatchesAcrossPages pages through the notifications two at a time,
+// with and without a search, and checks every page counts all of them.
+func TestTotalMatchesAcrossPages(t *testing.T) {
+	useNotifDB(t)
+	for _, m := range []string{"Your booking [7] is cancelled", "Order with Book is paid", "Your booking [8] is cancelled", "Order with Pen is paid", "Your booking [9] is cancelled"} {
+		if w := postNotif(`{"message":"`+m+`"}`, nil); w.Code != http.StatusOK {
+			t.Fatalf("create answered %d %s", w.Code, w.Body.String())
+		}
+	}
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+		total int
+	}{
+		{"first page", "?limit=2", []string{"Your booking [9] is cancelled", "Order with Pen is paid"}, 5},
+		{"middle page", "?limit=2&offset=2", []string{"Your booking [8] is cancelled", "Order with Book is paid"}, 5},
+		{"last page", "?limit=2&offset=4", []string{"Your booking [7] is cancelled"}, 5},
+		{"past the end", "?limit=2&offset=6", []string{}, 5},
+		{"search, first page", "?q=cancelled&limit=2", []string{"Your booking [9] is cancelled", "Your booking [8] is cancelled"}, 3},
+		{"search, last page", "?q=cancelled&limit=2&offset=2", []string{"Your booking [7] is cancelled"}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, total := listPage(t, tt.query)
+			if !reflect.DeepEqual(got, tt.want) || total != tt.total {
+				t.Fatalf("listed %q of %d, want %q of %d", got, total, tt.want, tt.total)
+			}
+		})
+	}
+
+	if got := listNotifs(t, "?limit=2"); len(got) != 2 {
+		t.Errorf("list without count listed %q, want a bare array of 2", got)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/hmac"
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// webhookDB fakes the notif_webhook table.
+type webhookDB struct {
+	mu    sync.Mutex
+	hooks map[int64]webhookModel
+}
+
+func useWebhookDB(t *testing.T) *webhookDB {
+	db := &webhookDB{hooks: map[int64]webhookModel{}}
+	useFakeDB(t, db.handle)
+	return db
+}
+
+func (db *webhookDB) handle(query string, args []driver.Value) fakeResult {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	switch {
+	case queryHas(query, "INSERT INTO notif_webhook"):
+		db.hooks[args[0].(int64)] = webhookModel{URL: args[1].(string), Secret: args[2].(string)}
+		return fakeResult{Affected: 1}
+	case queryHas(query, "SELECT url, secret FROM notif_webhook"):
+		res := fakeResult{Cols: []string{"url", "secret"}}
+		if wh, ok := db.hooks[args[0].(int64)]; ok {
+			res.Rows = [][]driver.Value{{wh.URL, wh.Secret}}
+		}
+		return res
+	case queryHas(query, "DELETE FROM notif_webhook"):
+		delete(db.hooks, args[0].(int64))
+		return fakeResult{Affected: 1}
+	}
+	return fakeResult{}
+}
+
+// webhookSink is the user's https endpoint receiving the webhooks.
+type webhookSink struct {
+	*httptest.Server
+	mu        sync.Mutex
+	bodies    [][]byte
+	signature []string
+}
+
+// useWebhookSink starts a sink and points httpClient at it, trusting its
+// certificate.
+func useWebhookSink(t *testing.T) *webhookSink {
+	s := &webhookSink{}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		s.bodies = append(s.bodies, body)
+		s.signature = append(s.signature, r.Header.Get(signatureHeader))
+		s.mu.Unlock()
+	}))
+	t.Cleanup(s.Close)
+	saved := httpClient
+	httpClient = s.Client()
+	t.Cleanup(func() { httpClient = saved })
+	return s
+}
+
+func (s *webhookSink) received() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.bodies)
+}
+
+// callWebhook calls h as user 9. Other tests notify user 5 and their
+// webhook deliveries run in the background, so they must not find this
+// user's webhook.
+func callWebhook(h http.HandlerFunc, method, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/notif/webhook", strings.NewReader(body))
+	r.Header.Set("X-User-Id", "9")
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestWebhookRegisterDeliverRemove(t *testing.T) {
+	useWebhookDB(t)
+	sink := useWebhookSink(t)
+
+	if w := callWebhook(setWebhook, http.MethodPost, `{"url":"http://example.com/hook"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("plain http url answered %d, want 400", w.Code)
+	}
+	w := callWebhook(setWebhook, http.MethodPost, `{"url":"`+sink.URL+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("register answered %d", w.Code)
+	}
+	registered := webhookModel{}
+	if err := json.Unmarshal(w.Body.Bytes(), &registered); err != nil || registered.Secret == "" {
+		t.Fatalf("register answered %s, want the url and a secret", w.Body.String())
+	}
+	w = callWebhook(getWebhook, http.MethodGet, "")
+	if w.Code != http.StatusOK || w.Body.String() != `{"url":"`+sink.URL+`"}` {
+		t.Fatalf("get answered %d %s, want the url without the secret", w.Code, w.Body.String())
+	}
+
+	deliverWebhook(9, "Your booking is confirmed")
+	if sink.received() != 1 {
+		t.Fatalf("sink got %d webhooks, want 1", sink.received())
+	}
+	got := notifModel{}
+	if err := json.Unmarshal(sink.bodies[0], &got); err != nil || got.UserID != 9 || got.Message != "Your booking is confirmed" {
+		t.Errorf("sink got %s", sink.bodies[0])
+	}
+	if want := signPayload(registered.Secret, sink.bodies[0]); !hmac.Equal([]byte(sink.signature[0]), []byte(want)) {
+		t.Errorf("signature %q, want %q", sink.signature[0], want)
+	}
+	if signPayload("other secret", sink.bodies[0]) == sink.signature[0] {
+		t.Error("signature does not depend on the secret")
+	}
+
+	if w := callWebhook(deleteWebhook, http.MethodDelete, ""); w.Code != http.StatusOK {
+		t.Fatalf("remove answered %d", w.Code)
+	}
+	if w := callWebhook(getWebhook, http.MethodGet, ""); w.Code != http.StatusNotFound {
+		t.Errorf("get after remove answered %d, want 404", w.Code)
+	}
+	deliverWebhook(9, "Another one")
+	if sink.received() != 1 {
+		t.Error("webhook delivered after remove")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// newCancelDB holds paid order 11 and orders of the given statuses after it,
+// all of user 5, charged 3000 each.
+func newCancelDB(t *testing.T, statuses ...string) *ordersDB {
+	db := newOrdersDB(t)
+	for i, s := range append([]string{orderStatusPaid}, statuses...) {
+		db.orders = append(db.orders, &orderModel{ID: 11 + i, UserID: 5, Item: "Concert", Amount: 3000, Status: s, ChargedAmount: 3000, PaymentRef: "ref"})
+	}
+	return db
+}
+
+// postCancel cancels order id as user 5.
+func postCancel(id int) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/orders/"+strconv.Itoa(id)+"/cancel", nil)
+	r.Header.Set("X-User-Id", "5")
+	r = mux.SetURLVars(r, map[string]string{"id": strconv.Itoa(id)})
+	w := httptest.NewRecorder()
+	cancelOrder(w, r)
+	return w
+}
+
+func TestCancelOrderRefundsCharge(t *testing.T) {
+	db := newCancelDB(t)
+	d := useStubServices(t, map[string]stubResponse{
+		"/account/genreq":  {http.StatusOK, ""},
+		"/account/deposit": {http.StatusOK, ""},
+		"/notif/create":    {http.StatusOK, ""},
+	})
+	w := postCancel(11)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status":"cancelled"`) {
+		t.Fatalf("answered %d %s, want 200 with the cancelled order", w.Code, w.Body.String())
+	}
+	if s := db.status(11); s != orderStatusCancelled {
+		t.Errorf("order is %s, want %s", s, orderStatusCancelled)
+	}
+	deposits := d.sent("/account/deposit")
+	if len(deposits) != 1 || string(deposits[0].body) != `{"delta":3000}` {
+		t.Fatalf("deposits %v, want one of 3000", deposits)
+	}
+	notifs := d.sent("/notif/create")
+	if len(notifs) != 1 || !strings.Contains(string(notifs[0].body), `"order_cancelled"`) {
+		t.Errorf("notifications %v, want one order_cancelled", notifs)
+	}
+	if w := postCancel(11); w.Code != http.StatusConflict {
+		t.Errorf("second cancel answered %d, want 409", w.Code)
+	}
+	if n := len(d.sent("/account/deposit")); n != 1 {
+		t.Errorf("second cancel refunded again, %d deposits", n)
+	}
+}
+
+func TestCancelOrderRejectsWrongState(t *testing.T) {
+	newCancelDB(t, orderStatusCancelled, orderStatusPending, orderStatusFailed)
+	d := useStubServices(t, nil)
+	for id, want := range map[int]int{12: http.StatusConflict, 13: http.StatusConflict, 14: http.StatusConflict, 99: http.StatusNotFound} {
+		if w := postCancel(id); w.Code != want {
+			t.Errorf("cancel of order %d answered %d, want %d", id, w.Code, want)
+		}
+	}
+	if len(d.reqs) != 0 {
+		t.Errorf("sent %d requests to other services", len(d.reqs))
+	}
+}
+
+func TestCancelOrderKeepsPaidWhenRefundFails(t *testing.T) {
+	db := newCancelDB(t)
+	useStubServices(t, map[string]stubResponse{
+		"/account/genreq":  {http.StatusOK, ""},
+		"/account/deposit": {http.StatusServiceUnavailable, ""},
+	})
+	if w := postCancel(11); w.Code != http.StatusBadGateway {
+		t.Fatalf("answered %d, want 502", w.Code)
+	}
+	if s := db.status(11); s != orderStatusPaid {
+		t.Errorf("order is %s, want it back in %s", s, orderStatusPaid)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// goldenDir holds the messages of the shared contracts package.
+const goldenDir = "../../contracts/testdata"
+
+func readGolden(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(goldenDir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// sameJSON reports whether a and b are the same json value regardless of
+// formatting and key order.
+func sameJSON(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var va, vb interface{}
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+// TestBookingOrderMatchesContract records the booking book sends and checks
+// the order it gets back.
+func TestBookingOrderMatchesContract(t *testing.T) {
+	var args []driver.Value
+	useFakeDB(t, func(query string, a []driver.Value) fakeResult {
+		if queryHas(query, "INSERT INTO orders", "book_id") {
+			args = a
+			return fakeResult{Cols: []string{"id"}, Rows: [][]driver.Value{{int64(11)}}}
+		}
+		return fakeResult{}
+	})
+	r := httptest.NewRequest(http.MethodPost, "/orders/booking", bytes.NewReader(readGolden(t, "booking_order.json")))
+	r.Header.Set("X-User-Id", "5")
+	w := httptest.NewRecorder()
+	createBookingOrder(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", w.Code)
+	}
+	want := []driver.Value{int64(5), "Concert", int64(3000), orderStatusPaid, int64(3000), "book:7", int64(7)}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("inserted %v, want %v", args, want)
+	}
+	if golden := readGolden(t, "order.json"); !sameJSON(t, w.Body.Bytes(), golden) {
+		t.Errorf("answered %s, want %s", w.Body.Bytes(), golden)
+	}
+}
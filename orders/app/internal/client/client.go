@@ -0,0 +1,104 @@
+// Package client calls account and notif on behalf of orders. It keeps the
+// paths and headers of those services in one place, the payloads are the
+// types of the shared contracts package.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"contracts"
+)
+
+const (
+	accountGenReqPath     = "/account/genreq"
+	accountWithdrawalPath = "/account/withdrawal"
+	accountDepositPath    = "/account/deposit"
+	notifCreatePath       = "/notif/create"
+)
+
+// StatusError is an unexpected status code from a service.
+type StatusError struct {
+	Service string
+	Code    int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s responded with status [%d]", e.Service, e.Code)
+}
+
+// Doer sends HTTP requests. *http.Client implements it, tests can pass a stub
+// instead.
+type Doer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// Client calls the account service at AccountURL and the notif service at
+// NotifURL.
+type Client struct {
+	HTTP       Doer
+	AccountURL string
+	NotifURL   string
+}
+
+// New returns a Client for the given base URLs using http.DefaultClient.
+func New(accountURL, notifURL string) *Client {
+	return &Client{HTTP: http.DefaultClient, AccountURL: accountURL, NotifURL: notifURL}
+}
+
+// PrepareOperation registers the request id rid in account for the next
+// balance change of the user.
+func (c *Client) PrepareOperation(uid int, rid string) error {
+	return c.send("account", http.MethodGet, c.AccountURL+accountGenReqPath, uid, rid, nil)
+}
+
+// Withdraw takes amount from the user's account under the request id rid,
+// which has to be prepared with PrepareOperation first.
+func (c *Client) Withdraw(uid int, rid string, amount int) error {
+	return c.send("account", http.MethodPost, c.AccountURL+accountWithdrawalPath, uid, rid, contracts.Withdrawal{WithDrawSum: amount})
+}
+
+// Deposit adds amount to the user's account under the request id rid, which
+// has to be prepared with PrepareOperation first.
+func (c *Client) Deposit(uid int, rid string, amount int) error {
+	return c.send("account", http.MethodPost, c.AccountURL+accountDepositPath, uid, rid, contracts.Deposit{Delta: amount})
+}
+
+// Notify asks notif to send n to its user.
+func (c *Client) Notify(n contracts.Notification) error {
+	return c.send("notif", http.MethodPost, c.NotifURL+notifCreatePath, n.UserID, "", n)
+}
+
+// send makes the request as the user uid with the request id rid, if any, and
+// v as the json body, if any. Anything but 200 is a StatusError.
+func (c *Client) send(service, method, url string, uid int, rid string, v interface{}) error {
+	var body io.Reader
+	if v != nil {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-User-Id", strconv.Itoa(uid))
+	if rid != "" {
+		req.Header.Set("X-Request-Id", rid)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{Service: service, Code: resp.StatusCode}
+	}
+	return nil
+}
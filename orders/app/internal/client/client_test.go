@@ -0,0 +1,136 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"contracts"
+)
+
+// goldenDir holds the messages of the shared contracts package.
+const goldenDir = "../../../../contracts/testdata"
+
+func readGolden(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(goldenDir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// sameJSON reports whether a and b are the same json value regardless of
+// formatting and key order.
+func sameJSON(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var va, vb interface{}
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+// stubDoer records the requests and answers each of them with status.
+type stubDoer struct {
+	status int
+	reqs   []*http.Request
+	bodies [][]byte
+}
+
+func (d *stubDoer) Do(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		body, _ = io.ReadAll(req.Body)
+	}
+	d.reqs = append(d.reqs, req)
+	d.bodies = append(d.bodies, body)
+	return &http.Response{StatusCode: d.status, Body: io.NopCloser(bytes.NewReader(nil))}, nil
+}
+
+func newStubClient(status int) (*Client, *stubDoer) {
+	d := &stubDoer{status: status}
+	c := New("http://account", "http://notif")
+	c.HTTP = d
+	return c, d
+}
+
+func TestRequestsMatchContracts(t *testing.T) {
+	tests := []struct {
+		name   string
+		golden string
+		body   string
+		method string
+		url    string
+		rid    string
+		call   func(c *Client) error
+	}{
+		{"prepare", "", "", http.MethodGet, "http://account/account/genreq", "r-1", func(c *Client) error { return c.PrepareOperation(5, "r-1") }},
+		{"withdraw", "", `{"book_id":0,"withdrawal_sum":3000}`, http.MethodPost, "http://account/account/withdrawal", "r-1", func(c *Client) error { return c.Withdraw(5, "r-1", 3000) }},
+		{"deposit", "deposit.json", "", http.MethodPost, "http://account/account/deposit", "r-1", func(c *Client) error { return c.Deposit(5, "r-1", 3000) }},
+		{"notify", "notification.json", "", http.MethodPost, "http://notif/notif/create", "", func(c *Client) error {
+			return c.Notify(contracts.Notification{
+				UserID:   5,
+				Type:     "order_failed",
+				Params:   map[string]string{"reason": "Not enough funds on your account"},
+				Locale:   "en",
+				Priority: "high",
+			})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, d := newStubClient(http.StatusOK)
+			if err := tt.call(c); err != nil {
+				t.Fatal(err)
+			}
+			if len(d.reqs) != 1 {
+				t.Fatalf("sent %d requests, want 1", len(d.reqs))
+			}
+			req := d.reqs[0]
+			if req.Method != tt.method || req.URL.String() != tt.url {
+				t.Errorf("%s %s, want %s %s", req.Method, req.URL, tt.method, tt.url)
+			}
+			if got := req.Header.Get("X-User-Id"); got != "5" {
+				t.Errorf("X-User-Id %q, want 5", got)
+			}
+			if got := req.Header.Get("X-Request-Id"); got != tt.rid {
+				t.Errorf("X-Request-Id %q, want %q", got, tt.rid)
+			}
+			want := []byte(tt.body)
+			if tt.golden != "" {
+				want = readGolden(t, tt.golden)
+			}
+			if len(want) == 0 {
+				if len(d.bodies[0]) != 0 {
+					t.Errorf("sent body %s, want none", d.bodies[0])
+				}
+				return
+			}
+			if !sameJSON(t, d.bodies[0], want) {
+				t.Errorf("sent %s, want %s", d.bodies[0], want)
+			}
+		})
+	}
+}
+
+func TestStatusErrors(t *testing.T) {
+	c, _ := newStubClient(http.StatusUnprocessableEntity)
+	err := c.Withdraw(5, "r-1", 3000)
+	if se, ok := err.(*StatusError); !ok || se.Service != "account" || se.Code != http.StatusUnprocessableEntity {
+		t.Errorf("account: got %v, want account StatusError 422", err)
+	}
+	c, _ = newStubClient(http.StatusServiceUnavailable)
+	err = c.Notify(contracts.Notification{UserID: 5})
+	if se, ok := err.(*StatusError); !ok || se.Service != "notif" || se.Code != http.StatusServiceUnavailable {
+		t.Errorf("notif: got %v, want notif StatusError 503", err)
+	}
+}
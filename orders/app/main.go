@@ -3,63 +3,211 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
+	"strings"
+	"time"
+
+	"app/internal/client"
+	"contracts"
+	"platform/config"
+	"platform/database"
+	"platform/web"
 
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
 )
 
 type orderModel struct {
-	Item   string `json:"item"`
-	Amount int    `json:"amount"`
+	ID            int    `json:"id,omitempty"`
+	UserID        int    `json:"user_id,omitempty"`
+	Item          string `json:"item"`
+	Amount        int    `json:"amount"`
+	Status        string `json:"status,omitempty"`
+	ChargedAmount int    `json:"charged_amount"`
+	PaymentRef    string `json:"payment_ref,omitempty"`
+	BookID        int    `json:"book_id,omitempty"`
 }
 
-type balanceModel struct {
-	Balance int `json:"balance"`
+// bookingOrderModel is a booking book has been paid for, recorded as an order
+// for reporting.
+type bookingOrderModel = contracts.BookingOrder
+
+type notifModel = contracts.Notification
+
+// notifPriorities are the notification types sent with other than the
+// normal priority.
+var notifPriorities = map[string]string{"order_failed": "high"}
+
+type balanceModel = contracts.Balance
+
+// pageModel is the list returned instead of a bare array when the client asks
+// for the total count with count=true.
+type pageModel struct {
+	Items interface{} `json:"items"`
+	Total int         `json:"total"`
 }
 
+// dlqNotif is a notification that notif did not accept and waits in
+// notif_dlq to be sent again.
+type dlqNotif struct {
+	id        int
+	userID    int
+	payload   string
+	attempts  int
+	createdAt time.Time
+}
+
+// services calls account and notif. Tests can put a stub into its HTTP field.
+var services = client.New("", "")
+
 type configModel struct {
-	dbHost string
-	dbPort string
-	dbName string
-	dbUser string
-	dbPass string
-	host   string
-	port   string
+	web.ServerConfig
+	dbHost      string
+	dbPort      string
+	dbName      string
+	dbUser      string
+	dbPass      string
+	accountURL  string
+	notifURL    string
+	origins     string
+	routePrefix string
+	maintenance string
+	dbWait      string
 }
 
 const (
-	createOrderTpl = `INSERT INTO orders (userid, item, amount) VALUES ($1, $2, $3) returning id`
-	notifTpl       = `{"userid":%d,"message":"%s"}`
+	orderStatusPending    = "pending"
+	orderStatusPaid       = "paid"
+	orderStatusRefunding  = "refunding"
+	orderStatusFailed     = "failed"
+	orderStatusCancelling = "cancelling"
+	orderStatusCancelled  = "cancelled"
+)
+
+// orderStatusRefundingInflight is an order in refunding whose refund is
+// being sent to account right now.
+const orderStatusRefundingInflight = "refunding_inflight"
+
+const countOrdersTpl = `SELECT COUNT(1) FROM orders WHERE userid=$1`
+
+// Steps of the order saga recorded in order_saga_log. An order is created
+// pending, the user is charged, then it's marked paid; if that fails the
+// charge is refunded.
+const (
+	stepCreate   = "create"
+	stepDebit    = "debit"
+	stepComplete = "complete"
+	stepRefund   = "refund"
+)
+
+const (
+	setOrderPaymentTpl = `UPDATE orders SET status=$2, charged_amount=$3, payment_ref=$4 WHERE id=$1 AND status=$5`
+	orderSagaLogTpl    = `INSERT INTO order_saga_log (order_id, step, error) VALUES ($1, $2, $3)`
+	getRefundingTpl    = `SELECT id FROM orders WHERE status=$1 OR (status=$2 AND refund_claimed_at < now() - make_interval(secs => $3)) ORDER BY id LIMIT $4`
+	claimRefundTpl     = `UPDATE orders SET status=$2, refund_ref=COALESCE(NULLIF(refund_ref, ''), $3), refund_claimed_at=now() WHERE id=$1 AND (status=$4 OR (status=$2 AND refund_claimed_at < now() - make_interval(secs => $5))) RETURNING userid, charged_amount, refund_ref`
+	swapOrderStatusTpl = `UPDATE orders SET status=$2 WHERE id=$1 AND status=$3`
+	refundInterval     = 30 * time.Second
+	refundBatch        = 100
+	refundClaimTimeout = 5 * time.Minute
+)
+
+const (
+	dlqPollInterval = 5 * time.Second
+	dlqBaseDelay    = time.Second
+	dlqMaxDelay     = 5 * time.Minute
+	dlqMaxAge       = 24 * time.Hour
+	dlqBatchSize    = 100
+)
+
+const (
+	enqueueNotifTpl  = `INSERT INTO notif_dlq (user_id, payload, next_attempt_at) VALUES ($1, $2, now() + make_interval(secs => $3))`
+	dueNotifsTpl     = `SELECT id, user_id, payload, attempts, created_at FROM notif_dlq WHERE next_attempt_at <= now() ORDER BY id LIMIT $1`
+	scheduleNotifTpl = `UPDATE notif_dlq SET attempts=$2, next_attempt_at=now() + make_interval(secs => $3) WHERE id=$1`
+	deleteNotifTpl   = `DELETE FROM notif_dlq WHERE id=$1`
+)
+
+const (
+	reserveIdempotencyKeyTpl = `INSERT INTO idempotency_key (user_id, key, request_hash) VALUES ($1, $2, $3) ON CONFLICT (user_id, key) DO UPDATE SET request_hash=excluded.request_hash, status=0, body='', created_at=now() WHERE idempotency_key.created_at < now() - make_interval(secs => $4) RETURNING user_id`
+	getIdempotencyKeyTpl     = `SELECT request_hash, status, body FROM idempotency_key WHERE user_id=$1 AND key=$2`
+	saveIdempotencyKeyTpl    = `UPDATE idempotency_key SET status=$3, body=$4 WHERE user_id=$1 AND key=$2`
+	deleteIdempotencyKeyTpl  = `DELETE FROM idempotency_key WHERE user_id=$1 AND key=$2`
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotencyKeyTTL        = 24 * time.Hour
+)
+
+const (
+	createOrderTpl        = `INSERT INTO orders (userid, item, amount, status, charged_amount, payment_ref) VALUES ($1, $2, $3, $4, $5, $6) returning id`
+	createBookingOrderTpl = `INSERT INTO orders (userid, item, amount, status, charged_amount, payment_ref, book_id) VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (book_id) DO UPDATE SET book_id=excluded.book_id returning id`
+	getOrdersTpl          = `SELECT id, userid, item, amount, status, charged_amount, payment_ref, coalesce(book_id, 0) FROM orders WHERE userid=$1 ORDER BY id`
+	startCancelOrderTpl   = `UPDATE orders SET status=$3 WHERE id=$1 AND userid=$2 AND status=$4 AND book_id IS NULL RETURNING item, charged_amount, payment_ref`
+	setOrderStatusTpl     = `UPDATE orders SET status=$2 WHERE id=$1`
+	getOrderStatusTpl     = `SELECT status FROM orders WHERE id=$1 AND userid=$2`
 )
 
 var (
-	createOrderStmt *sql.Stmt
+	createOrderStmt           *sql.Stmt
+	getOrdersStmt             *sql.Stmt
+	countOrdersStmt           *sql.Stmt
+	createBookingOrderStmt    *sql.Stmt
+	startCancelOrderStmt      *sql.Stmt
+	setOrderStatusStmt        *sql.Stmt
+	getOrderStatusStmt        *sql.Stmt
+	setOrderPaymentStmt       *sql.Stmt
+	orderSagaLogStmt          *sql.Stmt
+	getRefundingStmt          *sql.Stmt
+	claimRefundStmt           *sql.Stmt
+	swapOrderStatusStmt       *sql.Stmt
+	reserveIdempotencyKeyStmt *sql.Stmt
+	getIdempotencyKeyStmt     *sql.Stmt
+	saveIdempotencyKeyStmt    *sql.Stmt
+	deleteIdempotencyKeyStmt  *sql.Stmt
+	enqueueNotifStmt          *sql.Stmt
+	dueNotifsStmt             *sql.Stmt
+	scheduleNotifStmt         *sql.Stmt
+	deleteNotifStmt           *sql.Stmt
+	dbConn                    = &database.Conn{Prepare: mustPrepareStmts}
 )
 
 func readConf() *configModel {
 	cfg := &configModel{
-		dbHost: "orders-postgresql",
-		dbPort: "5432",
-		dbName: "ordersdb",
-		dbUser: "ordersuser",
-		dbPass: "orderspasswd",
-		host:   "0.0.0.0",
-		port:   "80",
-	}
-	dbHost := os.Getenv("DBHOST")
-	dbPort := os.Getenv("DBPORT")
-	dbName := os.Getenv("DBNAME")
-	dbUser := os.Getenv("DBUSER")
-	dbPass := os.Getenv("DBPASS")
-	host := os.Getenv("HOST")
-	port := os.Getenv("PORT")
+		dbHost:       "orders-postgresql",
+		dbPort:       "5432",
+		dbName:       "ordersdb",
+		dbUser:       "ordersuser",
+		dbPass:       "orderspasswd",
+		ServerConfig: web.DefaultServerConfig(),
+		accountURL:   "http://account.saga.svc.cluster.local:9000",
+		notifURL:     "http://notif.saga.svc.cluster.local:9000",
+		dbWait:       "60s",
+	}
+	dbHost := config.Getenv("DBHOST")
+	dbPort := config.Getenv("DBPORT")
+	dbName := config.Getenv("DBNAME")
+	dbUser := config.Getenv("DBUSER")
+	dbPass := config.Getenv("DBPASS")
+	host := config.Getenv("HOST")
+	port := config.Getenv("PORT")
+	accountURL := config.Getenv("ACCOUNT_URL")
+	notifURL := config.Getenv("NOTIF_URL")
+	tlsCertFile := config.Getenv("TLS_CERT_FILE")
+	tlsKeyFile := config.Getenv("TLS_KEY_FILE")
+	readTimeout := config.Getenv("READ_TIMEOUT")
+	writeTimeout := config.Getenv("WRITE_TIMEOUT")
+	idleTimeout := config.Getenv("IDLE_TIMEOUT")
+	origins := config.Getenv("ALLOWED_ORIGINS")
+	routePrefix := config.Getenv("ROUTE_PREFIX")
+	maintenance := config.Getenv("MAINTENANCE")
+	dbWait := config.Getenv("DB_WAIT_TIMEOUT")
 
 	if dbHost != "" {
 		cfg.dbHost = dbHost
@@ -77,10 +225,43 @@ func readConf() *configModel {
 		cfg.dbPass = dbPass
 	}
 	if host != "" {
-		cfg.host = host
+		cfg.Host = host
 	}
 	if port != "" {
-		cfg.port = port
+		cfg.Port = port
+	}
+	if accountURL != "" {
+		cfg.accountURL = accountURL
+	}
+	if notifURL != "" {
+		cfg.notifURL = notifURL
+	}
+	if tlsCertFile != "" {
+		cfg.TLSCertFile = tlsCertFile
+	}
+	if tlsKeyFile != "" {
+		cfg.TLSKeyFile = tlsKeyFile
+	}
+	if readTimeout != "" {
+		cfg.ReadTimeout = readTimeout
+	}
+	if writeTimeout != "" {
+		cfg.WriteTimeout = writeTimeout
+	}
+	if idleTimeout != "" {
+		cfg.IdleTimeout = idleTimeout
+	}
+	if origins != "" {
+		cfg.origins = origins
+	}
+	if routePrefix != "" {
+		cfg.routePrefix = routePrefix
+	}
+	if maintenance != "" {
+		cfg.maintenance = maintenance
+	}
+	if dbWait != "" {
+		cfg.dbWait = dbWait
 	}
 	return cfg
 }
@@ -90,11 +271,20 @@ func makeDBConn(cfg *configModel) (*sql.DB, error) {
 		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		cfg.dbHost, cfg.dbPort, cfg.dbUser, cfg.dbPass, cfg.dbName,
 	)
-	log.Println("connection string: ", pgConnString)
+	log.Printf("Connecting to database host=%s port=%s dbname=%s\n", cfg.dbHost, cfg.dbPort, cfg.dbName)
 	db, err := sql.Open("postgres", pgConnString)
 	return db, err
 }
 
+// maintenanceMode turns every request but health, version and the switch
+// itself away with 503. It starts from MAINTENANCE and is switched at runtime
+// by admins via maintenancePath.
+var maintenanceMode = &web.Maintenance{Health: []string{"/health"}}
+
+const maintenancePath = "/orders/maintenance"
+
+const roleAdmin = "admin"
+
 func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -107,56 +297,383 @@ func main() {
 	}
 	defer db.Close()
 
-	if err = db.PingContext(ctx); err != nil {
+	dbWait, err := time.ParseDuration(cfg.dbWait)
+	if err != nil {
+		log.Fatal("Failed to parse DB_WAIT_TIMEOUT:", err)
+	}
+	if err = database.Wait(ctx, db, dbWait); err != nil {
 		log.Fatal("Failed to check db connection:", err)
 	}
 
 	mustPrepareStmts(ctx, db)
+	dbConn.Open = func() (*sql.DB, error) { return makeDBConn(cfg) }
+	dbConn.Set(db)
+	services.AccountURL, services.NotifURL = cfg.accountURL, cfg.notifURL
 
-	r := mux.NewRouter()
+	go retryNotifs(ctx)
+	go retryRefunds(ctx)
 
-	r.HandleFunc("/orders/create", isAuthenticatedMiddleware(create)).Methods("POST")
+	if cfg.maintenance != "" {
+		on, err := strconv.ParseBool(cfg.maintenance)
+		if err != nil {
+			log.Fatal("Failed to parse MAINTENANCE:", err)
+		}
+		maintenanceMode.Set(on)
+	}
 
-	bindOn := fmt.Sprintf("%s:%s", cfg.host, cfg.port)
-	if err := http.ListenAndServe(bindOn, r); err != nil {
-		log.Printf("Failed to bind on [%s]: %s", bindOn, err)
+	prefix := strings.TrimSuffix(cfg.routePrefix, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		log.Fatalf("ROUTE_PREFIX [%s] must start with /", cfg.routePrefix)
+	}
+	r := newRouter(prefix)
+
+	h := maintenanceMode.Middleware(prefix+maintenancePath, r)
+	h = web.RecoverPanics(web.CORS(web.ParseOrigins(cfg.origins), h))
+	if err := web.Serve(cfg.ServerConfig, h); err != nil {
+		log.Printf("Failed to bind on [%s:%s]: %s", cfg.Host, cfg.Port, err)
 	}
 }
 
+// newRouter registers the routes, the api ones under prefix if it isn't
+// empty.
+func newRouter(prefix string) *mux.Router {
+	r := mux.NewRouter()
+
+	r.HandleFunc("/health", health)
+	r.HandleFunc("/version", web.VersionInfo).Methods("GET")
+	api := r
+	if prefix != "" {
+		api = r.PathPrefix(prefix).Subrouter()
+	}
+	api.HandleFunc("/orders/create", reqlog(web.Authenticated(idempotent(create)))).Methods("POST")
+	api.HandleFunc("/orders/get", reqlog(web.Authenticated(get))).Methods("GET")
+	api.HandleFunc("/orders/booking", reqlog(web.Authenticated(createBookingOrder))).Methods("POST")
+	api.HandleFunc("/orders/{id}/cancel", reqlog(web.Authenticated(cancelOrder))).Methods("POST")
+	api.HandleFunc(maintenancePath, reqlog(web.Authenticated(web.RequireRole(roleAdmin, maintenanceMode.Switch)))).Methods("GET", "PUT")
+	r.MethodNotAllowedHandler = web.MethodNotAllowed(r)
+	r.NotFoundHandler = http.HandlerFunc(web.NotFound)
+	return r
+}
+
+func health(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status": "OK"}`))
+}
+
 func mustPrepareStmts(ctx context.Context, db *sql.DB) {
 	var err error
 
+	enqueueNotifStmt, err = db.PrepareContext(ctx, enqueueNotifTpl)
+	if err != nil {
+		panic(err)
+	}
+	dueNotifsStmt, err = db.PrepareContext(ctx, dueNotifsTpl)
+	if err != nil {
+		panic(err)
+	}
+	scheduleNotifStmt, err = db.PrepareContext(ctx, scheduleNotifTpl)
+	if err != nil {
+		panic(err)
+	}
+	deleteNotifStmt, err = db.PrepareContext(ctx, deleteNotifTpl)
+	if err != nil {
+		panic(err)
+	}
+
 	createOrderStmt, err = db.PrepareContext(ctx, createOrderTpl)
 	if err != nil {
 		panic(err)
 	}
 
+	getOrdersStmt, err = db.PrepareContext(ctx, getOrdersTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	countOrdersStmt, err = db.PrepareContext(ctx, countOrdersTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	createBookingOrderStmt, err = db.PrepareContext(ctx, createBookingOrderTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	startCancelOrderStmt, err = db.PrepareContext(ctx, startCancelOrderTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	setOrderStatusStmt, err = db.PrepareContext(ctx, setOrderStatusTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	getOrderStatusStmt, err = db.PrepareContext(ctx, getOrderStatusTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	setOrderPaymentStmt, err = db.PrepareContext(ctx, setOrderPaymentTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	orderSagaLogStmt, err = db.PrepareContext(ctx, orderSagaLogTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	getRefundingStmt, err = db.PrepareContext(ctx, getRefundingTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	claimRefundStmt, err = db.PrepareContext(ctx, claimRefundTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	swapOrderStatusStmt, err = db.PrepareContext(ctx, swapOrderStatusTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	reserveIdempotencyKeyStmt, err = db.PrepareContext(ctx, reserveIdempotencyKeyTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	getIdempotencyKeyStmt, err = db.PrepareContext(ctx, getIdempotencyKeyTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	saveIdempotencyKeyStmt, err = db.PrepareContext(ctx, saveIdempotencyKeyTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	deleteIdempotencyKeyStmt, err = db.PrepareContext(ctx, deleteIdempotencyKeyTpl)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// parseLocale returns the primary language of the first tag in an
+// Accept-Language header, e.g. "ru" for "ru-RU,ru;q=0.9,en;q=0.8".
+func parseLocale(header string) string {
+	tag := strings.TrimSpace(strings.SplitN(header, ",", 2)[0])
+	tag = strings.SplitN(tag, ";", 2)[0]
+	tag = strings.SplitN(tag, "-", 2)[0]
+	return strings.ToLower(strings.TrimSpace(tag))
 }
 
-func createOrder(id, amount int, item string) error {
-	_, err := createOrderStmt.Query(id, item, amount)
+func createOrder(o *orderModel) error {
+	err := dbConn.Retry(func() error {
+		return createOrderStmt.QueryRow(o.UserID, o.Item, o.Amount, o.Status, o.ChargedAmount, o.PaymentRef).Scan(&o.ID)
+	})
 	if err != nil {
-		log.Printf("Failed to create order for user id [%d]: %s", id, err)
+		log.Printf("Failed to create order for user id [%d]: %s", o.UserID, err)
 		return err
 	}
 	return nil
 }
 
-func createNotif(id int, message string) error {
-	b := bytes.NewReader([]byte(fmt.Sprintf(notifTpl, id, message)))
-	req, err := http.NewRequest("POST", "http://notif.saga.svc.cluster.local:9000/notif/create", b)
+func getOrders(uid int) ([]orderModel, error) {
+	orders := []orderModel{}
+	err := dbConn.Retry(func() error {
+		orders = orders[:0]
+		rows, err := getOrdersStmt.Query(uid)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			o := orderModel{}
+			if err = rows.Scan(&o.ID, &o.UserID, &o.Item, &o.Amount, &o.Status, &o.ChargedAmount, &o.PaymentRef, &o.BookID); err != nil {
+				return err
+			}
+			orders = append(orders, o)
+		}
+		return rows.Err()
+	})
 	if err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// countOrders counts the orders getOrders returns for the user.
+func countOrders(uid int) (int, error) {
+	total := 0
+	err := dbConn.Retry(func() error {
+		return countOrdersStmt.QueryRow(uid).Scan(&total)
+	})
+	return total, err
+}
+
+// debit withdraws amount from the user's account. The account service needs
+// a prepared operation, so a request id is registered first and then used for
+// the withdrawal. The request id is returned as the payment reference.
+func debit(uid, amount int) (string, error) {
+	rid, err := newRequestID()
+	if err != nil {
+		return "", err
+	}
+	if err = services.PrepareOperation(uid, rid); err != nil {
+		return "", fmt.Errorf("failed to prepare operation for user %d: %w", uid, err)
+	}
+	if err = services.Withdraw(uid, rid, amount); err != nil {
+		return "", fmt.Errorf("failed to withdrawal fund for user %d: %w", uid, err)
+	}
+	return rid, nil
+}
+
+// credit returns amount to the user's account under the request id rid, it
+// is the compensation of debit. Account applies a request id once, so a
+// credit repeated with the same rid is not paid twice.
+func credit(uid, amount int, rid string) error {
+	if err := services.PrepareOperation(uid, rid); err != nil {
+		return fmt.Errorf("failed to prepare operation for user %d: %w", uid, err)
+	}
+	if err := services.Deposit(uid, rid, amount); err != nil {
+		return fmt.Errorf("failed to deposit fund for user %d: %w", uid, err)
+	}
+	return nil
+}
+
+func newRequestID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// createNotif asks notif to tell the user about the order with a
+// notification of the given type in the given locale, the wording lives in
+// notif. A notification notif does not accept is saved to notif_dlq and sent
+// again by retryNotifs, so notif being down never fails the order itself.
+func createNotif(id int, locale, typ string, params map[string]string) {
+	n := notifModel{UserID: id, Type: typ, Params: params, Locale: locale, Priority: notifPriorities[typ]}
+	if err := services.Notify(n); err != nil {
+		log.Printf("Failed to create notification for user id [%d], will retry later: %s\n", id, err)
+		data, err := json.Marshal(n)
+		if err != nil {
+			log.Printf("Failed to marshal notification for user id [%d]: %s\n", id, err)
+			return
+		}
+		enqueueNotif(id, data)
+	}
+}
+
+// resendNotif sends a notification saved in notif_dlq to notif again.
+func resendNotif(payload string) error {
+	n := notifModel{}
+	if err := json.Unmarshal([]byte(payload), &n); err != nil {
 		return err
 	}
-	req.Header.Set("X-User-Id", strconv.Itoa(id))
-	c := http.Client{}
-	resp, err := c.Do(req)
+	return services.Notify(n)
+}
+
+// enqueueNotif puts the failed notification into notif_dlq so that
+// retryNotifs sends it again later.
+func enqueueNotif(uid int, data []byte) {
+	err := dbConn.Retry(func() error {
+		_, err := enqueueNotifStmt.Exec(uid, string(data), notifBackoff(0).Seconds())
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to save notification for user [%d], notification is lost: %s: %s\n", uid, data, err)
+	}
+}
+
+// retryNotifs resends due notifications from notif_dlq every dlqPollInterval
+// until ctx is done.
+func retryNotifs(ctx context.Context) {
+	t := time.NewTicker(dlqPollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		retryDueNotifs()
+	}
+}
+
+// retryDueNotifs sends the notifications whose next attempt is due. Each
+// failure doubles the delay up to dlqMaxDelay, notifications older than
+// dlqMaxAge are dropped.
+func retryDueNotifs() {
+	ns := []dlqNotif{}
+	err := dbConn.Retry(func() error {
+		ns = ns[:0]
+		rows, err := dueNotifsStmt.Query(dlqBatchSize)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			n := dlqNotif{}
+			if err := rows.Scan(&n.id, &n.userID, &n.payload, &n.attempts, &n.createdAt); err != nil {
+				return err
+			}
+			ns = append(ns, n)
+		}
+		return rows.Err()
+	})
 	if err != nil {
-		log.Printf("Failed to execute request to get balance: %s\n", err)
+		log.Printf("Failed to get notifications to retry: %s\n", err)
+		return
+	}
+	for _, n := range ns {
+		if time.Since(n.createdAt) > dlqMaxAge {
+			log.Printf("Giving up on notification [%d] for user [%d] after [%d] attempts: %s\n", n.id, n.userID, n.attempts, n.payload)
+			deleteNotif(n.id)
+			continue
+		}
+		if err := resendNotif(n.payload); err != nil {
+			n.attempts++
+			log.Printf("Failed to resend notification [%d] for user [%d], attempt [%d]: %s\n", n.id, n.userID, n.attempts, err)
+			err = dbConn.Retry(func() error {
+				_, err := scheduleNotifStmt.Exec(n.id, n.attempts, notifBackoff(n.attempts).Seconds())
+				return err
+			})
+			if err != nil {
+				log.Printf("Failed to reschedule notification [%d]: %s\n", n.id, err)
+			}
+			continue
+		}
+		log.Printf("Successfully resent notification [%d] for user [%d]\n", n.id, n.userID)
+		deleteNotif(n.id)
+	}
+}
+
+func deleteNotif(id int) {
+	err := dbConn.Retry(func() error {
+		_, err := deleteNotifStmt.Exec(id)
 		return err
+	})
+	if err != nil {
+		log.Printf("Failed to delete notification [%d]: %s\n", id, err)
 	}
-	defer resp.Body.Close()
-	return nil
+}
+
+// notifBackoff is the delay before the next attempt after the given number
+// of failed attempts.
+func notifBackoff(attempts int) time.Duration {
+	d := dlqBaseDelay
+	for i := 0; i < attempts && d < dlqMaxDelay; i++ {
+		d *= 2
+	}
+	if d > dlqMaxDelay {
+		d = dlqMaxDelay
+	}
+	return d
 }
 
 // func getbalance(id int) (int, error) {
@@ -205,42 +722,483 @@ func createNotif(id int, message string) error {
 
 func create(w http.ResponseWriter, r *http.Request) {
 	headers := r.Header
-	id, err := strconv.Atoi(headers.Get("X-User-Id"))
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Got wrong header [X-User-Id]: %s", err)
+	id, ok := web.MustUserID(w, r)
+	if !ok {
 		return
 	}
+	var err error
+	locale := parseLocale(headers.Get("Accept-Language"))
 	o := orderModel{}
 	if err = json.NewDecoder(r.Body).Decode(&o); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusBadRequest)
 		log.Printf("Failed to parse request body user id [%d]: %s\n", id, err)
 		return
 	}
-	if err = createOrder(id, o.Amount, o.Item); err != nil {
-    }
-		w.WriteHeader(http.StatusInternalServerError)
-		if err = createNotif(id, "Failed to create order. Your funds will be return on your account"); err != nil {
-			log.Printf("Failed to create notification for user id [%d]: %s\n", id, err)
+	o.UserID = id
+	o.Status = orderStatusPending
+	if err = createOrder(&o); err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to create order for user [%d]: %w", id, err))
+		return
+	}
+	logOrderSaga(o.ID, stepCreate, "")
+	ref, err := debit(id, o.Amount)
+	if err != nil {
+		log.Printf("Failed to charge user id [%d] for order [%d]: %s\n", id, o.ID, err)
+		logOrderSaga(o.ID, stepDebit, err.Error())
+		if err = setOrderStatus(o.ID, orderStatusFailed); err != nil {
+			log.Printf("Failed to set order [%d] to status [%s]: %s\n", o.ID, orderStatusFailed, err)
 		}
+		w.WriteHeader(http.StatusPaymentRequired)
+		createNotif(id, locale, "order_failed", map[string]string{"reason": "Not enough funds on your account"})
 		return
 	}
-	if err = createNotif(id, fmt.Sprintf("Successfully created order with %s", o.Item)); err != nil {
-		log.Printf("Failed to create notification for user id [%d]: %s\n", id, err)
+	logOrderSaga(o.ID, stepDebit, "")
+	if err = completeOrder(&o, ref); err != nil {
+		logOrderSaga(o.ID, stepComplete, err.Error())
+		refundOrder(o.ID, id, o.Amount, ref)
+		web.InternalError(w, r, fmt.Errorf("failed to complete order [%d] for user [%d]: %w", o.ID, id, err))
+		createNotif(id, locale, "order_failed", map[string]string{"reason": "Your funds will be return on your account"})
+		return
 	}
+	logOrderSaga(o.ID, stepComplete, "")
+	createNotif(id, locale, "order_created", map[string]string{"item": o.Item})
 	log.Printf("Successfully created order for user id [%d]\n", id)
+	data, _ := json.Marshal(o)
 	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// createBookingOrder records a paid booking as an order of the user. The
+// money was charged by book, so nothing is debited here. An order already
+// recorded for the booking is returned as is, book may repeat the call.
+func createBookingOrder(w http.ResponseWriter, r *http.Request) {
+	uid, ok := web.MustUserID(w, r)
+	if !ok {
+		return
+	}
+	bo := bookingOrderModel{}
+	if err := json.NewDecoder(r.Body).Decode(&bo); err != nil {
+		log.Printf("Failed to parse request body user id [%d]: %s\n", uid, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if bo.BookID <= 0 || bo.Amount < 0 {
+		log.Printf("Wrong booking order [%+v] of user id [%d]\n", bo, uid)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	o := orderModel{
+		UserID:        uid,
+		Item:          bo.Item,
+		Amount:        bo.Amount,
+		Status:        orderStatusPaid,
+		ChargedAmount: bo.Amount,
+		PaymentRef:    "book:" + strconv.Itoa(bo.BookID),
+		BookID:        bo.BookID,
+	}
+	err := dbConn.Retry(func() error {
+		return createBookingOrderStmt.QueryRow(o.UserID, o.Item, o.Amount, o.Status, o.ChargedAmount, o.PaymentRef, o.BookID).Scan(&o.ID)
+	})
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to create order for book [%d]: %w", bo.BookID, err))
+		return
+	}
+	log.Printf("Order [%d] is linked to book [%d] of user id [%d]\n", o.ID, bo.BookID, uid)
+	data, _ := json.Marshal(o)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func get(w http.ResponseWriter, r *http.Request) {
+	id, ok := web.MustUserID(w, r)
+	if !ok {
+		return
+	}
+	count := false
+	if v := r.URL.Query().Get("count"); v != "" {
+		var err error
+		if count, err = strconv.ParseBool(v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "wrong value of [count]: %q", v)
+			return
+		}
+	}
+	orders, err := getOrders(id)
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to get orders for user id [%d]: %w", id, err))
+		return
+	}
+	if !count {
+		data, _ := json.Marshal(orders)
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+		return
+	}
+	total, err := countOrders(id)
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to count orders for user id [%d]: %w", id, err))
+		return
+	}
+	data, _ := json.Marshal(pageModel{Items: orders, Total: total})
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// cancelOrder cancels a paid order of the user and refunds the charged amount.
+// The order is moved to cancelling first so that concurrent cancels can't
+// refund twice, and back to paid if the refund fails.
+func cancelOrder(w http.ResponseWriter, r *http.Request) {
+	uid, ok := web.MustUserID(w, r)
+	if !ok {
+		return
+	}
+	oid, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		log.Println("Failed to parse request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	o := orderModel{ID: oid, UserID: uid}
+	err = dbConn.Retry(func() error {
+		return startCancelOrderStmt.QueryRow(oid, uid, orderStatusCancelling, orderStatusPaid).Scan(&o.Item, &o.ChargedAmount, &o.PaymentRef)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		status := ""
+		err = dbConn.Retry(func() error {
+			return getOrderStatusStmt.QueryRow(oid, uid).Scan(&status)
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Could not find order [%d] of user id [%d]\n", oid, uid)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			web.InternalError(w, r, fmt.Errorf("failed to get order [%d]: %w", oid, err))
+			return
+		}
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Order in status [%s] can't be cancelled", status)
+		return
+	}
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to cancel order [%d]: %w", oid, err))
+		return
+	}
+	rid, err := newRequestID()
+	if err == nil {
+		err = credit(uid, o.ChargedAmount, rid)
+	}
+	if err != nil {
+		log.Printf("Failed to refund order [%d] to user id [%d]: %s\n", oid, uid, err)
+		if err = setOrderStatus(oid, orderStatusPaid); err != nil {
+			log.Printf("Failed to return order [%d] to status [%s]: %s\n", oid, orderStatusPaid, err)
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if err = setOrderStatus(oid, orderStatusCancelled); err != nil {
+		// the money is already refunded, the order is left in cancelling
+		log.Printf("Failed to set order [%d] to status [%s]: %s\n", oid, orderStatusCancelled, err)
+	}
+	o.Status = orderStatusCancelled
+	locale := parseLocale(r.Header.Get("Accept-Language"))
+	params := map[string]string{"item": o.Item, "amount": strconv.Itoa(o.ChargedAmount)}
+	createNotif(uid, locale, "order_cancelled", params)
+	log.Printf("Successfully cancelled order [%d] for user id [%d]\n", oid, uid)
+	data, _ := json.Marshal(o)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// completeOrder marks the pending order paid with the charge made for it.
+func completeOrder(o *orderModel, ref string) error {
+	var res sql.Result
+	err := dbConn.Retry(func() (err error) {
+		res, err = setOrderPaymentStmt.Exec(o.ID, orderStatusPaid, o.Amount, ref, orderStatusPending)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return fmt.Errorf("order [%d] is not pending", o.ID)
+	}
+	o.Status, o.ChargedAmount, o.PaymentRef = orderStatusPaid, o.Amount, ref
+	return nil
+}
+
+// refundOrder is the compensation of a charged order that could not be
+// completed. The order is moved to refunding with the charge first, so if
+// the refund fails retryRefunds finds it and tries again.
+func refundOrder(oid, uid, amount int, ref string) {
+	err := dbConn.Retry(func() error {
+		_, err := setOrderPaymentStmt.Exec(oid, orderStatusRefunding, amount, ref, orderStatusPending)
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to set order [%d] to status [%s], refund of [%d] to user id [%d] is not made: %s\n", oid, orderStatusRefunding, amount, uid, err)
+		return
+	}
+	refund(oid)
+}
+
+// refund credits the charge of an order in refunding back to the user. The
+// order is claimed first by moving it to refunding_inflight, so only one
+// refund of it runs at a time, and the claim stores the request id of the
+// credit with the order, so every retry credits under the same request id
+// and account pays it once. A claim older than refundClaimTimeout is taken
+// over, the instance that made it is assumed gone.
+func refund(oid int) {
+	rid, err := newRequestID()
+	if err != nil {
+		log.Printf("Failed to generate request id to refund order [%d]: %s\n", oid, err)
+		return
+	}
+	o := orderModel{ID: oid}
+	err = dbConn.Retry(func() error {
+		return claimRefundStmt.QueryRow(oid, orderStatusRefundingInflight, rid, orderStatusRefunding, refundClaimTimeout.Seconds()).Scan(&o.UserID, &o.ChargedAmount, &rid)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		// refunded already or being refunded by another call
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to claim refund of order [%d]: %s\n", oid, err)
+		return
+	}
+	if err = credit(o.UserID, o.ChargedAmount, rid); err != nil {
+		log.Printf("Failed to refund order [%d] to user id [%d], will retry: %s\n", oid, o.UserID, err)
+		logOrderSaga(oid, stepRefund, err.Error())
+		if err = swapOrderStatus(oid, orderStatusRefunding, orderStatusRefundingInflight); err != nil {
+			log.Printf("Failed to return order [%d] to status [%s]: %s\n", oid, orderStatusRefunding, err)
+		}
+		return
+	}
+	logOrderSaga(oid, stepRefund, "")
+	if err = swapOrderStatus(oid, orderStatusFailed, orderStatusRefundingInflight); err != nil {
+		log.Printf("Failed to set order [%d] to status [%s]: %s\n", oid, orderStatusFailed, err)
+		return
+	}
+	log.Printf("Refunded order [%d] to user id [%d]\n", oid, o.UserID)
 }
 
-func isAuthenticatedMiddleware(h http.HandlerFunc) http.HandlerFunc {
+// retryRefunds refunds orders left in refunding every refundInterval.
+func retryRefunds(ctx context.Context) {
+	t := time.NewTicker(refundInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		ids, err := getRefunding()
+		if err != nil {
+			log.Printf("Failed to get orders waiting for a refund: %s\n", err)
+			continue
+		}
+		for _, oid := range ids {
+			refund(oid)
+		}
+	}
+}
+
+// getRefunding returns the orders waiting for a refund, with the ones whose
+// refund claim has timed out.
+func getRefunding() ([]int, error) {
+	ids := []int{}
+	err := dbConn.Retry(func() error {
+		ids = ids[:0]
+		rows, err := getRefundingStmt.Query(orderStatusRefunding, orderStatusRefundingInflight, refundClaimTimeout.Seconds(), refundBatch)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			oid := 0
+			if err = rows.Scan(&oid); err != nil {
+				return err
+			}
+			ids = append(ids, oid)
+		}
+		return rows.Err()
+	})
+	return ids, err
+}
+
+// logOrderSaga records the outcome of a step of the order. A failure to
+// record is only logged, the saga goes on without it.
+func logOrderSaga(oid int, step, errText string) {
+	err := dbConn.Retry(func() error {
+		_, err := orderSagaLogStmt.Exec(oid, step, errText)
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to write saga log of order [%d]: %s\n", oid, err)
+	}
+}
+
+func setOrderStatus(oid int, status string) error {
+	return dbConn.Retry(func() error {
+		_, err := setOrderStatusStmt.Exec(oid, status)
+		return err
+	})
+}
+
+// swapOrderStatus moves the order to status if it is in status from.
+func swapOrderStatus(oid int, status, from string) error {
+	return dbConn.Retry(func() error {
+		_, err := swapOrderStatusStmt.Exec(oid, status, from)
+		return err
+	})
+}
+
+// statusRecorder remembers the status code and the size of the response
+// written by the wrapped handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+func reqlog(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		headers := r.Header
-		fmt.Println(headers)
-		if _, ok := headers["X-User-Id"]; !ok {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("Not authenticated"))
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		log.Printf("method=%s path=%s status=%d bytes=%d duration=%s request_id=%q host=%s\n",
+			r.Method, r.URL.Path, rec.status, rec.bytes, time.Since(start), r.Header.Get("X-Request-Id"), r.Host)
+	}
+}
+
+// idempotent makes retries of h with the same Idempotency-Key header safe.
+// The first response for a (user, key) pair is stored and replayed for
+// repeated requests within idempotencyKeyTTL instead of running h again.
+// Server errors are not stored so that the request can be retried.
+func idempotent(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		uid, ok := web.MustUserID(w, r)
+		if !ok {
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			log.Printf("Failed to read request body user id [%d]: %s\n", uid, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+		hash := hex.EncodeToString(sum[:])
+
+		reserved := false
+		err = dbConn.Retry(func() error {
+			err := reserveIdempotencyKeyStmt.QueryRow(uid, key, hash, idempotencyKeyTTL.Seconds()).Scan(new(int))
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+			reserved = err == nil
+			return err
+		})
+		if err != nil {
+			web.InternalError(w, r, fmt.Errorf("failed to reserve idempotency key [%s] for user id [%d]: %w", key, uid, err))
+			return
+		}
+		if !reserved {
+			replayIdempotent(w, uid, key, hash)
 			return
 		}
-		h.ServeHTTP(w, r)
+
+		rec := &bodyRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		err = dbConn.Retry(func() error {
+			if rec.status >= http.StatusInternalServerError {
+				_, err := deleteIdempotencyKeyStmt.Exec(uid, key)
+				return err
+			}
+			_, err := saveIdempotencyKeyStmt.Exec(uid, key, rec.status, rec.body.String())
+			return err
+		})
+		if err != nil {
+			log.Printf("Failed to save response for idempotency key [%s] user id [%d]: %s\n", key, uid, err)
+		}
+	}
+}
+
+// replayIdempotent writes the stored response for the key. A request with a
+// different body or a request that is still being served gets a conflict.
+func replayIdempotent(w http.ResponseWriter, uid int, key, hash string) {
+	var storedHash, body string
+	status := 0
+	err := dbConn.Retry(func() error {
+		return getIdempotencyKeyStmt.QueryRow(uid, key).Scan(&storedHash, &status, &body)
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to get idempotency key [%s] for user id [%d]: %s\n", key, uid, err)
+		return
+	}
+	if storedHash != hash {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte("Idempotency-Key was already used with another request"))
+		return
+	}
+	if status == 0 {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("Request with this Idempotency-Key is in progress"))
+		return
+	}
+	log.Printf("Replaying response for idempotency key [%s] user id [%d]\n", key, uid)
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(status)
+	w.Write([]byte(body))
+}
+
+// bodyRecorder keeps a copy of the response so that idempotent can store it.
+type bodyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bodyRecorder) WriteHeader(code int) {
+	if b.status == 0 {
+		b.status = code
+	}
+	b.ResponseWriter.WriteHeader(code)
+}
+
+func (b *bodyRecorder) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
 	}
+	b.body.Write(p)
+	return b.ResponseWriter.Write(p)
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dlqRow is a row of the fake notif_dlq table.
+type dlqRow struct {
+	id       int64
+	uid      int64
+	payload  string
+	attempts int64
+}
+
+// notifDLQ fakes notif_dlq next to the fake orders table.
+type notifDLQ struct {
+	mu     sync.Mutex
+	orders *ordersDB
+	rows   []*dlqRow
+}
+
+func useNotifDLQ(t *testing.T) *notifDLQ {
+	q := &notifDLQ{orders: newOrdersDB(t)}
+	useFakeDB(t, q.handle)
+	return q
+}
+
+func (q *notifDLQ) handle(query string, args []driver.Value) fakeResult {
+	if !queryHas(query, "notif_dlq") {
+		return q.orders.handle(query, args)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	switch {
+	case queryHas(query, "INSERT INTO notif_dlq"):
+		q.rows = append(q.rows, &dlqRow{id: int64(len(q.rows) + 1), uid: args[0].(int64), payload: args[1].(string)})
+		return fakeResult{Affected: 1}
+	case queryHas(query, "FROM notif_dlq WHERE next_attempt_at <= now()"):
+		res := fakeResult{Cols: []string{"id", "user_id", "payload", "attempts", "created_at"}}
+		for _, r := range q.rows {
+			res.Rows = append(res.Rows, []driver.Value{r.id, r.uid, r.payload, r.attempts, time.Now()})
+		}
+		return res
+	case queryHas(query, "UPDATE notif_dlq SET attempts=$2"):
+		for _, r := range q.rows {
+			if r.id == args[0] {
+				r.attempts = args[1].(int64)
+			}
+		}
+		return fakeResult{Affected: 1}
+	case queryHas(query, "DELETE FROM notif_dlq WHERE id=$1"):
+		for i, r := range q.rows {
+			if r.id == args[0] {
+				q.rows = append(q.rows[:i], q.rows[i+1:]...)
+				break
+			}
+		}
+		return fakeResult{Affected: 1}
+	}
+	return fakeResult{}
+}
+
+func TestOrderSucceedsWhenNotifIsDown(t *testing.T) {
+	q := useNotifDLQ(t)
+	d := useStubServices(t, map[string]stubResponse{
+		"/account/genreq":     {http.StatusOK, ""},
+		"/account/withdrawal": {http.StatusOK, ""},
+		"/notif/create":       {http.StatusServiceUnavailable, ""},
+	})
+	w := callOrders(create, http.MethodPost, "/orders/create", `{"item":"Concert","amount":3000}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("create answered %d with notif down, want 200", w.Code)
+	}
+	if s := q.orders.status(11); s != orderStatusPaid {
+		t.Errorf("order is %s, want %s", s, orderStatusPaid)
+	}
+	if len(q.rows) != 1 || q.rows[0].uid != 5 {
+		t.Fatalf("notif_dlq holds %+v, want one row for user 5", q.rows)
+	}
+	n := notifModel{}
+	if err := json.Unmarshal([]byte(q.rows[0].payload), &n); err != nil {
+		t.Fatal(err)
+	}
+	if n.UserID != 5 || n.Type != "order_created" || n.Params["item"] != "Concert" {
+		t.Errorf("queued %s, want the order_created notification", q.rows[0].payload)
+	}
+
+	retryDueNotifs()
+	if len(q.rows) != 1 || q.rows[0].attempts != 1 {
+		t.Fatalf("notif_dlq holds %+v after a failed retry, want one row with 1 attempt", q.rows)
+	}
+	d.route("/notif/create", stubResponse{status: http.StatusOK})
+	retryDueNotifs()
+	if len(q.rows) != 0 {
+		t.Errorf("notif_dlq holds %+v after notif came back, want it empty", q.rows)
+	}
+	if sent := d.sent("/notif/create"); len(sent) != 3 || string(sent[2].body) != string(sent[0].body) {
+		t.Errorf("notif got %d requests, want the same notification 3 times", len(sent))
+	}
+}
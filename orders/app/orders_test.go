@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// ordersDB fakes the orders table for creating, paying, listing and counting
+// orders.
+type ordersDB struct {
+	mu     sync.Mutex
+	orders []*orderModel
+}
+
+func newOrdersDB(t *testing.T) *ordersDB {
+	db := &ordersDB{}
+	useFakeDB(t, db.handle)
+	return db
+}
+
+func (db *ordersDB) handle(query string, args []driver.Value) fakeResult {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	switch {
+	case queryHas(query, "INSERT INTO orders (userid, item, amount, status, charged_amount, payment_ref) VALUES"):
+		o := &orderModel{
+			ID:            len(db.orders) + 11,
+			UserID:        int(args[0].(int64)),
+			Item:          args[1].(string),
+			Amount:        int(args[2].(int64)),
+			Status:        args[3].(string),
+			ChargedAmount: int(args[4].(int64)),
+			PaymentRef:    args[5].(string),
+		}
+		db.orders = append(db.orders, o)
+		return fakeResult{Cols: []string{"id"}, Rows: [][]driver.Value{{int64(o.ID)}}}
+	case queryHas(query, "UPDATE orders SET status=$2, charged_amount=$3, payment_ref=$4"):
+		if o := db.find(args[0]); o != nil && o.Status == args[4] {
+			o.Status, o.ChargedAmount, o.PaymentRef = args[1].(string), int(args[2].(int64)), args[3].(string)
+			return fakeResult{Affected: 1}
+		}
+		return fakeResult{}
+	case queryHas(query, "FROM orders WHERE userid=$1 ORDER BY id"):
+		res := fakeResult{Cols: []string{"id", "userid", "item", "amount", "status", "charged_amount", "payment_ref", "book_id"}}
+		for _, o := range db.orders {
+			if int64(o.UserID) == args[0] {
+				res.Rows = append(res.Rows, []driver.Value{int64(o.ID), int64(o.UserID), o.Item, int64(o.Amount), o.Status, int64(o.ChargedAmount), o.PaymentRef, int64(o.BookID)})
+			}
+		}
+		return res
+	case queryHas(query, "SELECT COUNT(1) FROM orders WHERE userid=$1"):
+		n := int64(0)
+		for _, o := range db.orders {
+			if int64(o.UserID) == args[0] {
+				n++
+			}
+		}
+		return fakeResult{Cols: []string{"count"}, Rows: [][]driver.Value{{n}}}
+	case queryHas(query, "UPDATE orders SET status=$3 WHERE id=$1 AND userid=$2 AND status=$4 AND book_id IS NULL"):
+		o := db.find(args[0])
+		if o == nil || int64(o.UserID) != args[1] || o.Status != args[3] || o.BookID != 0 {
+			return fakeResult{Cols: []string{"item", "charged_amount", "payment_ref"}}
+		}
+		o.Status = args[2].(string)
+		return fakeResult{Cols: []string{"item", "charged_amount", "payment_ref"}, Rows: [][]driver.Value{{o.Item, int64(o.ChargedAmount), o.PaymentRef}}}
+	case queryHas(query, "UPDATE orders SET status=$2 WHERE id=$1") && !strings.Contains(query, "AND status"):
+		if o := db.find(args[0]); o != nil {
+			o.Status = args[1].(string)
+			return fakeResult{Affected: 1}
+		}
+		return fakeResult{}
+	case queryHas(query, "SELECT status FROM orders WHERE id=$1 AND userid=$2"):
+		res := fakeResult{Cols: []string{"status"}}
+		if o := db.find(args[0]); o != nil && int64(o.UserID) == args[1] {
+			res.Rows = [][]driver.Value{{o.Status}}
+		}
+		return res
+	}
+	return fakeResult{Affected: 1}
+}
+
+// status returns the status of the order id.
+func (db *ordersDB) status(id int) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if o := db.find(int64(id)); o != nil {
+		return o.Status
+	}
+	return ""
+}
+
+func (db *ordersDB) find(id driver.Value) *orderModel {
+	for _, o := range db.orders {
+		if int64(o.ID) == id {
+			return o
+		}
+	}
+	return nil
+}
+
+// callOrders sends body to h as user 5.
+func callOrders(h http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("X-User-Id", "5")
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestCreateRecordsChargedAmountAndPaymentRef(t *testing.T) {
+	db := newOrdersDB(t)
+	d := useStubServices(t, map[string]stubResponse{
+		"/account/genreq":     {http.StatusOK, ""},
+		"/account/withdrawal": {http.StatusOK, ""},
+		"/notif/create":       {http.StatusOK, ""},
+	})
+	w := callOrders(create, http.MethodPost, "/orders/create", `{"item":"Concert","amount":3000}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("create answered %d", w.Code)
+	}
+	created := orderModel{}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	ref := d.sent("/account/withdrawal")[0].header.Get("X-Request-Id")
+	if created.Status != orderStatusPaid || created.ChargedAmount != 3000 || created.PaymentRef == "" || created.PaymentRef != ref {
+		t.Fatalf("create answered %s, want paid with 3000 charged under %q", w.Body.String(), ref)
+	}
+	if o := db.orders[0]; o.Status != orderStatusPaid || o.ChargedAmount != 3000 || o.PaymentRef != ref {
+		t.Errorf("stored %+v", *o)
+	}
+
+	w = callOrders(get, http.MethodGet, "/orders/get", "")
+	listed := []orderModel{}
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0] != created {
+		t.Errorf("listed %s, want the created order", w.Body.String())
+	}
+}
+
+func TestCreateWithoutFundsChargesNothing(t *testing.T) {
+	db := newOrdersDB(t)
+	useStubServices(t, map[string]stubResponse{
+		"/account/genreq":     {http.StatusOK, ""},
+		"/account/withdrawal": {http.StatusInternalServerError, ""},
+		"/notif/create":       {http.StatusOK, ""},
+	})
+	if w := callOrders(create, http.MethodPost, "/orders/create", `{"item":"Concert","amount":3000}`); w.Code != http.StatusPaymentRequired {
+		t.Fatalf("create answered %d, want 402", w.Code)
+	}
+	if o := db.orders[0]; o.ChargedAmount != 0 || o.PaymentRef != "" {
+		t.Errorf("stored %+v, want nothing charged", *o)
+	}
+}
+
+func TestCreateRejectsMalformedBody(t *testing.T) {
+	db := newOrdersDB(t)
+	d := useStubServices(t, map[string]stubResponse{})
+	if w := callOrders(create, http.MethodPost, "/orders/create", `{"item":`); w.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if len(db.orders) != 0 || len(d.sent("/account/withdrawal")) != 0 {
+		t.Error("malformed order was charged or stored")
+	}
+}
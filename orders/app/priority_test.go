@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// TestFailedOrderNotifiesWithHighPriority checks order_failed goes to notif
+// with high priority while order_created keeps the normal one.
+func TestFailedOrderNotifiesWithHighPriority(t *testing.T) {
+	tests := []struct {
+		name       string
+		withdrawal int
+		typ        string
+		priority   string
+	}{
+		{"paid", http.StatusOK, "order_created", ""},
+		{"no funds", http.StatusInternalServerError, "order_failed", "high"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newOrdersDB(t)
+			d := useStubServices(t, map[string]stubResponse{
+				"/account/genreq":     {http.StatusOK, ""},
+				"/account/withdrawal": {tt.withdrawal, ""},
+				"/notif/create":       {http.StatusOK, ""},
+			})
+			callOrders(create, http.MethodPost, "/orders/create", `{"item":"Concert","amount":3000}`)
+			notifs := d.sent("/notif/create")
+			if len(notifs) != 1 {
+				t.Fatalf("sent %d notifications, want 1", len(notifs))
+			}
+			n := notifModel{}
+			if err := json.Unmarshal(notifs[0].body, &n); err != nil {
+				t.Fatal(err)
+			}
+			if n.Type != tt.typ || n.Priority != tt.priority {
+				t.Errorf("sent %s with priority %q, want %s with %q", n.Type, n.Priority, tt.typ, tt.priority)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// refundDB fakes the orders table holding one order and its saga log.
+type refundDB struct {
+	mu        sync.Mutex
+	status    string
+	userID    int64
+	charged   int64
+	refundRef string
+	failPaid  bool
+	saga      []string
+}
+
+func (db *refundDB) handle(query string, args []driver.Value) fakeResult {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	switch {
+	case queryHas(query, "INSERT INTO orders"):
+		db.status, db.userID = args[3].(string), args[0].(int64)
+		return fakeResult{Cols: []string{"id"}, Rows: [][]driver.Value{{int64(11)}}}
+	case queryHas(query, "UPDATE orders SET status=$2, charged_amount=$3"):
+		if db.status != args[4] {
+			return fakeResult{}
+		}
+		if db.failPaid && args[1] == orderStatusPaid {
+			return fakeResult{Err: errors.New("disk full")}
+		}
+		db.status, db.charged = args[1].(string), args[2].(int64)
+		return fakeResult{Affected: 1}
+	case queryHas(query, "refund_ref=COALESCE"):
+		if db.status != args[3] {
+			return fakeResult{Cols: []string{"userid", "charged_amount", "refund_ref"}}
+		}
+		db.status = args[1].(string)
+		if db.refundRef == "" {
+			db.refundRef = args[2].(string)
+		}
+		return fakeResult{Cols: []string{"userid", "charged_amount", "refund_ref"}, Rows: [][]driver.Value{{db.userID, db.charged, db.refundRef}}}
+	case queryHas(query, "UPDATE orders SET status=$2 WHERE id=$1 AND status=$3"):
+		if db.status != args[2] {
+			return fakeResult{}
+		}
+		db.status = args[1].(string)
+		return fakeResult{Affected: 1}
+	case queryHas(query, "INSERT INTO order_saga_log"):
+		db.saga = append(db.saga, args[1].(string)+":"+args[2].(string))
+		return fakeResult{Affected: 1}
+	}
+	return fakeResult{Affected: 1}
+}
+
+func (db *refundDB) state() string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.status
+}
+
+// requestIDs returns the X-Request-Id of each request.
+func requestIDs(reqs []stubRequest) []string {
+	ids := make([]string, 0, len(reqs))
+	for _, r := range reqs {
+		ids = append(ids, r.header.Get("X-Request-Id"))
+	}
+	return ids
+}
+
+// TestRefundRetryReusesRequestID checks a refund account did not take is
+// retried under the request id of the first attempt, so account can't pay
+// it twice, and that a finished refund is not sent again.
+func TestRefundRetryReusesRequestID(t *testing.T) {
+	db := &refundDB{status: orderStatusRefunding, userID: 5, charged: 3000}
+	useFakeDB(t, db.handle)
+	d := useStubServices(t, map[string]stubResponse{
+		"/account/genreq":  {http.StatusOK, ""},
+		"/account/deposit": {http.StatusServiceUnavailable, ""},
+	})
+
+	refund(11)
+	if s := db.state(); s != orderStatusRefunding {
+		t.Fatalf("order is %s after a failed refund, want %s", s, orderStatusRefunding)
+	}
+	d.route("/account/deposit", stubResponse{status: http.StatusOK})
+	refund(11)
+	if s := db.state(); s != orderStatusFailed {
+		t.Fatalf("order is %s after the refund, want %s", s, orderStatusFailed)
+	}
+	refund(11)
+
+	deposits := d.sent("/account/deposit")
+	if len(deposits) != 2 {
+		t.Fatalf("sent %d deposits, want 2", len(deposits))
+	}
+	ids := requestIDs(deposits)
+	if ids[0] == "" || ids[0] != ids[1] || ids[0] != db.refundRef {
+		t.Errorf("deposit request ids %v, want both %q", ids, db.refundRef)
+	}
+	if got := string(deposits[1].body); got != `{"delta":3000}` {
+		t.Errorf("deposit body %s", got)
+	}
+}
+
+// TestConcurrentRefundsCreditOnce plays retryRefunds of several instances
+// picking up the same order at once.
+func TestConcurrentRefundsCreditOnce(t *testing.T) {
+	db := &refundDB{status: orderStatusRefunding, userID: 5, charged: 3000}
+	useFakeDB(t, db.handle)
+	d := useStubServices(t, map[string]stubResponse{
+		"/account/genreq":  {http.StatusOK, ""},
+		"/account/deposit": {http.StatusOK, ""},
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			refund(11)
+		}()
+	}
+	wg.Wait()
+	if n := len(d.sent("/account/deposit")); n != 1 {
+		t.Fatalf("sent %d deposits, want 1", n)
+	}
+	if s := db.state(); s != orderStatusFailed {
+		t.Fatalf("order is %s, want %s", s, orderStatusFailed)
+	}
+}
+
+// TestCreateRefundsWhenOrderCantComplete runs create against stubbed
+// account and notif: the user is charged, the order can't be marked paid,
+// so the charge is credited back and the user told.
+func TestCreateRefundsWhenOrderCantComplete(t *testing.T) {
+	db := &refundDB{failPaid: true}
+	useFakeDB(t, db.handle)
+	d := useStubServices(t, map[string]stubResponse{
+		"/account/genreq":     {http.StatusOK, ""},
+		"/account/withdrawal": {http.StatusOK, ""},
+		"/account/deposit":    {http.StatusOK, ""},
+		"/notif/create":       {http.StatusOK, ""},
+	})
+	r := httptest.NewRequest(http.MethodPost, "/orders/create", strings.NewReader(`{"item":"Concert","amount":3000}`))
+	r.Header.Set("X-User-Id", "5")
+	w := httptest.NewRecorder()
+	create(w, r)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("answered %d, want 500", w.Code)
+	}
+	if s := db.state(); s != orderStatusFailed {
+		t.Fatalf("order is %s, want %s", s, orderStatusFailed)
+	}
+	withdrawals, deposits := d.sent("/account/withdrawal"), d.sent("/account/deposit")
+	if len(withdrawals) != 1 || len(deposits) != 1 {
+		t.Fatalf("sent %d withdrawals and %d deposits, want 1 and 1", len(withdrawals), len(deposits))
+	}
+	if requestIDs(deposits)[0] == requestIDs(withdrawals)[0] {
+		t.Error("refund reused the request id of the charge")
+	}
+	notifs := d.sent("/notif/create")
+	if len(notifs) != 1 || !strings.Contains(string(notifs[0].body), `"order_failed"`) {
+		t.Fatalf("notifications %v, want one order_failed", notifs)
+	}
+	if want := []string{stepCreate + ":", stepDebit + ":", stepComplete + ":disk full", stepRefund + ":"}; strings.Join(db.saga, ",") != strings.Join(want, ",") {
+		t.Errorf("saga log %v, want %v", db.saga, want)
+	}
+}
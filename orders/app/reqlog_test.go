@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"testing"
+)
+
+func TestReqlogLogsRequestFields(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	h := reqlog(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	})
+	r := httptest.NewRequest(http.MethodPost, "http://orders.local/orders/create", nil)
+	r.Header.Set("X-Request-Id", "r-42")
+	h(httptest.NewRecorder(), r)
+
+	line := regexp.MustCompile(`method=POST path=/orders/create status=418 bytes=15 duration=\S+ request_id="r-42" host=orders.local`)
+	if !line.Match(buf.Bytes()) {
+		t.Fatalf("logged %q", buf.String())
+	}
+}
+
+func TestReqlogDefaultsToOK(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	reqlog(func(http.ResponseWriter, *http.Request) {})(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/orders/get", nil))
+	if !regexp.MustCompile(`method=GET path=/orders/get status=200 bytes=0 `).Match(buf.Bytes()) {
+		t.Fatalf("logged %q", buf.String())
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// TestTotalMatchesListedOrders lists the orders of user 5 with count=true
+// and checks the total counts only theirs, while a list without it stays a
+// bare array.
+func TestTotalMatchesListedOrders(t *testing.T) {
+	db := newOrdersDB(t)
+	db.orders = []*orderModel{
+		{ID: 11, UserID: 5, Item: "Concert", Amount: 3000, Status: orderStatusPaid},
+		{ID: 12, UserID: 6, Item: "Lecture", Amount: 500, Status: orderStatusPaid},
+		{ID: 13, UserID: 5, Item: "Book", Amount: 700, Status: orderStatusPaid},
+	}
+
+	w := callOrders(get, http.MethodGet, "/orders/get?count=true", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("list answered %d %s", w.Code, w.Body.String())
+	}
+	page := struct {
+		Items []orderModel `json:"items"`
+		Total int          `json:"total"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatalf("list answered %s: %s", w.Body.String(), err)
+	}
+	if page.Total != 2 || len(page.Items) != page.Total {
+		t.Errorf("listed %s, want the 2 orders of user 5 counted", w.Body.String())
+	}
+
+	w = callOrders(get, http.MethodGet, "/orders/get", "")
+	listed := []orderModel{}
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil || len(listed) != 2 {
+		t.Errorf("list without count answered %s, want a bare array of 2", w.Body.String())
+	}
+	if w := callOrders(get, http.MethodGet, "/orders/get?count=maybe", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("count=maybe answered %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,22 @@
+// Package config reads the settings of a service from its environment.
+package config
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+// Getenv returns the value of the environment variable key. When key_FILE is
+// set the value is read from that file instead, so secrets mounted by Docker
+// or Kubernetes don't have to be put in the environment.
+func Getenv(key string) string {
+	if path := os.Getenv(key + "_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Failed to read %s_FILE: %s\n", key, err)
+		}
+		return strings.TrimRight(string(data), "\r\n")
+	}
+	return os.Getenv(key)
+}
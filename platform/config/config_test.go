@@ -0,0 +1,25 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecretFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dbpass")
+	if err := os.WriteFile(path, []byte("from-file\r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DBPASS", "inline")
+	if got := Getenv("DBPASS"); got != "inline" {
+		t.Fatalf("password %q, want the inline one", got)
+	}
+	t.Setenv("DBPASS_FILE", path)
+	if got := Getenv("DBPASS"); got != "from-file" {
+		t.Errorf("password %q, want the file's one", got)
+	}
+	if got := Getenv("DBUSER"); got != "" {
+		t.Errorf("unset variable is %q, want empty", got)
+	}
+}
@@ -0,0 +1,160 @@
+// Package database keeps the connection of a service to Postgres alive: it
+// waits for a database that starts after the service and reopens a lost
+// connection before the query that noticed it runs again.
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	reconnectDelay   = 100 * time.Millisecond
+	reconnectTimeout = 30 * time.Second
+)
+
+// waitMaxDelay caps the backoff of Wait.
+const waitMaxDelay = 5 * time.Second
+
+// Conn is the connection of a service to its database. Open and Prepare must
+// be set before the connection can be reopened.
+type Conn struct {
+	// Open opens a new connection to the database.
+	Open func() (*sql.DB, error)
+	// Prepare prepares the statements of the service on db and panics if it
+	// can't.
+	Prepare func(ctx context.Context, db *sql.DB)
+
+	mu sync.RWMutex
+	db *sql.DB
+}
+
+// Set makes db the connection, the statements must already be prepared on it.
+func (c *Conn) Set(db *sql.DB) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.db = db
+}
+
+// DB returns the current connection. It may only be called inside Retry,
+// anywhere else the connection can be swapped under the caller.
+func (c *Conn) DB() *sql.DB {
+	return c.db
+}
+
+// Retry runs f, which must do all of its database work inside. If f failed
+// because the connection to the database was lost, the connection is
+// reopened and f is run one more time.
+func (c *Conn) Retry(f func() error) error {
+	c.mu.RLock()
+	err := f()
+	c.mu.RUnlock()
+	if !IsConnError(err) {
+		return err
+	}
+	log.Println("Lost connection to database, reconnecting:", err)
+	if rerr := c.Reconnect(); rerr != nil {
+		log.Println("Failed to reconnect to database:", rerr)
+		return err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return f()
+}
+
+// Reconnect reopens the database with backoff and prepares the statements
+// again on the new connection.
+func (c *Conn) Reconnect() (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), reconnectTimeout)
+	defer cancel()
+	if c.db != nil && c.db.PingContext(ctx) == nil {
+		// someone else has already reconnected
+		return nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("failed to prepare statements: %v", r)
+		}
+	}()
+
+	delay := reconnectDelay
+	for {
+		var db *sql.DB
+		if db, err = c.Open(); err == nil {
+			if err = db.PingContext(ctx); err == nil {
+				c.Prepare(ctx, db)
+				if c.db != nil {
+					c.db.Close()
+				}
+				c.db = db
+				log.Println("Reconnected to database")
+				return nil
+			}
+			db.Close()
+		}
+		log.Printf("Failed to reconnect to database, retry in %s: %s\n", delay, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// IsConnError reports whether err means the connection to the database is
+// broken rather than the query itself being wrong.
+func IsConnError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) {
+		return true
+	}
+	if msg := err.Error(); msg == "sql: database is closed" || msg == "sql: statement is closed" {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// 08 - connection exception, 57 - operator intervention (e.g. shutdown)
+		class := pqErr.Code.Class()
+		return class == "08" || class == "57"
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// Wait pings the database with backoff until it answers or timeout passes,
+// so the service survives a database that starts after it.
+func Wait(ctx context.Context, db *sql.DB, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	delay := reconnectDelay
+	for attempt := 1; ; attempt++ {
+		err := db.PingContext(ctx)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Database is not ready, attempt %d, retry in %s: %s\n", attempt, delay, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > waitMaxDelay {
+			delay = waitMaxDelay
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/lib/pq"
+
+	"platform/fakedb"
+)
+
+// TestRetryReconnectsAfterConnectionLoss closes the database under a running
+// service and checks the next call reopens it, prepares the statements again
+// and succeeds.
+func TestRetryReconnectsAfterConnectionLoss(t *testing.T) {
+	ran := 0
+	h := func(query string, args []driver.Value) fakedb.Result {
+		ran++
+		return fakedb.Result{Cols: []string{"balance"}, Rows: [][]driver.Value{{int64(700)}}}
+	}
+	prepared := 0
+	c := &Conn{
+		Open:    func() (*sql.DB, error) { return fakedb.Open(t, h), nil },
+		Prepare: func(context.Context, *sql.DB) { prepared++ },
+	}
+	lost := fakedb.Open(t, h)
+	c.Set(lost)
+	lost.Close()
+
+	var balance int
+	err := c.Retry(func() error {
+		return c.DB().QueryRow("SELECT balance").Scan(&balance)
+	})
+	if err != nil || balance != 700 {
+		t.Fatalf("answered %d, %v after the connection was lost, want the balance", balance, err)
+	}
+	if c.DB() == lost {
+		t.Fatal("database was not reopened")
+	}
+	if prepared != 1 || ran != 1 {
+		t.Errorf("prepared %d times and queried %d times, want once each on the new connection", prepared, ran)
+	}
+}
+
+// TestRetryKeepsQueryErrors checks an error of the query itself is returned
+// as is, without reconnecting or running the query again.
+func TestRetryKeepsQueryErrors(t *testing.T) {
+	c := &Conn{Open: func() (*sql.DB, error) {
+		t.Fatal("reconnected on a query error")
+		return nil, nil
+	}}
+	ran := 0
+	want := errors.New("syntax error")
+	if err := c.Retry(func() error { ran++; return want }); err != want {
+		t.Errorf("returned %v, want %v", err, want)
+	}
+	if ran != 1 {
+		t.Errorf("ran the query %d times, want once", ran)
+	}
+}
+
+func TestIsConnError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{driver.ErrBadConn, true},
+		{fmt.Errorf("query: %w", sql.ErrConnDone), true},
+		{errors.New("sql: database is closed"), true},
+		{&pq.Error{Code: "08006"}, true},
+		{&pq.Error{Code: "57P01"}, true},
+		{&pq.Error{Code: "23505"}, false},
+		{sql.ErrNoRows, false},
+	}
+	for _, tt := range tests {
+		if got := IsConnError(tt.err); got != tt.want {
+			t.Errorf("IsConnError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
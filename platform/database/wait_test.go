@@ -0,0 +1,90 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowDB is a database that refuses connections until it has been dialed
+// up times, as Postgres does while it starts.
+type slowDB struct {
+	mu    sync.Mutex
+	dials int
+	up    int
+}
+
+func (d *slowDB) Connect(context.Context) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.dials++; d.dials < d.up {
+		return nil, errors.New("connection refused")
+	}
+	return slowConn{}, nil
+}
+
+func (d *slowDB) Driver() driver.Driver { return nil }
+
+func (d *slowDB) attempts() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dials
+}
+
+type slowConn struct{}
+
+func (slowConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (slowConn) Close() error                        { return nil }
+func (slowConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+// TestWaitRetriesUntilReachable starts against a database that answers
+// on the third dial and checks the wait succeeds, logging each failed attempt.
+func TestWaitRetriesUntilReachable(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	d := &slowDB{up: 3}
+	db := sql.OpenDB(d)
+	t.Cleanup(func() { db.Close() })
+	if err := Wait(context.Background(), db, 10*time.Second); err != nil {
+		t.Fatalf("waiting for the database failed: %s", err)
+	}
+	if n := d.attempts(); n != 3 {
+		t.Errorf("dialed the database %d times, want 3", n)
+	}
+	for _, attempt := range []string{"attempt 1,", "attempt 2,"} {
+		if !strings.Contains(buf.String(), attempt) {
+			t.Errorf("log %q does not mention %s", buf.String(), attempt)
+		}
+	}
+	if strings.Contains(buf.String(), "attempt 3") {
+		t.Errorf("log %q reports the successful attempt as failed", buf.String())
+	}
+}
+
+// TestWaitGivesUp checks the wait returns an error once the timeout
+// passes on a database that never answers.
+func TestWaitGivesUp(t *testing.T) {
+	d := &slowDB{up: math.MaxInt}
+	db := sql.OpenDB(d)
+	t.Cleanup(func() { db.Close() })
+	start := time.Now()
+	if err := Wait(context.Background(), db, 250*time.Millisecond); err == nil {
+		t.Fatal("waiting for an unreachable database succeeded")
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("gave up after %s, want about the timeout", took)
+	}
+	if n := d.attempts(); n < 2 {
+		t.Errorf("dialed the database %d times before giving up, want retries", n)
+	}
+}
@@ -0,0 +1,120 @@
+// Package fakedb is a database/sql driver for tests. It answers every
+// statement with a handler the test sets, so a service can be tested with
+// its real statements and without Postgres.
+package fakedb
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Result is what the fake database answers to one statement.
+type Result struct {
+	Cols     []string
+	Rows     [][]driver.Value
+	Affected int64
+	Err      error
+}
+
+// Handler answers a statement by its query text and arguments.
+type Handler func(query string, args []driver.Value) Result
+
+var (
+	mu      sync.Mutex
+	current Handler
+	regOnce sync.Once
+)
+
+// Open opens a fake database that answers every statement with h until the
+// next Open. It is closed when t ends.
+func Open(t testing.TB, h Handler) *sql.DB {
+	t.Helper()
+	regOnce.Do(func() { sql.Register("fakedb", fakeDriver{}) })
+	mu.Lock()
+	current = h
+	mu.Unlock()
+	db, err := sql.Open("fakedb", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// QueryHas reports whether query contains every part.
+func QueryHas(query string, parts ...string) bool {
+	for _, p := range parts {
+		if !strings.Contains(query, p) {
+			return false
+		}
+	}
+	return true
+}
+
+func handle(query string, args []driver.Value) Result {
+	mu.Lock()
+	h := current
+	mu.Unlock()
+	if h == nil {
+		return Result{Err: fmt.Errorf("unexpected query %q", query)}
+	}
+	return h(query, args)
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(string) (driver.Conn, error) { return fakeConn{}, nil }
+
+type fakeConn struct{}
+
+func (fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{query}, nil }
+func (fakeConn) Close() error                              { return nil }
+func (fakeConn) Begin() (driver.Tx, error)                 { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct{ query string }
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	res := handle(s.query, args)
+	if res.Err != nil {
+		return nil, res.Err
+	}
+	return driver.RowsAffected(res.Affected), nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	res := handle(s.query, args)
+	if res.Err != nil {
+		return nil, res.Err
+	}
+	return &fakeRows{cols: res.Cols, rows: res.Rows}, nil
+}
+
+type fakeRows struct {
+	cols []string
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
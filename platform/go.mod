@@ -0,0 +1,8 @@
+module platform
+
+go 1.21.1
+
+require (
+	github.com/gorilla/mux v1.8.1
+	github.com/lib/pq v1.10.9
+)
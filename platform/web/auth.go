@@ -0,0 +1,58 @@
+package web
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Authenticated lets the request through only if auth has put the user into
+// the X-User-Id header, anything else is answered with 401.
+func Authenticated(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Header["X-User-Id"]; !ok {
+			log.Println("Not authenticated")
+			Unauthenticated(w)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}
+}
+
+// RequireRole lets the request through only if auth has put the given role
+// into the X-User-Role header.
+func RequireRole(role string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-User-Role") != role {
+			log.Printf("User [%s] is not allowed to %s %s\n", r.Header.Get("X-User-Id"), r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Not allowed"))
+			return
+		}
+		h.ServeHTTP(w, r)
+	}
+}
+
+// UserID returns the id of the user from the X-User-Id header set by auth.
+func UserID(r *http.Request) (int, error) {
+	return strconv.Atoi(r.Header.Get("X-User-Id"))
+}
+
+// MustUserID is UserID for handlers. If the header is missing or malformed
+// it answers 401 and reports false.
+func MustUserID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := UserID(r)
+	if err != nil {
+		log.Printf("Got wrong header [X-User-Id]: %s\n", err)
+		Unauthenticated(w)
+		return 0, false
+	}
+	return id, true
+}
+
+// Unauthenticated answers 401 with a JSON error.
+func Unauthenticated(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write([]byte(`{"error":"unauthenticated"}`))
+}
@@ -0,0 +1,89 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUnauthenticatedGetsJSONError(t *testing.T) {
+	called := false
+	h := Authenticated(func(w http.ResponseWriter, r *http.Request) { called = true })
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusUnauthorized || called {
+		t.Fatalf("answered %d, called the handler %t, want 401 only", w.Code, called)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q, want application/json", ct)
+	}
+	body := map[string]string{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body %q is not JSON: %s", w.Body.String(), err)
+	}
+	if body["error"] != "unauthenticated" {
+		t.Errorf("body %s, want the unauthenticated error", w.Body.String())
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-User-Id", "5")
+	h(httptest.NewRecorder(), r)
+	if !called {
+		t.Error("authenticated request did not reach the handler")
+	}
+}
+
+func TestMustUserID(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []string
+		id     int
+		ok     bool
+	}{
+		{"valid", []string{"5"}, 5, true},
+		{"missing", nil, 0, false},
+		{"empty", []string{""}, 0, false},
+		{"not an integer", []string{"five"}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != nil {
+				r.Header["X-User-Id"] = tt.header
+			}
+			w := httptest.NewRecorder()
+			id, ok := MustUserID(w, r)
+			if id != tt.id || ok != tt.ok {
+				t.Fatalf("got %d %t, want %d %t", id, ok, tt.id, tt.ok)
+			}
+			if want := map[bool]int{true: http.StatusOK, false: http.StatusUnauthorized}[ok]; w.Code != want {
+				t.Errorf("answered %d, want %d", w.Code, want)
+			}
+		})
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	called := false
+	h := RequireRole("admin", func(w http.ResponseWriter, r *http.Request) { called = true })
+	for _, role := range []string{"", "user", "Admin"} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-User-Id", "5")
+		r.Header.Set("X-User-Role", role)
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != http.StatusForbidden || called {
+			t.Errorf("role %q answered %d, called the handler %t, want 403 only", role, w.Code, called)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-User-Id", "1")
+	r.Header.Set("X-User-Role", "admin")
+	h(httptest.NewRecorder(), r)
+	if !called {
+		t.Error("admin request did not reach the handler")
+	}
+}
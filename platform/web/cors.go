@@ -0,0 +1,54 @@
+package web
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	corsAllowMethods = "GET, POST, PUT, PATCH, DELETE"
+	corsAllowHeaders = "Authorization, Content-Type, Accept-Language, Idempotency-Key, X-Request-Id"
+	corsMaxAge       = "600"
+)
+
+// CORS applies the service's origin policy. A request without an Origin
+// header doesn't come from a browser and passes as is. A browser request from
+// an origin missing in allowed is rejected with 403, so unless ALLOWED_ORIGINS
+// is set the service can't be called from a browser at all. Preflights of
+// allowed origins are answered here.
+func CORS(allowed map[string]bool, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		if !allowed[origin] && !allowed["*"] {
+			log.Printf("Rejected browser request from origin [%s] to [%s]\n", origin, r.URL.Path)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// ParseOrigins parses a comma separated list of origins, "*" allows any.
+func ParseOrigins(s string) map[string]bool {
+	origins := map[string]bool{}
+	for _, o := range strings.Split(s, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			origins[o] = true
+		}
+	}
+	return origins
+}
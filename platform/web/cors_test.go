@@ -0,0 +1,71 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// preflight sends a browser preflight from origin through CORS with the
+// allowed origins around h.
+func preflight(allowed string, h http.Handler, origin string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodOptions, "/account/balance", nil)
+	r.Header.Set("Origin", origin)
+	r.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	w := httptest.NewRecorder()
+	CORS(ParseOrigins(allowed), h).ServeHTTP(w, r)
+	return w
+}
+
+// TestBrowsersAreDeniedByDefault checks a service with ALLOWED_ORIGINS unset,
+// as the charts leave it, rejects a browser while service calls pass.
+func TestBrowsersAreDeniedByDefault(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	w := preflight("", h, "https://app.example.com")
+	if w.Code != http.StatusForbidden || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("preflight answered %d with %v, want 403 without CORS headers", w.Code, w.Header())
+	}
+	r := httptest.NewRequest(http.MethodGet, "/account/balance", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	w = httptest.NewRecorder()
+	CORS(ParseOrigins(""), h).ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("browser request answered %d, want 403", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	CORS(ParseOrigins(""), h).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/account/balance", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("request without an Origin answered %d, want 200", w.Code)
+	}
+}
+
+// TestConfiguredOriginIsAllowed checks the preflight of an origin in
+// ALLOWED_ORIGINS is answered and any other origin is rejected.
+func TestConfiguredOriginIsAllowed(t *testing.T) {
+	allowed := "https://app.example.com, https://admin.example.com"
+	called := false
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	w := preflight(allowed, h, "https://app.example.com")
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Errorf("preflight answered %d with %v, want 204 allowing the origin", w.Code, w.Header())
+	}
+	if w.Header().Get("Access-Control-Allow-Methods") == "" || w.Header().Get("Vary") != "Origin" {
+		t.Errorf("preflight answered headers %v", w.Header())
+	}
+	if called {
+		t.Error("preflight reached the handler")
+	}
+	if w := preflight(allowed, h, "https://evil.example.com"); w.Code != http.StatusForbidden {
+		t.Errorf("preflight of another origin answered %d, want 403", w.Code)
+	}
+	if w := preflight("*", h, "https://evil.example.com"); w.Code != http.StatusNoContent {
+		t.Errorf("preflight with any origin allowed answered %d, want 204", w.Code)
+	}
+}
@@ -0,0 +1,49 @@
+package web
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// MethodNotAllowed answers 405 for a known path requested with a wrong
+// method. The Allow header lists the methods the path does support.
+func MethodNotAllowed(router *mux.Router) http.Handler {
+	methods := []string{
+		http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions,
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed := []string{}
+		for _, m := range methods {
+			req := r.Clone(r.Context())
+			req.Method = m
+			match := mux.RouteMatch{}
+			if router.Match(req, &match) && match.MatchErr == nil {
+				allowed = append(allowed, m)
+			}
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(`{"error":"method_not_allowed"}`))
+	})
+}
+
+// NotFound answers 404 for a path no route matches.
+func NotFound(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte(`{"error":"not_found"}`))
+}
+
+// InternalError logs err with the request id and answers 500 with a generic
+// body, so details like SQL or addresses never reach the client.
+func InternalError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("Internal error request_id=%q: %s\n", r.Header.Get("X-Request-Id"), err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte(`{"error":"internal error"}`))
+}
@@ -0,0 +1,67 @@
+package web
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// router serves GET and PUT on /items and 404s and 405s as the services do.
+func router() *mux.Router {
+	r := mux.NewRouter()
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	r.HandleFunc("/items", ok).Methods("GET", "PUT")
+	r.MethodNotAllowedHandler = MethodNotAllowed(r)
+	r.NotFoundHandler = http.HandlerFunc(NotFound)
+	return r
+}
+
+func TestUnknownPathAndWrongMethodAnswerJSON(t *testing.T) {
+	w := httptest.NewRecorder()
+	router().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/nowhere", nil))
+	if w.Code != http.StatusNotFound || w.Body.String() != `{"error":"not_found"}` {
+		t.Errorf("unknown path answered %d %s, want 404 not_found", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("unknown path answered Content-Type %q", ct)
+	}
+
+	w = httptest.NewRecorder()
+	router().ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/items", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Body.String() != `{"error":"method_not_allowed"}` {
+		t.Errorf("DELETE /items answered %d %s, want 405 method_not_allowed", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("wrong method answered Content-Type %q", ct)
+	}
+	if got := w.Header().Get("Allow"); got != "GET, PUT" {
+		t.Errorf("wrong method got Allow %q, want %q", got, "GET, PUT")
+	}
+}
+
+func TestInternalErrorHidesDetails(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	r := httptest.NewRequest(http.MethodGet, "/items", nil)
+	r.Header.Set("X-Request-Id", "req-1")
+	w := httptest.NewRecorder()
+	InternalError(w, r, errors.New(`pq: relation "items" does not exist`))
+	if w.Code != http.StatusInternalServerError || w.Body.String() != `{"error":"internal error"}` {
+		t.Errorf("answered %d %s, want 500 with a generic JSON error", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("answered Content-Type %q, want application/json", ct)
+	}
+	if logged := buf.String(); !strings.Contains(logged, `relation "items"`) || !strings.Contains(logged, `request_id="req-1"`) {
+		t.Errorf("logged %q, want the error with the request id", logged)
+	}
+}
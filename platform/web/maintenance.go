@@ -0,0 +1,73 @@
+package web
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// maintenanceRetryAfter is the Retry-After, in seconds, of a request turned
+// away in maintenance mode.
+const maintenanceRetryAfter = "60"
+
+// Maintenance is the maintenance mode of a service. While it is on every
+// request answers 503 except the health routes, /version and the switch.
+type Maintenance struct {
+	// Health are the health routes the service registers.
+	Health []string
+
+	on atomic.Bool
+}
+
+type maintenanceModel struct {
+	Enabled bool `json:"enabled"`
+}
+
+// On reports whether the service is in maintenance mode.
+func (m *Maintenance) On() bool {
+	return m.on.Load()
+}
+
+// Set switches maintenance mode on or off.
+func (m *Maintenance) Set(on bool) {
+	m.on.Store(on)
+}
+
+// Middleware answers 503 with Retry-After to every request while the service
+// is in maintenance mode, except the health routes, /version and path, the
+// route of Switch with its prefix.
+func (m *Maintenance) Middleware(path string, h http.Handler) http.Handler {
+	up := map[string]bool{"/version": true, path: true}
+	for _, p := range m.Health {
+		up[p] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.On() || up[r.URL.Path] {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", maintenanceRetryAfter)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"error":"service is under maintenance"}`))
+	})
+}
+
+// Switch reports the maintenance mode and, on PUT, switches it. Who may call
+// it is up to the route.
+func (m *Maintenance) Switch(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		mm := maintenanceModel{}
+		if err := json.NewDecoder(r.Body).Decode(&mm); err != nil {
+			log.Println("Failed to parse request:", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		m.Set(mm.Enabled)
+		log.Printf("User [%s] switched maintenance mode to [%t]\n", r.Header.Get("X-User-Id"), mm.Enabled)
+	}
+	data, _ := json.Marshal(maintenanceModel{Enabled: m.On()})
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -0,0 +1,103 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// maintained builds a service under /api with a business route, /health,
+// /version and the maintenance switch for admins, all behind m.
+func maintained(m *Maintenance) http.Handler {
+	r := mux.NewRouter()
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	r.HandleFunc("/health", ok)
+	r.HandleFunc("/health/all", ok)
+	r.HandleFunc("/version", VersionInfo)
+	api := r.PathPrefix("/api").Subrouter()
+	api.HandleFunc("/svc/do", ok).Methods("POST")
+	api.HandleFunc("/svc/maintenance", Authenticated(RequireRole("admin", m.Switch))).Methods("GET", "PUT")
+	r.NotFoundHandler = http.HandlerFunc(NotFound)
+	return m.Middleware("/api/svc/maintenance", r)
+}
+
+// TestMaintenanceModeAnswers503 switches maintenance on as an admin and
+// checks business routes answer 503 with Retry-After while health, version
+// and the switch stay up, until it is switched off again.
+func TestMaintenanceModeAnswers503(t *testing.T) {
+	h := maintained(&Maintenance{Health: []string{"/health"}})
+	call := func(method, target, role, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("X-User-Id", "5")
+		if role != "" {
+			r.Header.Set("X-User-Role", role)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := call(http.MethodPost, "/api/svc/do", "", ""); w.Code != http.StatusOK {
+		t.Fatalf("POST /api/svc/do answered %d before maintenance, want 200", w.Code)
+	}
+	if w := call(http.MethodPut, "/api/svc/maintenance", "", `{"enabled":true}`); w.Code != http.StatusForbidden {
+		t.Fatalf("a user switching maintenance answered %d, want 403", w.Code)
+	}
+	if w := call(http.MethodPut, "/api/svc/maintenance", "admin", `{`); w.Code != http.StatusBadRequest {
+		t.Fatalf("switching maintenance with a malformed body answered %d, want 400", w.Code)
+	}
+	if w := call(http.MethodPut, "/api/svc/maintenance", "admin", `{"enabled":true}`); w.Code != http.StatusOK || w.Body.String() != `{"enabled":true}` {
+		t.Fatalf("switching maintenance on answered %d %s", w.Code, w.Body.String())
+	}
+
+	w := call(http.MethodPost, "/api/svc/do", "", "")
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != maintenanceRetryAfter {
+		t.Errorf("POST /api/svc/do answered %d with Retry-After %q in maintenance, want 503 with %q", w.Code, w.Header().Get("Retry-After"), maintenanceRetryAfter)
+	}
+	if w.Body.String() != `{"error":"service is under maintenance"}` {
+		t.Errorf("POST /api/svc/do answered %s in maintenance", w.Body.String())
+	}
+	for _, target := range []string{"/health", "/version"} {
+		if w := call(http.MethodGet, target, "", ""); w.Code != http.StatusOK {
+			t.Errorf("%s answered %d in maintenance, want 200", target, w.Code)
+		}
+	}
+	if w := call(http.MethodGet, "/api/svc/maintenance", "admin", ""); w.Code != http.StatusOK || w.Body.String() != `{"enabled":true}` {
+		t.Errorf("reading maintenance answered %d %s", w.Code, w.Body.String())
+	}
+
+	if w := call(http.MethodPut, "/api/svc/maintenance", "admin", `{"enabled":false}`); w.Code != http.StatusOK || w.Body.String() != `{"enabled":false}` {
+		t.Fatalf("switching maintenance off answered %d %s", w.Code, w.Body.String())
+	}
+	if w := call(http.MethodPost, "/api/svc/do", "", ""); w.Code != http.StatusOK {
+		t.Errorf("POST /api/svc/do answered %d after maintenance, want 200", w.Code)
+	}
+}
+
+// TestMaintenanceLetsThroughExactPathsOnly checks only the health routes the
+// service lists and the switch at its exact path pass in maintenance.
+func TestMaintenanceLetsThroughExactPathsOnly(t *testing.T) {
+	m := &Maintenance{Health: []string{"/health"}}
+	m.Set(true)
+	h := maintained(m)
+	for target, want := range map[string]int{
+		"/health":                    http.StatusOK,
+		"/health/all":                http.StatusServiceUnavailable,
+		"/api/svc/maintenance":       http.StatusOK,
+		"/svc/maintenance":           http.StatusServiceUnavailable,
+		"/api/other/svc/maintenance": http.StatusServiceUnavailable,
+		"/api/svc/maintenance/x":     http.StatusServiceUnavailable,
+	} {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("X-User-Id", "1")
+		r.Header.Set("X-User-Role", "admin")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("%s answered %d in maintenance, want %d", target, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+// Package web holds the HTTP plumbing every service shares: the middleware
+// the router is wrapped in, the server and the common answers.
+package web
+
+import (
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+// RecoverPanics answers 500 to a request whose handler panicked and logs the
+// stack, instead of dropping the connection with an empty response.
+func RecoverPanics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			log.Printf("Panic serving %s %s request_id=%q: %v\n%s", r.Method, r.URL.Path, r.Header.Get("X-Request-Id"), err, debug.Stack())
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"internal error"}`))
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,46 @@
+package web
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPanicAnswers500AndLogsStack(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	h := RecoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/panic", nil)
+	r.Header.Set("X-Request-Id", "req-1")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusInternalServerError || w.Body.String() != `{"error":"internal error"}` {
+		t.Errorf("answered %d %s, want 500 with a JSON error", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("answered Content-Type %q, want application/json", ct)
+	}
+	logged := buf.String()
+	for _, want := range []string{"boom", `request_id="req-1"`, "goroutine ", "recover_test.go"} {
+		if !strings.Contains(logged, want) {
+			t.Errorf("logged %q, want it to hold %q", logged, want)
+		}
+	}
+
+	ok := RecoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	w = httptest.NewRecorder()
+	ok.ServeHTTP(w, r)
+	if w.Code != http.StatusTeapot {
+		t.Errorf("handler without a panic answered %d, want 418", w.Code)
+	}
+}
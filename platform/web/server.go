@@ -0,0 +1,67 @@
+package web
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ServerConfig is where and how a service listens. The timeouts are
+// durations like "15s" from READ_TIMEOUT, WRITE_TIMEOUT and IDLE_TIMEOUT.
+// HTTPS is served when both TLSCertFile and TLSKeyFile are set.
+type ServerConfig struct {
+	Host         string
+	Port         string
+	ReadTimeout  string
+	WriteTimeout string
+	IdleTimeout  string
+	TLSCertFile  string
+	TLSKeyFile   string
+}
+
+// DefaultServerConfig listens on port 80 of all interfaces over plain HTTP.
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		Host:         "0.0.0.0",
+		Port:         "80",
+		ReadTimeout:  "15s",
+		WriteTimeout: "30s",
+		IdleTimeout:  "2m",
+	}
+}
+
+// NewServer builds the server with the timeouts of cfg, so slow or idle
+// clients can't hold connections forever.
+func NewServer(cfg ServerConfig, h http.Handler) (*http.Server, error) {
+	srv := &http.Server{
+		Addr:    fmt.Sprintf("%s:%s", cfg.Host, cfg.Port),
+		Handler: h,
+	}
+	var err error
+	if srv.ReadTimeout, err = time.ParseDuration(cfg.ReadTimeout); err != nil {
+		return nil, fmt.Errorf("failed to parse READ_TIMEOUT: %w", err)
+	}
+	if srv.WriteTimeout, err = time.ParseDuration(cfg.WriteTimeout); err != nil {
+		return nil, fmt.Errorf("failed to parse WRITE_TIMEOUT: %w", err)
+	}
+	if srv.IdleTimeout, err = time.ParseDuration(cfg.IdleTimeout); err != nil {
+		return nil, fmt.Errorf("failed to parse IDLE_TIMEOUT: %w", err)
+	}
+	return srv, nil
+}
+
+// Serve listens on the configured address, over HTTPS when cfg has a
+// certificate and a key and over plain HTTP otherwise.
+func Serve(cfg ServerConfig, h http.Handler) error {
+	srv, err := NewServer(cfg, h)
+	if err != nil {
+		return err
+	}
+	if cfg.TLSCertFile != "" && cfg.TLSKeyFile != "" {
+		log.Printf("Listening on [%s] with TLS\n", srv.Addr)
+		return srv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+	}
+	log.Printf("Listening on [%s]\n", srv.Addr)
+	return srv.ListenAndServe()
+}
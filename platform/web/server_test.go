@@ -0,0 +1,132 @@
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCert writes a certificate for 127.0.0.1 and its key to dir
+// and returns their paths and the certificate.
+func writeSelfSignedCert(t *testing.T, dir string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+// freePort returns a port nothing listens on right now.
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestServeHTTPSWithCert(t *testing.T) {
+	certFile, keyFile, cert := writeSelfSignedCert(t, t.TempDir())
+	port := strconv.Itoa(freePort(t))
+	cfg := DefaultServerConfig()
+	cfg.Host, cfg.Port, cfg.TLSCertFile, cfg.TLSKeyFile = "127.0.0.1", port, certFile, keyFile
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	errs := make(chan error, 1)
+	go func() { errs <- Serve(cfg, h) }()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res, err := c.Get("https://127.0.0.1:" + port + "/")
+		if err == nil {
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			if res.TLS == nil || string(body) != "hello" {
+				t.Fatalf("got %q, tls %v", body, res.TLS != nil)
+			}
+			return
+		}
+		select {
+		case err := <-errs:
+			t.Fatalf("serve stopped: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no HTTPS answer: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	h := http.NotFoundHandler()
+	cfg := DefaultServerConfig()
+	srv, err := NewServer(cfg, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.Addr != "0.0.0.0:80" || srv.ReadTimeout != 15*time.Second || srv.WriteTimeout != 30*time.Second || srv.IdleTimeout != 2*time.Minute {
+		t.Errorf("default server on %s with timeouts read %s write %s idle %s, want 0.0.0.0:80 and 15s 30s 2m", srv.Addr, srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout)
+	}
+
+	cfg.ReadTimeout, cfg.WriteTimeout, cfg.IdleTimeout = "5s", "10s", "1m"
+	if srv, err = NewServer(cfg, h); err != nil {
+		t.Fatal(err)
+	}
+	if srv.ReadTimeout != 5*time.Second || srv.WriteTimeout != 10*time.Second || srv.IdleTimeout != time.Minute {
+		t.Errorf("configured timeouts read %s write %s idle %s, want 5s 10s 1m", srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout)
+	}
+
+	cfg.WriteTimeout = "ten seconds"
+	if _, err = NewServer(cfg, h); err == nil {
+		t.Error("a wrong WRITE_TIMEOUT was accepted")
+	}
+}
@@ -0,0 +1,27 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// version, commit and buildTime describe the build. They are set with
+// -ldflags "-X platform/web.version=... -X platform/web.commit=...
+// -X platform/web.buildTime=...".
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildTime = "unknown"
+)
+
+// VersionInfo reports the build of the running binary.
+func VersionInfo(w http.ResponseWriter, _ *http.Request) {
+	data, _ := json.Marshal(map[string]string{
+		"version":    version,
+		"commit":     commit,
+		"build_time": buildTime,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -0,0 +1,24 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVersionReportsBuild(t *testing.T) {
+	saved := [3]string{version, commit, buildTime}
+	t.Cleanup(func() { version, commit, buildTime = saved[0], saved[1], saved[2] })
+	// what go build -ldflags "-X platform/web.version=... ..." sets
+	version, commit, buildTime = "1.4.2", "9f2c1ab", "2030-05-01T12:00:00Z"
+
+	w := httptest.NewRecorder()
+	VersionInfo(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+	want := `{"build_time":"2030-05-01T12:00:00Z","commit":"9f2c1ab","version":"1.4.2"}`
+	if w.Code != http.StatusOK || w.Body.String() != want {
+		t.Fatalf("answered %d %s, want 200 %s", w.Code, w.Body.String(), want)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q, want application/json", ct)
+	}
+}
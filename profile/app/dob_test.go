@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAgeAt(t *testing.T) {
+	dob := time.Date(1990, 6, 15, 0, 0, 0, 0, time.UTC)
+	for now, want := range map[string]int{
+		"2030-06-14": 39,
+		"2030-06-15": 40,
+		"2030-12-01": 40,
+		"2031-01-01": 40,
+	} {
+		at, _ := time.Parse(dobLayout, now)
+		if got := ageAt(dob, at); got != want {
+			t.Errorf("age on %s is %d, want %d", now, got, want)
+		}
+	}
+}
+
+// meAge updates the profile with body and returns the date of birth and age
+// /profile/me answers with.
+func meAge(t *testing.T, body string) (string, int) {
+	t.Helper()
+	if w := call(updateMe, http.MethodPut, body); w.Code != http.StatusOK {
+		t.Fatalf("update with %s answered %d %s", body, w.Code, w.Body.String())
+	}
+	w := call(me, http.MethodGet, "")
+	got := struct {
+		DateOfBirth string `json:"date_of_birth"`
+		Age         int    `json:"age"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	return got.DateOfBirth, got.Age
+}
+
+func TestAgeFromDateOfBirth(t *testing.T) {
+	useMemoryStore(t)
+	dob := time.Now().AddDate(-30, 0, -1).Format(dobLayout)
+	if gotDOB, age := meAge(t, fmt.Sprintf(`{"date_of_birth":%q,"age":99}`, dob)); gotDOB != dob || age != 30 {
+		t.Errorf("me answered born %s aged %d, want %s aged 30", gotDOB, age, dob)
+	}
+
+	if gotDOB, age := meAge(t, `{"age":42}`); gotDOB != "" || age != 42 {
+		t.Errorf("me answered born %q aged %d, want the explicit age 42", gotDOB, age)
+	}
+}
+
+func TestWrongDateOfBirthIsRejected(t *testing.T) {
+	useMemoryStore(t)
+	for _, dob := range []string{
+		"15.06.1990",
+		time.Now().AddDate(0, 0, 1).Format(dobLayout),
+		time.Now().AddDate(-200, 0, 0).Format(dobLayout),
+	} {
+		if w := call(updateMe, http.MethodPut, fmt.Sprintf(`{"date_of_birth":%q}`, dob)); w.Code != http.StatusBadRequest {
+			t.Errorf("date of birth %s answered %d, want 400", dob, w.Code)
+		}
+	}
+}
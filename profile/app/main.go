@@ -4,22 +4,96 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"platform/config"
+	"platform/database"
+	"platform/web"
 
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
 )
 
+// profileModel is the user's profile. Age is derived from DateOfBirth
+// (YYYY-MM-DD) when it's set, otherwise it's the age the client sent.
 type profileModel struct {
-	id        int
-	AvatarURI string `json:"avatar_uri"`
-	Age       int    `json:"age"`
+	id          int
+	AvatarURI   string `json:"avatar_uri"`
+	Age         int    `json:"age"`
+	DateOfBirth string `json:"date_of_birth,omitempty"`
+}
+
+// profileRow is a profile as it is stored.
+type profileRow struct {
+	avatarURI string
+	age       int
+	dob       sql.NullTime
+}
+
+// profileStore keeps the profiles. sqlStore is the default, STORAGE=memory
+// selects memoryStore.
+type profileStore interface {
+	// load returns sql.ErrNoRows for a user without a profile.
+	load(id int) (profileRow, error)
+	save(id int, p profileRow) error
+}
+
+// sqlStore keeps the profiles in Postgres.
+type sqlStore struct{}
+
+func (sqlStore) load(id int) (profileRow, error) {
+	p := profileRow{}
+	err := dbConn.Retry(func() error {
+		return getUserStmt.QueryRow(id).Scan(&p.avatarURI, &p.age, &p.dob)
+	})
+	return p, err
+}
+
+func (sqlStore) save(id int, p profileRow) error {
+	return dbConn.Retry(func() error {
+		_, err := updateUserStmt.Exec(id, p.avatarURI, p.age, p.dob)
+		return err
+	})
+}
+
+// memoryStore keeps the profiles in the process, so the service can run
+// without Postgres in local development and integration tests. Everything
+// is lost on restart.
+type memoryStore struct {
+	mu   sync.RWMutex
+	rows map[int]profileRow
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{rows: map[int]profileRow{}}
 }
 
+func (m *memoryStore) load(id int) (profileRow, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	p, ok := m.rows[id]
+	if !ok {
+		return p, sql.ErrNoRows
+	}
+	return p, nil
+}
+
+func (m *memoryStore) save(id int, p profileRow) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rows[id] = p
+	return nil
+}
+
+var store profileStore = sqlStore{}
+
 type userModel struct {
 	id        int
 	Login     string `json:"login"`
@@ -34,50 +108,87 @@ type loginModel struct {
 	Password string `json:"password"`
 }
 
+// identityModel is the identity resolved by auth and passed in headers.
+type identityModel struct {
+	ID        int    `json:"id"`
+	Login     string `json:"login"`
+	Email     string `json:"email"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Role      string `json:"role"`
+}
+
 type extendedUserModel struct {
 	userModel
 	profileModel
+	Complete bool `json:"complete"`
 }
 
 type configModel struct {
-	dbHost string
-	dbPort string
-	dbName string
-	dbUser string
-	dbPass string
-	host   string
-	port   string
+	web.ServerConfig
+	dbHost      string
+	dbPort      string
+	dbName      string
+	dbUser      string
+	dbPass      string
+	maxAge      string
+	origins     string
+	routePrefix string
+	storage     string
+	maintenance string
+	dbWait      string
 }
 
 const (
-	getUserTpl    = `SELECT avatar_uri, age FROM user_profile WHERE id=$1 limit 1`
-	updateUserTpl = `INSERT INTO user_profile (id, avatar_uri, age) VALUES ($1, $2, $3) ON CONFLICT (id) DO UPDATE SET avatar_uri = excluded.avatar_uri , age = excluded.age`
+	getUserTpl    = `SELECT avatar_uri, age, date_of_birth FROM user_profile WHERE id=$1 limit 1`
+	updateUserTpl = `INSERT INTO user_profile (id, avatar_uri, age, date_of_birth) VALUES ($1, $2, $3, $4) ON CONFLICT (id) DO UPDATE SET avatar_uri = excluded.avatar_uri , age = excluded.age, date_of_birth = excluded.date_of_birth`
+)
+
+const (
+	minAge    = 1
+	dobLayout = "2006-01-02"
 )
 
 var (
 	getUserStmt    *sql.Stmt
 	updateUserStmt *sql.Stmt
+	dbConn         = &database.Conn{Prepare: mustPrepareStmts}
+	// maxAge is the oldest age a profile may have
+	maxAge int
 )
 
 func readConf() *configModel {
 	cfg := &configModel{
-		dbHost: "profile-postgresql",
-		dbPort: "5432",
-		dbName: "profiledb",
-		dbUser: "profileuser",
-		dbPass: "profilepasswd",
-		host:   "0.0.0.0",
-		port:   "80",
-	}
-	dbHost := os.Getenv("DBHOST")
-	dbPort := os.Getenv("DBPORT")
-	dbName := os.Getenv("DBNAME")
-	dbUser := os.Getenv("DBUSER")
-	dbPass := os.Getenv("DBPASS")
-	host := os.Getenv("HOST")
-	port := os.Getenv("PORT")
-
-	dbURI := os.Getenv("DATABASE_URI")
+		dbHost:       "profile-postgresql",
+		dbPort:       "5432",
+		dbName:       "profiledb",
+		dbUser:       "profileuser",
+		dbPass:       "profilepasswd",
+		ServerConfig: web.DefaultServerConfig(),
+		maxAge:       "150",
+		storage:      "sql",
+		dbWait:       "60s",
+	}
+	dbHost := config.Getenv("DBHOST")
+	dbPort := config.Getenv("DBPORT")
+	dbName := config.Getenv("DBNAME")
+	dbUser := config.Getenv("DBUSER")
+	dbPass := config.Getenv("DBPASS")
+	host := config.Getenv("HOST")
+	port := config.Getenv("PORT")
+	tlsCertFile := config.Getenv("TLS_CERT_FILE")
+	tlsKeyFile := config.Getenv("TLS_KEY_FILE")
+	maxAge := config.Getenv("MAX_AGE")
+	readTimeout := config.Getenv("READ_TIMEOUT")
+	writeTimeout := config.Getenv("WRITE_TIMEOUT")
+	idleTimeout := config.Getenv("IDLE_TIMEOUT")
+	origins := config.Getenv("ALLOWED_ORIGINS")
+	routePrefix := config.Getenv("ROUTE_PREFIX")
+	storage := config.Getenv("STORAGE")
+	maintenance := config.Getenv("MAINTENANCE")
+	dbWait := config.Getenv("DB_WAIT_TIMEOUT")
+
+	dbURI := config.Getenv("DATABASE_URI")
 	log.Println("... h43 ... ################")
 	log.Println(dbURI)
 	log.Println("... h43 ... ################")
@@ -98,10 +209,43 @@ func readConf() *configModel {
 		cfg.dbPass = dbPass
 	}
 	if host != "" {
-		cfg.host = host
+		cfg.Host = host
 	}
 	if port != "" {
-		cfg.port = port
+		cfg.Port = port
+	}
+	if tlsCertFile != "" {
+		cfg.TLSCertFile = tlsCertFile
+	}
+	if tlsKeyFile != "" {
+		cfg.TLSKeyFile = tlsKeyFile
+	}
+	if maxAge != "" {
+		cfg.maxAge = maxAge
+	}
+	if readTimeout != "" {
+		cfg.ReadTimeout = readTimeout
+	}
+	if writeTimeout != "" {
+		cfg.WriteTimeout = writeTimeout
+	}
+	if idleTimeout != "" {
+		cfg.IdleTimeout = idleTimeout
+	}
+	if origins != "" {
+		cfg.origins = origins
+	}
+	if routePrefix != "" {
+		cfg.routePrefix = routePrefix
+	}
+	if storage != "" {
+		cfg.storage = storage
+	}
+	if maintenance != "" {
+		cfg.maintenance = maintenance
+	}
+	if dbWait != "" {
+		cfg.dbWait = dbWait
 	}
 	return cfg
 }
@@ -111,39 +255,101 @@ func makeDBConn(cfg *configModel) (*sql.DB, error) {
 		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		cfg.dbHost, cfg.dbPort, cfg.dbUser, cfg.dbPass, cfg.dbName,
 	)
-	log.Println("connection string: ", pgConnString)
+	log.Printf("Connecting to database host=%s port=%s dbname=%s\n", cfg.dbHost, cfg.dbPort, cfg.dbName)
 	db, err := sql.Open("postgres", pgConnString)
 	return db, err
 }
 
+// maintenanceMode turns every request but health, version and the switch
+// itself away with 503. It starts from MAINTENANCE and is switched at runtime
+// by admins via maintenancePath.
+var maintenanceMode = &web.Maintenance{Health: []string{"/health"}}
+
+const maintenancePath = "/profile/maintenance"
+
+const roleAdmin = "admin"
+
 func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	cfg := readConf()
 
-	db, err := makeDBConn(cfg)
-	if err != nil {
-		log.Fatal("Failed to connect to database:", err)
+	var err error
+	if store, err = openStore(ctx, cfg); err != nil {
+		log.Fatal("Failed to open store:", err)
+	}
+	if maxAge, err = strconv.Atoi(cfg.maxAge); err != nil || maxAge < minAge {
+		log.Fatal("Failed to parse MAX_AGE:", cfg.maxAge)
+	}
+
+	if cfg.maintenance != "" {
+		on, err := strconv.ParseBool(cfg.maintenance)
+		if err != nil {
+			log.Fatal("Failed to parse MAINTENANCE:", err)
+		}
+		maintenanceMode.Set(on)
 	}
-	defer db.Close()
 
-	if err = db.PingContext(ctx); err != nil {
-		log.Fatal("Failed to check db connection:", err)
+	prefix := strings.TrimSuffix(cfg.routePrefix, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		log.Fatalf("ROUTE_PREFIX [%s] must start with /", cfg.routePrefix)
 	}
+	r := newRouter(prefix)
 
-	mustPrepareStmts(ctx, db)
+	h := maintenanceMode.Middleware(prefix+maintenancePath, r)
+	h = web.RecoverPanics(web.CORS(web.ParseOrigins(cfg.origins), h))
+	if err := web.Serve(cfg.ServerConfig, h); err != nil {
+		log.Printf("Failed to bind on [%s:%s]: %s", cfg.Host, cfg.Port, err)
+	}
+}
 
-	r := mux.NewRouter()
+// openStore opens the store STORAGE selects. For sql it connects to the
+// database, waits for it and prepares the statements.
+func openStore(ctx context.Context, cfg *configModel) (profileStore, error) {
+	switch cfg.storage {
+	case "sql":
+		db, err := makeDBConn(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to database: %w", err)
+		}
+		dbWait, err := time.ParseDuration(cfg.dbWait)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse DB_WAIT_TIMEOUT: %w", err)
+		}
+		if err = database.Wait(ctx, db, dbWait); err != nil {
+			return nil, fmt.Errorf("failed to check db connection: %w", err)
+		}
+		mustPrepareStmts(ctx, db)
+		dbConn.Open = func() (*sql.DB, error) { return makeDBConn(cfg) }
+		dbConn.Set(db)
+		return sqlStore{}, nil
+	case "memory":
+		log.Println("Keeping profiles in memory, they are lost on restart")
+		return newMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unknown STORAGE [%s], use sql or memory", cfg.storage)
+}
 
-	// r.HandleFunc("/health", health)
-	r.HandleFunc("/profile/me", isAuthenticatedMiddleware(updateMe)).Methods("PUT")
-	r.HandleFunc("/profile/me", isAuthenticatedMiddleware(me))
+// newRouter registers the routes, the api ones under prefix if it isn't
+// empty.
+func newRouter(prefix string) *mux.Router {
+	r := mux.NewRouter()
 
-	bindOn := fmt.Sprintf("%s:%s", cfg.host, cfg.port)
-	if err := http.ListenAndServe(bindOn, r); err != nil {
-		log.Printf("Failed to bind on [%s]: %s", bindOn, err)
+	r.HandleFunc("/health", health)
+	r.HandleFunc("/version", web.VersionInfo).Methods("GET")
+	api := r
+	if prefix != "" {
+		api = r.PathPrefix(prefix).Subrouter()
 	}
+	api.HandleFunc("/profile/me", reqlog(web.Authenticated(updateMe))).Methods("PUT")
+	api.HandleFunc("/profile/me", reqlog(web.Authenticated(me)))
+	api.HandleFunc("/profile/whoami", reqlog(web.Authenticated(whoami))).Methods("GET")
+	api.HandleFunc("/profile/complete", reqlog(web.Authenticated(complete))).Methods("GET")
+	api.HandleFunc(maintenancePath, reqlog(web.Authenticated(web.RequireRole(roleAdmin, maintenanceMode.Switch)))).Methods("GET", "PUT")
+	r.MethodNotAllowedHandler = web.MethodNotAllowed(r)
+	r.NotFoundHandler = http.HandlerFunc(web.NotFound)
+	return r
 }
 
 func mustPrepareStmts(ctx context.Context, db *sql.DB) {
@@ -168,21 +374,15 @@ func health(w http.ResponseWriter, _ *http.Request) {
 
 func me(w http.ResponseWriter, r *http.Request) {
 	headers := r.Header
-	id, err := strconv.Atoi(headers.Get("X-User-Id"))
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Got wrong header [X-User-Id]: %s", err)
+	id, ok := web.MustUserID(w, r)
+	if !ok {
 		return
 	}
-	row := getUserStmt.QueryRow(id)
-	avatarURL := new(string)
-	age := new(int)
-	p := profileModel{}
-	if err := row.Scan(avatarURL, age); err == nil {
-		p.Age = *age
-		p.AvatarURI = *avatarURL
+	p, err := getProfile(id)
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to get profile of user [%d]: %w", id, err))
+		return
 	}
-
 	eu := extendedUserModel{
 		userModel: userModel{
 			id:        id,
@@ -192,13 +392,93 @@ func me(w http.ResponseWriter, r *http.Request) {
 			LastName:  headers.Get("X-Last-Name"),
 		},
 		profileModel: p,
+		Complete:     isComplete(p),
 	}
 	data, _ := json.Marshal(eu)
 	w.WriteHeader(http.StatusOK)
 	w.Write(data)
 }
 
+// getProfile returns the stored profile of the user, or an empty one when
+// the user has none yet.
+func getProfile(id int) (profileModel, error) {
+	p := profileModel{id: id}
+	row, err := store.load(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return p, nil
+	}
+	if err != nil {
+		return p, err
+	}
+	p.Age = row.age
+	p.AvatarURI = row.avatarURI
+	if row.dob.Valid {
+		p.DateOfBirth = row.dob.Time.Format(dobLayout)
+		p.Age = ageAt(row.dob.Time, time.Now())
+	}
+	return p, nil
+}
+
+// ageAt returns the age in full years at now of someone born on dob.
+func ageAt(dob, now time.Time) int {
+	age := now.Year() - dob.Year()
+	if now.Month() < dob.Month() || (now.Month() == dob.Month() && now.Day() < dob.Day()) {
+		age--
+	}
+	return age
+}
+
+func validAge(age int) bool {
+	return age >= minAge && age <= maxAge
+}
+
+// isComplete reports whether the profile has everything features gated on a
+// complete profile need: an avatar and a valid age.
+func isComplete(p profileModel) bool {
+	return p.AvatarURI != "" && validAge(p.Age)
+}
+
+// complete is for other services that allow an action only to users with a
+// complete profile.
+func complete(w http.ResponseWriter, r *http.Request) {
+	id, ok := web.MustUserID(w, r)
+	if !ok {
+		return
+	}
+	p, err := getProfile(id)
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("failed to get profile of user [%d]: %w", id, err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"complete":%t}`, isComplete(p))
+}
+
+// whoami echoes the identity headers set by auth without touching the
+// database.
+func whoami(w http.ResponseWriter, r *http.Request) {
+	id, ok := web.MustUserID(w, r)
+	if !ok {
+		return
+	}
+	headers := r.Header
+	data, _ := json.Marshal(identityModel{
+		ID:        id,
+		Login:     headers.Get("X-User"),
+		Email:     headers.Get("X-Email"),
+		FirstName: headers.Get("X-First-Name"),
+		LastName:  headers.Get("X-Last-Name"),
+		Role:      headers.Get("X-User-Role"),
+	})
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
 func updateMe(w http.ResponseWriter, r *http.Request) {
+	uid, ok := web.MustUserID(w, r)
+	if !ok {
+		return
+	}
 	up := &profileModel{}
 	if err := json.NewDecoder(r.Body).Decode(up); err != nil {
 		log.Println("Failed to parse data:", err)
@@ -207,35 +487,81 @@ func updateMe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	log.Printf("userProfile: %+v\n", up)
-	var err error
-	if up.id, err = strconv.Atoi(r.Header.Get("X-User-Id")); err != nil {
-		panic(err)
+	var dob sql.NullTime
+	if up.DateOfBirth != "" {
+		t, err := time.Parse(dobLayout, up.DateOfBirth)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Date of birth must be YYYY-MM-DD"))
+			return
+		}
+		if !t.Before(time.Now()) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Date of birth must be in the past"))
+			return
+		}
+		dob = sql.NullTime{Time: t, Valid: true}
+		up.Age = ageAt(t, time.Now())
+		if !validAge(up.Age) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Date of birth must give an age between %d and %d", minAge, maxAge)
+			return
+		}
+	}
+	if up.Age != 0 && !validAge(up.Age) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Age must be between %d and %d", minAge, maxAge)
+		return
 	}
+	up.id = uid
 
-	if _, err = updateUserStmt.Query(up.id, up.AvatarURI, up.Age); err != nil {
-		log.Println("Internal server error:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	err := store.save(up.id, profileRow{avatarURI: up.AvatarURI, age: up.Age, dob: dob})
+	if err != nil {
+		web.InternalError(w, r, fmt.Errorf("internal server error: %w", err))
 		return
 	}
 	data, err := json.Marshal(up)
 	if err != nil {
-		log.Println("Internal server error:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		web.InternalError(w, r, fmt.Errorf("internal server error: %w", err))
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 	w.Write(data)
 }
 
-func isAuthenticatedMiddleware(h http.HandlerFunc) http.HandlerFunc {
+// statusRecorder remembers the status code and the size of the response
+// written by the wrapped handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+func reqlog(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		headers := r.Header
-		fmt.Println(headers)
-		if _, ok := headers["X-User-Id"]; !ok {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("Not authenticated"))
-			return
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
 		}
-		h.ServeHTTP(w, r)
+		log.Printf("method=%s path=%s status=%d bytes=%d duration=%s request_id=%q host=%s\n",
+			r.Method, r.URL.Path, rec.status, rec.bytes, time.Since(start), r.Header.Get("X-Request-Id"), r.Host)
 	}
 }
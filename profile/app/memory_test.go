@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"platform/web"
+)
+
+// useMemoryStore runs the test against a fresh memoryStore, as the service
+// does with STORAGE=memory.
+func useMemoryStore(t *testing.T) {
+	t.Helper()
+	saved, savedMaxAge := store, maxAge
+	store, maxAge = newMemoryStore(), 150
+	t.Cleanup(func() { store, maxAge = saved, savedMaxAge })
+}
+
+// call sends a request of user 5 to h and returns the recorded answer.
+func call(h http.HandlerFunc, method, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/profile", strings.NewReader(body))
+	r.Header.Set("X-User-Id", "5")
+	r.Header.Set("X-User", "john")
+	w := httptest.NewRecorder()
+	web.Authenticated(h)(w, r)
+	return w
+}
+
+func TestMemoryStoreProfile(t *testing.T) {
+	useMemoryStore(t)
+
+	if w := call(complete, http.MethodGet, ""); w.Code != http.StatusOK || w.Body.String() != `{"complete":false}` {
+		t.Fatalf("complete before update answered %d %s", w.Code, w.Body.String())
+	}
+	if w := call(updateMe, http.MethodPut, `{"avatar_uri":"a.png","age":30}`); w.Code != http.StatusOK {
+		t.Fatalf("update answered %d %s", w.Code, w.Body.String())
+	}
+	w := call(me, http.MethodGet, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("me answered %d", w.Code)
+	}
+	got := struct {
+		Login     string `json:"login"`
+		AvatarURI string `json:"avatar_uri"`
+		Age       int    `json:"age"`
+		Complete  bool   `json:"complete"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Login != "john" || got.AvatarURI != "a.png" || got.Age != 30 || !got.Complete {
+		t.Errorf("me answered %s", w.Body.String())
+	}
+	if w := call(complete, http.MethodGet, ""); w.Body.String() != `{"complete":true}` {
+		t.Errorf("complete after update answered %s", w.Body.String())
+	}
+}
+
+// TestMemoryStoreEndToEnd starts profile as with STORAGE=memory and no
+// database and talks to it over HTTP as the ingress does.
+func TestMemoryStoreEndToEnd(t *testing.T) {
+	t.Setenv("STORAGE", "memory")
+	cfg := readConf()
+	opened, err := openStore(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, savedMaxAge := store, maxAge
+	t.Cleanup(func() { store, maxAge = saved, savedMaxAge })
+	store = opened
+	if maxAge, err = strconv.Atoi(cfg.maxAge); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(newRouter(""))
+	t.Cleanup(srv.Close)
+
+	send := func(method, path, uid, body string) (int, string) {
+		t.Helper()
+		r, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("X-User-Id", uid)
+		r.Header.Set("X-User", "user"+uid)
+		res, err := srv.Client().Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		data, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(data)
+	}
+
+	if code, body := send(http.MethodPut, "/profile/me", "5", `{"avatar_uri":"a.png","age":30}`); code != http.StatusOK {
+		t.Fatalf("update answered %d %s", code, body)
+	}
+	if code, body := send(http.MethodGet, "/profile/complete", "5", ""); code != http.StatusOK || body != `{"complete":true}` {
+		t.Errorf("complete of user 5 answered %d %s", code, body)
+	}
+	if code, body := send(http.MethodGet, "/profile/complete", "6", ""); code != http.StatusOK || body != `{"complete":false}` {
+		t.Errorf("complete of user 6 answered %d %s, want the profile of 5 kept apart", code, body)
+	}
+	code, body := send(http.MethodGet, "/profile/me", "5", "")
+	got := struct {
+		Login     string `json:"login"`
+		AvatarURI string `json:"avatar_uri"`
+		Age       int    `json:"age"`
+	}{}
+	if err := json.Unmarshal([]byte(body), &got); err != nil || code != http.StatusOK {
+		t.Fatalf("me answered %d %s", code, body)
+	}
+	if got.Login != "user5" || got.AvatarURI != "a.png" || got.Age != 30 {
+		t.Errorf("me answered %s", body)
+	}
+
+	t.Setenv("STORAGE", "redis")
+	if _, err := openStore(context.Background(), readConf()); err == nil {
+		t.Error("unknown STORAGE was accepted")
+	}
+}
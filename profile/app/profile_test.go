@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"platform/web"
+)
+
+func TestComplete(t *testing.T) {
+	dob := time.Now().AddDate(-30, 0, -1)
+	tests := []struct {
+		name string
+		row  *profileRow
+		want string
+	}{
+		{"no profile", nil, `{"complete":false}`},
+		{"avatar and age", &profileRow{avatarURI: "a.png", age: 30}, `{"complete":true}`},
+		{"avatar and date of birth", &profileRow{avatarURI: "a.png", dob: sql.NullTime{Time: dob, Valid: true}}, `{"complete":true}`},
+		{"no avatar", &profileRow{age: 30}, `{"complete":false}`},
+		{"no age", &profileRow{avatarURI: "a.png"}, `{"complete":false}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useMemoryStore(t)
+			if tt.row != nil {
+				store.save(5, *tt.row)
+			}
+			w := call(complete, http.MethodGet, "")
+			if w.Code != http.StatusOK || w.Body.String() != tt.want {
+				t.Fatalf("answered %d %s, want 200 %s", w.Code, w.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+// brokenStore fails every call like a store whose database is down.
+type brokenStore struct{}
+
+func (brokenStore) load(int) (profileRow, error) {
+	return profileRow{}, errors.New("connection refused")
+}
+
+func (brokenStore) save(int, profileRow) error { return errors.New("connection refused") }
+
+func TestStoreErrorsAnswer500(t *testing.T) {
+	saved := store
+	store = brokenStore{}
+	t.Cleanup(func() { store = saved })
+	for name, h := range map[string]http.HandlerFunc{"me": me, "complete": complete} {
+		if w := call(h, http.MethodGet, ""); w.Code != http.StatusInternalServerError {
+			t.Errorf("%s answered %d %s, want 500", name, w.Code, w.Body.String())
+		}
+	}
+}
+
+// TestWhoamiEchoesHeaders runs whoami with a store that fails every call, so
+// it only passes without a database lookup.
+func TestWhoamiEchoesHeaders(t *testing.T) {
+	saved := store
+	store = brokenStore{}
+	t.Cleanup(func() { store = saved })
+
+	r := httptest.NewRequest(http.MethodGet, "/profile/whoami", nil)
+	for k, v := range map[string]string{
+		"X-User-Id":    "5",
+		"X-User":       "john",
+		"X-Email":      "john@example.com",
+		"X-First-Name": "John",
+		"X-Last-Name":  "Smith",
+		"X-User-Role":  "admin",
+	} {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	web.Authenticated(whoami)(w, r)
+	want := `{"id":5,"login":"john","email":"john@example.com","first_name":"John","last_name":"Smith","role":"admin"}`
+	if w.Code != http.StatusOK || w.Body.String() != want {
+		t.Fatalf("answered %d %s, want 200 %s", w.Code, w.Body.String(), want)
+	}
+
+	w = httptest.NewRecorder()
+	web.Authenticated(whoami)(w, httptest.NewRequest(http.MethodGet, "/profile/whoami", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated whoami answered %d, want 401", w.Code)
+	}
+}